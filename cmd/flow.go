@@ -0,0 +1,292 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/maximthomas/gortas/pkg/auth"
+	"github.com/maximthomas/gortas/pkg/auth/callbacks"
+	"github.com/maximthomas/gortas/pkg/config"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+	"gopkg.in/yaml.v3"
+
+	autherrors "github.com/maximthomas/gortas/pkg/auth/errors"
+)
+
+var (
+	flowScriptFile string
+	diagramFormat  string
+)
+
+var flowCmd = &cobra.Command{
+	Use:   "flow",
+	Short: "Authentication flow tools",
+}
+
+var flowRunCmd = &cobra.Command{
+	Use:   "run <name>",
+	Short: "Run the authentication flow in the terminal",
+	Long: "Run the authentication flow in-process against the configured data stores: " +
+		"prints callbacks requested by the flow modules, asks for the answers and prints the resulting token or error. " +
+		"With --script the answers are read from the YAML file",
+	Args:          cobra.ExactArgs(1),
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var answers flowAnswers
+		if flowScriptFile != "" {
+			script, err := readFlowScript(flowScriptFile)
+			if err != nil {
+				return err
+			}
+			answers = script
+		} else {
+			answers = newTerminalAnswers(cmd.InOrStdin(), cmd.OutOrStdout())
+		}
+		return runFlow(cmd.Context(), cmd.OutOrStdout(), args[0], answers)
+	},
+}
+
+var flowDiagramCmd = &cobra.Command{
+	Use:   "diagram <name>",
+	Short: "Print the authentication flow diagram",
+	Long: "Print the authentication flow diagram in the Mermaid or Graphviz DOT format: " +
+		"modules with their types and criteria, conditions, transitions and pass and fail edges",
+	Args: cobra.ExactArgs(1),
+	// the diagram is rendered from the configuration, services are not initialized
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {},
+	SilenceUsage:     true,
+	SilenceErrors:    true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		c, err := config.ReadConfig()
+		if err != nil {
+			return err
+		}
+		d, err := auth.FlowDiagram(c.Flows, args[0], diagramFormat)
+		if err != nil {
+			return err
+		}
+		fmt.Fprint(cmd.OutOrStdout(), d)
+		return nil
+	},
+}
+
+func init() {
+	flowRunCmd.Flags().StringVar(&flowScriptFile, "script", "", "YAML file with answers to the flow callbacks")
+	flowDiagramCmd.Flags().StringVar(&diagramFormat, "format", auth.DiagramMermaid, "diagram format: mermaid or dot")
+	flowCmd.AddCommand(flowRunCmd)
+	flowCmd.AddCommand(flowDiagramCmd)
+}
+
+// flowAnswers answers callbacks requested by the flow
+type flowAnswers interface {
+	answer(out io.Writer, cbResp callbacks.Response) ([]callbacks.Callback, error)
+}
+
+// runFlow processes the flow until it returns a token or an error, callbacks are answered by answers
+func runFlow(ctx context.Context, out io.Writer, flowName string, answers flowAnswers) error {
+	fp := auth.NewFlowProcessor()
+	var cbReq callbacks.Request
+	for {
+		method := http.MethodGet
+		if cbReq.FlowID != "" {
+			method = http.MethodPost
+		}
+		r := httptest.NewRequest(method, "/gortas/v1/auth/"+flowName, http.NoBody).WithContext(ctx)
+		cbResp, err := fp.Process(ctx, flowName, cbReq, r, httptest.NewRecorder())
+		if err != nil {
+			return errors.Wrapf(err, "flow %v failed with %v", flowName, autherrors.Code(err))
+		}
+		if cbResp.Token != "" {
+			fmt.Fprintf(out, "authenticated, %v token: %v\n", cbResp.Type, cbResp.Token)
+			return nil
+		}
+		renderCallbacks(out, cbResp)
+		cbs, err := answers.answer(out, cbResp)
+		if err != nil {
+			return err
+		}
+		cbReq = callbacks.Request{
+			Module:    cbResp.Module,
+			Callbacks: cbs,
+			FlowID:    cbResp.FlowID,
+		}
+	}
+}
+
+// renderCallbacks prints the callbacks requested by the module
+func renderCallbacks(out io.Writer, cbResp callbacks.Response) {
+	fmt.Fprintf(out, "module %v:\n", cbResp.Module)
+	for _, cb := range cbResp.Callbacks {
+		fmt.Fprintf(out, "  %v (%v)", cb.Name, cb.Type)
+		if cb.Prompt != "" {
+			fmt.Fprintf(out, ": %v", cb.Prompt)
+		}
+		if cb.Required {
+			fmt.Fprint(out, " *")
+		}
+		fmt.Fprintln(out)
+		switch {
+		case cb.Type == callbacks.TypeImage:
+			fmt.Fprintf(out, "    image: %v bytes\n", len(cb.Value))
+		case cb.Type == callbacks.TypeHTTPStatus:
+			fmt.Fprintf(out, "    status: %v\n", cb.Value)
+		case cb.Value != "" && cb.Type != callbacks.TypePassword:
+			fmt.Fprintf(out, "    value: %v\n", cb.Value)
+		}
+		for i, o := range cb.Options {
+			fmt.Fprintf(out, "    %v) %v\n", i+1, o)
+		}
+		keys := make([]string, 0, len(cb.Properties))
+		for k := range cb.Properties {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(out, "    %v: %v\n", k, cb.Properties[k])
+		}
+		if cb.Error != "" {
+			fmt.Fprintf(out, "    error: %v\n", cb.Error)
+		}
+	}
+}
+
+// needsAnswer returns true if the value of the callback is entered by the user,
+// other callbacks are submitted as is
+func needsAnswer(cb callbacks.Callback) bool {
+	switch cb.Type {
+	case callbacks.TypeImage, callbacks.TypeAutoSubmit, callbacks.TypeHTTPStatus:
+		return false
+	}
+	return true
+}
+
+// terminalAnswers asks the user for the callback values
+type terminalAnswers struct {
+	in  *bufio.Reader
+	fd  int // terminal file descriptor to read passwords without echo, -1 if the input is not a terminal
+	out io.Writer
+}
+
+func newTerminalAnswers(in io.Reader, out io.Writer) *terminalAnswers {
+	fd := -1
+	if f, ok := in.(*os.File); ok && term.IsTerminal(int(f.Fd())) {
+		fd = int(f.Fd())
+	}
+	return &terminalAnswers{in: bufio.NewReader(in), fd: fd, out: out}
+}
+
+func (t *terminalAnswers) answer(_ io.Writer, cbResp callbacks.Response) ([]callbacks.Callback, error) {
+	cbs := make([]callbacks.Callback, len(cbResp.Callbacks))
+	copy(cbs, cbResp.Callbacks)
+	for i := range cbs {
+		cb := &cbs[i]
+		if !needsAnswer(*cb) {
+			continue
+		}
+		prompt := cb.Prompt
+		if prompt == "" {
+			prompt = cb.Name
+		}
+		if cb.Value != "" && cb.Type != callbacks.TypePassword {
+			prompt = fmt.Sprintf("%v [%v]", prompt, cb.Value)
+		}
+		fmt.Fprintf(t.out, "%v: ", prompt)
+		value, err := t.readLine(cb.Type == callbacks.TypePassword)
+		if err != nil {
+			return nil, err
+		}
+		if value == "" {
+			continue
+		}
+		// options could be selected by number
+		if n, err := strconv.Atoi(value); err == nil && n > 0 && n <= len(cb.Options) {
+			value = cb.Options[n-1]
+		}
+		cb.Value = value
+	}
+	return cbs, nil
+}
+
+func (t *terminalAnswers) readLine(password bool) (string, error) {
+	if password && t.fd >= 0 {
+		value, err := term.ReadPassword(t.fd)
+		fmt.Fprintln(t.out)
+		return string(value), errors.Wrap(err, "error reading password")
+	}
+	line, err := t.in.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", errors.Wrap(err, "error reading answer")
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// flowScript answers the flow callbacks from a YAML file, a step answers callbacks of a single module request, e.g.
+//
+//	steps:
+//	  - module: login
+//	    callbacks:
+//	      login: user1
+//	      password: password
+type flowScript struct {
+	Steps []flowScriptStep `yaml:"steps"`
+	step  int
+}
+
+type flowScriptStep struct {
+	Module    string            `yaml:"module"` // optional, checks the module requesting callbacks
+	Callbacks map[string]string `yaml:"callbacks"`
+}
+
+func readFlowScript(file string) (*flowScript, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading script")
+	}
+	var s flowScript
+	err = yaml.Unmarshal(data, &s)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error parsing script %v", file)
+	}
+	return &s, nil
+}
+
+func (s *flowScript) answer(out io.Writer, cbResp callbacks.Response) ([]callbacks.Callback, error) {
+	if s.step >= len(s.Steps) {
+		return nil, errors.Errorf("script has no step for module %v", cbResp.Module)
+	}
+	step := s.Steps[s.step]
+	s.step++
+	if step.Module != "" && step.Module != cbResp.Module {
+		return nil, errors.Errorf("script step %v expects module %v, flow requested module %v", s.step, step.Module, cbResp.Module)
+	}
+	cbs := make([]callbacks.Callback, len(cbResp.Callbacks))
+	copy(cbs, cbResp.Callbacks)
+	answered := 0
+	for i := range cbs {
+		value, ok := step.Callbacks[cbs[i].Name]
+		if !ok {
+			continue
+		}
+		answered++
+		cbs[i].Value = value
+		if cbs[i].Type == callbacks.TypePassword {
+			value = "********"
+		}
+		fmt.Fprintf(out, "  %v = %v\n", cbs[i].Name, value)
+	}
+	if answered != len(step.Callbacks) {
+		return nil, errors.Errorf("script step %v answers callbacks, that module %v did not request", s.step, cbResp.Module)
+	}
+	return cbs, nil
+}
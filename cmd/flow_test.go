@@ -0,0 +1,134 @@
+package cmd
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlowRun(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		input  string
+		output []string
+		err    string
+	}{
+		{
+			name: "script",
+			script: `
+steps:
+  - module: login
+    callbacks:
+      login: user1
+      password: wrong
+  - module: login
+    callbacks:
+      login: user1
+      password: password
+`,
+			output: []string{"module login:", "login (text): Login *", "password = ********",
+				"error: Invalid username or password", "authenticated, Bearer token: "},
+		},
+		{
+			name: "script without answers",
+			script: `
+steps:
+  - callbacks:
+      login: user1
+      password: wrong
+`,
+			err: "script has no step for module login",
+		},
+		{
+			name: "script with unexpected module",
+			script: `
+steps:
+  - module: otp
+    callbacks:
+      otp: "1234"
+`,
+			err: "script step 1 expects module otp, flow requested module login",
+		},
+		{
+			name:   "terminal",
+			input:  "user1\npassword\n",
+			output: []string{"Login: Password: ", "authenticated, Bearer token: "},
+		},
+		{
+			name:  "terminal input closed",
+			input: "user1\n",
+			err:   "error reading answer: EOF",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := []string{"flow", "run", "login", "--config", "../test/auth-config-dev.yaml"}
+			if tt.script != "" {
+				script := filepath.Join(t.TempDir(), "script.yaml")
+				assert.NoError(t, os.WriteFile(script, []byte(tt.script), 0o600))
+				args = append(args, "--script", script)
+			}
+			var out bytes.Buffer
+			rootCmd.SetOut(&out)
+			rootCmd.SetIn(strings.NewReader(tt.input))
+			defer func() {
+				rootCmd.SetOut(nil)
+				rootCmd.SetIn(nil)
+				flowScriptFile = ""
+			}()
+			rootCmd.SetArgs(args)
+			err := rootCmd.Execute()
+			if tt.err != "" {
+				assert.EqualError(t, err, tt.err)
+				return
+			}
+			assert.NoError(t, err)
+			for _, o := range tt.output {
+				assert.Contains(t, out.String(), o)
+			}
+		})
+	}
+}
+
+func TestFlowRun_UnknownFlow(t *testing.T) {
+	rootCmd.SetArgs([]string{"flow", "run", "unknown", "--config", "../test/auth-config-dev.yaml"})
+	err := rootCmd.Execute()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "flow unknown failed with flow_not_found")
+}
+
+func TestFlowDiagram(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   []string
+		output string
+		err    string
+	}{
+		{name: "mermaid", args: []string{"qr"}, output: `m0["qr: qr<br/>requisite"]`},
+		{name: "dot", args: []string{"qr", "--format", "dot"}, output: `m0 [label="qr: qr\nrequisite", shape=box];`},
+		{name: "unknown flow", args: []string{"unknown"}, err: "auth flow unknown not found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			rootCmd.SetOut(&out)
+			defer func() {
+				rootCmd.SetOut(nil)
+				diagramFormat = "mermaid"
+			}()
+			rootCmd.SetArgs(append([]string{"flow", "diagram", "--config", "../test/auth-config-dev.yaml"}, tt.args...))
+			err := rootCmd.Execute()
+			if tt.err != "" {
+				assert.EqualError(t, err, tt.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Contains(t, out.String(), tt.output)
+		})
+	}
+}
@@ -19,6 +19,12 @@ var (
 	rootCmd = &cobra.Command{
 		Use:   "gortas",
 		Short: "Gortas is a golang authentication service",
+		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+			err := config.InitConfig()
+			if err != nil {
+				er(err)
+			}
+		},
 		Run: func(cmd *cobra.Command, args []string) {
 			server.RunServer()
 		},
@@ -44,6 +50,8 @@ func init() {
 	cobra.OnInitialize(initConfig)
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/auth-config.yaml)")
 	rootCmd.AddCommand(versionCmd)
+	rootCmd.AddCommand(validateCmd)
+	rootCmd.AddCommand(flowCmd)
 }
 
 func er(msg interface{}) {
@@ -73,10 +81,6 @@ func initConfig() {
 
 	if err := viper.ReadInConfig(); err == nil {
 		fmt.Println("Using config file:", viper.ConfigFileUsed())
-		err = config.InitConfig()
-		if err != nil {
-			er(err)
-		}
 	} else {
 		er(err)
 	}
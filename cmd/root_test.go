@@ -1,6 +1,9 @@
 package cmd
 
 import (
+	"bytes"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/maximthomas/gortas/pkg/config"
@@ -17,3 +20,92 @@ func TestExecute(t *testing.T) {
 	assert.True(t, len(conf.Flows) > 0)
 
 }
+
+func TestValidate(t *testing.T) {
+	invalidConfig := filepath.Join(t.TempDir(), "auth-config.yaml")
+	err := os.WriteFile(invalidConfig, []byte(`
+flows:
+  login:
+    modules:
+      - id: "login"
+        type: "logn"
+      - id: "login"
+        type: "login"
+        criteria: "sufficent"
+  otp:
+    modules:
+      - id: "otp"
+        type: "otp"
+        properties:
+          sender:
+            senderType: "sms"
+  qr:
+    modules:
+      - id: "qr"
+        type: "qr"
+        properties:
+          qrTimeout: "long"
+  hydra:
+    modules:
+      - id: "hydra"
+        type: "hydra"
+session:
+  type: "stateless"
+encryptionKey: "bad"
+server:
+  admin:
+    enabled: true
+  tls:
+    certFile: "server.crt"
+    clientAuth: "always"
+  apiKeys:
+    defaultTtlSec: 3600
+    maxTtlSec: 60
+`), 0o600)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		file     string
+		valid    bool
+		problems []string
+	}{
+		{name: "valid config", file: "../test/auth-config-otp.yaml", valid: true},
+		{name: "invalid config", file: invalidConfig, problems: []string{
+			"flows.login.modules[0].type: unknown module type logn",
+			"flows.login.modules[1].id: duplicate module id login",
+			"flows.login.modules[1].criteria: unknown criteria sufficent",
+			"flows.hydra.modules[0]: module hydra: properties.uri: is required",
+			"flows.otp.modules[0]: module otp: sender sms does not exists",
+			"flows.qr.modules[0]: module qr: properties.qrTimeout: should be int, got string",
+			"session.jwt.privateKeyPem: private key is required for stateless sessions",
+			"encryptionKey: invalid base64",
+			"server.admin.token: is required for the admin endpoints",
+			"server.tls.keyFile: certificate and key should be set together",
+			"server.tls.clientAuth: unknown mode always",
+			"server.apiKeys.defaultTtlSec: should not be greater than maxTtlSec",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out, errOut bytes.Buffer
+			rootCmd.SetOut(&out)
+			rootCmd.SetErr(&errOut)
+			defer func() {
+				rootCmd.SetOut(nil)
+				rootCmd.SetErr(nil)
+			}()
+			rootCmd.SetArgs([]string{"validate", "--config", tt.file})
+			err := rootCmd.Execute()
+			if tt.valid {
+				assert.NoError(t, err)
+				assert.Contains(t, out.String(), "configuration is valid")
+				return
+			}
+			assert.Error(t, err)
+			for _, p := range tt.problems {
+				assert.Contains(t, errOut.String(), tt.file+": "+p)
+			}
+		})
+	}
+}
@@ -0,0 +1,45 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/maximthomas/gortas/pkg/config"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var validateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "Validate the configuration and flows",
+	Long: "Validate the configuration and flows: creates every module of every flow and checks its settings, " +
+		"sender types, regular expressions, key material and data store settings without connecting to data stores",
+	// the configuration is only checked, services are not initialized
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {},
+	SilenceUsage:     true,
+	SilenceErrors:    true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return validateConfig(cmd, viper.ConfigFileUsed())
+	},
+}
+
+// validateConfig prints all problems of the configuration prefixed with the config file
+func validateConfig(cmd *cobra.Command, file string) error {
+	c, err := config.ReadConfig()
+	if err != nil {
+		return errors.Wrap(err, file)
+	}
+	err = config.Validate(&c)
+	if err == nil {
+		fmt.Fprintf(cmd.OutOrStdout(), "%v: configuration is valid\n", file)
+		return nil
+	}
+	problems := []error{err}
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		problems = joined.Unwrap()
+	}
+	for _, p := range problems {
+		fmt.Fprintf(cmd.ErrOrStderr(), "%v: %v\n", file, p)
+	}
+	return errors.Errorf("%v: %v configuration problems found", file, len(problems))
+}
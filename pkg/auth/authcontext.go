@@ -0,0 +1,133 @@
+package auth
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/maximthomas/gortas/pkg/auth/modules"
+	"github.com/maximthomas/gortas/pkg/auth/state"
+	"github.com/maximthomas/gortas/pkg/session"
+)
+
+// amrMfa authentication method reference of the multiple-factor authentication
+const amrMfa = "mfa"
+
+// moduleAmr returns authentication method reference of the module, the module type by default
+func moduleAmr(mi *state.FlowStateModuleInfo) string {
+	if mi.Amr != "" {
+		return mi.Amr
+	}
+	return mi.Type
+}
+
+// passedModulesAuth returns the highest authentication level, authentication methods
+// and module types of the passed modules of the flow and its sub-flows
+func passedModulesAuth(fs *state.FlowState) (level int, amr, types []string) {
+	for i := range fs.Modules {
+		mi := &fs.Modules[i]
+		if mi.Status != state.Pass || mi.Type == modules.ChoiceModuleType {
+			continue
+		}
+		if mi.SubFlow != nil {
+			subLevel, subAmr, subTypes := passedModulesAuth(mi.SubFlow)
+			if subLevel > level {
+				level = subLevel
+			}
+			amr = append(amr, subAmr...)
+			types = append(types, subTypes...)
+			continue
+		}
+		if mi.AuthLevel > level {
+			level = mi.AuthLevel
+		}
+		amr = append(amr, moduleAmr(mi))
+		types = append(types, mi.Type)
+	}
+	return level, amr, types
+}
+
+// mergeModuleTypes returns sorted unique module types
+func mergeModuleTypes(lists ...[]string) []string {
+	unique := make(map[string]bool)
+	res := make([]string, 0)
+	for _, types := range lists {
+		for _, t := range types {
+			if !unique[t] {
+				unique[t] = true
+				res = append(res, t)
+			}
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// mergeAmr returns sorted unique authentication methods,
+// mfa is added if there are at least two different methods
+func mergeAmr(amrs ...[]string) []string {
+	unique := make(map[string]bool)
+	res := make([]string, 0)
+	for _, amr := range amrs {
+		for _, m := range amr {
+			if m != amrMfa && !unique[m] {
+				unique[m] = true
+				res = append(res, m)
+			}
+		}
+	}
+	if len(res) > 1 {
+		res = append(res, amrMfa)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// modulesPassed returns true if at least one module of the flow or its sub-flows authenticated the user
+func modulesPassed(fs *state.FlowState) bool {
+	_, _, types := passedModulesAuth(fs)
+	return len(types) > 0
+}
+
+// setAuthContext sets the authentication level, methods and time of the completed flow,
+// the step-up flow keeps the authentication context of the existing session,
+// and its authentication time, if no module passed in the flow
+func (f *flowProcessor) setAuthContext(ctx context.Context, fs *state.FlowState) error {
+	level, amr, types := passedModulesAuth(fs)
+	authTime := time.Now().Unix()
+	if fs.SessionID != "" {
+		sess, err := f.getStepUpSession(ctx, fs)
+		if err != nil {
+			return err
+		}
+		ac := sess.GetAuthContext()
+		if ac.Level > level {
+			level = ac.Level
+		}
+		if len(types) == 0 {
+			authTime = 0
+			if !ac.AuthTime.IsZero() {
+				authTime = ac.AuthTime.Unix()
+			}
+		}
+		amr = mergeAmr(ac.Amr, amr)
+		types = mergeModuleTypes(ac.Modules, types)
+	} else {
+		amr = mergeAmr(amr)
+		types = mergeModuleTypes(types)
+	}
+	fs.AuthLevel = level
+	fs.Amr = amr
+	fs.AuthTime = authTime
+	fs.AuthModules = types
+	return nil
+}
+
+func flowAuthContext(fs *state.FlowState) session.AuthContext {
+	return session.AuthContext{
+		Level:    fs.AuthLevel,
+		Amr:      fs.Amr,
+		AuthTime: time.Unix(fs.AuthTime, 0),
+		Modules:  fs.AuthModules,
+	}
+}
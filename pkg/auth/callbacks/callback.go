@@ -8,6 +8,12 @@ const (
 	TypeAutoSubmit = "autosubmit"
 	TypeOptions    = "options"
 	TypeActions    = "actions"
+	// TypeWebAuthnRegistration value is the PublicKeyCredential JSON, created with the options from the options property
+	TypeWebAuthnRegistration = "webauthnRegistration"
+	// TypeWebAuthnAssertion value is the PublicKeyCredential JSON, got with the options from the options property
+	TypeWebAuthnAssertion = "webauthnAssertion"
+	// TypeRedirect value is the URL, the user should be redirected to, the URL of the redirect back is sent as the value
+	TypeRedirect = "redirect"
 )
 
 type Callback struct {
@@ -34,6 +40,14 @@ type Response struct {
 	Module    string     `json:"module,omitempty"`
 	Callbacks []Callback `json:"callbacks,omitempty"`
 	Token     string     `json:"token,omitempty"`
-	Type      string     `json:"type,omitempty"`   // returns token type
-	FlowID    string     `json:"flowId,omitempty"` // TODO add error
+	Type      string     `json:"type,omitempty"` // returns token type
+	FlowID    string     `json:"flowId,omitempty"`
+	Status    string     `json:"status,omitempty"` // fail, if authentication failed
+	Error     *Error     `json:"error,omitempty"`
+}
+
+// Error describes why authentication failed
+type Error struct {
+	Code    string `json:"code"` // machine readable error code
+	Message string `json:"message,omitempty"`
 }
@@ -0,0 +1,74 @@
+package auth
+
+import (
+	"github.com/maximthomas/gortas/pkg/auth/modules"
+	"github.com/maximthomas/gortas/pkg/auth/state"
+	"github.com/maximthomas/gortas/pkg/config"
+	"github.com/pkg/errors"
+)
+
+// choiceOptionModuleID returns id of the module of the choice option,
+// sub-flow options are processed by the implicit sub-flow modules, placed after the choice module
+func choiceOptionModuleID(choiceID string, o modules.ChoiceOption) string {
+	if o.Module != "" {
+		return o.Module
+	}
+	return choiceID + "." + o.Name
+}
+
+// expandChoices validates choice modules options of the flow state and adds sub-flow modules for the sub-flow options
+func (f *flowProcessor) expandChoices(flows map[string]config.Flow, fs *state.FlowState, parents []string) error {
+	expanded := make([]state.FlowStateModuleInfo, 0, len(fs.Modules))
+	for i := range fs.Modules {
+		mi := fs.Modules[i]
+		expanded = append(expanded, mi)
+		if mi.Type != modules.ChoiceModuleType {
+			continue
+		}
+		options, err := modules.DecodeChoiceOptions(mi.Properties)
+		if err != nil {
+			return errors.Wrapf(err, "auth flow %v module %v", fs.Name, mi.ID)
+		}
+		for _, o := range options {
+			if o.Module != "" {
+				if fs.ModuleIndex(o.Module) <= i {
+					return errors.Errorf("auth flow %v module %v: option %v module %v should be after the choice module",
+						fs.Name, mi.ID, o.Name, o.Module)
+				}
+				continue
+			}
+			subFlow, err := f.newFlowState(flows, o.Flow, append(parents, fs.Name))
+			if err != nil {
+				return errors.Wrapf(err, "auth flow %v module %v", fs.Name, mi.ID)
+			}
+			expanded = append(expanded, state.FlowStateModuleInfo{
+				ID:         choiceOptionModuleID(mi.ID, o),
+				Type:       subFlowModuleType,
+				Properties: state.FlowStateModuleProperties{subFlowProperty: o.Flow},
+				State:      make(map[string]interface{}),
+				SubFlow:    &subFlow,
+			})
+		}
+	}
+	fs.Modules = expanded
+	return nil
+}
+
+// selectChoiceOption skips modules of the options, that were not selected in the passed choice module
+func selectChoiceOption(fs *state.FlowState, choice *state.FlowStateModuleInfo) error {
+	options, err := modules.DecodeChoiceOptions(choice.Properties)
+	if err != nil {
+		return errors.Wrapf(err, "module %v", choice.ID)
+	}
+	selected, _ := choice.State[modules.ChoiceStateOption].(string)
+	for _, o := range options {
+		if o.Name == selected {
+			continue
+		}
+		i := fs.ModuleIndex(choiceOptionModuleID(choice.ID, o))
+		if i >= 0 && fs.Modules[i].Status == state.Start {
+			fs.Modules[i].Status = state.Skip
+		}
+	}
+	return nil
+}
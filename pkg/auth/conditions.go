@@ -0,0 +1,206 @@
+package auth
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/maximthomas/gortas/pkg/auth/state"
+	"github.com/maximthomas/gortas/pkg/config"
+	"github.com/maximthomas/gortas/pkg/user"
+	"github.com/pkg/errors"
+)
+
+const (
+	conditionSourceSharedState = "sharedState"
+	conditionSourceUser        = "user"
+	conditionSourceHeader      = "header"
+	conditionSourceRemoteAddr  = "remoteAddr"
+	conditionSourceStatus      = "status"
+)
+
+const (
+	conditionOperatorEq           = "eq"
+	conditionOperatorNe           = "ne"
+	conditionOperatorExists       = "exists"
+	conditionOperatorNotExists    = "notExists"
+	conditionOperatorMatches      = "matches"
+	conditionOperatorNotMatches   = "notMatches"
+	conditionOperatorInNetwork    = "inNetwork"
+	conditionOperatorNotInNetwork = "notInNetwork"
+)
+
+// conditionsMet returns true if all conditions are met,
+// prev is the index of the module which outcome is checked by the status conditions without a key
+func conditionsMet(ctx context.Context, conds []config.Condition, fs *state.FlowState, prev int, r *http.Request) (bool, error) {
+	for _, c := range conds {
+		met, err := evaluateCondition(ctx, c, fs, prev, r)
+		if err != nil {
+			return false, err
+		}
+		if !met {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func evaluateCondition(ctx context.Context, c config.Condition, fs *state.FlowState, prev int, r *http.Request) (bool, error) {
+	value, exists, err := conditionValue(ctx, c, fs, prev, r)
+	if err != nil {
+		return false, err
+	}
+	switch c.Operator {
+	case "", conditionOperatorEq:
+		return exists && value == c.Value, nil
+	case conditionOperatorNe:
+		return !exists || value != c.Value, nil
+	case conditionOperatorExists:
+		return exists, nil
+	case conditionOperatorNotExists:
+		return !exists, nil
+	case conditionOperatorMatches, conditionOperatorNotMatches:
+		re, err := regexp.Compile(c.Value)
+		if err != nil {
+			return false, errors.Wrapf(err, "error compiling condition regex %v", c.Value)
+		}
+		matches := exists && re.MatchString(value)
+		return matches == (c.Operator == conditionOperatorMatches), nil
+	case conditionOperatorInNetwork, conditionOperatorNotInNetwork:
+		in, err := inNetwork(value, c.Value)
+		if err != nil {
+			return false, err
+		}
+		in = exists && in
+		return in == (c.Operator == conditionOperatorInNetwork), nil
+	default:
+		return false, errors.Errorf("unknown condition operator %v", c.Operator)
+	}
+}
+
+func conditionValue(ctx context.Context, c config.Condition, fs *state.FlowState, prev int, r *http.Request) (value string, exists bool, err error) {
+	switch c.Source {
+	case conditionSourceSharedState:
+		value, exists = fs.SharedState[c.Key]
+	case conditionSourceUser:
+		if fs.UserID == "" {
+			return value, false, nil
+		}
+		u, ok := user.GetUserService().GetUser(ctx, fs.UserID)
+		if !ok {
+			return value, false, nil
+		}
+		if c.Key == "" {
+			return u.ID, true, nil
+		}
+		value, exists = u.Properties[c.Key]
+	case conditionSourceHeader:
+		if r == nil {
+			return value, false, nil
+		}
+		values := r.Header.Values(c.Key)
+		if len(values) > 0 {
+			value, exists = values[0], true
+		}
+	case conditionSourceRemoteAddr:
+		if r == nil || r.RemoteAddr == "" {
+			return value, false, nil
+		}
+		value, _, err = net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			value = r.RemoteAddr
+		}
+		exists = true
+	case conditionSourceStatus:
+		if c.Key != "" {
+			var mi state.FlowStateModuleInfo
+			mi, exists = fs.FindModule(c.Key)
+			return mi.Status.String(), exists, nil
+		}
+		if prev < 0 || prev >= len(fs.Modules) {
+			return value, false, nil
+		}
+		value, exists = fs.Modules[prev].Status.String(), true
+	default:
+		return value, false, errors.Errorf("unknown condition source %v", c.Source)
+	}
+	return value, exists, nil
+}
+
+// validateCondition checks the condition source, operator and value
+func validateCondition(c config.Condition) error {
+	switch c.Source {
+	case conditionSourceSharedState, conditionSourceUser, conditionSourceHeader, conditionSourceRemoteAddr, conditionSourceStatus:
+	default:
+		return errors.Errorf("unknown condition source %v", c.Source)
+	}
+	switch c.Operator {
+	case "", conditionOperatorEq, conditionOperatorNe, conditionOperatorExists, conditionOperatorNotExists:
+	case conditionOperatorMatches, conditionOperatorNotMatches:
+		if _, err := regexp.Compile(c.Value); err != nil {
+			return errors.Wrapf(err, "error compiling condition regex %v", c.Value)
+		}
+	case conditionOperatorInNetwork, conditionOperatorNotInNetwork:
+		if _, err := inNetwork("", c.Value); err != nil {
+			return err
+		}
+	default:
+		return errors.Errorf("unknown condition operator %v", c.Operator)
+	}
+	return nil
+}
+
+// inNetwork checks if the ip address belongs to one of comma separated networks in CIDR notation,
+// if the address is a comma separated list, like in X-Forwarded-For header, the first address is used
+func inNetwork(addr, networks string) (bool, error) {
+	addr = strings.TrimSpace(strings.Split(addr, ",")[0])
+	ip := net.ParseIP(addr)
+	for _, n := range strings.Split(networks, ",") {
+		_, ipNet, err := net.ParseCIDR(strings.TrimSpace(n))
+		if err != nil {
+			return false, errors.Wrapf(err, "error parsing network %v", n)
+		}
+		if ip != nil && ipNet.Contains(ip) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// previousModuleIndex returns index of the last completed module before the module with the index
+func previousModuleIndex(fs *state.FlowState, index int) int {
+	for i := index - 1; i >= 0; i-- {
+		if s := fs.Modules[i].Status; s == state.Pass || s == state.Fail {
+			return i
+		}
+	}
+	return -1
+}
+
+// nextModuleIndex evaluates transitions of the completed module and returns index of the next module,
+// modules between the completed module and the transition target are skipped
+func nextModuleIndex(ctx context.Context, fs *state.FlowState, index int, r *http.Request) (int, error) {
+	for _, t := range fs.Modules[index].Transitions {
+		met, err := conditionsMet(ctx, t.When, fs, index, r)
+		if err != nil {
+			return -1, errors.Wrapf(err, "error evaluating transition for module %v", fs.Modules[index].ID)
+		}
+		if !met {
+			continue
+		}
+		next := fs.ModuleIndex(t.Next)
+		if next <= index {
+			return -1, errors.Errorf("transition from module %v to %v: target module should be after the current one",
+				fs.Modules[index].ID, t.Next)
+		}
+		for i := index + 1; i < next; i++ {
+			if fs.Modules[i].Status == state.Start {
+				fs.Modules[i].Status = state.Skip
+			}
+		}
+		return next, nil
+	}
+	return index + 1, nil
+}
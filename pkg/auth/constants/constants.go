@@ -1,5 +1,16 @@
 package constants
 
-const CriteriaSufficient = "sufficient"
+// Module criteria, defines how module result affects the authentication flow result
+const (
+	// CriteriaRequired module failure fails the flow, but the remaining modules are still processed
+	CriteriaRequired = "required"
+	// CriteriaRequisite module failure fails the flow immediately
+	CriteriaRequisite = "requisite"
+	// CriteriaSufficient module success completes the flow immediately if no required module has failed before,
+	// module failure is ignored
+	CriteriaSufficient = "sufficient"
+	// CriteriaOptional module result is ignored, unless there are no other passed modules in the flow
+	CriteriaOptional = "optional"
+)
 
 const FlowStateSessionProperty = "fs"
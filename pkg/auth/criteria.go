@@ -0,0 +1,69 @@
+package auth
+
+import (
+	"github.com/maximthomas/gortas/pkg/auth/constants"
+	"github.com/maximthomas/gortas/pkg/auth/modules"
+	"github.com/maximthomas/gortas/pkg/auth/state"
+	"github.com/pkg/errors"
+)
+
+// criteriaAction is what the flow processor does after a module is completed
+type criteriaAction int
+
+const (
+	criteriaContinue criteriaAction = iota // process the next module
+	criteriaDone                           // stop processing modules and evaluate the flow result
+	criteriaFail                           // fail the flow immediately
+)
+
+// moduleCriteria returns the module criteria, modules without criteria are requisite,
+// so a module failure stops the flow as before the criteria were introduced
+func moduleCriteria(mi *state.FlowStateModuleInfo) string {
+	if mi.Criteria == "" {
+		return constants.CriteriaRequisite
+	}
+	return mi.Criteria
+}
+
+func validateCriteria(criteria string) error {
+	switch criteria {
+	case "", constants.CriteriaRequired, constants.CriteriaRequisite, constants.CriteriaSufficient, constants.CriteriaOptional:
+		return nil
+	}
+	return errors.Errorf("unknown criteria %v", criteria)
+}
+
+// nextCriteriaAction returns what to do after the module is completed with the Pass or Fail status
+func nextCriteriaAction(mi *state.FlowStateModuleInfo) criteriaAction {
+	criteria := moduleCriteria(mi)
+	switch {
+	case mi.Status == state.Pass && criteria == constants.CriteriaSufficient:
+		return criteriaDone
+	case mi.Status == state.Fail && criteria == constants.CriteriaRequisite:
+		return criteriaFail
+	}
+	return criteriaContinue
+}
+
+// flowSucceeded evaluates the flow result after modules processing is finished.
+// The flow succeeds if none of required or requisite modules failed and at least one module passed.
+// Skipped modules and modules that were not processed after a sufficient module success are ignored.
+// Step-up flow also succeeds if all its modules were skipped as already passed by the user session.
+func flowSucceeded(fs *state.FlowState) bool {
+	passed := false
+	for i := range fs.Modules {
+		mi := &fs.Modules[i]
+		switch mi.Status {
+		case state.Pass:
+			// the choice module only selects the next modules, so it does not authenticate the user by itself
+			passed = passed || mi.Type != modules.ChoiceModuleType
+		case state.Fail:
+			criteria := moduleCriteria(mi)
+			if criteria == constants.CriteriaRequired || criteria == constants.CriteriaRequisite {
+				return false
+			}
+		}
+	}
+	// step-up flow succeeds, if the session has already passed all modules
+	return passed || fs.SessionID != ""
+}
@@ -0,0 +1,275 @@
+package auth
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/maximthomas/gortas/pkg/auth/constants"
+	"github.com/maximthomas/gortas/pkg/auth/modules"
+	"github.com/maximthomas/gortas/pkg/auth/state"
+	"github.com/maximthomas/gortas/pkg/config"
+	"github.com/maximthomas/gortas/pkg/log"
+	"github.com/pkg/errors"
+
+	autherrors "github.com/maximthomas/gortas/pkg/auth/errors"
+)
+
+// Flow diagram formats
+const (
+	DiagramMermaid = "mermaid"
+	DiagramDOT     = "dot"
+)
+
+type diagramShape int
+
+const (
+	shapeTerminal diagramShape = iota
+	shapeModule
+	shapeDecision
+)
+
+type diagramNode struct {
+	id    string
+	label []string // lines of the label
+	shape diagramShape
+}
+
+type diagramEdge struct {
+	from, to, label string
+}
+
+// flowDiagram is the graph of the flow modules with the edges the flow processor follows between them
+type flowDiagram struct {
+	name  string
+	nodes []diagramNode
+	edges []diagramEdge
+}
+
+const (
+	diagramStart   = "start"
+	diagramResult  = "result"
+	diagramSuccess = "success"
+	diagramFailure = "failure"
+)
+
+// FlowDiagram renders the flow with its modules, criteria, conditions and transitions in the Mermaid or DOT format
+func FlowDiagram(flows map[string]config.Flow, flowName, format string) (string, error) {
+	if _, ok := flows[flowName]; !ok {
+		return "", autherrors.NewFlowNotFound(fmt.Sprintf("auth flow %v not found", flowName))
+	}
+	f := &flowProcessor{logger: log.WithField("module", "FlowDiagram")}
+	fs, err := f.newFlowState(flows, flowName, nil)
+	if err != nil {
+		return "", err
+	}
+	d := newFlowDiagram(&fs, flows[flowName].StepUp)
+	switch format {
+	case "", DiagramMermaid:
+		return d.mermaid(), nil
+	case DiagramDOT:
+		return d.dot(), nil
+	}
+	return "", errors.Errorf("unknown diagram format %v", format)
+}
+
+func newFlowDiagram(fs *state.FlowState, stepUp bool) *flowDiagram {
+	d := &flowDiagram{name: fs.Name}
+	start := "start"
+	if stepUp {
+		start = "start step-up, modules passed by the session are skipped"
+	}
+	d.node(diagramStart, shapeTerminal, start)
+
+	// options of the choice modules, after an option module the other options of the same choice are skipped
+	optionOf := make(map[int]int)
+	for i := range fs.Modules {
+		mi := &fs.Modules[i]
+		if mi.Type != modules.ChoiceModuleType {
+			continue
+		}
+		options, _ := modules.DecodeChoiceOptions(mi.Properties)
+		for _, o := range options {
+			if j := fs.ModuleIndex(choiceOptionModuleID(mi.ID, o)); j >= 0 {
+				optionOf[j] = i
+			}
+		}
+	}
+	next := func(i int) int {
+		c, isOption := optionOf[i]
+		for j := i + 1; j < len(fs.Modules); j++ {
+			if oc, ok := optionOf[j]; !isOption || !ok || oc != c {
+				return j
+			}
+		}
+		return len(fs.Modules)
+	}
+	target := func(i int) string {
+		switch {
+		case i >= len(fs.Modules):
+			return diagramResult
+		case len(fs.Modules[i].When) > 0:
+			return moduleNodeID(i) + "_when"
+		}
+		return moduleNodeID(i)
+	}
+
+	if len(fs.Modules) > 0 {
+		d.edge(diagramStart, target(0), "")
+	} else {
+		d.edge(diagramStart, diagramResult, "")
+	}
+	for i := range fs.Modules {
+		mi := &fs.Modules[i]
+		id := moduleNodeID(i)
+		if len(mi.When) > 0 {
+			d.node(target(i), shapeDecision, "when "+conditionsString(mi.When))
+			d.edge(target(i), id, "met")
+			d.edge(target(i), target(next(i)), "not met, skip")
+		}
+		d.node(id, shapeModule, moduleLabel(mi)...)
+
+		// statuses, after which the flow continues to the next module
+		var statuses []string
+		if moduleCriteria(mi) == constants.CriteriaSufficient {
+			d.edge(id, diagramResult, "pass")
+		} else {
+			statuses = append(statuses, "pass")
+		}
+		switch {
+		case mi.Type == modules.ChoiceModuleType:
+			// the choice module does not fail, it waits for a valid option
+		case moduleCriteria(mi) == constants.CriteriaRequisite:
+			d.edge(id, diagramFailure, "fail")
+		default:
+			statuses = append(statuses, "fail")
+		}
+		if len(statuses) == 0 {
+			continue
+		}
+		label := strings.Join(statuses, ", ")
+		for _, t := range mi.Transitions {
+			if j := fs.ModuleIndex(t.Next); j > i {
+				d.edge(id, target(j), label+" when "+conditionsString(t.When))
+			}
+		}
+		if mi.Type == modules.ChoiceModuleType {
+			options, _ := modules.DecodeChoiceOptions(mi.Properties)
+			for _, o := range options {
+				if j := fs.ModuleIndex(choiceOptionModuleID(mi.ID, o)); j > i {
+					d.edge(id, target(j), "option "+o.Name)
+				}
+			}
+			continue
+		}
+		d.edge(id, target(next(i)), label)
+	}
+
+	d.node(diagramResult, shapeDecision, "no required module failed", "and a module passed")
+	d.node(diagramSuccess, shapeTerminal, "success")
+	d.node(diagramFailure, shapeTerminal, "failure")
+	d.edge(diagramResult, diagramSuccess, "yes")
+	d.edge(diagramResult, diagramFailure, "no")
+	return d
+}
+
+func (d *flowDiagram) node(id string, shape diagramShape, label ...string) {
+	d.nodes = append(d.nodes, diagramNode{id: id, label: label, shape: shape})
+}
+
+func (d *flowDiagram) edge(from, to, label string) {
+	d.edges = append(d.edges, diagramEdge{from: from, to: to, label: label})
+}
+
+func moduleNodeID(i int) string {
+	return fmt.Sprintf("m%v", i)
+}
+
+// moduleLabel returns the module id, type and criteria, sub-flow modules show the name of the flow
+func moduleLabel(mi *state.FlowStateModuleInfo) []string {
+	kind := mi.Type
+	if mi.SubFlow != nil {
+		kind = "flow " + mi.SubFlow.Name
+	}
+	label := []string{fmt.Sprintf("%v: %v", mi.ID, kind), moduleCriteria(mi)}
+	if mi.AuthLevel > 0 {
+		label = append(label, fmt.Sprintf("auth level %v", mi.AuthLevel))
+	}
+	return label
+}
+
+func conditionsString(conds []config.Condition) string {
+	parts := make([]string, len(conds))
+	for i, c := range conds {
+		s := c.Source
+		if c.Key != "" {
+			s += "." + c.Key
+		}
+		op := c.Operator
+		if op == "" {
+			op = conditionOperatorEq
+		}
+		s += " " + op
+		if c.Value != "" {
+			s += " " + c.Value
+		}
+		parts[i] = s
+	}
+	return strings.Join(parts, " and ")
+}
+
+func (d *flowDiagram) mermaid() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "---\ntitle: %v\n---\nflowchart TD\n", d.name)
+	for _, n := range d.nodes {
+		label := mermaidEscape(strings.Join(n.label, "\n"))
+		label = strings.ReplaceAll(label, "\n", "<br/>")
+		switch n.shape {
+		case shapeTerminal:
+			fmt.Fprintf(&b, "    %v([\"%v\"])\n", n.id, label)
+		case shapeDecision:
+			fmt.Fprintf(&b, "    %v{\"%v\"}\n", n.id, label)
+		default:
+			fmt.Fprintf(&b, "    %v[\"%v\"]\n", n.id, label)
+		}
+	}
+	for _, e := range d.edges {
+		if e.label == "" {
+			fmt.Fprintf(&b, "    %v --> %v\n", e.from, e.to)
+			continue
+		}
+		fmt.Fprintf(&b, "    %v -->|\"%v\"| %v\n", e.from, mermaidEscape(e.label), e.to)
+	}
+	return b.String()
+}
+
+func mermaidEscape(s string) string {
+	return strings.NewReplacer(`"`, "#quot;", "<", "#lt;", ">", "#gt;").Replace(s)
+}
+
+func (d *flowDiagram) dot() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "digraph %v {\n", dotQuote(d.name))
+	for _, n := range d.nodes {
+		shape := "box"
+		switch n.shape {
+		case shapeTerminal:
+			shape = "oval"
+		case shapeDecision:
+			shape = "diamond"
+		}
+		fmt.Fprintf(&b, "    %v [label=%v, shape=%v];\n", n.id, dotQuote(strings.Join(n.label, "\n")), shape)
+	}
+	for _, e := range d.edges {
+		if e.label == "" {
+			fmt.Fprintf(&b, "    %v -> %v;\n", e.from, e.to)
+			continue
+		}
+		fmt.Fprintf(&b, "    %v -> %v [label=%v];\n", e.from, e.to, dotQuote(e.label))
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+func dotQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
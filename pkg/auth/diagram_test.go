@@ -0,0 +1,99 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/maximthomas/gortas/pkg/config"
+	"github.com/stretchr/testify/assert"
+
+	autherrors "github.com/maximthomas/gortas/pkg/auth/errors"
+)
+
+func TestFlowDiagram(t *testing.T) {
+	flows := map[string]config.Flow{
+		"login": {Modules: []config.Module{
+			{ID: "kerberos", Type: "kerberos", Criteria: "sufficient"},
+			{ID: "login", Type: "login", Criteria: "requisite", AuthLevel: 1},
+			{ID: "otp", Type: "otp", When: []config.Condition{{Source: "user", Key: "phone", Operator: "exists"}},
+				Transitions: []config.Transition{{When: []config.Condition{{Source: "status", Value: "fail"}}, Next: "done"}}},
+			{ID: "mfa", Type: "flow", Criteria: "optional", Properties: map[string]interface{}{"flow": "static"}},
+			{ID: "done", Type: "static"},
+		}},
+		"static": {Modules: []config.Module{{ID: "static", Type: "static"}}},
+		"choice": {Modules: []config.Module{
+			{ID: "choice", Type: "choice", Properties: map[string]interface{}{
+				"options": []interface{}{
+					map[string]interface{}{"name": "a", "module": "a"},
+					map[string]interface{}{"name": "b", "flow": "static"},
+				},
+			}},
+			{ID: "a", Type: "static"},
+			{ID: "last", Type: "static"},
+		}},
+	}
+
+	t.Run("dot", func(t *testing.T) {
+		d, err := FlowDiagram(flows, "static", DiagramDOT)
+		assert.NoError(t, err)
+		assert.Equal(t, `digraph "static" {
+    start [label="start", shape=oval];
+    m0 [label="static: static\nrequisite", shape=box];
+    result [label="no required module failed\nand a module passed", shape=diamond];
+    success [label="success", shape=oval];
+    failure [label="failure", shape=oval];
+    start -> m0;
+    m0 -> failure [label="fail"];
+    m0 -> result [label="pass"];
+    result -> success [label="yes"];
+    result -> failure [label="no"];
+}
+`, d)
+	})
+
+	t.Run("criteria, conditions and transitions", func(t *testing.T) {
+		d, err := FlowDiagram(flows, "login", DiagramMermaid)
+		assert.NoError(t, err)
+		assert.Contains(t, d, "---\ntitle: login\n---\nflowchart TD\n")
+		for _, line := range []string{
+			`m0["kerberos: kerberos<br/>sufficient"]`,
+			`m0 -->|"pass"| result`,
+			`m0 -->|"fail"| m1`,
+			`m1["login: login<br/>requisite<br/>auth level 1"]`,
+			`m1 -->|"fail"| failure`,
+			`m1 -->|"pass"| m2_when`,
+			`m2_when{"when user.phone exists"}`,
+			`m2_when -->|"met"| m2`,
+			`m2_when -->|"not met, skip"| m3`,
+			`m2 -->|"fail"| failure`,
+			`m2 -->|"pass when status eq fail"| m4`,
+			`m2 -->|"pass"| m3`,
+			`m3["mfa: flow static<br/>optional"]`,
+			`m3 -->|"pass, fail"| m4`,
+			`m4 -->|"pass"| result`,
+		} {
+			assert.Contains(t, d, "    "+line+"\n")
+		}
+	})
+
+	t.Run("choice", func(t *testing.T) {
+		d, err := FlowDiagram(flows, "choice", DiagramMermaid)
+		assert.NoError(t, err)
+		for _, line := range []string{
+			`m0 -->|"option b"| m1`,
+			`m0 -->|"option a"| m2`,
+			`m1["choice.b: flow static<br/>requisite"]`,
+			`m1 -->|"pass"| m3`,
+			`m2 -->|"pass"| m3`,
+		} {
+			assert.Contains(t, d, "    "+line+"\n")
+		}
+		assert.NotContains(t, d, "m0 -->|\"pass\"")
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		_, err := FlowDiagram(flows, "unknown", DiagramMermaid)
+		assert.Equal(t, autherrors.CodeFlowNotFound, autherrors.Code(err))
+		_, err = FlowDiagram(flows, "login", "svg")
+		assert.EqualError(t, err, "unknown diagram format svg")
+	})
+}
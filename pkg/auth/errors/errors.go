@@ -1,5 +1,65 @@
 package errors
 
+import (
+	"errors"
+	"net/http"
+)
+
+// Machine readable error codes of the authentication process
+const (
+	CodeFlowNotFound     = "flow_not_found"
+	CodeFlowExpired      = "flow_expired"
+	CodeInvalidCallbacks = "invalid_callbacks"
+	CodeUnexpectedModule = "unexpected_module"
+	CodeAuthFailed       = "auth_failed"
+	CodeLockedOut        = "locked_out"
+	CodeInternal         = "internal"
+)
+
+var httpStatuses = map[string]int{
+	CodeFlowNotFound:     http.StatusNotFound,
+	CodeFlowExpired:      http.StatusGone,
+	CodeInvalidCallbacks: http.StatusBadRequest,
+	CodeUnexpectedModule: http.StatusConflict,
+	CodeAuthFailed:       http.StatusUnauthorized,
+	CodeLockedOut:        http.StatusTooManyRequests,
+	CodeInternal:         http.StatusInternalServerError,
+}
+
+// codedError is implemented by the errors, that could be returned to the client
+type codedError interface {
+	error
+	Code() string
+}
+
+// Code returns the error code of the first coded error in the err chain,
+// other errors are internal
+func Code(err error) string {
+	var ce codedError
+	if errors.As(err, &ce) {
+		return ce.Code()
+	}
+	return CodeInternal
+}
+
+// Message returns the client message of the first coded error in the err chain,
+// messages of internal errors are not exposed
+func Message(err error) string {
+	var ce codedError
+	if errors.As(err, &ce) {
+		return ce.Error()
+	}
+	return "internal error"
+}
+
+// HTTPStatus returns http status of the error code
+func HTTPStatus(code string) int {
+	if status, ok := httpStatuses[code]; ok {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
 type AuthFailed struct {
 	msg string
 }
@@ -9,3 +69,65 @@ func NewAuthFailed(msg string) *AuthFailed {
 }
 
 func (e *AuthFailed) Error() string { return e.msg }
+
+func (e *AuthFailed) Code() string { return CodeAuthFailed }
+
+type FlowExpired struct {
+	msg string
+}
+
+func NewFlowExpired(msg string) *FlowExpired {
+	return &FlowExpired{msg: msg}
+}
+
+func (e *FlowExpired) Error() string { return e.msg }
+
+func (e *FlowExpired) Code() string { return CodeFlowExpired }
+
+type FlowNotFound struct {
+	msg string
+}
+
+func NewFlowNotFound(msg string) *FlowNotFound {
+	return &FlowNotFound{msg: msg}
+}
+
+func (e *FlowNotFound) Error() string { return e.msg }
+
+func (e *FlowNotFound) Code() string { return CodeFlowNotFound }
+
+type InvalidCallbacks struct {
+	msg string
+}
+
+func NewInvalidCallbacks(msg string) *InvalidCallbacks {
+	return &InvalidCallbacks{msg: msg}
+}
+
+func (e *InvalidCallbacks) Error() string { return e.msg }
+
+func (e *InvalidCallbacks) Code() string { return CodeInvalidCallbacks }
+
+type UnexpectedModule struct {
+	msg string
+}
+
+func NewUnexpectedModule(msg string) *UnexpectedModule {
+	return &UnexpectedModule{msg: msg}
+}
+
+func (e *UnexpectedModule) Error() string { return e.msg }
+
+func (e *UnexpectedModule) Code() string { return CodeUnexpectedModule }
+
+type LockedOut struct {
+	msg string
+}
+
+func NewLockedOut(msg string) *LockedOut {
+	return &LockedOut{msg: msg}
+}
+
+func (e *LockedOut) Error() string { return e.msg }
+
+func (e *LockedOut) Code() string { return CodeLockedOut }
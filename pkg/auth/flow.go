@@ -1,9 +1,11 @@
 package auth
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/maximthomas/gortas/pkg/auth/callbacks"
@@ -20,9 +22,12 @@ import (
 )
 
 type FlowProcessor interface {
-	Process(flowName string, cbReq callbacks.Request, r *http.Request, w http.ResponseWriter) (cbResp callbacks.Response, err error)
+	Process(ctx context.Context, flowName string, cbReq callbacks.Request, r *http.Request, w http.ResponseWriter) (cbResp callbacks.Response, err error)
 }
 
+// defaultFlowLifetime is used, if the flow lifetime is not set
+const defaultFlowLifetime = 30 * time.Minute
+
 type flowProcessor struct {
 	logger logrus.FieldLogger
 }
@@ -35,133 +40,226 @@ func NewFlowProcessor() FlowProcessor {
 
 // Process responsible for the authentication process
 // goes through flow state authentication modules, requests and processes callbacks
-func (f *flowProcessor) Process(flowName string, cbReq callbacks.Request, r *http.Request, w http.ResponseWriter) (cbResp callbacks.Response, err error) {
+func (f *flowProcessor) Process(ctx context.Context, flowName string, cbReq callbacks.Request, r *http.Request, w http.ResponseWriter) (cbResp callbacks.Response, err error) {
 
-	fs, err := f.getFlowState(flowName, cbReq.FlowID)
+	fs, err := f.getFlowState(ctx, flowName, cbReq.FlowID, r)
 	if err != nil {
 		return cbResp, fmt.Errorf("Process: error getting flow state %w", err)
 	}
-	// TODO extract process callbacks to a separate function
 
-	inCbs := cbReq.Callbacks
-	var outCbs []callbacks.Callback
+	status, cbResp, err := f.processFlow(ctx, &fs, &fs, cbReq, r, w)
+	if err != nil {
+		return cbResp, err
+	}
+	switch status {
+	case state.InProgress, state.Start:
+		cbResp.FlowID = fs.ID
+		return cbResp, nil
+	case state.Fail:
+		err = session.GetSessionService().DeleteSession(ctx, fs.ID)
+		if err != nil {
+			f.logger.Warnf("error clearing session %s %v", fs.ID, err)
+		}
+		return cbResp, autherrors.NewAuthFailed("auth failed")
+	}
+
+	err = f.setAuthContext(ctx, &fs)
+	if err != nil {
+		return cbResp, err
+	}
+
+	err = f.postProcess(ctx, &fs, r, w)
+	if err != nil {
+		return cbResp, err
+	}
+
+	var sessID string
+	sessID, err = f.createSession(ctx, &fs)
+	if err != nil {
+		return cbResp, errors.Wrap(err, "error creating session")
+	}
+	cbResp = callbacks.Response{
+		Token: sessID,
+		Type:  "Bearer",
+	}
+	err = session.GetSessionService().DeleteSession(ctx, fs.ID)
+	if err != nil {
+		f.logger.Warnf("error clearing session %s %v", fs.ID, err)
+	}
+
+	return cbResp, nil
+}
+
+// processFlow processes modules of the flow or sub-flow fs, root is the top level flow state that is stored in the session.
+// Returns InProgress status and callbacks response, if a module requests callbacks,
+// otherwise returns the flow result
+func (f *flowProcessor) processFlow(ctx context.Context, root, fs *state.FlowState, cbReq callbacks.Request, r *http.Request,
+	w http.ResponseWriter) (status state.ModuleStatus, cbResp callbacks.Response, err error) {
+	firstModuleIndex := -1
 modules:
-	for moduleIndex, moduleInfo := range fs.Modules {
+	for moduleIndex := 0; moduleIndex < len(fs.Modules); moduleIndex++ {
+		moduleInfo := fs.Modules[moduleIndex]
+		if moduleInfo.Status == state.Start && len(moduleInfo.When) > 0 {
+			var met bool
+			met, err = conditionsMet(ctx, moduleInfo.When, fs, previousModuleIndex(fs, moduleIndex), r)
+			if err != nil {
+				return state.Fail, cbResp, errors.Wrapf(err, "error evaluating conditions for module %v", moduleInfo.ID)
+			}
+			if !met {
+				moduleInfo.Status = state.Skip
+				fs.UpdateModuleInfo(moduleIndex, moduleInfo)
+				continue
+			}
+		}
+		if firstModuleIndex < 0 && moduleInfo.Status != state.Skip {
+			firstModuleIndex = moduleIndex
+		}
 		switch moduleInfo.Status {
-		// TODO v2 match module names in a callback request
 		case state.Start, state.InProgress:
-			var instance modules.AuthModule
-			instance, err = modules.GetAuthModule(moduleInfo, r, w)
-			if err != nil {
-				return cbResp, fmt.Errorf("Process: error getting auth module %v %w", moduleInfo, err)
+			// callbacks from the request belong to the module in progress or to the first module in the flow
+			var req callbacks.Request
+			if moduleInfo.Status == state.InProgress || moduleIndex == firstModuleIndex {
+				req = cbReq
 			}
 			var newState state.ModuleStatus
-			// if module is the first in the flow, then pass callbacks directly to the module
-			if (len(cbReq.Callbacks) == 0 || moduleIndex > 0) && moduleInfo.Status == state.Start {
-				newState, outCbs, err = instance.Process(&fs)
+			var outCbs []callbacks.Callback
+			if moduleInfo.Type == subFlowModuleType {
+				newState, cbResp, err = f.processSubFlow(ctx, root, fs, &moduleInfo, req, r, w)
 				if err != nil {
-					return cbResp, err
+					return state.Fail, cbResp, err
 				}
+				outCbs = cbResp.Callbacks
 			} else {
-				if err != nil {
-					f.logger.Error("error parsing request body: ", err)
-					return cbResp, errors.New("bad request")
+				if len(req.Callbacks) > 0 && req.Module != "" && req.Module != moduleInfo.ID {
+					return state.Fail, cbResp, autherrors.NewUnexpectedModule(
+						fmt.Sprintf("callbacks for module %v, expected module %v", req.Module, moduleInfo.ID))
 				}
-				err = instance.ValidateCallbacks(inCbs)
+				newState, outCbs, err = f.processModule(ctx, fs, &moduleInfo, req.Callbacks, r, w)
 				if err != nil {
-					return cbResp, err
+					return state.Fail, cbResp, err
 				}
-				newState, outCbs, err = instance.ProcessCallbacks(inCbs, &fs)
-				if err != nil {
-					return cbResp, err
+				cbResp = callbacks.Response{
+					Callbacks: outCbs,
+					Module:    moduleInfo.ID,
 				}
 			}
 
 			moduleInfo.Status = newState
+			if moduleInfo.Type == modules.ChoiceModuleType && moduleInfo.Status == state.Pass {
+				err = selectChoiceOption(fs, &moduleInfo)
+				if err != nil {
+					return state.Fail, cbResp, err
+				}
+			}
 
 			fs.UpdateModuleInfo(moduleIndex, moduleInfo)
-			err = f.updateFlowState(&fs)
+			err = f.updateFlowState(ctx, root)
 			if err != nil {
-				return cbResp, errors.Wrap(err, "error update flowstate")
+				return state.Fail, cbResp, errors.Wrap(err, "error update flowstate")
 			}
 
 			switch moduleInfo.Status {
 			case state.InProgress, state.Start:
-				cbResp = callbacks.Response{
-					Callbacks: outCbs,
-					Module:    moduleInfo.ID,
-					FlowID:    fs.ID,
-				}
-				return cbResp, err
-			case state.Pass:
-				if moduleInfo.Criteria == constants.CriteriaSufficient { // TODO v2 refactor move to function
-					break modules
-				}
-				continue
-			case state.Fail:
-				if moduleInfo.Criteria == constants.CriteriaSufficient { // TODO v2 refactor move to function
-					continue
-				}
-				return cbResp, autherrors.NewAuthFailed("auth failed")
+				return state.InProgress, cbResp, err
+			}
+			switch nextCriteriaAction(&moduleInfo) {
+			case criteriaDone:
+				break modules
+			case criteriaFail:
+				return state.Fail, callbacks.Response{}, nil
 			}
+			var next int
+			next, err = nextModuleIndex(ctx, fs, moduleIndex, r)
+			if err != nil {
+				return state.Fail, callbacks.Response{}, err
+			}
+			moduleIndex = next - 1
 		}
 	}
-	authSucceeded := true
-	for _, moduleInfo := range fs.Modules {
+	if !flowSucceeded(fs) {
+		return state.Fail, callbacks.Response{}, nil
+	}
+	return state.Pass, callbacks.Response{}, nil
+}
 
-		if moduleInfo.Criteria == constants.CriteriaSufficient { // TODO v2 refactor move to function
-			if moduleInfo.Status == state.Pass {
-				break
-			}
-		} else if moduleInfo.Status != state.Pass {
-			authSucceeded = false
-			break
-		}
+// processModule passes callbacks to the module, or starts the module if there are no callbacks
+func (f *flowProcessor) processModule(ctx context.Context, fs *state.FlowState, moduleInfo *state.FlowStateModuleInfo, cbs []callbacks.Callback,
+	r *http.Request, w http.ResponseWriter) (ms state.ModuleStatus, outCbs []callbacks.Callback, err error) {
+	instance, err := modules.GetAuthModule(*moduleInfo, r, w)
+	if err != nil {
+		return state.Fail, nil, fmt.Errorf("Process: error getting auth module %v %w", moduleInfo, err)
+	}
+	ctx, cancel := moduleContext(ctx, moduleInfo)
+	defer cancel()
+	if len(cbs) == 0 && moduleInfo.Status == state.Start {
+		return instance.Process(ctx, fs)
 	}
+	err = instance.ValidateCallbacks(cbs)
+	if err != nil {
+		f.logger.Warnf("invalid callbacks for module %v: %v", moduleInfo.ID, err)
+		return state.Fail, nil, autherrors.NewInvalidCallbacks(fmt.Sprintf("invalid callbacks for module %v", moduleInfo.ID))
+	}
+	return instance.ProcessCallbacks(ctx, cbs, fs)
+}
 
-	if authSucceeded {
-		for _, moduleInfo := range fs.Modules {
-			var am modules.AuthModule
-			am, err = modules.GetAuthModule(moduleInfo, r, w)
-			if err != nil {
-				return cbResp, errors.Wrap(err, "error getting auth module for postprocess")
-			}
-			err = am.PostProcess(&fs)
-			if err != nil {
-				return cbResp, errors.Wrap(err, "error while postprocess")
+// postProcess calls PostProcess for every processed module of the flow and its sub-flows
+func (f *flowProcessor) postProcess(ctx context.Context, fs *state.FlowState, r *http.Request, w http.ResponseWriter) error {
+	for _, moduleInfo := range fs.Modules {
+		if moduleInfo.Status == state.Skip || moduleInfo.Status == state.Fail {
+			continue
+		}
+		if moduleInfo.Type == subFlowModuleType {
+			if sub := moduleInfo.SubFlow; sub != nil && moduleInfo.Status == state.Pass {
+				sub.UserID = fs.UserID
+				err := f.postProcess(ctx, sub, r, w)
+				if err != nil {
+					return err
+				}
+				if sub.RedirectURI != "" {
+					fs.RedirectURI = sub.RedirectURI
+				}
 			}
+			continue
 		}
-
-		var sessID string
-		sessID, err = f.createSession(&fs)
+		am, err := modules.GetAuthModule(moduleInfo, r, w)
 		if err != nil {
-			return cbResp, errors.Wrap(err, "error creating session")
-		}
-		cbResp = callbacks.Response{
-			Token: sessID,
-			Type:  "Bearer",
+			return errors.Wrap(err, "error getting auth module for postprocess")
 		}
-		err = session.GetSessionService().DeleteSession(fs.ID)
+		moduleCtx, cancel := moduleContext(ctx, &moduleInfo)
+		err = am.PostProcess(moduleCtx, fs)
+		cancel()
 		if err != nil {
-			f.logger.Warnf("error clearing session %s %v", fs.ID, err)
+			return errors.Wrap(err, "error while postprocess")
 		}
-
-		return cbResp, err
 	}
+	return nil
+}
 
-	return cbResp, err
+// moduleContext limits the module call with the module timeout, if it is set
+func moduleContext(ctx context.Context, moduleInfo *state.FlowStateModuleInfo) (context.Context, context.CancelFunc) {
+	if moduleInfo.TimeoutSec > 0 {
+		return context.WithTimeout(ctx, time.Duration(moduleInfo.TimeoutSec)*time.Second)
+	}
+	return context.WithCancel(ctx)
 }
 
-func (f *flowProcessor) createSession(fs *state.FlowState) (sessID string, err error) {
+func (f *flowProcessor) createSession(ctx context.Context, fs *state.FlowState) (sessID string, err error) {
 	if fs.UserID == "" {
 		return sessID, errors.New("user id is not set")
 	}
 
-	return session.GetSessionService().CreateUserSession(fs.UserID)
+	if fs.SessionID != "" {
+		// the session is not upgraded, if all modules were skipped as already passed or only optional modules failed
+		if !modulesPassed(fs) {
+			return fs.SessionID, nil
+		}
+		return f.upgradeSession(ctx, fs)
+	}
+	return session.GetSessionService().CreateUserSession(ctx, fs.UserID, flowAuthContext(fs))
 
 }
 
-func (f *flowProcessor) updateFlowState(fs *state.FlowState) error {
+func (f *flowProcessor) updateFlowState(ctx context.Context, fs *state.FlowState) error {
 	sessionProp, err := json.Marshal(*fs)
 	if err != nil {
 		return errors.Wrap(err, "error marshaling flow sate")
@@ -169,17 +267,20 @@ func (f *flowProcessor) updateFlowState(fs *state.FlowState) error {
 
 	ss := session.GetSessionService()
 
-	sess, err := ss.GetSession(fs.ID)
+	sess, err := ss.GetSession(ctx, fs.ID)
 	if err != nil {
 		sess = session.Session{
 			ID:         fs.ID,
 			Properties: make(map[string]string),
 		}
+		if fs.ExpiresAt > 0 {
+			sess.ExpiresAt = time.UnixMilli(fs.ExpiresAt)
+		}
 		sess.Properties[constants.FlowStateSessionProperty] = string(sessionProp)
-		_, err = ss.CreateSession(sess)
+		_, err = ss.CreateSession(ctx, sess)
 	} else {
 		sess.Properties[constants.FlowStateSessionProperty] = string(sessionProp)
-		err = ss.UpdateSession(sess)
+		err = ss.UpdateSession(ctx, sess)
 	}
 	if err != nil {
 		return err
@@ -188,50 +289,99 @@ func (f *flowProcessor) updateFlowState(fs *state.FlowState) error {
 
 }
 
-func (f *flowProcessor) getFlowState(name, id string) (state.FlowState, error) {
+// flowLifetime returns the maximum flow duration, defaultFlowLifetime if it is not set
+func flowLifetime(flow config.Flow) time.Duration {
+	if flow.LifetimeSec > 0 {
+		return time.Duration(flow.LifetimeSec) * time.Second
+	}
+	return defaultFlowLifetime
+}
+
+func (f *flowProcessor) getFlowState(ctx context.Context, name, id string, r *http.Request) (state.FlowState, error) {
 	c := config.GetConfig()
 	ss := session.GetSessionService()
-	sess, err := ss.GetSession(id)
+	sess, err := ss.GetSession(ctx, id)
 	var fs state.FlowState
 	if err != nil {
-		flow, ok := c.Flows[name]
-		if !ok {
-			return fs, errors.Errorf("auth flow %v not found", name)
+		if _, ok := c.Flows[name]; !ok {
+			return fs, autherrors.NewFlowNotFound(fmt.Sprintf("auth flow %v not found", name))
+		}
+		fs, err = f.newFlowState(c.Flows, name, nil)
+		if err != nil {
+			return fs, err
+		}
+		fs.ID = uuid.New().String()
+		fs.ExpiresAt = time.Now().Add(flowLifetime(c.Flows[name])).UnixMilli()
+		if c.Flows[name].StepUp {
+			f.startStepUp(ctx, &fs, r)
 		}
-		fs = f.newFlowState(name, flow)
 	} else {
 		err = json.Unmarshal([]byte(sess.Properties[constants.FlowStateSessionProperty]), &fs)
 		if err != nil {
 			return fs, errors.New("session property fs does not exsit")
 		}
+		if fs.Expired() || sess.Expired(time.Now()) {
+			err = ss.DeleteSession(ctx, fs.ID)
+			if err != nil {
+				f.logger.Warnf("error clearing session %s %v", fs.ID, err)
+			}
+			return fs, autherrors.NewFlowExpired(fmt.Sprintf("auth flow %v expired", fs.Name))
+		}
 	}
 
 	return fs, nil
 }
 
-// createNewFlowState - creates new flow state from the Realm and AuthFlow settings, generates new flow Id and fill module properties
-func (f *flowProcessor) newFlowState(flowName string, flow config.Flow) state.FlowState {
+// newFlowState - creates new flow state from the flow settings and fills module properties,
+// sub-flow modules get their own flow states, parents are the names of the flows, that include the flow
+func (f *flowProcessor) newFlowState(flows map[string]config.Flow, flowName string, parents []string) (state.FlowState, error) {
+	var fs state.FlowState
+	flow, ok := flows[flowName]
+	if !ok {
+		return fs, errors.Errorf("auth flow %v not found", flowName)
+	}
+	for _, p := range parents {
+		if p == flowName {
+			return fs, errors.Errorf("auth flow %v includes itself", flowName)
+		}
+	}
 
-	fs := state.FlowState{
+	fs = state.FlowState{
 		Modules:     make([]state.FlowStateModuleInfo, len(flow.Modules)),
 		SharedState: make(map[string]string),
 		UserID:      "",
-		ID:          uuid.New().String(),
 		Name:        flowName,
 	}
 
 	for i, module := range flow.Modules {
+		if err := validateCriteria(module.Criteria); err != nil {
+			return fs, errors.Wrapf(err, "auth flow %v module %v", flowName, module.ID)
+		}
 		fs.Modules[i].ID = module.ID
 		fs.Modules[i].Type = module.Type
 		fs.Modules[i].Properties = make(state.FlowStateModuleProperties)
 		for k, v := range module.Properties {
 			fs.Modules[i].Properties[k] = v
 		}
-		for k, v := range module.Properties {
-			fs.Modules[i].Properties[k] = v
-		}
 		fs.Modules[i].State = make(map[string]interface{})
 		fs.Modules[i].Criteria = module.Criteria
+		fs.Modules[i].When = module.When
+		fs.Modules[i].Transitions = module.Transitions
+		fs.Modules[i].AuthLevel = module.AuthLevel
+		fs.Modules[i].Amr = module.Amr
+		fs.Modules[i].TimeoutSec = module.TimeoutSec
+		if module.Type == subFlowModuleType {
+			subFlowName, _ := module.Properties[subFlowProperty].(string)
+			subFlow, err := f.newFlowState(flows, subFlowName, append(parents, flowName))
+			if err != nil {
+				return fs, errors.Wrapf(err, "auth flow %v module %v", flowName, module.ID)
+			}
+			fs.Modules[i].SubFlow = &subFlow
+		}
 	}
-	return fs
+	err := f.expandChoices(flows, &fs, parents)
+	if err != nil {
+		return fs, err
+	}
+	return fs, nil
 }
@@ -1,10 +1,21 @@
 package auth
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
 	"testing"
+	"time"
 
 	"github.com/maximthomas/gortas/pkg/auth/callbacks"
 	"github.com/maximthomas/gortas/pkg/auth/constants"
+	autherrors "github.com/maximthomas/gortas/pkg/auth/errors"
+	"github.com/maximthomas/gortas/pkg/auth/modules"
+	"github.com/maximthomas/gortas/pkg/auth/modules/otp"
 	"github.com/maximthomas/gortas/pkg/auth/state"
 	"github.com/maximthomas/gortas/pkg/session"
 
@@ -15,7 +26,46 @@ import (
 const testFlowID = "test-flow-id"
 const corruptedFlowID = "corrupted-flow-id"
 
+// staticModule passes or fails depending on the result property and counts its calls
+type staticModule struct {
+	modules.BaseAuthModule
+}
+
+var staticModuleCalls = make(map[string]int)
+
+func (sm *staticModule) Process(ctx context.Context, fs *state.FlowState) (ms state.ModuleStatus, cbs []callbacks.Callback, err error) {
+	if err = ctx.Err(); err != nil {
+		return state.Fail, cbs, err
+	}
+	name, _ := sm.Properties["name"].(string)
+	staticModuleCalls[name]++
+	if sm.Properties["result"] == "pass" {
+		fs.UserID = "user1"
+		if fs.SharedState != nil {
+			fs.SharedState["static"] = name
+		}
+		return state.Pass, cbs, err
+	}
+	return state.Fail, cbs, err
+}
+
+func (sm *staticModule) ProcessCallbacks(ctx context.Context, _ []callbacks.Callback, fs *state.FlowState) (ms state.ModuleStatus, cbs []callbacks.Callback, err error) {
+	return sm.Process(ctx, fs)
+}
+
+func (sm *staticModule) ValidateCallbacks(_ []callbacks.Callback) error {
+	return nil
+}
+
+func (sm *staticModule) PostProcess(_ context.Context, _ *state.FlowState) error {
+	return nil
+}
+
 func init() {
+	modules.RegisterModule("static", func(base modules.BaseAuthModule) (modules.AuthModule, error) {
+		return &staticModule{base}, nil
+	})
+
 	flows := map[string]config.Flow{
 		"login": {Modules: []config.Module{
 			{
@@ -38,13 +88,98 @@ func init() {
 		},
 		},
 		"sso": {Modules: []config.Module{}},
+		"branch": {Modules: []config.Module{
+			{
+				ID:   "identify",
+				Type: "credentials",
+				Properties: map[string]interface{}{
+					"primaryField": map[string]interface{}{
+						"name":     "login",
+						"prompt":   "Login",
+						"required": true,
+					},
+				},
+				Transitions: []config.Transition{
+					{
+						When: []config.Condition{{Source: "user", Operator: "notExists"}},
+						Next: "register",
+					},
+				},
+			},
+			{
+				ID:       "password",
+				Type:     "login",
+				Criteria: constants.CriteriaSufficient,
+			},
+			{
+				ID:   "register",
+				Type: "registration",
+				Properties: map[string]interface{}{
+					"primaryField": map[string]interface{}{
+						"name":   "login",
+						"prompt": "Login",
+					},
+				},
+			},
+		}},
+		"conditional": {Modules: []config.Module{
+			{
+				ID:   "login",
+				Type: "login",
+			},
+			{
+				ID:   "otp",
+				Type: "otp",
+				When: []config.Condition{
+					{Source: "remoteAddr", Operator: "notInNetwork", Value: "10.0.0.0/8"},
+				},
+				Properties: map[string]interface{}{
+					"otpLength":          4,
+					"useDigits":          true,
+					"otpTimeoutSec":      180,
+					"otpResendSec":       90,
+					"otpRetryCount":      5,
+					"otpMessageTemplate": "Code {{.OTP}}",
+					"sender": map[string]interface{}{
+						"senderType": "test",
+					},
+				},
+			},
+		}},
 	}
 
+	flows["composite"] = config.Flow{Modules: []config.Module{
+		{ID: "password", Type: "flow", Properties: map[string]interface{}{"flow": "login"}},
+		{ID: "second", Type: "flow", Properties: map[string]interface{}{"flow": "static-pass"}},
+	}}
+	flows["static-pass"] = config.Flow{Modules: []config.Module{
+		{ID: "static-pass", Type: "static", Properties: map[string]interface{}{"name": "static-pass", "result": "pass"}},
+	}}
+	flows["step-up"] = config.Flow{StepUp: true, Modules: []config.Module{
+		{ID: "static", Type: "static", Properties: map[string]interface{}{"name": "step-up-static", "result": "pass"}},
+		{ID: "login", Type: "login", AuthLevel: 2, Amr: "pwd"},
+	}}
+	flows["choice"] = config.Flow{Modules: []config.Module{
+		{ID: "choice", Type: "choice", Properties: map[string]interface{}{
+			"options": []interface{}{
+				map[string]interface{}{"name": "a", "module": "a"},
+				map[string]interface{}{"name": "b", "flow": "static-pass"},
+				map[string]interface{}{"name": "c", "module": "c"},
+			},
+		}},
+		{ID: "a", Type: "static", Properties: map[string]interface{}{"name": "choice-a", "result": "pass"}},
+		{ID: "c", Type: "static", Properties: map[string]interface{}{"name": "choice-c", "result": "fail"}},
+	}}
+	flows["loop"] = config.Flow{Modules: []config.Module{
+		{ID: "loop", Type: "flow", Properties: map[string]interface{}{"flow": "loop"}},
+	}}
+
 	conf := config.Config{
 		Flows: flows,
 		Session: session.Config{
 			Type: "stateful",
 		},
+		EncryptionKey: "Gb8l9wSZzEjeL2FTRG0k6bBnw7AZ/rBCcZfDDGLVreY=",
 	}
 	config.SetConfig(&conf)
 
@@ -54,14 +189,14 @@ func init() {
 			constants.FlowStateSessionProperty: "{}",
 		},
 	}
-	_, _ = session.GetSessionService().CreateSession(s)
+	_, _ = session.GetSessionService().CreateSession(context.Background(), s)
 	corruptedSession := session.Session{
 		ID: corruptedFlowID,
 		Properties: map[string]string{
 			constants.FlowStateSessionProperty: "bad",
 		},
 	}
-	_, _ = session.GetSessionService().CreateSession(corruptedSession)
+	_, _ = session.GetSessionService().CreateSession(context.Background(), corruptedSession)
 }
 
 func TestGetFlowState(t *testing.T) {
@@ -88,7 +223,7 @@ func TestGetFlowState(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			fs, err := fp.getFlowState(tt.flowName, tt.flowID)
+			fs, err := fp.getFlowState(context.Background(), tt.flowName, tt.flowID, nil)
 			tt.checkError(t, err)
 			tt.checkFlow(t, fs)
 		})
@@ -98,7 +233,7 @@ func TestGetFlowState(t *testing.T) {
 func TestProcess(t *testing.T) {
 	fp := NewFlowProcessor()
 	var cbReq callbacks.Request
-	cbResp, err := fp.Process("login", cbReq, nil, nil)
+	cbResp, err := fp.Process(context.Background(), "login", cbReq, nil, nil)
 	assert.NoError(t, err)
 	assert.True(t, len(cbResp.Callbacks) > 0)
 	assert.Equal(t, "login", cbResp.Module)
@@ -112,7 +247,7 @@ func TestProcess(t *testing.T) {
 	cbReq.Callbacks[0].Value = "test"
 	cbReq.Callbacks[1].Value = "test"
 	cbReq.FlowID = cbResp.FlowID
-	cbResp, err = fp.Process("login", cbReq, nil, nil)
+	cbResp, err = fp.Process(context.Background(), "login", cbReq, nil, nil)
 	assert.NoError(t, err)
 	assert.True(t, len(cbResp.Callbacks) > 0)
 	assert.Equal(t, "login", cbResp.Module)
@@ -122,11 +257,646 @@ func TestProcess(t *testing.T) {
 	//valid login and password
 	cbReq.Callbacks[0].Value = "user1"
 	cbReq.Callbacks[1].Value = "password"
-	cbResp, err = fp.Process("login", cbReq, nil, nil)
+	cbResp, err = fp.Process(context.Background(), "login", cbReq, nil, nil)
 	assert.NoError(t, err)
 	assert.True(t, len(cbResp.Callbacks) == 0)
 	assert.Empty(t, cbResp.FlowID)
 	assert.NotEmpty(t, cbResp.Token)
 }
 
-//TODO v0 add test with complex flow (2FA)
+func TestProcess_Transitions(t *testing.T) {
+	fp := NewFlowProcessor()
+
+	t.Run("existing user goes to password", func(t *testing.T) {
+		cbResp, err := fp.Process(context.Background(), "branch", callbacks.Request{}, nil, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, "identify", cbResp.Module)
+
+		cbReq := callbacks.Request{FlowID: cbResp.FlowID, Callbacks: cbResp.Callbacks}
+		cbReq.Callbacks[0].Value = "user2"
+		cbResp, err = fp.Process(context.Background(), "branch", cbReq, nil, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, "password", cbResp.Module)
+
+		cbReq = callbacks.Request{FlowID: cbResp.FlowID, Callbacks: cbResp.Callbacks}
+		cbReq.Callbacks[0].Value = "user2"
+		cbReq.Callbacks[1].Value = "password"
+		cbResp, err = fp.Process(context.Background(), "branch", cbReq, nil, nil)
+		assert.NoError(t, err)
+		assert.NotEmpty(t, cbResp.Token)
+	})
+
+	t.Run("unknown user goes to registration", func(t *testing.T) {
+		cbResp, err := fp.Process(context.Background(), "branch", callbacks.Request{}, nil, nil)
+		assert.NoError(t, err)
+
+		cbReq := callbacks.Request{FlowID: cbResp.FlowID, Callbacks: cbResp.Callbacks}
+		cbReq.Callbacks[0].Value = "newUser"
+		cbResp, err = fp.Process(context.Background(), "branch", cbReq, nil, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, "register", cbResp.Module)
+		fs, err := fp.(*flowProcessor).getFlowState(context.Background(), "branch", cbResp.FlowID, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, state.Skip, fs.Modules[1].Status)
+
+		cbReq = callbacks.Request{FlowID: cbResp.FlowID, Callbacks: cbResp.Callbacks}
+		cbReq.Callbacks[0].Value = "newUser"
+		cbReq.Callbacks[1].Value = "passw0rd"
+		cbReq.Callbacks[2].Value = "passw0rd"
+		cbResp, err = fp.Process(context.Background(), "branch", cbReq, nil, nil)
+		assert.NoError(t, err)
+		assert.NotEmpty(t, cbResp.Token)
+	})
+}
+
+func TestProcess_ModuleConditions(t *testing.T) {
+	fp := NewFlowProcessor()
+	tests := []struct {
+		name        string
+		remoteAddr  string
+		expectedOTP bool
+	}{
+		{name: "internal network skips otp", remoteAddr: "10.1.2.3:1234", expectedOTP: false},
+		{name: "external network requires otp", remoteAddr: "192.0.2.1:1234", expectedOTP: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/gortas/v1/auth/conditional", nil)
+			r.RemoteAddr = tt.remoteAddr
+			cbResp, err := fp.Process(context.Background(), "conditional", callbacks.Request{}, r, nil)
+			assert.NoError(t, err)
+			cbReq := callbacks.Request{FlowID: cbResp.FlowID, Callbacks: cbResp.Callbacks}
+			cbReq.Callbacks[0].Value = "user1"
+			cbReq.Callbacks[1].Value = "password"
+			cbResp, err = fp.Process(context.Background(), "conditional", cbReq, r, nil)
+			assert.NoError(t, err)
+			if tt.expectedOTP {
+				assert.Equal(t, "otp", cbResp.Module)
+				assert.Empty(t, cbResp.Token)
+			} else {
+				assert.NotEmpty(t, cbResp.Token)
+			}
+		})
+	}
+}
+
+func TestEvaluateCondition(t *testing.T) {
+	fs := &state.FlowState{
+		SharedState: map[string]string{"channel": "mobile"},
+		UserID:      "user1",
+		Modules: []state.FlowStateModuleInfo{
+			{ID: "login", Status: state.Pass},
+			{ID: "otp", Status: state.Fail},
+		},
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.0.0.5:5555"
+	r.Header.Set("X-Forwarded-For", "192.168.1.10, 10.0.0.1")
+
+	tests := []struct {
+		name     string
+		cond     config.Condition
+		expected bool
+	}{
+		{"shared state eq", config.Condition{Source: "sharedState", Key: "channel", Value: "mobile"}, true},
+		{"shared state ne", config.Condition{Source: "sharedState", Key: "channel", Operator: "ne", Value: "mobile"}, false},
+		{"shared state not exists", config.Condition{Source: "sharedState", Key: "bad", Operator: "notExists"}, true},
+		{"user exists", config.Condition{Source: "user", Operator: "exists"}, true},
+		{"user property not exists", config.Condition{Source: "user", Key: "bad", Operator: "exists"}, false},
+		{"header matches", config.Condition{Source: "header", Key: "X-Forwarded-For", Operator: "matches", Value: "^192\\."}, true},
+		{"header in network", config.Condition{Source: "header", Key: "X-Forwarded-For", Operator: "inNetwork", Value: "192.168.0.0/16"}, true},
+		{"remote addr not in network", config.Condition{Source: "remoteAddr", Operator: "notInNetwork", Value: "10.0.0.0/8"}, false},
+		{"previous module status", config.Condition{Source: "status", Value: "fail"}, true},
+		{"module status by id", config.Condition{Source: "status", Key: "login", Value: "pass"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			met, err := evaluateCondition(context.Background(), tt.cond, fs, 1, r)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, met)
+		})
+	}
+
+	_, err := evaluateCondition(context.Background(), config.Condition{Source: "bad"}, fs, 1, r)
+	assert.Error(t, err)
+	_, err = evaluateCondition(context.Background(), config.Condition{Source: "sharedState", Operator: "bad"}, fs, 1, r)
+	assert.Error(t, err)
+}
+
+func TestProcess_Criteria(t *testing.T) {
+	type module struct {
+		criteria string
+		result   string
+	}
+	tests := []struct {
+		name      string
+		modules   []module
+		succeeded bool
+		processed []bool
+	}{
+		{name: "required modules pass", succeeded: true, processed: []bool{true, true},
+			modules: []module{{"", "pass"}, {constants.CriteriaRequired, "pass"}}},
+		{name: "required failure processes remaining modules", succeeded: false, processed: []bool{true, true},
+			modules: []module{{constants.CriteriaRequired, "fail"}, {constants.CriteriaRequired, "pass"}}},
+		{name: "requisite failure stops the flow", succeeded: false, processed: []bool{true, false},
+			modules: []module{{constants.CriteriaRequisite, "fail"}, {constants.CriteriaRequired, "pass"}}},
+		{name: "default criteria failure stops the flow", succeeded: false, processed: []bool{true, false},
+			modules: []module{{"", "fail"}, {"", "pass"}}},
+		{name: "sufficient success stops the flow", succeeded: true, processed: []bool{true, true, false},
+			modules: []module{{constants.CriteriaRequired, "pass"}, {constants.CriteriaSufficient, "pass"}, {constants.CriteriaRequired, "fail"}}},
+		{name: "sufficient success after required failure", succeeded: false, processed: []bool{true, true, false},
+			modules: []module{{constants.CriteriaRequired, "fail"}, {constants.CriteriaSufficient, "pass"}, {constants.CriteriaRequired, "pass"}}},
+		{name: "sufficient failure is ignored", succeeded: true, processed: []bool{true, true},
+			modules: []module{{constants.CriteriaSufficient, "fail"}, {constants.CriteriaRequired, "pass"}}},
+		{name: "only sufficient failure", succeeded: false, processed: []bool{true},
+			modules: []module{{constants.CriteriaSufficient, "fail"}}},
+		{name: "optional failure is ignored", succeeded: true, processed: []bool{true, true},
+			modules: []module{{constants.CriteriaOptional, "fail"}, {constants.CriteriaRequired, "pass"}}},
+		{name: "only optional failure", succeeded: false, processed: []bool{true},
+			modules: []module{{constants.CriteriaOptional, "fail"}}},
+		{name: "only optional success", succeeded: true, processed: []bool{true},
+			modules: []module{{constants.CriteriaOptional, "pass"}}},
+	}
+
+	fp := NewFlowProcessor()
+	flows := config.GetConfig().Flows
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flow := config.Flow{}
+			names := make([]string, len(tt.modules))
+			for i, m := range tt.modules {
+				names[i] = tt.name + string(rune('a'+i))
+				flow.Modules = append(flow.Modules, config.Module{
+					ID:         names[i],
+					Type:       "static",
+					Criteria:   m.criteria,
+					Properties: map[string]interface{}{"name": names[i], "result": m.result},
+				})
+			}
+			flows[tt.name] = flow
+
+			cbResp, err := fp.Process(context.Background(), tt.name, callbacks.Request{}, nil, nil)
+			if tt.succeeded {
+				assert.NoError(t, err)
+				assert.NotEmpty(t, cbResp.Token)
+			} else {
+				var authFailed *autherrors.AuthFailed
+				assert.ErrorAs(t, err, &authFailed)
+				assert.Empty(t, cbResp.Token)
+			}
+			for i, processed := range tt.processed {
+				assert.Equal(t, processed, staticModuleCalls[names[i]] > 0, names[i])
+			}
+		})
+	}
+}
+
+func TestProcess_UnknownCriteria(t *testing.T) {
+	config.GetConfig().Flows["bad-criteria"] = config.Flow{Modules: []config.Module{
+		{ID: "static", Type: "static", Criteria: "sufficent"},
+	}}
+	_, err := NewFlowProcessor().Process(context.Background(), "bad-criteria", callbacks.Request{}, nil, nil)
+	assert.Error(t, err)
+}
+
+func TestProcess_SubFlow(t *testing.T) {
+	fp := NewFlowProcessor()
+	cbResp, err := fp.Process(context.Background(), "composite", callbacks.Request{}, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "login", cbResp.Module)
+	assert.NotEmpty(t, cbResp.FlowID)
+	flowID := cbResp.FlowID
+
+	cbReq := callbacks.Request{FlowID: flowID, Callbacks: cbResp.Callbacks}
+	cbReq.Callbacks[0].Value = "user2"
+	cbReq.Callbacks[1].Value = "bad"
+	cbResp, err = fp.Process(context.Background(), "composite", cbReq, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "login", cbResp.Module)
+	assert.Equal(t, "Invalid username or password", cbResp.Callbacks[0].Error)
+
+	fs, err := fp.(*flowProcessor).getFlowState(context.Background(), "composite", flowID, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, state.InProgress, fs.Modules[0].Status)
+	assert.Equal(t, state.InProgress, fs.Modules[0].SubFlow.Modules[0].Status)
+
+	cbReq.Callbacks[1].Value = "password"
+	cbResp, err = fp.Process(context.Background(), "composite", cbReq, nil, nil)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, cbResp.Token)
+}
+
+func TestProcessSubFlow_MergeState(t *testing.T) {
+	fp := &flowProcessor{}
+	fs, err := fp.newFlowState(config.GetConfig().Flows, "composite", nil)
+	assert.NoError(t, err)
+	fs.ID = "merge-flow-id"
+	fs.UserID = "user2"
+	fs.SharedState["parent"] = "value"
+	fs.Modules[0].Status = state.Pass
+
+	mi := fs.Modules[1]
+	ms, _, err := fp.processSubFlow(context.Background(), &fs, &fs, &mi, callbacks.Request{}, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, state.Pass, ms)
+	assert.Equal(t, fs.ID, mi.SubFlow.ID)
+	assert.Equal(t, "value", mi.SubFlow.SharedState["parent"])
+	assert.Equal(t, "static-pass", fs.SharedState["static"])
+	assert.Equal(t, "user1", fs.UserID)
+	sub, ok := fs.FindModule("static-pass")
+	assert.True(t, ok)
+	assert.Equal(t, state.Pass, sub.Status)
+}
+
+func TestNewFlowState_SubFlowErrors(t *testing.T) {
+	fp := &flowProcessor{}
+	_, err := fp.newFlowState(config.GetConfig().Flows, "loop", nil)
+	assert.Error(t, err)
+
+	flows := map[string]config.Flow{
+		"parent": {Modules: []config.Module{
+			{ID: "child", Type: "flow", Properties: map[string]interface{}{"flow": "bad"}},
+		}},
+	}
+	_, err = fp.newFlowState(flows, "parent", nil)
+	assert.Error(t, err)
+}
+
+func TestProcess_FlowExpired(t *testing.T) {
+	fp := NewFlowProcessor()
+	cbResp, err := fp.Process(context.Background(), "login", callbacks.Request{}, nil, nil)
+	assert.NoError(t, err)
+	flowID := cbResp.FlowID
+
+	sess, err := session.GetSessionService().GetSession(context.Background(), flowID)
+	assert.NoError(t, err)
+	var fs state.FlowState
+	assert.NoError(t, json.Unmarshal([]byte(sess.Properties[constants.FlowStateSessionProperty]), &fs))
+	assert.True(t, fs.ExpiresAt > time.Now().UnixMilli())
+	fs.ExpiresAt = time.Now().Add(-time.Second).UnixMilli()
+	fsJSON, _ := json.Marshal(fs)
+	sess.Properties[constants.FlowStateSessionProperty] = string(fsJSON)
+	assert.NoError(t, session.GetSessionService().UpdateSession(context.Background(), sess))
+
+	_, err = fp.Process(context.Background(), "login", callbacks.Request{FlowID: flowID}, nil, nil)
+	var expiredErr *autherrors.FlowExpired
+	assert.True(t, errors.As(err, &expiredErr))
+	_, err = session.GetSessionService().GetSession(context.Background(), flowID)
+	assert.Error(t, err)
+}
+
+func TestProcess_StepUp(t *testing.T) {
+	fp := NewFlowProcessor()
+	cbResp, err := fp.Process(context.Background(), "static-pass", callbacks.Request{}, nil, nil)
+	assert.NoError(t, err)
+	sessID := cbResp.Token
+	assert.NotEmpty(t, sessID)
+	sess, err := session.GetSessionService().GetUserSession(context.Background(), sessID)
+	assert.NoError(t, err)
+	assert.Equal(t, "0", sess.Properties[session.AcrProperty])
+	assert.Equal(t, "static", sess.Properties[session.AmrProperty])
+	assert.Equal(t, "static", sess.Properties[session.AuthModulesProperty])
+	authTime := sess.GetAuthContext().AuthTime
+	assert.False(t, authTime.IsZero())
+
+	stepUp := func(login string) (callbacks.Response, error) {
+		r := httptest.NewRequest("POST", "/gortas/v1/auth/step-up", nil)
+		r.AddCookie(&http.Cookie{Name: state.SessionCookieName, Value: sessID})
+		cbResp, err := fp.Process(context.Background(), "step-up", callbacks.Request{}, r, nil)
+		assert.NoError(t, err)
+		// already passed static module is skipped
+		assert.Equal(t, "login", cbResp.Module)
+		assert.Equal(t, 0, staticModuleCalls["step-up-static"])
+
+		cbReq := callbacks.Request{FlowID: cbResp.FlowID, Callbacks: cbResp.Callbacks}
+		cbReq.Callbacks[0].Value = login
+		cbReq.Callbacks[1].Value = "password"
+		return fp.Process(context.Background(), "step-up", cbReq, r, nil)
+	}
+
+	t.Run("another user", func(t *testing.T) {
+		cbResp, err := stepUp("user2")
+		var authFailed *autherrors.AuthFailed
+		assert.ErrorAs(t, err, &authFailed)
+		assert.Empty(t, cbResp.Token)
+	})
+
+	t.Run("upgrade session", func(t *testing.T) {
+		cbResp, err := stepUp("user1")
+		assert.NoError(t, err)
+		assert.Equal(t, sessID, cbResp.Token)
+		sess, err := session.GetSessionService().GetUserSession(context.Background(), sessID)
+		assert.NoError(t, err)
+		assert.Equal(t, "2", sess.Properties[session.AcrProperty])
+		assert.Equal(t, "mfa,pwd,static", sess.Properties[session.AmrProperty])
+		// module types are recorded regardless of the configured amr
+		assert.Equal(t, "login,static", sess.Properties[session.AuthModulesProperty])
+		assert.False(t, sess.GetAuthContext().AuthTime.Before(authTime))
+	})
+
+	t.Run("all modules passed", func(t *testing.T) {
+		// the session keeps its authentication time, as nothing is authenticated again
+		oldSessID, err := session.GetSessionService().CreateUserSession(context.Background(), "user1",
+			session.AuthContext{Level: 2, Amr: []string{"mfa", "pwd", "static"}, AuthTime: time.Unix(1000, 0)})
+		assert.NoError(t, err)
+		r := httptest.NewRequest("POST", "/gortas/v1/auth/step-up", nil)
+		r.AddCookie(&http.Cookie{Name: state.SessionCookieName, Value: oldSessID})
+		cbResp, err := fp.Process(context.Background(), "step-up", callbacks.Request{}, r, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, oldSessID, cbResp.Token)
+		sess, err := session.GetSessionService().GetUserSession(context.Background(), oldSessID)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1000), sess.GetAuthContext().AuthTime.Unix())
+		assert.Equal(t, "mfa,pwd,static", sess.Properties[session.AmrProperty])
+	})
+
+	t.Run("no session", func(t *testing.T) {
+		cbResp, err := fp.Process(context.Background(), "step-up", callbacks.Request{}, nil, nil)
+		assert.NoError(t, err)
+		assert.Empty(t, cbResp.Token)
+		assert.Equal(t, 1, staticModuleCalls["step-up-static"])
+	})
+}
+
+func TestProcess_Choice(t *testing.T) {
+	fp := NewFlowProcessor()
+	choose := func(option string) (callbacks.Response, error) {
+		cbResp, err := fp.Process(context.Background(), "choice", callbacks.Request{}, nil, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, "choice", cbResp.Module)
+		assert.Equal(t, 1, len(cbResp.Callbacks))
+		assert.Equal(t, callbacks.TypeOptions, cbResp.Callbacks[0].Type)
+		assert.Equal(t, []string{"a", "b", "c"}, cbResp.Callbacks[0].Options)
+		cbReq := callbacks.Request{FlowID: cbResp.FlowID, Callbacks: cbResp.Callbacks}
+		cbReq.Callbacks[0].Value = option
+		return fp.Process(context.Background(), "choice", cbReq, nil, nil)
+	}
+
+	t.Run("module option", func(t *testing.T) {
+		cbResp, err := choose("a")
+		assert.NoError(t, err)
+		assert.NotEmpty(t, cbResp.Token)
+		assert.Equal(t, 1, staticModuleCalls["choice-a"])
+		assert.Equal(t, 0, staticModuleCalls["choice-c"])
+		sess, err := session.GetSessionService().GetUserSession(context.Background(), cbResp.Token)
+		assert.NoError(t, err)
+		assert.Equal(t, "static", sess.Properties[session.AmrProperty])
+	})
+
+	t.Run("sub-flow option", func(t *testing.T) {
+		calls := staticModuleCalls["static-pass"]
+		cbResp, err := choose("b")
+		assert.NoError(t, err)
+		assert.NotEmpty(t, cbResp.Token)
+		assert.Equal(t, calls+1, staticModuleCalls["static-pass"])
+		assert.Equal(t, 1, staticModuleCalls["choice-a"])
+		assert.Equal(t, 0, staticModuleCalls["choice-c"])
+	})
+
+	t.Run("failed option", func(t *testing.T) {
+		cbResp, err := choose("c")
+		var authFailed *autherrors.AuthFailed
+		assert.ErrorAs(t, err, &authFailed)
+		assert.Empty(t, cbResp.Token)
+		assert.Equal(t, 1, staticModuleCalls["choice-a"])
+	})
+
+	t.Run("invalid option", func(t *testing.T) {
+		cbResp, err := choose("d")
+		assert.NoError(t, err)
+		assert.Equal(t, "choice", cbResp.Module)
+		assert.Equal(t, "Invalid option", cbResp.Callbacks[0].Error)
+	})
+}
+
+func TestNewFlowState_ChoiceErrors(t *testing.T) {
+	fp := &flowProcessor{}
+	tests := []struct {
+		name    string
+		options []interface{}
+	}{
+		{name: "no options"},
+		{name: "option module before choice", options: []interface{}{
+			map[string]interface{}{"name": "a", "module": "before"},
+		}},
+		{name: "option module does not exist", options: []interface{}{
+			map[string]interface{}{"name": "a", "module": "bad"},
+		}},
+		{name: "option without module and flow", options: []interface{}{
+			map[string]interface{}{"name": "a"},
+		}},
+		{name: "option flow does not exist", options: []interface{}{
+			map[string]interface{}{"name": "a", "flow": "bad"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flows := map[string]config.Flow{"choice": {Modules: []config.Module{
+				{ID: "before", Type: "static"},
+				{ID: "choice", Type: "choice", Properties: map[string]interface{}{"options": tt.options}},
+			}}}
+			_, err := fp.newFlowState(flows, "choice", nil)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestProcess_ErrorCodes(t *testing.T) {
+	fp := NewFlowProcessor()
+	_, err := fp.Process(context.Background(), "bad", callbacks.Request{}, nil, nil)
+	assert.Equal(t, autherrors.CodeFlowNotFound, autherrors.Code(err))
+
+	cbResp, err := fp.Process(context.Background(), "login", callbacks.Request{}, nil, nil)
+	assert.NoError(t, err)
+	cbReq := callbacks.Request{FlowID: cbResp.FlowID, Callbacks: cbResp.Callbacks[:1]}
+	_, err = fp.Process(context.Background(), "login", cbReq, nil, nil)
+	assert.Equal(t, autherrors.CodeInvalidCallbacks, autherrors.Code(err))
+
+	// the flow could be continued after invalid callbacks
+	cbReq.Callbacks = cbResp.Callbacks
+	cbReq.Callbacks[0].Value = "user1"
+	cbReq.Callbacks[1].Value = "password"
+	cbResp, err = fp.Process(context.Background(), "login", cbReq, nil, nil)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, cbResp.Token)
+
+	assert.Equal(t, autherrors.CodeInternal, autherrors.Code(errors.New("unknown")))
+}
+
+func TestProcess_Context(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := NewFlowProcessor().Process(ctx, "static-pass", callbacks.Request{}, nil, nil)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, autherrors.CodeInternal, autherrors.Code(err))
+}
+
+func TestModuleContext(t *testing.T) {
+	ctx, cancel := moduleContext(context.Background(), &state.FlowStateModuleInfo{})
+	_, ok := ctx.Deadline()
+	assert.False(t, ok)
+	cancel()
+	assert.ErrorIs(t, ctx.Err(), context.Canceled)
+
+	ctx, cancel = moduleContext(context.Background(), &state.FlowStateModuleInfo{TimeoutSec: 10})
+	defer cancel()
+	deadline, ok := ctx.Deadline()
+	assert.True(t, ok)
+	assert.WithinDuration(t, time.Now().Add(10*time.Second), deadline, time.Second)
+}
+
+func TestProcess_CallbacksModule(t *testing.T) {
+	fp := NewFlowProcessor()
+	cbResp, err := fp.Process(context.Background(), "composite", callbacks.Request{}, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "login", cbResp.Module)
+	flowID := cbResp.FlowID
+
+	cbReq := callbacks.Request{FlowID: flowID, Module: "otp", Callbacks: cbResp.Callbacks}
+	cbReq.Callbacks[0].Value = "user1"
+	cbReq.Callbacks[1].Value = "password"
+	_, err = fp.Process(context.Background(), "composite", cbReq, nil, nil)
+	assert.Equal(t, autherrors.CodeUnexpectedModule, autherrors.Code(err))
+
+	// the rejected callbacks do not change the flow state
+	fs, err := fp.(*flowProcessor).getFlowState(context.Background(), "composite", flowID, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, state.InProgress, fs.Modules[0].SubFlow.Modules[0].Status)
+
+	cbReq.Module = "login"
+	cbResp, err = fp.Process(context.Background(), "composite", cbReq, nil, nil)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, cbResp.Token)
+
+	// callbacks without the module name are passed to the current module
+	cbResp, err = fp.Process(context.Background(), "login", callbacks.Request{}, nil, nil)
+	assert.NoError(t, err)
+	cbReq = callbacks.Request{FlowID: cbResp.FlowID, Callbacks: cbResp.Callbacks}
+	cbReq.Callbacks[0].Value = "user1"
+	cbReq.Callbacks[1].Value = "password"
+	cbResp, err = fp.Process(context.Background(), "login", cbReq, nil, nil)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, cbResp.Token)
+}
+
+func TestValidateFlows(t *testing.T) {
+	flows := config.GetConfig().Flows
+	valid := map[string]config.Flow{"composite": flows["composite"], "login": flows["login"], "static-pass": flows["static-pass"]}
+	assert.NoError(t, validateFlows(&config.Config{Flows: valid}))
+
+	tests := []struct {
+		name  string
+		flows map[string]config.Flow
+	}{
+		{name: "unknown module type", flows: map[string]config.Flow{
+			"bad": {Modules: []config.Module{{ID: "bad", Type: "unknown"}}},
+		}},
+		{name: "unknown sub-flow module type", flows: map[string]config.Flow{
+			"parent": {Modules: []config.Module{{ID: "sub", Type: "flow", Properties: map[string]interface{}{"flow": "bad"}}}},
+			"bad":    {Modules: []config.Module{{ID: "bad", Type: "unknown"}}},
+		}},
+		{name: "unknown sub-flow", flows: map[string]config.Flow{
+			"parent": {Modules: []config.Module{{ID: "sub", Type: "flow", Properties: map[string]interface{}{"flow": "none"}}}},
+		}},
+		{name: "unknown criteria", flows: map[string]config.Flow{
+			"bad": {Modules: []config.Module{{ID: "login", Type: "login", Criteria: "sufficent"}}},
+		}},
+		{name: "invalid condition regex", flows: map[string]config.Flow{
+			"bad": {Modules: []config.Module{{ID: "login", Type: "login",
+				When: []config.Condition{{Source: "header", Key: "X", Operator: "matches", Value: "("}}}}},
+		}},
+		{name: "invalid condition network", flows: map[string]config.Flow{
+			"bad": {Modules: []config.Module{{ID: "login", Type: "login",
+				When: []config.Condition{{Source: "remoteAddr", Operator: "inNetwork", Value: "10.0.0.0"}}}}},
+		}},
+		{name: "transition to a previous module", flows: map[string]config.Flow{
+			"bad": {Modules: []config.Module{{ID: "login", Type: "login", Transitions: []config.Transition{{Next: "login"}}}}},
+		}},
+		{name: "invalid module properties", flows: map[string]config.Flow{
+			"bad": {Modules: []config.Module{{ID: "hydra", Type: "hydra"}}},
+		}},
+		{name: "invalid callback validation", flows: map[string]config.Flow{
+			"bad": {Modules: []config.Module{{ID: "credentials", Type: "credentials", Properties: map[string]interface{}{
+				"primaryField": map[string]interface{}{"name": "login", "validation": "("},
+			}}}},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateFlows(&config.Config{Flows: tt.flows})
+			assert.Error(t, err)
+			assert.Contains(t, err.Error(), "flows.")
+		})
+	}
+}
+
+func TestProcess_VerificationLinkAtTimeout(t *testing.T) {
+	flow := config.Flow{LifetimeSec: 7200, Modules: []config.Module{{ID: "registration", Type: "registration",
+		Properties: map[string]interface{}{
+			"primaryField":           map[string]interface{}{"name": "login", "prompt": "Email", "required": true},
+			"verifyEmail":            true,
+			"sender":                 map[string]interface{}{"senderType": "test"},
+			"verificationTimeoutSec": 3600,
+			"messageTemplate":        "code {{.OTP}} link {{.MagicLink}}",
+		},
+	}}}
+	// the link could not outlive the flow, that sent it
+	short := flow
+	short.LifetimeSec = 0
+	err := validateFlows(&config.Config{Flows: map[string]config.Flow{"register": short}})
+	assert.ErrorContains(t, err, "flows.register.modules[0]: properties.verificationTimeoutSec: should not be greater than the flow lifetime 1800 seconds")
+	assert.NoError(t, validateFlows(&config.Config{Flows: map[string]config.Flow{"register": flow}}))
+	config.GetConfig().Flows["register-link"] = flow
+
+	ctx := context.Background()
+	fp := NewFlowProcessor()
+	cbResp, err := fp.Process(ctx, "register-link", callbacks.Request{}, nil, nil)
+	assert.NoError(t, err)
+	cbReq := callbacks.Request{Module: cbResp.Module, Callbacks: cbResp.Callbacks, FlowID: cbResp.FlowID}
+	for i, v := range []string{"june@example.com", "Passw0rd!", "Passw0rd!"} {
+		cbReq.Callbacks[i].Value = v
+	}
+	cbResp, err = fp.Process(ctx, "register-link", cbReq, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "otp", cbResp.Callbacks[0].Name)
+	sender, _ := otp.GetSender("test", nil)
+	m := regexp.MustCompile(`^code \w+ link (\S+)$`).FindStringSubmatch(sender.(*otp.TestSender).Messages["june@example.com"])
+	assert.Len(t, m, 2)
+
+	// the flow, that sent the link, is still valid a second before the verification timeout
+	sess, err := session.GetSessionService().GetSession(ctx, cbResp.FlowID)
+	assert.NoError(t, err)
+	var fs state.FlowState
+	assert.NoError(t, json.Unmarshal([]byte(sess.Properties[constants.FlowStateSessionProperty]), &fs))
+	elapsed := 3599 * time.Second
+	fs.ExpiresAt -= elapsed.Milliseconds()
+	fsJSON, _ := json.Marshal(fs)
+	sess.Properties[constants.FlowStateSessionProperty] = string(fsJSON)
+	sess.ExpiresAt = sess.ExpiresAt.Add(-elapsed)
+	assert.NoError(t, session.GetSessionService().UpdateSession(ctx, sess))
+
+	r := httptest.NewRequest("GET", "/gortas/v1/auth/register-link?code="+url.QueryEscape(m[1]), nil)
+	cbResp, err = fp.Process(ctx, "register-link", callbacks.Request{}, r, httptest.NewRecorder())
+	assert.NoError(t, err)
+	assert.NotEmpty(t, cbResp.Token)
+}
+
+func TestProcess_FlowChangedInProgress(t *testing.T) {
+	flows := config.GetConfig().Flows
+	flows["changed"] = config.Flow{Modules: []config.Module{{ID: "login", Type: "login"}}}
+	fp := NewFlowProcessor()
+	cbResp, err := fp.Process(context.Background(), "changed", callbacks.Request{}, nil, nil)
+	assert.NoError(t, err)
+
+	// the flow in progress keeps the module definitions, it was started with
+	flows["changed"] = config.Flow{Modules: []config.Module{
+		{ID: "static", Type: "static", Properties: map[string]interface{}{"name": "changed", "result": "fail"}},
+	}}
+	cbReq := callbacks.Request{FlowID: cbResp.FlowID, Module: cbResp.Module, Callbacks: cbResp.Callbacks}
+	cbReq.Callbacks[0].Value = "user1"
+	cbReq.Callbacks[1].Value = "password"
+	cbResp, err = fp.Process(context.Background(), "changed", cbReq, nil, nil)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, cbResp.Token)
+	assert.Zero(t, staticModuleCalls["changed"])
+}
@@ -0,0 +1,42 @@
+package auth
+
+import (
+	"fmt"
+
+	"github.com/maximthomas/gortas/pkg/auth/modules"
+	"github.com/maximthomas/gortas/pkg/config"
+	"github.com/maximthomas/gortas/pkg/log"
+
+	autherrors "github.com/maximthomas/gortas/pkg/auth/errors"
+)
+
+// metadataProvider is implemented by modules, that publish metadata for the external providers, like SAML
+type metadataProvider interface {
+	Metadata() ([]byte, error)
+}
+
+// ModuleMetadata returns the metadata of the module in the flow,
+// returns FlowNotFound error if there is no such module or the module has no metadata
+func ModuleMetadata(flows map[string]config.Flow, flowName, moduleID string) ([]byte, error) {
+	if _, ok := flows[flowName]; !ok {
+		return nil, autherrors.NewFlowNotFound(fmt.Sprintf("auth flow %v not found", flowName))
+	}
+	f := &flowProcessor{logger: log.WithField("module", "ModuleMetadata")}
+	fs, err := f.newFlowState(flows, flowName, nil)
+	if err != nil {
+		return nil, err
+	}
+	mi, ok := fs.FindModule(moduleID)
+	if !ok {
+		return nil, autherrors.NewFlowNotFound(fmt.Sprintf("module %v not found in auth flow %v", moduleID, flowName))
+	}
+	m, err := modules.GetAuthModule(mi, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	mp, ok := m.(metadataProvider)
+	if !ok {
+		return nil, autherrors.NewFlowNotFound(fmt.Sprintf("module %v has no metadata", moduleID))
+	}
+	return mp.Metadata()
+}
@@ -0,0 +1,54 @@
+package auth
+
+import (
+	"encoding/xml"
+	"testing"
+
+	"github.com/crewjam/saml"
+	"github.com/maximthomas/gortas/pkg/config"
+	"github.com/stretchr/testify/assert"
+
+	autherrors "github.com/maximthomas/gortas/pkg/auth/errors"
+)
+
+const testIDPMetadata = `<EntityDescriptor xmlns="urn:oasis:names:tc:SAML:2.0:metadata" entityID="https://idp.example.com/metadata">
+  <IDPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol">
+    <SingleSignOnService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect" Location="https://idp.example.com/sso"/>
+  </IDPSSODescriptor>
+</EntityDescriptor>`
+
+func TestModuleMetadata(t *testing.T) {
+	flows := map[string]config.Flow{
+		"sso": {Modules: []config.Module{
+			{ID: "login", Type: "login"},
+			{ID: "saml", Type: "saml", Properties: map[string]interface{}{
+				"entityId":    "https://gortas.example.com/saml",
+				"acsUrl":      "https://gortas.example.com/acs",
+				"idpMetadata": testIDPMetadata,
+			}},
+		}},
+	}
+
+	b, err := ModuleMetadata(flows, "sso", "saml")
+	assert.NoError(t, err)
+	var ed saml.EntityDescriptor
+	assert.NoError(t, xml.Unmarshal(b, &ed))
+	assert.Equal(t, "https://gortas.example.com/saml", ed.EntityID)
+
+	tests := []struct {
+		name   string
+		flow   string
+		module string
+	}{
+		{name: "unknown flow", flow: "other", module: "saml"},
+		{name: "unknown module", flow: "sso", module: "other"},
+		{name: "module without metadata", flow: "sso", module: "login"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ModuleMetadata(flows, tt.flow, tt.module)
+			assert.Error(t, err)
+			assert.Equal(t, autherrors.CodeFlowNotFound, autherrors.Code(err))
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package modules
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/maximthomas/gortas/pkg/auth/callbacks"
+	"github.com/maximthomas/gortas/pkg/auth/state"
+	"github.com/maximthomas/gortas/pkg/user"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+)
+
+// APIKeyModuleType module authenticates non-interactive clients with the API keys of the users
+const APIKeyModuleType = "apiKey"
+
+// APIKey reads the key from the request header and checks it against the hashed keys of the user,
+// the module fails without callbacks, if the key is missing or invalid
+type APIKey struct {
+	BaseAuthModule
+	Header string // header with the key, the Bearer scheme is accepted in the Authorization header
+}
+
+func (a *APIKey) Process(ctx context.Context, fs *state.FlowState) (ms state.ModuleStatus, cbs []callbacks.Callback, err error) {
+	key := a.key()
+	if key == "" {
+		a.l.Warn("api key is not presented")
+		return state.Fail, nil, nil
+	}
+	userID, keyID, secret, ok := user.ParseAPIKey(key)
+	if !ok {
+		a.l.Warn("invalid api key format")
+		return state.Fail, nil, nil
+	}
+	u, ok := user.GetUserService().GetUser(ctx, userID)
+	if !ok {
+		a.l.Warnf("user %v not found", userID)
+		return state.Fail, nil, nil
+	}
+	keys, err := u.APIKeys()
+	if err != nil {
+		return state.Fail, nil, err
+	}
+	for _, k := range keys {
+		if k.ID == keyID && k.Matches(secret, time.Now()) {
+			fs.UserID = u.ID
+			return state.Pass, nil, nil
+		}
+	}
+	a.l.Warnf("invalid api key %v of %v", keyID, userID)
+	return state.Fail, nil, nil
+}
+
+func (a *APIKey) key() string {
+	if a.req == nil {
+		return ""
+	}
+	v := strings.TrimSpace(a.req.Header.Get(a.Header))
+	if strings.EqualFold(a.Header, "Authorization") {
+		scheme, token, ok := strings.Cut(v, " ")
+		if !ok || !strings.EqualFold(scheme, "Bearer") {
+			return ""
+		}
+		v = strings.TrimSpace(token)
+	}
+	return v
+}
+
+func (a *APIKey) ProcessCallbacks(ctx context.Context, _ []callbacks.Callback, fs *state.FlowState) (ms state.ModuleStatus, cbs []callbacks.Callback, err error) {
+	return a.Process(ctx, fs)
+}
+
+func (a *APIKey) ValidateCallbacks(cbs []callbacks.Callback) error {
+	return a.BaseAuthModule.ValidateCallbacks(cbs)
+}
+
+func (a *APIKey) PostProcess(_ context.Context, _ *state.FlowState) error {
+	return nil
+}
+
+func init() {
+	RegisterModule(APIKeyModuleType, newAPIKeyModule,
+		Property{Name: "header", Type: PropertyString, Default: "X-API-Key"},
+	)
+}
+
+func newAPIKeyModule(base BaseAuthModule) (AuthModule, error) {
+	var a APIKey
+	err := mapstructure.Decode(base.Properties, &a)
+	if err != nil {
+		return nil, errors.Wrap(err, "error decoding apiKey properties")
+	}
+	if a.Header == "" {
+		return nil, errors.New("properties.header: required")
+	}
+	a.BaseAuthModule = base
+	return &a, nil
+}
@@ -0,0 +1,74 @@
+package modules
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maximthomas/gortas/pkg/auth/state"
+	"github.com/maximthomas/gortas/pkg/config"
+	"github.com/maximthomas/gortas/pkg/user"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAPIKey(t *testing.T) {
+	config.SetConfig(&config.Config{})
+	ctx := context.Background()
+	us := user.GetUserService()
+	u, ok := us.GetUser(ctx, "user1")
+	assert.True(t, ok)
+	key, k, err := user.NewAPIKey(u.ID, "ci", 0)
+	assert.NoError(t, err)
+	expiredKey, expired, err := user.NewAPIKey(u.ID, "expired", time.Second)
+	assert.NoError(t, err)
+	expired.ExpiresAt = time.Now().Add(-time.Minute).Unix()
+	otherKey, _, err := user.NewAPIKey("user2", "other", 0)
+	assert.NoError(t, err)
+	assert.NoError(t, u.SetAPIKeys([]user.APIKey{k, expired}))
+	assert.NoError(t, us.UpdateUser(ctx, u))
+	_, keyID, _, _ := user.ParseAPIKey(key)
+
+	tests := []struct {
+		name   string
+		header string
+		value  string
+		userID string
+	}{
+		{name: "valid key", value: key, userID: "user1"},
+		{name: "bearer", header: "Authorization", value: "Bearer " + key, userID: "user1"},
+		{name: "other scheme", header: "Authorization", value: "Basic " + key},
+		{name: "no key"},
+		{name: "invalid format", value: "invalid"},
+		{name: "invalid secret", value: key[:strings.LastIndex(key, ".")+1] + "secret"},
+		{name: "expired", value: expiredKey},
+		{name: "key of another user", value: strings.Replace(otherKey, strings.Split(otherKey, ".")[1], keyID, 1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mi := state.FlowStateModuleInfo{ID: "apiKey", Type: APIKeyModuleType, Properties: map[string]interface{}{}}
+			header := "X-API-Key"
+			if tt.header != "" {
+				header = tt.header
+				mi.Properties["header"] = tt.header
+			}
+			r := httptest.NewRequest("GET", "/gortas/v1/auth/api", nil)
+			if tt.value != "" {
+				r.Header.Set(header, tt.value)
+			}
+			m, err := GetAuthModule(mi, r, nil)
+			assert.NoError(t, err)
+			fs := &state.FlowState{}
+			status, cbs, err := m.Process(ctx, fs)
+			assert.NoError(t, err)
+			assert.Empty(t, cbs)
+			assert.Equal(t, tt.userID, fs.UserID)
+			if tt.userID == "" {
+				assert.Equal(t, state.Fail, status)
+			} else {
+				assert.Equal(t, state.Pass, status)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package modules
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/maximthomas/gortas/pkg/auth/callbacks"
+	"github.com/maximthomas/gortas/pkg/auth/state"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+)
+
+// BasicModuleType module authenticates non-interactive clients with the HTTP Basic authentication
+const BasicModuleType = "basic"
+
+// Basic reads the username and the password from the Authorization header,
+// if the header is missing or the credentials are invalid, the module returns 401 status with the Basic challenge
+type Basic struct {
+	BaseAuthModule
+	Realm string
+}
+
+func (b *Basic) Process(ctx context.Context, fs *state.FlowState) (ms state.ModuleStatus, cbs []callbacks.Callback, err error) {
+	if b.req == nil {
+		return state.InProgress, b.challenge(), nil
+	}
+	username, password, ok := b.req.BasicAuth()
+	if !ok {
+		return state.InProgress, b.challenge(), nil
+	}
+	valid, err := b.validatePassword(ctx, username, password)
+	if err != nil {
+		return state.Fail, nil, err
+	}
+	if valid {
+		fs.UserID = username
+		return state.Pass, nil, nil
+	}
+	b.l.Warnf("invalid credentials of %v", username)
+	return state.InProgress, b.challenge(), nil
+}
+
+func (b *Basic) challenge() []callbacks.Callback {
+	return []callbacks.Callback{{
+		Name:  "httpstatus",
+		Type:  callbacks.TypeHTTPStatus,
+		Value: "401",
+		Properties: map[string]string{
+			"WWW-Authenticate": fmt.Sprintf(`Basic realm="%v", charset="UTF-8"`, strings.ReplaceAll(b.Realm, `"`, "")),
+		},
+	}}
+}
+
+// ProcessCallbacks checks the header of the request again, the client sends the credentials with the repeated request
+func (b *Basic) ProcessCallbacks(ctx context.Context, _ []callbacks.Callback, fs *state.FlowState) (ms state.ModuleStatus, cbs []callbacks.Callback, err error) {
+	return b.Process(ctx, fs)
+}
+
+// ValidateCallbacks accepts any callbacks, the credentials are read only from the header
+func (b *Basic) ValidateCallbacks(_ []callbacks.Callback) error {
+	return nil
+}
+
+func (b *Basic) PostProcess(_ context.Context, _ *state.FlowState) error {
+	return nil
+}
+
+func init() {
+	RegisterModule(BasicModuleType, newBasicModule,
+		Property{Name: "realm", Type: PropertyString, Default: "gortas"},
+	)
+}
+
+func newBasicModule(base BaseAuthModule) (AuthModule, error) {
+	var b Basic
+	err := mapstructure.Decode(base.Properties, &b)
+	if err != nil {
+		return nil, errors.Wrap(err, "error decoding basic properties")
+	}
+	b.BaseAuthModule = base
+	return &b, nil
+}
@@ -0,0 +1,61 @@
+package modules
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/maximthomas/gortas/pkg/auth/callbacks"
+	autherrors "github.com/maximthomas/gortas/pkg/auth/errors"
+	"github.com/maximthomas/gortas/pkg/auth/state"
+	"github.com/maximthomas/gortas/pkg/config"
+	"github.com/maximthomas/gortas/pkg/lockout"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBasic(t *testing.T) {
+	config.SetConfig(&config.Config{Lockout: lockout.Config{User: lockout.Policy{MaxFailures: 2}}})
+	defer config.SetConfig(&config.Config{})
+
+	basic := func(username, password string) (state.ModuleStatus, []callbacks.Callback, *state.FlowState, error) {
+		r := httptest.NewRequest("GET", "/gortas/v1/auth/basic", nil)
+		if username != "" {
+			r.SetBasicAuth(username, password)
+		}
+		m, err := GetAuthModule(state.FlowStateModuleInfo{ID: "basic", Type: BasicModuleType,
+			Properties: map[string]interface{}{"realm": "scripts"}}, r, nil)
+		assert.NoError(t, err)
+		fs := &state.FlowState{}
+		status, cbs, err := m.Process(context.Background(), fs)
+		return status, cbs, fs, err
+	}
+	assertChallenge := func(cbs []callbacks.Callback) {
+		assert.Equal(t, 1, len(cbs))
+		assert.Equal(t, callbacks.TypeHTTPStatus, cbs[0].Type)
+		assert.Equal(t, "401", cbs[0].Value)
+		assert.Equal(t, `Basic realm="scripts", charset="UTF-8"`, cbs[0].Properties["WWW-Authenticate"])
+	}
+
+	status, cbs, _, err := basic("", "")
+	assert.NoError(t, err)
+	assert.Equal(t, state.InProgress, status)
+	assertChallenge(cbs)
+
+	status, cbs, fs, err := basic("user1", "password")
+	assert.NoError(t, err)
+	assert.Equal(t, state.Pass, status)
+	assert.Empty(t, cbs)
+	assert.Equal(t, "user1", fs.UserID)
+
+	status, cbs, fs, err = basic("user1", "bad")
+	assert.NoError(t, err)
+	assert.Equal(t, state.InProgress, status)
+	assertChallenge(cbs)
+	assert.Empty(t, fs.UserID)
+
+	// the second failure locks out the username, even the valid password is rejected
+	_, _, _, err = basic("user1", "bad")
+	assert.Equal(t, autherrors.CodeLockedOut, autherrors.Code(err))
+	_, _, _, err = basic("user1", "password")
+	assert.Equal(t, autherrors.CodeLockedOut, autherrors.Code(err))
+}
@@ -0,0 +1,121 @@
+package modules
+
+import (
+	"context"
+
+	"github.com/maximthomas/gortas/pkg/auth/callbacks"
+	"github.com/maximthomas/gortas/pkg/auth/state"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+)
+
+const (
+	// ChoiceModuleType module lets the user choose one of alternative authentication modules or sub-flows
+	ChoiceModuleType = "choice"
+	// ChoiceStateOption module state key with the name of the selected option
+	ChoiceStateOption = "option"
+)
+
+const choiceCallbackName = "option"
+
+// ChoiceOption alternative of the choice module, either a module of the same flow or a sub-flow
+type ChoiceOption struct {
+	Name   string
+	Module string // id of the module, placed after the choice module in the flow
+	Flow   string // name of the flow, processed as a sub-flow
+}
+
+type Choice struct {
+	BaseAuthModule
+	Prompt  string
+	Options []ChoiceOption
+}
+
+// DecodeChoiceOptions reads the choice module options from the module properties
+func DecodeChoiceOptions(properties map[string]interface{}) ([]ChoiceOption, error) {
+	var options []ChoiceOption
+	err := mapstructure.Decode(properties["options"], &options)
+	if err != nil {
+		return nil, errors.Wrap(err, "error decoding choice options")
+	}
+	if len(options) == 0 {
+		return nil, errors.New("choice options are not set")
+	}
+	names := make(map[string]bool)
+	for _, o := range options {
+		if o.Name == "" {
+			return nil, errors.New("choice option name is not set")
+		}
+		if names[o.Name] {
+			return nil, errors.Errorf("duplicate choice option %v", o.Name)
+		}
+		names[o.Name] = true
+		if (o.Module == "") == (o.Flow == "") {
+			return nil, errors.Errorf("choice option %v should have either module or flow", o.Name)
+		}
+	}
+	return options, nil
+}
+
+func (c *Choice) Process(_ context.Context, _ *state.FlowState) (ms state.ModuleStatus, cbs []callbacks.Callback, err error) {
+	return state.InProgress, c.Callbacks, nil
+}
+
+func (c *Choice) ProcessCallbacks(_ context.Context, inCbs []callbacks.Callback, _ *state.FlowState) (ms state.ModuleStatus, cbs []callbacks.Callback, err error) {
+	selected := inCbs[0].Value
+	for _, o := range c.Options {
+		if o.Name == selected {
+			c.State[ChoiceStateOption] = selected
+			return state.Pass, nil, nil
+		}
+	}
+	cbs = make([]callbacks.Callback, len(c.Callbacks))
+	copy(cbs, c.Callbacks)
+	(&cbs[0]).Error = "Invalid option"
+	return state.InProgress, cbs, nil
+}
+
+func (c *Choice) ValidateCallbacks(cbs []callbacks.Callback) error {
+	return c.BaseAuthModule.ValidateCallbacks(cbs)
+}
+
+func (c *Choice) PostProcess(_ context.Context, _ *state.FlowState) error {
+	return nil
+}
+
+func init() {
+	RegisterModule(ChoiceModuleType, newChoice,
+		Property{Name: "prompt", Type: PropertyString, Default: "Choose authentication method"},
+		Property{Name: "options", Type: PropertyList, Required: true},
+	)
+}
+
+func newChoice(base BaseAuthModule) (AuthModule, error) {
+	c := Choice{
+		BaseAuthModule: base,
+		Prompt:         "Choose authentication method",
+	}
+	if prompt, ok := base.Properties["prompt"].(string); ok {
+		c.Prompt = prompt
+	}
+	options, err := DecodeChoiceOptions(base.Properties)
+	if err != nil {
+		return nil, err
+	}
+	c.Options = options
+
+	names := make([]string, len(options))
+	for i, o := range options {
+		names[i] = o.Name
+	}
+	(&c.BaseAuthModule).Callbacks = []callbacks.Callback{
+		{
+			Name:     choiceCallbackName,
+			Type:     callbacks.TypeOptions,
+			Prompt:   c.Prompt,
+			Options:  names,
+			Required: true,
+		},
+	}
+	return &c, nil
+}
@@ -0,0 +1,59 @@
+package modules
+
+import (
+	"context"
+	"testing"
+
+	"github.com/maximthomas/gortas/pkg/auth/callbacks"
+	"github.com/maximthomas/gortas/pkg/auth/state"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChoice(t *testing.T) {
+	b := BaseAuthModule{
+		Properties: map[string]interface{}{
+			"prompt": "Sign in with",
+			"options": []interface{}{
+				map[interface{}]interface{}{"name": "password", "module": "login"},
+				map[interface{}]interface{}{"name": "qr", "flow": "qr"},
+			},
+		},
+		State: make(map[string]interface{}),
+	}
+	m, err := newChoice(b)
+	assert.NoError(t, err)
+	c := m.(*Choice)
+
+	ms, cbs, err := c.Process(context.Background(), &state.FlowState{})
+	assert.NoError(t, err)
+	assert.Equal(t, state.InProgress, ms)
+	assert.Equal(t, callbacks.TypeOptions, cbs[0].Type)
+	assert.Equal(t, "Sign in with", cbs[0].Prompt)
+	assert.Equal(t, []string{"password", "qr"}, cbs[0].Options)
+
+	inCbs := []callbacks.Callback{{Name: "option", Value: "bad"}}
+	assert.NoError(t, c.ValidateCallbacks(inCbs))
+	ms, cbs, err = c.ProcessCallbacks(context.Background(), inCbs, &state.FlowState{})
+	assert.NoError(t, err)
+	assert.Equal(t, state.InProgress, ms)
+	assert.Equal(t, "Invalid option", cbs[0].Error)
+	assert.Empty(t, c.Callbacks[0].Error)
+
+	inCbs[0].Value = "qr"
+	ms, _, err = c.ProcessCallbacks(context.Background(), inCbs, &state.FlowState{})
+	assert.NoError(t, err)
+	assert.Equal(t, state.Pass, ms)
+	assert.Equal(t, "qr", c.State[ChoiceStateOption])
+}
+
+func TestDecodeChoiceOptions(t *testing.T) {
+	_, err := DecodeChoiceOptions(map[string]interface{}{"options": []interface{}{
+		map[string]interface{}{"name": "a", "module": "a"},
+		map[string]interface{}{"name": "a", "module": "b"},
+	}})
+	assert.Error(t, err)
+	_, err = DecodeChoiceOptions(map[string]interface{}{"options": []interface{}{
+		map[string]interface{}{"name": "a", "module": "a", "flow": "a"},
+	}})
+	assert.Error(t, err)
+}
@@ -0,0 +1,408 @@
+package modules
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/maximthomas/gortas/pkg/auth/callbacks"
+	"github.com/maximthomas/gortas/pkg/auth/state"
+	"github.com/maximthomas/gortas/pkg/user"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+)
+
+// ClientCertModuleType module authenticates the client with the X.509 certificate of the mutual TLS connection
+const ClientCertModuleType = "clientCert"
+
+// fields of the client certificate, mapped to the user id
+const (
+	certFieldCN           = "cn"
+	certFieldSubject      = "subject"
+	certFieldSerialNumber = "serialNumber"
+	certFieldEmail        = "email"
+	certFieldDNS          = "dns"
+	certFieldURI          = "uri"
+	certFieldFingerprint  = "fingerprint"
+)
+
+var certFields = map[string]bool{certFieldCN: true, certFieldSubject: true, certFieldSerialNumber: true,
+	certFieldEmail: true, certFieldDNS: true, certFieldURI: true, certFieldFingerprint: true}
+
+// ClientCertRule maps a field of the client certificate to the user id
+type ClientCertRule struct {
+	Field   string // cn, subject, serialNumber (hex), email, dns, uri (subject alternative names) or fingerprint (SHA-256 hex)
+	Pattern string // regular expression, the field should match, any value matches if not set
+	UserID  string // user id with the pattern groups like $1, the whole value if not set
+}
+
+// ClientCert reads the client certificate from the TLS connection, or from the header, set by a trusted proxy,
+// verifies it against the CA bundles and the CRLs, and identifies the user by the first matching rule
+type ClientCert struct {
+	BaseAuthModule
+	CAFiles        []string // PEM bundles of the trusted CAs
+	CRLFiles       []string // PEM or DER revocation lists of the CAs
+	Header         string   // header with the certificate, like X-Forwarded-Client-Cert, it is read only from the trusted proxies
+	TrustedProxies []string // networks of the proxies in CIDR notation
+	Rules          []ClientCertRule
+	RequireUser    bool // the user should exist in the user data store
+	roots          *x509.CertPool
+	crls           []*x509.RevocationList
+	proxies        []*net.IPNet
+	patterns       []*regexp.Regexp
+}
+
+func (c *ClientCert) Process(ctx context.Context, fs *state.FlowState) (ms state.ModuleStatus, cbs []callbacks.Callback, err error) {
+	chain, err := c.peerCertificates()
+	if err != nil {
+		c.l.Warnf("invalid client certificate: %v", err)
+		return state.Fail, nil, nil
+	}
+	if len(chain) == 0 {
+		c.l.Warn("client certificate is not presented")
+		return state.Fail, nil, nil
+	}
+	if err = c.verify(chain, time.Now()); err != nil {
+		c.l.Warnf("client certificate %v is not accepted: %v", chain[0].Subject, err)
+		return state.Fail, nil, nil
+	}
+	userID := c.userID(chain[0])
+	if userID == "" {
+		c.l.Warnf("no rule matches client certificate %v", chain[0].Subject)
+		return state.Fail, nil, nil
+	}
+	if c.RequireUser {
+		if _, ok := user.GetUserService().GetUser(ctx, userID); !ok {
+			c.l.Warnf("user %v not found", userID)
+			return state.Fail, nil, nil
+		}
+	}
+	fs.UserID = userID
+	return state.Pass, nil, nil
+}
+
+// peerCertificates returns the certificate chain of the client, leaf first.
+// Requests of the trusted proxies should have the header, the certificate of the connection belongs to the proxy
+func (c *ClientCert) peerCertificates() ([]*x509.Certificate, error) {
+	r := c.req
+	if r == nil {
+		return nil, nil
+	}
+	if c.Header != "" {
+		value := r.Header.Get(c.Header)
+		if c.trustedProxy(remoteIP(r)) {
+			if value == "" {
+				return nil, errors.Errorf("header %v is missing in the request of the trusted proxy %v", c.Header, r.RemoteAddr)
+			}
+			return headerCertificates(value)
+		}
+		if value != "" {
+			c.l.Warnf("header %v from untrusted address %v is ignored", c.Header, r.RemoteAddr)
+		}
+	}
+	if r.TLS == nil {
+		return nil, nil
+	}
+	return r.TLS.PeerCertificates, nil
+}
+
+func (c *ClientCert) trustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range c.proxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// headerCertificates parses the certificate chain of the proxy header. The value could be an Envoy
+// X-Forwarded-Client-Cert header, the element added by the nearest proxy is used, URL encoded PEM,
+// like nginx $ssl_client_escaped_cert, or base64 DER
+func headerCertificates(value string) ([]*x509.Certificate, error) {
+	if k, _, ok := strings.Cut(value, "="); ok && xfccKeys[strings.ToLower(strings.TrimSpace(k))] {
+		elements := splitQuoted(value, ',')
+		fields := make(map[string]string)
+		for _, kv := range splitQuoted(elements[len(elements)-1], ';') {
+			if k, v, ok := strings.Cut(kv, "="); ok {
+				fields[strings.ToLower(strings.TrimSpace(k))] = strings.Trim(strings.TrimSpace(v), `"`)
+			}
+		}
+		value = fields["chain"]
+		if value == "" {
+			value = fields["cert"]
+		}
+		if value == "" {
+			return nil, errors.New("no certificate in the forwarded client certificate")
+		}
+	}
+	if unescaped, err := url.PathUnescape(value); err == nil {
+		value = unescaped
+	}
+	value = strings.TrimSpace(value)
+	if !strings.HasPrefix(value, "-----BEGIN") {
+		der, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, errors.Wrap(err, "error decoding certificate")
+		}
+		return x509.ParseCertificates(der)
+	}
+	var chain []*x509.Certificate
+	rest := []byte(value)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrap(err, "error parsing certificate")
+		}
+		chain = append(chain, cert)
+	}
+	return chain, nil
+}
+
+// xfccKeys are the keys of the X-Forwarded-Client-Cert element
+var xfccKeys = map[string]bool{"by": true, "hash": true, "cert": true, "chain": true, "subject": true, "uri": true, "dns": true}
+
+// splitQuoted splits the value by the separator outside of the double quotes
+func splitQuoted(value string, sep byte) []string {
+	var parts []string
+	quoted, start := false, 0
+	for i := 0; i < len(value); i++ {
+		switch value[i] {
+		case '"':
+			quoted = !quoted
+		case sep:
+			if !quoted {
+				parts = append(parts, value[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, value[start:])
+}
+
+// verify checks the chain of the certificate up to the trusted CA and the revocation of its certificates
+func (c *ClientCert) verify(chain []*x509.Certificate, now time.Time) error {
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+	verified, err := chain[0].Verify(x509.VerifyOptions{
+		Roots:         c.roots,
+		Intermediates: intermediates,
+		CurrentTime:   now,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return err
+	}
+	for _, vc := range verified {
+		if err = c.checkRevocation(vc, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkRevocation checks the certificates of the verified chain against the revocation lists of their issuers
+func (c *ClientCert) checkRevocation(chain []*x509.Certificate, now time.Time) error {
+	for i := 0; i < len(chain)-1; i++ {
+		cert, issuer := chain[i], chain[i+1]
+		for _, crl := range c.crls {
+			if crl.CheckSignatureFrom(issuer) != nil {
+				continue
+			}
+			if !crl.NextUpdate.IsZero() && now.After(crl.NextUpdate) {
+				return errors.Errorf("revocation list of %v expired at %v", issuer.Subject, crl.NextUpdate)
+			}
+			for _, rc := range crl.RevokedCertificates {
+				if rc.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+					return errors.Errorf("certificate %v is revoked", cert.Subject)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// userID returns the user id of the first rule, that matches a field of the certificate
+func (c *ClientCert) userID(cert *x509.Certificate) string {
+	for i, rule := range c.Rules {
+		for _, v := range certFieldValues(cert, rule.Field) {
+			m := c.patterns[i].FindStringSubmatchIndex(v)
+			if m == nil {
+				continue
+			}
+			tmpl := rule.UserID
+			if tmpl == "" {
+				tmpl = "$0"
+			}
+			if userID := string(c.patterns[i].ExpandString(nil, tmpl, v, m)); userID != "" {
+				return userID
+			}
+		}
+	}
+	return ""
+}
+
+func certFieldValues(cert *x509.Certificate, field string) []string {
+	switch field {
+	case certFieldCN:
+		return []string{cert.Subject.CommonName}
+	case certFieldSubject:
+		return []string{cert.Subject.String()}
+	case certFieldSerialNumber:
+		return []string{hex.EncodeToString(cert.SerialNumber.Bytes())}
+	case certFieldEmail:
+		return cert.EmailAddresses
+	case certFieldDNS:
+		return cert.DNSNames
+	case certFieldURI:
+		uris := make([]string, len(cert.URIs))
+		for i, u := range cert.URIs {
+			uris[i] = u.String()
+		}
+		return uris
+	case certFieldFingerprint:
+		sum := sha256.Sum256(cert.Raw)
+		return []string{hex.EncodeToString(sum[:])}
+	}
+	return nil
+}
+
+func (c *ClientCert) ProcessCallbacks(ctx context.Context, _ []callbacks.Callback, fs *state.FlowState) (ms state.ModuleStatus, cbs []callbacks.Callback, err error) {
+	return c.Process(ctx, fs)
+}
+
+func (c *ClientCert) ValidateCallbacks(cbs []callbacks.Callback) error {
+	return c.BaseAuthModule.ValidateCallbacks(cbs)
+}
+
+func (c *ClientCert) PostProcess(_ context.Context, _ *state.FlowState) error {
+	return nil
+}
+
+func init() {
+	RegisterModule(ClientCertModuleType, newClientCertModule,
+		Property{Name: "caFiles", Type: PropertyList, Required: true},
+		Property{Name: "crlFiles", Type: PropertyList},
+		Property{Name: "header", Type: PropertyString},
+		Property{Name: "trustedProxies", Type: PropertyList},
+		Property{Name: "rules", Type: PropertyList, Default: []interface{}{map[string]interface{}{"field": certFieldCN}}},
+		Property{Name: "requireUser", Type: PropertyBool, Default: true},
+	)
+}
+
+func newClientCertModule(base BaseAuthModule) (AuthModule, error) {
+	var c ClientCert
+	err := mapstructure.Decode(base.Properties, &c)
+	if err != nil {
+		return nil, errors.Wrap(err, "error decoding clientCert properties")
+	}
+	if c.Header != "" && len(c.TrustedProxies) == 0 {
+		return nil, errors.New("properties.trustedProxies: required to read the certificate from the header")
+	}
+	for _, p := range c.TrustedProxies {
+		_, n, err := net.ParseCIDR(strings.TrimSpace(p))
+		if err != nil {
+			return nil, errors.Wrap(err, "properties.trustedProxies")
+		}
+		c.proxies = append(c.proxies, n)
+	}
+	if len(c.Rules) == 0 {
+		return nil, errors.New("properties.rules: at least one rule required")
+	}
+	for i, rule := range c.Rules {
+		if !certFields[rule.Field] {
+			return nil, errors.Errorf("properties.rules[%v].field: unknown field %v", i, rule.Field)
+		}
+		pattern := rule.Pattern
+		if pattern == "" {
+			pattern = "^(?s:.*)$"
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, errors.Wrapf(err, "properties.rules[%v].pattern", i)
+		}
+		c.patterns = append(c.patterns, re)
+	}
+	trust, err := readClientCertTrust(c.CAFiles, c.CRLFiles)
+	if err != nil {
+		return nil, err
+	}
+	c.roots, c.crls = trust.roots, trust.crls
+	c.BaseAuthModule = base
+	return &c, nil
+}
+
+// clientCertTrust is the parsed CA bundles and revocation lists of the module
+type clientCertTrust struct {
+	roots *x509.CertPool
+	crls  []*x509.RevocationList
+}
+
+// clientCertTrusts caches parsed CA bundles and revocation lists by the file names,
+// so they are not read on every request, the cache is cleared with ResetFileCaches
+var clientCertTrusts = &sync.Map{}
+
+// readClientCertTrust returns the cached CA bundles and revocation lists or reads them from the files
+func readClientCertTrust(caFiles, crlFiles []string) (*clientCertTrust, error) {
+	key := strings.Join(caFiles, "\n") + "\x00" + strings.Join(crlFiles, "\n")
+	if t, ok := clientCertTrusts.Load(key); ok {
+		return t.(*clientCertTrust), nil
+	}
+	t := &clientCertTrust{roots: x509.NewCertPool()}
+	for _, f := range caFiles {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return nil, errors.Wrap(err, "error reading CA file")
+		}
+		if !t.roots.AppendCertsFromPEM(b) {
+			return nil, errors.Errorf("properties.caFiles: no certificates found in %v", f)
+		}
+	}
+	for _, f := range crlFiles {
+		crl, err := readCRL(f)
+		if err != nil {
+			return nil, err
+		}
+		t.crls = append(t.crls, crl)
+	}
+	actual, _ := clientCertTrusts.LoadOrStore(key, t)
+	return actual.(*clientCertTrust), nil
+}
+
+func readCRL(file string) (*x509.RevocationList, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading CRL file")
+	}
+	if block, _ := pem.Decode(b); block != nil {
+		b = block.Bytes
+	}
+	crl, err := x509.ParseRevocationList(b)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error parsing CRL file %v", file)
+	}
+	return crl, nil
+}
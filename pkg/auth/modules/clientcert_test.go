@@ -0,0 +1,241 @@
+package modules
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/maximthomas/gortas/pkg/auth/state"
+	"github.com/maximthomas/gortas/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// testCA issues client certificates and revocation lists
+type testCA struct {
+	cert   *x509.Certificate
+	key    *rsa.PrivateKey
+	serial int64
+}
+
+func newTestCA(t *testing.T, name string, parent *testCA) *testCA {
+	ca := &testCA{}
+	ca.cert, ca.key = ca.issue(t, parent, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: name},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	})
+	return ca
+}
+
+// issue signs the certificate with the key of the parent CA, self-signed if the parent is nil
+func (ca *testCA) issue(t *testing.T, parent *testCA, tmpl *x509.Certificate) (*x509.Certificate, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	issuer, issuerKey := tmpl, key
+	if parent != nil {
+		parent.serial++
+		tmpl.SerialNumber = big.NewInt(parent.serial)
+		issuer, issuerKey = parent.cert, parent.key
+	} else {
+		tmpl.SerialNumber = big.NewInt(1)
+	}
+	if tmpl.NotBefore.IsZero() {
+		tmpl.NotBefore, tmpl.NotAfter = time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, issuer, &key.PublicKey, issuerKey)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	return cert, key
+}
+
+func (ca *testCA) client(t *testing.T, cn string, emails ...string) *x509.Certificate {
+	cert, _ := ca.issue(t, ca, &x509.Certificate{
+		Subject:        pkix.Name{CommonName: cn},
+		EmailAddresses: emails,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	return cert
+}
+
+func (ca *testCA) crl(t *testing.T, nextUpdate time.Time, revoked ...*x509.Certificate) []byte {
+	var rcs []pkix.RevokedCertificate
+	for _, c := range revoked {
+		rcs = append(rcs, pkix.RevokedCertificate{SerialNumber: c.SerialNumber, RevocationTime: time.Now()})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{Number: big.NewInt(1),
+		ThisUpdate: time.Now().Add(-time.Hour), NextUpdate: nextUpdate, RevokedCertificates: rcs}, ca.cert, ca.key)
+	assert.NoError(t, err)
+	return der
+}
+
+func writeTestFile(t *testing.T, name string, data []byte) string {
+	f := filepath.Join(t.TempDir(), name)
+	assert.NoError(t, os.WriteFile(f, data, 0600))
+	return f
+}
+
+func certPEM(certs ...*x509.Certificate) []byte {
+	var b []byte
+	for _, c := range certs {
+		b = append(b, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})...)
+	}
+	return b
+}
+
+func TestClientCert(t *testing.T) {
+	config.SetConfig(&config.Config{})
+	root := newTestCA(t, "root", nil)
+	ca := newTestCA(t, "issuing", root)
+	other := newTestCA(t, "other", nil)
+	revoked := ca.client(t, "user2")
+	server, _ := ca.issue(t, ca, &x509.Certificate{Subject: pkix.Name{CommonName: "user1"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}})
+	caFile := writeTestFile(t, "ca.pem", certPEM(root.cert))
+	crlFile := writeTestFile(t, "ca.crl", pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: ca.crl(t, time.Now().Add(time.Hour), revoked)}))
+	expiredCRLFile := writeTestFile(t, "expired.crl", ca.crl(t, time.Now().Add(-time.Minute)))
+
+	peer := func(certs ...*x509.Certificate) func(r *http.Request) {
+		return func(r *http.Request) {
+			r.TLS.PeerCertificates = certs
+		}
+	}
+	header := func(remoteAddr, value string) func(r *http.Request) {
+		return func(r *http.Request) {
+			r.RemoteAddr = remoteAddr
+			r.Header.Set("X-Forwarded-Client-Cert", value)
+		}
+	}
+	user1 := ca.client(t, "user1", "user1@example.com", "first.last@example.org")
+	xfcc := `By=spiffe://example.com/gortas;Hash=abc;Subject="CN=user1,O=Example";Cert="` +
+		url.PathEscape(string(certPEM(user1))) + `";Chain="` + url.PathEscape(string(certPEM(user1, ca.cert))) + `"`
+
+	tests := []struct {
+		name    string
+		props   map[string]interface{}
+		request func(r *http.Request)
+		userID  string
+	}{
+		{name: "peer certificate", request: peer(user1, ca.cert), userID: "user1"},
+		{name: "no certificate", request: peer()},
+		{name: "no intermediate", request: peer(user1)},
+		{name: "untrusted CA", request: peer(other.client(t, "user1"))},
+		{name: "server certificate", request: peer(server, ca.cert)},
+		{name: "revoked", request: peer(revoked, ca.cert)},
+		{name: "expired CRL", props: map[string]interface{}{"crlFiles": []interface{}{expiredCRLFile}}, request: peer(user1, ca.cert)},
+		{name: "unknown user", request: peer(ca.client(t, "kiosk-1"), ca.cert)},
+		{name: "unknown user allowed", props: map[string]interface{}{"requireUser": false},
+			request: peer(ca.client(t, "kiosk-1"), ca.cert), userID: "kiosk-1"},
+		{name: "email rule", props: map[string]interface{}{"rules": []interface{}{
+			map[string]interface{}{"field": "dns"},
+			map[string]interface{}{"field": "email", "pattern": `^(.+)\.(.+)@example\.org$`, "userid": "$1$2"},
+		}, "requireUser": false}, request: peer(user1, ca.cert), userID: "firstlast"},
+		{name: "xfcc header", request: header("10.0.0.1:5000", `By=spiffe://example.com/edge;Cert="invalid",`+xfcc), userID: "user1"},
+		{name: "xfcc header from untrusted address", request: header("192.168.0.1:5000", xfcc)},
+		{name: "no header from trusted proxy", request: func(r *http.Request) {
+			// the certificate of the connection belongs to the proxy
+			r.RemoteAddr = "10.0.0.1:5000"
+			r.TLS.PeerCertificates = []*x509.Certificate{user1, ca.cert}
+		}},
+		{name: "escaped pem header", request: header("10.0.0.1:5000", url.PathEscape(string(certPEM(user1, ca.cert)))), userID: "user1"},
+		{name: "der header", props: map[string]interface{}{"caFiles": []interface{}{writeTestFile(t, "ca.pem", certPEM(root.cert, ca.cert))}},
+			request: header("10.0.0.1:5000", base64.StdEncoding.EncodeToString(user1.Raw)), userID: "user1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mi := state.FlowStateModuleInfo{ID: "cert", Type: ClientCertModuleType,
+				Properties: map[string]interface{}{
+					"caFiles":        []interface{}{caFile},
+					"crlFiles":       []interface{}{crlFile},
+					"header":         "X-Forwarded-Client-Cert",
+					"trustedProxies": []interface{}{"10.0.0.0/8"},
+				}}
+			for k, v := range tt.props {
+				mi.Properties[k] = v
+			}
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.TLS = &tls.ConnectionState{}
+			tt.request(r)
+			m, err := GetAuthModule(mi, r, nil)
+			assert.NoError(t, err)
+			fs := &state.FlowState{}
+			status, _, err := m.Process(context.Background(), fs)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.userID, fs.UserID)
+			if tt.userID == "" {
+				assert.Equal(t, state.Fail, status)
+			} else {
+				assert.Equal(t, state.Pass, status)
+			}
+		})
+	}
+}
+
+func TestClientCert_TrustCache(t *testing.T) {
+	caFile := writeTestFile(t, "ca.pem", certPEM(newTestCA(t, "root", nil).cert))
+	mi := state.FlowStateModuleInfo{ID: "cert", Type: ClientCertModuleType,
+		Properties: map[string]interface{}{"caFiles": []interface{}{caFile}}}
+	getModule := func() *ClientCert {
+		m, err := GetAuthModule(mi, nil, nil)
+		assert.NoError(t, err)
+		return m.(*ClientCert)
+	}
+
+	// the CA file is read once for the modules with the same files
+	roots := getModule().roots
+	assert.Same(t, roots, getModule().roots)
+
+	// the changed file is read again, when the configuration is reloaded
+	assert.NoError(t, os.WriteFile(caFile, nil, 0600))
+	assert.Same(t, roots, getModule().roots)
+	ResetFileCaches()
+	_, err := GetAuthModule(mi, nil, nil)
+	assert.ErrorContains(t, err, "no certificates found")
+}
+
+func TestClientCert_Properties(t *testing.T) {
+	caFile := writeTestFile(t, "ca.pem", certPEM(newTestCA(t, "root", nil).cert))
+	tests := []struct {
+		name  string
+		props map[string]interface{}
+		err   string
+	}{
+		{name: "no CA", props: map[string]interface{}{"caFiles": nil}, err: "properties.caFiles: is required"},
+		{name: "empty CA file", props: map[string]interface{}{"caFiles": []interface{}{writeTestFile(t, "empty.pem", nil)}},
+			err: "no certificates found"},
+		{name: "header without proxies", props: map[string]interface{}{"header": "X-Forwarded-Client-Cert"},
+			err: "properties.trustedProxies: required"},
+		{name: "invalid proxy", props: map[string]interface{}{"header": "X-Client-Cert", "trustedProxies": []interface{}{"10.0.0.1"}},
+			err: "properties.trustedProxies"},
+		{name: "unknown field", props: map[string]interface{}{"rules": []interface{}{map[string]interface{}{"field": "upn"}}},
+			err: "properties.rules[0].field: unknown field upn"},
+		{name: "invalid pattern", props: map[string]interface{}{"rules": []interface{}{map[string]interface{}{"field": "cn", "pattern": "("}}},
+			err: "properties.rules[0].pattern"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mi := state.FlowStateModuleInfo{ID: "cert", Type: ClientCertModuleType,
+				Properties: map[string]interface{}{"caFiles": []interface{}{caFile}}}
+			for k, v := range tt.props {
+				mi.Properties[k] = v
+			}
+			_, err := GetAuthModule(mi, nil, nil)
+			assert.Error(t, err)
+			assert.Contains(t, err.Error(), tt.err)
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package modules
 
 import (
+	"context"
 	"regexp"
 
 	"github.com/maximthomas/gortas/pkg/auth/callbacks"
@@ -10,6 +11,9 @@ import (
 	"github.com/pkg/errors"
 )
 
+// CredentialsModuleType module collects the user id and properties, it identifies the user without checking credentials
+const CredentialsModuleType = "credentials"
+
 type Credentials struct {
 	BaseAuthModule
 	PrimaryField     Field
@@ -22,11 +26,11 @@ type credentialsState struct {
 	Properties map[string]string
 }
 
-func (cm *Credentials) Process(s *state.FlowState) (ms state.ModuleStatus, cbs []callbacks.Callback, err error) {
+func (cm *Credentials) Process(_ context.Context, s *state.FlowState) (ms state.ModuleStatus, cbs []callbacks.Callback, err error) {
 	return state.InProgress, cm.Callbacks, nil
 }
 
-func (cm *Credentials) ProcessCallbacks(inCbs []callbacks.Callback, s *state.FlowState) (ms state.ModuleStatus, cbs []callbacks.Callback, err error) {
+func (cm *Credentials) ProcessCallbacks(_ context.Context, inCbs []callbacks.Callback, s *state.FlowState) (ms state.ModuleStatus, cbs []callbacks.Callback, err error) {
 	cbs = make([]callbacks.Callback, len(cm.Callbacks))
 	copy(cbs, cm.Callbacks)
 
@@ -81,22 +85,22 @@ func (cm *Credentials) ValidateCallbacks(cbs []callbacks.Callback) error {
 	return cm.BaseAuthModule.ValidateCallbacks(cbs)
 }
 
-func (cm *Credentials) PostProcess(fs *state.FlowState) error {
+func (cm *Credentials) PostProcess(ctx context.Context, fs *state.FlowState) error {
 	moduleUser := user.User{
 		ID:         cm.credentialsState.UserID,
 		Properties: cm.credentialsState.Properties,
 	}
 	us := user.GetUserService()
-	u, ok := us.GetUser(moduleUser.ID)
+	u, ok := us.GetUser(ctx, moduleUser.ID)
 	var err error
 	if !ok {
-		u, err = us.CreateUser(moduleUser)
+		u, err = us.CreateUser(ctx, moduleUser)
 		if err != nil {
 			return errors.Wrap(err, "error creating user")
 		}
 	} else {
 		u.Properties = moduleUser.Properties
-		err = us.UpdateUser(u)
+		err = us.UpdateUser(ctx, u)
 		if err != nil {
 			return errors.Wrap(err, "error updating user")
 		}
@@ -106,14 +110,22 @@ func (cm *Credentials) PostProcess(fs *state.FlowState) error {
 }
 
 func init() {
-	RegisterModule("credentials", newCredentials)
+	RegisterModule(CredentialsModuleType, newCredentials,
+		Property{Name: "primaryField", Type: PropertyObject},
+		Property{Name: "additionalFields", Type: PropertyList},
+	)
 }
 
-func newCredentials(base BaseAuthModule) AuthModule {
+func newCredentials(base BaseAuthModule) (AuthModule, error) {
 	var cm Credentials
 	err := mapstructure.Decode(base.Properties, &cm)
 	if err != nil {
-		panic(err) // TODO add error processing
+		return nil, errors.Wrap(err, "error decoding credentials properties")
+	}
+	for _, f := range append([]Field{cm.PrimaryField}, cm.AdditionalFields...) {
+		if err = f.initField(); err != nil {
+			return nil, errors.Wrapf(err, "field %v validation", f.Name)
+		}
 	}
 
 	if cm.PrimaryField.Name == "" {
@@ -158,5 +170,5 @@ func newCredentials(base BaseAuthModule) AuthModule {
 	}
 
 	(&cm.BaseAuthModule).Callbacks = adcbs
-	return &cm
+	return &cm, nil
 }
@@ -1,6 +1,7 @@
 package modules
 
 import (
+	"context"
 	"testing"
 
 	"github.com/maximthomas/gortas/pkg/auth/callbacks"
@@ -13,7 +14,7 @@ import (
 
 func TestCredentialsProcess(t *testing.T) {
 	cm := getCredentialsModule(t)
-	ms, cbs, err := cm.Process(nil)
+	ms, cbs, err := cm.Process(context.Background(), nil)
 	assert.NoError(t, err)
 	assert.Equal(t, 2, len(cbs))
 	assert.Equal(t, state.InProgress, ms)
@@ -74,7 +75,7 @@ func TestCredentialsProcessCallbacks(t *testing.T) {
 				},
 			}
 			var fs state.FlowState
-			ms, cbs, err := cm.ProcessCallbacks(inCbs, &fs)
+			ms, cbs, err := cm.ProcessCallbacks(context.Background(), inCbs, &fs)
 			assert.NoError(t, err)
 			assert.Equal(t, tt.status, ms)
 			switch ms {
@@ -108,13 +109,13 @@ func TestCredentiaslPostProcess(t *testing.T) {
 	}
 
 	us := user.GetUserService()
-	_, ok := us.GetUser(testEmail)
+	_, ok := us.GetUser(context.Background(), testEmail)
 	assert.False(t, ok, "User does not exists")
 	fs := &state.FlowState{}
-	err := cm.PostProcess(fs)
+	err := cm.PostProcess(context.Background(), fs)
 	assert.NoError(t, err)
 
-	u, ok := us.GetUser(testEmail)
+	u, ok := us.GetUser(context.Background(), testEmail)
 	assert.True(t, ok, "user exists")
 	assert.Equal(t, testEmail, u.ID)
 	assert.Equal(t, testName, u.Properties["name"])
@@ -149,7 +150,8 @@ func getCredentialsModule(t *testing.T) *Credentials {
 		},
 		State: make(map[string]interface{}),
 	}
-	var m = newCredentials(b)
+	m, err := newCredentials(b)
+	assert.NoError(t, err)
 	cm, ok := m.(*Credentials)
 	assert.True(t, ok)
 	return cm
@@ -0,0 +1,102 @@
+package modules
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+
+	"github.com/maximthomas/gortas/pkg/session"
+	"github.com/maximthomas/gortas/pkg/user"
+	"github.com/pkg/errors"
+)
+
+var errUserNotFound = errors.New("user not found")
+
+// reservedProperties are set by gortas itself or are keys of the session subject and the authentication context,
+// so they could not be mapped from claims or attributes of external providers
+var reservedProperties = map[string]bool{
+	user.EmailVerifiedProperty:  true,
+	user.PendingUntilProperty:   true,
+	"sub":                       true,
+	"userId":                    true,
+	session.AcrProperty:         true,
+	session.AmrProperty:         true,
+	session.AuthTimeProperty:    true,
+	session.AuthModulesProperty: true,
+}
+
+// federatedUserIDPrefix returns the default prefix of user ids, authenticated by the provider, like oidc:idp.example.com:,
+// so users of the provider are never merged with local users or users of other providers with the same id
+func federatedUserIDPrefix(moduleType, provider string) string {
+	if u, err := url.Parse(provider); err == nil && u.Host != "" {
+		provider = u.Host
+	}
+	return moduleType + ":" + provider + ":"
+}
+
+// validateFederatedMapping rejects mappings to reserved and private user properties,
+// name is the name of the module property with the mapping
+func validateFederatedMapping(name string, mapping map[string]string) error {
+	us := user.GetUserService()
+	keys := make([]string, 0, len(mapping))
+	for k := range mapping {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if prop := mapping[k]; reservedProperties[prop] || us.IsPrivateProperty(prop) {
+			return errors.Errorf("properties.%v.%v: user property %v could not be mapped", name, k, prop)
+		}
+	}
+	return nil
+}
+
+// syncFederatedUser creates the user, authenticated by an external provider, if provisioning is enabled,
+// or updates the mapped properties of the existing user, mapping is the claim or attribute to the user property.
+// The user id should be prefixed with the provider prefix, reserved and private properties are never updated
+func syncFederatedUser(ctx context.Context, userID string, claims map[string]interface{}, mapping map[string]string, provision bool) error {
+	us := user.GetUserService()
+	u, exists := us.GetUser(ctx, userID)
+	if !exists && !provision {
+		return errUserNotFound
+	}
+	if !exists {
+		u = user.User{ID: userID}
+	}
+	changed := false
+	for claim, prop := range mapping {
+		v, ok := claims[claim]
+		if !ok || reservedProperties[prop] || us.IsPrivateProperty(prop) {
+			continue
+		}
+		if s := claimString(v); u.Properties[prop] != s {
+			u.SetProperty(prop, s)
+			changed = true
+		}
+	}
+	if !exists {
+		_, err := us.CreateUser(ctx, u)
+		return errors.Wrap(err, "error creating user")
+	}
+	if changed {
+		return errors.Wrap(us.UpdateUser(ctx, u), "error updating user")
+	}
+	return nil
+}
+
+// claimString converts the claim or attribute value to the user property value, lists and objects are converted to JSON
+func claimString(v interface{}) string {
+	switch c := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return c
+	case bool, float64:
+		return fmt.Sprint(c)
+	default:
+		b, _ := json.Marshal(c)
+		return string(b)
+	}
+}
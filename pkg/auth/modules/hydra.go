@@ -12,6 +12,8 @@ import (
 
 	"github.com/maximthomas/gortas/pkg/auth/callbacks"
 	"github.com/maximthomas/gortas/pkg/auth/state"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
 )
 
 // Hydra ORY Hydra authentication module
@@ -27,19 +29,19 @@ type hydraLoginData struct {
 }
 
 type hydraSubject struct {
-	Subject     string `json:"subject"`
-	Remember    bool   `json:"remember"`
-	RememberFor int32  `json:"remember_for"`
-	ACR         string `json:"acr"`
+	Subject     string   `json:"subject"`
+	Remember    bool     `json:"remember"`
+	RememberFor int32    `json:"remember_for"`
+	ACR         string   `json:"acr"`
+	AMR         []string `json:"amr,omitempty"`
 }
 
 func (h *Hydra) getLoginChallenge() string {
 	return url.PathEscape(h.req.URL.Query().Get("login_challenge"))
 }
 
-func (h *Hydra) Process(_ *state.FlowState) (ms state.ModuleStatus, cbs []callbacks.Callback, err error) {
+func (h *Hydra) Process(ctx context.Context, _ *state.FlowState) (ms state.ModuleStatus, cbs []callbacks.Callback, err error) {
 	hydraLoginURL := fmt.Sprintf("%s/oauth2/auth/requests/login?login_challenge=%s", h.URI, h.getLoginChallenge())
-	ctx := context.Background()
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, hydraLoginURL, http.NoBody)
 	if err != nil {
 		return state.Fail, h.Callbacks, fmt.Errorf("Process %v: %v", hydraLoginURL, err)
@@ -63,21 +65,22 @@ func (h *Hydra) Process(_ *state.FlowState) (ms state.ModuleStatus, cbs []callba
 	return state.Pass, h.Callbacks, err
 }
 
-func (h *Hydra) ProcessCallbacks(_ []callbacks.Callback, s *state.FlowState) (ms state.ModuleStatus, cbs []callbacks.Callback, err error) {
-	return h.Process(s)
+func (h *Hydra) ProcessCallbacks(ctx context.Context, _ []callbacks.Callback, s *state.FlowState) (ms state.ModuleStatus, cbs []callbacks.Callback, err error) {
+	return h.Process(ctx, s)
 }
 
 func (h *Hydra) ValidateCallbacks(cbs []callbacks.Callback) error {
 	return h.BaseAuthModule.ValidateCallbacks(cbs)
 }
 
-func (h *Hydra) PostProcess(fs *state.FlowState) error {
+func (h *Hydra) PostProcess(ctx context.Context, fs *state.FlowState) error {
 
 	hs := hydraSubject{
 		Subject:     fs.UserID,
 		Remember:    false,
 		RememberFor: 0,
-		ACR:         "gortas",
+		ACR:         fs.Acr(),
+		AMR:         fs.Amr,
 	}
 
 	// marshal User to json
@@ -86,7 +89,6 @@ func (h *Hydra) PostProcess(fs *state.FlowState) error {
 		return err
 	}
 	uri := fmt.Sprintf("%s/oauth2/auth/requests/login/accept?login_challenge=%s", h.URI, h.getLoginChallenge())
-	ctx := context.Background()
 	req, err := http.NewRequestWithContext(ctx, http.MethodPut, uri, bytes.NewBuffer(jsonBody))
 	if err != nil {
 		return err
@@ -95,7 +97,7 @@ func (h *Hydra) PostProcess(fs *state.FlowState) error {
 	req.Header.Set("Content-Type", "application/json; charset=utf-8")
 	resp, err := h.client.Do(req)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	defer resp.Body.Close()
@@ -116,17 +118,25 @@ func (h *Hydra) PostProcess(fs *state.FlowState) error {
 }
 
 func init() {
-	RegisterModule("hydra", newHydraModule)
+	RegisterModule("hydra", newHydraModule,
+		Property{Name: "uri", Type: PropertyString, Required: true},
+		Property{Name: "skipTLS", Type: PropertyBool},
+	)
 }
 
-func newHydraModule(base BaseAuthModule) AuthModule {
-	skipTLS, _ := base.Properties["skiptls"].(bool)
-
-	uri, ok := base.Properties["uri"].(string)
-
-	if !ok {
-		panic("hydra module missing uri property")
+func newHydraModule(base BaseAuthModule) (AuthModule, error) {
+	var props struct {
+		URI     string
+		SkipTLS bool
+	}
+	err := mapstructure.Decode(base.Properties, &props)
+	if err != nil {
+		return nil, errors.Wrap(err, "error decoding hydra properties")
+	}
+	if props.URI == "" {
+		return nil, errors.New("hydra module missing uri property")
 	}
+	skipTLS, uri := props.SkipTLS, props.URI
 	client := &http.Client{
 		Transport: &http.Transport{
 			TLSClientConfig: &tls.Config{
@@ -135,5 +145,5 @@ func newHydraModule(base BaseAuthModule) AuthModule {
 		},
 	}
 
-	return &Hydra{URI: uri, client: client}
+	return &Hydra{BaseAuthModule: base, URI: uri, client: client}, nil
 }
@@ -1,6 +1,8 @@
 package modules
 
 import (
+	"context"
+	"encoding/json"
 	"log"
 	"net/http"
 	"net/http/httptest"
@@ -29,6 +31,10 @@ func TestHydra(t *testing.T) {
 			}`))
 			return
 		} else if req.Method == http.MethodPut && req.URL.Path == "/oauth2/auth/requests/login/accept" {
+			var hs hydraSubject
+			assert.NoError(t, json.NewDecoder(req.Body).Decode(&hs))
+			assert.Equal(t, "2", hs.ACR)
+			assert.Equal(t, []string{"mfa", "otp", "pwd"}, hs.AMR)
 			_, _ = rw.Write([]byte(`{
 				"redirect_to": "https://hydra/"
 			}`))
@@ -45,7 +51,8 @@ func TestHydra(t *testing.T) {
 			"uri": server.URL,
 		},
 	}
-	am := newHydraModule(b)
+	am, err := newHydraModule(b)
+	assert.NoError(t, err)
 	h, _ := am.(*Hydra)
 
 	assert.Equal(t, server.URL, h.URI)
@@ -55,7 +62,7 @@ func TestHydra(t *testing.T) {
 		h.w = httptest.NewRecorder()
 		fs := &state.FlowState{}
 
-		status, cbs, err := h.Process(fs)
+		status, cbs, err := h.Process(context.Background(), fs)
 
 		assert.NoError(t, err)
 
@@ -66,9 +73,9 @@ func TestHydra(t *testing.T) {
 		h.req = httptest.NewRequest("GET", "/login?login_challenge="+loginChallenge, nil)
 		h.w = httptest.NewRecorder()
 
-		fs := &state.FlowState{}
+		fs := &state.FlowState{AuthLevel: 2, Amr: []string{"mfa", "otp", "pwd"}}
 
-		err := h.PostProcess(fs)
+		err := h.PostProcess(context.Background(), fs)
 
 		assert.NoError(t, err)
 		assert.Equal(t, "https://hydra/", fs.RedirectURI)
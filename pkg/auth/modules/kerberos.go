@@ -1,14 +1,13 @@
 package modules
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/hex"
 	"fmt"
 	"log"
 	"strings"
 
-	"github.com/pkg/errors"
-
 	"github.com/jcmturner/gokrb5/v8/credentials"
 	"github.com/jcmturner/gokrb5/v8/gssapi"
 	"github.com/jcmturner/gokrb5/v8/keytab"
@@ -16,7 +15,10 @@ import (
 	"github.com/jcmturner/gokrb5/v8/spnego"
 	"github.com/jcmturner/gokrb5/v8/types"
 	"github.com/maximthomas/gortas/pkg/auth/callbacks"
+	autherrors "github.com/maximthomas/gortas/pkg/auth/errors"
 	"github.com/maximthomas/gortas/pkg/auth/state"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
 )
 
 type Kerberos struct {
@@ -26,9 +28,9 @@ type Kerberos struct {
 }
 
 const (
-	keyTabFileProperty       = "keytabfile"
-	keyTabDataProperty       = "keytabdata"
-	servicePrincipalProperty = "serviceprincipal"
+	keyTabFileProperty       = "keyTabFile"
+	keyTabDataProperty       = "keyTabData"
+	servicePrincipalProperty = "servicePrincipal"
 	ctxCredentials           = "github.com/jcmturner/gokrb5/v8/ctxCredentials"
 )
 
@@ -43,39 +45,50 @@ var outCallback = []callbacks.Callback{
 }
 
 func init() {
-	RegisterModule("kerberos", newKerberosModule)
+	RegisterModule("kerberos", newKerberosModule,
+		Property{Name: keyTabFileProperty, Type: PropertyString},
+		Property{Name: keyTabDataProperty, Type: PropertyString},
+		Property{Name: servicePrincipalProperty, Type: PropertyString},
+	)
 }
 
-func newKerberosModule(base BaseAuthModule) AuthModule {
+func newKerberosModule(base BaseAuthModule) (AuthModule, error) {
 	k := &Kerberos{
 		BaseAuthModule: base,
 	}
+	var props struct {
+		KeyTabFile       string
+		KeyTabData       string
+		ServicePrincipal string
+	}
+	err := mapstructure.Decode(base.Properties, &props)
+	if err != nil {
+		return nil, errors.Wrap(err, "error decoding kerberos properties")
+	}
 	var kt *keytab.Keytab
-	var err error
-	if ktFileProp, ok := k.BaseAuthModule.Properties[keyTabFileProperty]; ok {
-		ktFile, _ := ktFileProp.(string)
-		kt, err = keytab.Load(ktFile)
+	if props.KeyTabFile != "" {
+		kt, err = keytab.Load(props.KeyTabFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error loading keytab file %v", props.KeyTabFile)
+		}
+	} else if props.KeyTabData != "" {
+		b, err := hex.DecodeString(props.KeyTabData)
 		if err != nil {
-			panic(err) // If the "krb5.keytab" file is not available the application will show an error message.
+			return nil, errors.Wrap(err, "error decoding keytab data")
 		}
-	} else if ktDataProp, ok := k.BaseAuthModule.Properties[keyTabDataProperty]; ok {
-		ktData := ktDataProp.(string)
-		b, _ := hex.DecodeString(ktData)
 		kt = keytab.New()
 		err = kt.Unmarshal(b)
 		if err != nil {
-			panic(err)
+			return nil, errors.Wrap(err, "error parsing keytab data")
 		}
 	}
 	k.kt = kt
-	if spProp, ok := k.BaseAuthModule.Properties[servicePrincipalProperty]; ok {
-		k.servicePrincipal = spProp.(string)
-	}
+	k.servicePrincipal = props.ServicePrincipal
 
-	return k
+	return k, nil
 }
 
-func (k *Kerberos) Process(fs *state.FlowState) (ms state.ModuleStatus, cbs []callbacks.Callback, err error) {
+func (k *Kerberos) Process(_ context.Context, fs *state.FlowState) (ms state.ModuleStatus, cbs []callbacks.Callback, err error) {
 
 	servicePrincipal := k.servicePrincipal
 	kt := k.kt
@@ -107,14 +120,14 @@ func (k *Kerberos) Process(fs *state.FlowState) (ms state.ModuleStatus, cbs []ca
 	if err != nil {
 		errText := fmt.Sprintf("%s - SPNEGO error in base64 decoding negotiation header: %v", r.RemoteAddr, err)
 		log.Print(errText)
-		return ms, cbs, errors.New(errText)
+		return ms, cbs, autherrors.NewAuthFailed(errText)
 	}
 	var st spnego.SPNEGOToken
 	err = st.Unmarshal(b)
 	if err != nil {
 		errText := fmt.Sprintf("%s - SPNEGO error in unmarshaling SPNEGO token: %v", r.RemoteAddr, err)
 		log.Print(errText)
-		return ms, cbs, errors.New(errText)
+		return ms, cbs, autherrors.NewAuthFailed(errText)
 	}
 
 	// Validate the context token
@@ -122,12 +135,12 @@ func (k *Kerberos) Process(fs *state.FlowState) (ms state.ModuleStatus, cbs []ca
 	if status.Code != gssapi.StatusComplete && status.Code != gssapi.StatusContinueNeeded {
 		errText := fmt.Sprintf("%s - SPNEGO validation error: %v", r.RemoteAddr, status)
 		log.Print(errText)
-		return ms, cbs, errors.New(errText)
+		return ms, cbs, autherrors.NewAuthFailed(errText)
 	}
 	if status.Code == gssapi.StatusContinueNeeded {
 		errText := fmt.Sprintf("%s - SPNEGO GSS-API continue needed", r.RemoteAddr)
 		log.Print(errText)
-		return ms, cbs, errors.New(errText)
+		return ms, cbs, autherrors.NewAuthFailed(errText)
 	}
 	if authed {
 		// Authentication successful; get user's credentials from the context
@@ -138,11 +151,11 @@ func (k *Kerberos) Process(fs *state.FlowState) (ms state.ModuleStatus, cbs []ca
 	}
 	errText := fmt.Sprintf("%s - SPNEGO Kerberos authentication failed", r.RemoteAddr)
 	log.Print(errText)
-	return ms, cbs, errors.New(errText)
+	return ms, cbs, autherrors.NewAuthFailed(errText)
 
 }
 
-func (k *Kerberos) ProcessCallbacks(_ []callbacks.Callback, _ *state.FlowState) (ms state.ModuleStatus, cbs []callbacks.Callback, err error) {
+func (k *Kerberos) ProcessCallbacks(_ context.Context, _ []callbacks.Callback, _ *state.FlowState) (ms state.ModuleStatus, cbs []callbacks.Callback, err error) {
 	return state.InProgress, outCallback, err
 }
 
@@ -150,6 +163,6 @@ func (k *Kerberos) ValidateCallbacks(cbs []callbacks.Callback) error {
 	return k.BaseAuthModule.ValidateCallbacks(cbs)
 }
 
-func (k *Kerberos) PostProcess(_ *state.FlowState) error {
+func (k *Kerberos) PostProcess(_ context.Context, _ *state.FlowState) error {
 	return nil
 }
@@ -1,6 +1,7 @@
 package modules
 
 import (
+	"context"
 	"log"
 	"net/http/httptest"
 	"testing"
@@ -20,7 +21,8 @@ func TestKerberos(t *testing.T) {
 		},
 	}
 
-	m := newKerberosModule(b)
+	m, err := newKerberosModule(b)
+	assert.NoError(t, err)
 	k, _ := m.(*Kerberos)
 
 	t.Run("Test request negotiate", func(t *testing.T) {
@@ -30,7 +32,7 @@ func TestKerberos(t *testing.T) {
 		k.w = recorder
 		fs := &state.FlowState{}
 
-		status, cbs, err := k.Process(fs)
+		status, cbs, err := k.Process(context.Background(), fs)
 
 		assert.NoError(t, err)
 		log.Print(status, cbs, err)
@@ -48,7 +50,7 @@ func TestKerberos(t *testing.T) {
 		k.w = httptest.NewRecorder()
 		fs := &state.FlowState{}
 
-		status, cbs, err := k.Process(fs)
+		status, cbs, err := k.Process(context.Background(), fs)
 
 		log.Print(status, cbs, err)
 
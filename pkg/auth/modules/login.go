@@ -1,20 +1,29 @@
 package modules
 
 import (
+	"context"
+	"net"
+	"net/http"
+
 	"github.com/maximthomas/gortas/pkg/auth/callbacks"
+	autherrors "github.com/maximthomas/gortas/pkg/auth/errors"
 	"github.com/maximthomas/gortas/pkg/auth/state"
+	"github.com/maximthomas/gortas/pkg/lockout"
 	"github.com/maximthomas/gortas/pkg/user"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
 )
 
 type LoginPassword struct {
 	BaseAuthModule
+	RequireEmailVerified bool // users, who did not confirm the email address, could not log in
 }
 
-func (lm *LoginPassword) Process(_ *state.FlowState) (ms state.ModuleStatus, cbs []callbacks.Callback, err error) {
+func (lm *LoginPassword) Process(_ context.Context, _ *state.FlowState) (ms state.ModuleStatus, cbs []callbacks.Callback, err error) {
 	return state.InProgress, lm.Callbacks, err
 }
 
-func (lm *LoginPassword) ProcessCallbacks(inCbs []callbacks.Callback, fs *state.FlowState) (ms state.ModuleStatus, cbs []callbacks.Callback, err error) {
+func (lm *LoginPassword) ProcessCallbacks(ctx context.Context, inCbs []callbacks.Callback, fs *state.FlowState) (ms state.ModuleStatus, cbs []callbacks.Callback, err error) {
 	var username string
 	var password string
 
@@ -27,11 +36,21 @@ func (lm *LoginPassword) ProcessCallbacks(inCbs []callbacks.Callback, fs *state.
 			password = cb.Value
 		}
 	}
-	us := user.GetUserService()
-	valid := us.ValidatePassword(username, password)
+	valid, err := lm.validatePassword(ctx, username, password)
+	if err != nil {
+		return state.Fail, cbs, err
+	}
+	if valid && lm.RequireEmailVerified {
+		if u, ok := user.GetUserService().GetUser(ctx, username); !ok || !u.EmailVerified() {
+			lm.l.Warnf("email of %v is not verified", username)
+			cbs = lm.Callbacks
+			(&cbs[0]).Error = "Email is not verified"
+			return state.InProgress, cbs, nil
+		}
+	}
 	if valid {
 		fs.UserID = username
-		return state.Pass, cbs, err
+		return state.Pass, cbs, nil
 	}
 	cbs = lm.Callbacks
 	(&cbs[0]).Error = "Invalid username or password"
@@ -39,19 +58,63 @@ func (lm *LoginPassword) ProcessCallbacks(inCbs []callbacks.Callback, fs *state.
 
 }
 
+// remoteIP returns the client address of the request without the port
+func remoteIP(r *http.Request) string {
+	if r == nil {
+		return ""
+	}
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// validatePassword checks the password of the user, locked out usernames and addresses are rejected
+// with the LockedOut error without checking the password, the attempt is registered in the lockout service
+func (b BaseAuthModule) validatePassword(ctx context.Context, username, password string) (bool, error) {
+	ls := lockout.GetService()
+	ip := remoteIP(b.req)
+	locked, err := ls.Check(ctx, username, ip)
+	if err != nil {
+		return false, errors.Wrap(err, "error checking lockout")
+	}
+	if locked > 0 {
+		b.l.Warnf("login of %v from %v is locked out for %v", username, ip, locked)
+		return false, autherrors.NewLockedOut("too many failed attempts, try again later")
+	}
+	if user.GetUserService().ValidatePassword(ctx, username, password) {
+		if err = ls.Succeed(ctx, username); err != nil {
+			b.l.Warnf("error resetting failed attempts of %v: %v", username, err)
+		}
+		return true, nil
+	}
+	locked, err = ls.Fail(ctx, username, ip)
+	if err != nil {
+		return false, errors.Wrap(err, "error registering failed attempt")
+	}
+	if locked > 0 {
+		b.l.Warnf("login of %v from %v is locked out for %v", username, ip, locked)
+		return false, autherrors.NewLockedOut("too many failed attempts, try again later")
+	}
+	return false, nil
+}
+
 func (lm *LoginPassword) ValidateCallbacks(cbs []callbacks.Callback) error {
 	return lm.BaseAuthModule.ValidateCallbacks(cbs)
 }
 
-func (lm *LoginPassword) PostProcess(_ *state.FlowState) error {
+func (lm *LoginPassword) PostProcess(_ context.Context, _ *state.FlowState) error {
 	return nil
 }
 
 func init() {
-	RegisterModule("login", newLoginPassword)
+	RegisterModule("login", newLoginPassword,
+		Property{Name: "requireEmailVerified", Type: PropertyBool, Default: false},
+	)
 }
 
-func newLoginPassword(base BaseAuthModule) AuthModule {
+func newLoginPassword(base BaseAuthModule) (AuthModule, error) {
 	(&base).Callbacks = []callbacks.Callback{
 		{
 			Name:     "login",
@@ -68,7 +131,10 @@ func newLoginPassword(base BaseAuthModule) AuthModule {
 			Required: true,
 		},
 	}
-	return &LoginPassword{
-		base,
+	lm := &LoginPassword{BaseAuthModule: base}
+	err := mapstructure.Decode(base.Properties, lm)
+	if err != nil {
+		return nil, errors.Wrap(err, "error decoding login properties")
 	}
+	return lm, nil
 }
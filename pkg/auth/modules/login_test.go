@@ -0,0 +1,89 @@
+package modules
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/maximthomas/gortas/pkg/auth/callbacks"
+	autherrors "github.com/maximthomas/gortas/pkg/auth/errors"
+	"github.com/maximthomas/gortas/pkg/auth/state"
+	"github.com/maximthomas/gortas/pkg/config"
+	"github.com/maximthomas/gortas/pkg/lockout"
+	"github.com/maximthomas/gortas/pkg/user"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoginPassword_Lockout(t *testing.T) {
+	config.SetConfig(&config.Config{Lockout: lockout.Config{
+		User: lockout.Policy{MaxFailures: 2},
+		IP:   lockout.Policy{MaxFailures: 5},
+	}})
+	defer config.SetConfig(&config.Config{})
+
+	login := func(username, password, remoteAddr string) (state.ModuleStatus, []callbacks.Callback, error) {
+		r := httptest.NewRequest("POST", "/gortas/v1/auth/login", nil)
+		r.RemoteAddr = remoteAddr
+		m, err := GetAuthModule(state.FlowStateModuleInfo{ID: "login", Type: "login"}, r, nil)
+		assert.NoError(t, err)
+		fs := &state.FlowState{}
+		return m.ProcessCallbacks(context.Background(),
+			[]callbacks.Callback{{Name: "login", Value: username}, {Name: "password", Value: password}}, fs)
+	}
+
+	status, cbs, err := login("user1", "bad", "10.0.0.1:1234")
+	assert.NoError(t, err)
+	assert.Equal(t, state.InProgress, status)
+	assert.Equal(t, "Invalid username or password", cbs[0].Error)
+
+	// the second failure locks out the username, even the valid password is rejected
+	_, _, err = login("user1", "bad", "10.0.0.1:1234")
+	assert.Equal(t, autherrors.CodeLockedOut, autherrors.Code(err))
+	_, _, err = login("user1", "password", "10.0.0.2:1234")
+	assert.Equal(t, autherrors.CodeLockedOut, autherrors.Code(err))
+
+	// other users could log in from the same address until the address is locked out
+	status, _, err = login("user2", "password", "10.0.0.1:1234")
+	assert.NoError(t, err)
+	assert.Equal(t, state.Pass, status)
+	for _, username := range []string{"user3", "user4"} {
+		_, _, err = login(username, "bad", "10.0.0.1:1234")
+		assert.NoError(t, err)
+	}
+	_, _, err = login("user5", "bad", "10.0.0.1:1234")
+	assert.Equal(t, autherrors.CodeLockedOut, autherrors.Code(err))
+	_, _, err = login("user2", "password", "10.0.0.1:1234")
+	assert.Equal(t, autherrors.CodeLockedOut, autherrors.Code(err))
+}
+
+func TestLoginPassword_RequireEmailVerified(t *testing.T) {
+	config.SetConfig(&config.Config{})
+	ctx := context.Background()
+	us := user.GetUserService()
+	u, _ := us.GetUser(ctx, "user2")
+	u.SetProperty(user.EmailVerifiedProperty, "true")
+	assert.NoError(t, us.UpdateUser(ctx, u))
+
+	mi := state.FlowStateModuleInfo{ID: "login", Type: "login", Properties: map[string]interface{}{"requireEmailVerified": true}}
+	tests := []struct {
+		username string
+		status   state.ModuleStatus
+		cbError  string
+	}{
+		{username: "user1", status: state.InProgress, cbError: "Email is not verified"},
+		{username: "user2", status: state.Pass},
+	}
+	for _, tt := range tests {
+		t.Run(tt.username, func(t *testing.T) {
+			m, err := GetAuthModule(mi, httptest.NewRequest("POST", "/gortas/v1/auth/login", nil), nil)
+			assert.NoError(t, err)
+			status, cbs, err := m.ProcessCallbacks(ctx,
+				[]callbacks.Callback{{Name: "login", Value: tt.username}, {Name: "password", Value: "password"}}, &state.FlowState{})
+			assert.NoError(t, err)
+			assert.Equal(t, tt.status, status)
+			if tt.cbError != "" {
+				assert.Equal(t, tt.cbError, cbs[0].Error)
+			}
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package modules
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/maximthomas/gortas/pkg/auth/constants"
+	autherrors "github.com/maximthomas/gortas/pkg/auth/errors"
+	"github.com/maximthomas/gortas/pkg/auth/state"
+	"github.com/maximthomas/gortas/pkg/crypt"
+	"github.com/maximthomas/gortas/pkg/session"
+	"github.com/pkg/errors"
+)
+
+// magicLink is the encrypted flow id, expiration time and code, sent to the user.
+// The link is opened in a new flow, which continues the flow, that sent the link
+type magicLink struct {
+	FlowID    string
+	ExpiresAt int64 // unix time in milliseconds
+	Code      string
+}
+
+func (ml magicLink) encrypt() (string, error) {
+	link, err := crypt.EncryptWithConfig(ml.FlowID + "|" + strconv.FormatInt(ml.ExpiresAt, 10) + "|" + ml.Code)
+	if err != nil {
+		return "", errors.Wrap(err, "error generating magic link")
+	}
+	return link, nil
+}
+
+// readMagicLink decrypts the link and returns the state of the flow, that sent the link
+func readMagicLink(ctx context.Context, link string) (ml magicLink, fs state.FlowState, err error) {
+	decrypted, err := crypt.DecryptWithConfig(link)
+	if err != nil {
+		return ml, fs, errors.Wrap(err, "invalid magic link")
+	}
+	parts := strings.Split(decrypted, "|")
+	if len(parts) != 3 {
+		return ml, fs, errors.New("invalid magic link")
+	}
+	ml.FlowID, ml.Code = parts[0], parts[2]
+	ml.ExpiresAt, err = strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return ml, fs, errors.Wrap(err, "invalid magic link")
+	}
+	if time.Now().UnixMilli() > ml.ExpiresAt {
+		return ml, fs, autherrors.NewFlowExpired("link expired")
+	}
+	sess, err := session.GetSessionService().GetSession(ctx, ml.FlowID)
+	if err != nil {
+		return ml, fs, autherrors.NewFlowExpired("link expired")
+	}
+	err = json.Unmarshal([]byte(sess.Properties[constants.FlowStateSessionProperty]), &fs)
+	if err != nil {
+		return ml, fs, errors.Wrap(err, "error reading flow state")
+	}
+	// the expired flow could still exist until it is cleaned up
+	if fs.Expired() || sess.Expired(time.Now()) {
+		return ml, fs, autherrors.NewFlowExpired("link expired")
+	}
+	return ml, fs, nil
+}
+
+// deleteLinkFlow deletes the flow, that sent the link, so the link could be used only once
+func deleteLinkFlow(ctx context.Context, ml magicLink) error {
+	return session.GetSessionService().DeleteSession(ctx, ml.FlowID)
+}
+
+// linkModuleState returns the state of the module of the type in the flow, that sent the link,
+// the flow should have the same name as the current flow
+func linkModuleState(linkFs, fs *state.FlowState, moduleType string) map[string]interface{} {
+	if linkFs.Name != fs.Name {
+		return nil
+	}
+	for _, m := range linkFs.Modules {
+		if m.Type == moduleType {
+			return m.State
+		}
+	}
+	return nil
+}
+
+func hashCode(code string) string {
+	h := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(h[:])
+}
+
+// codeMatches compares the code with the hash in constant time, codes never match an empty hash
+func codeMatches(hash, code string) bool {
+	return hash != "" && subtle.ConstantTimeCompare([]byte(hash), []byte(hashCode(code))) == 1
+}
+
+// codeMessage generates the message with the code, its validity period and the magic link
+func codeMessage(messageTemplate, code string, timeoutSec int, ml magicLink) (string, error) {
+	tmpl, err := template.New("message").Parse(messageTemplate)
+	if err != nil {
+		return "", errors.Wrap(err, "error parsing message template")
+	}
+	link, err := ml.encrypt()
+	if err != nil {
+		return "", err
+	}
+	data := struct {
+		OTP       string
+		ValidFor  string
+		MagicLink string
+	}{
+		OTP:       code,
+		ValidFor:  validFor(timeoutSec),
+		MagicLink: link,
+	}
+	var b bytes.Buffer
+	err = tmpl.Execute(&b, data)
+	if err != nil {
+		return "", errors.Wrap(err, "error generating message")
+	}
+	return b.String(), nil
+}
+
+// validFor formats the validity period in hours and minutes, like "1 hour 30 minutes",
+// periods shorter than a minute are formatted in seconds
+func validFor(timeoutSec int) string {
+	var parts []string
+	if h := timeoutSec / 3600; h > 0 {
+		parts = append(parts, pluralize(h, "hour"))
+	}
+	if m := timeoutSec % 3600 / 60; m > 0 {
+		parts = append(parts, pluralize(m, "minute"))
+	}
+	if len(parts) == 0 {
+		return pluralize(timeoutSec, "second")
+	}
+	return strings.Join(parts, " ")
+}
+
+func pluralize(n int, unit string) string {
+	if n == 1 {
+		return "1 " + unit
+	}
+	return fmt.Sprintf("%v %vs", n, unit)
+}
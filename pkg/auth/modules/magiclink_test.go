@@ -0,0 +1,23 @@
+package modules
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidFor(t *testing.T) {
+	tests := []struct {
+		timeoutSec int
+		want       string
+	}{
+		{timeoutSec: 30, want: "30 seconds"},
+		{timeoutSec: 60, want: "1 minute"},
+		{timeoutSec: 600, want: "10 minutes"},
+		{timeoutSec: 5400, want: "1 hour 30 minutes"},
+		{timeoutSec: 86400, want: "24 hours"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, validFor(tt.timeoutSec))
+	}
+}
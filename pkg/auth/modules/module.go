@@ -1,6 +1,7 @@
 package modules
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"sync"
@@ -11,11 +12,12 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// AuthModule authenticates the user, ctx is the request context, limited by the module deadline
 type AuthModule interface {
-	Process(s *state.FlowState) (ms state.ModuleStatus, cbs []callbacks.Callback, err error)
-	ProcessCallbacks(inCbs []callbacks.Callback, s *state.FlowState) (ms state.ModuleStatus, cbs []callbacks.Callback, err error)
+	Process(ctx context.Context, s *state.FlowState) (ms state.ModuleStatus, cbs []callbacks.Callback, err error)
+	ProcessCallbacks(ctx context.Context, inCbs []callbacks.Callback, s *state.FlowState) (ms state.ModuleStatus, cbs []callbacks.Callback, err error)
 	ValidateCallbacks(cbs []callbacks.Callback) error
-	PostProcess(fs *state.FlowState) error
+	PostProcess(ctx context.Context, fs *state.FlowState) error
 }
 
 type Field struct {
@@ -27,29 +29,97 @@ type Field struct {
 
 var modulesRegistry = &sync.Map{}
 
-func RegisterModule(mt string, constructor func(BaseAuthModule) AuthModule) {
+// ModuleConstructor creates the module from the module properties and state,
+// returns an error if the properties are invalid
+type ModuleConstructor func(base BaseAuthModule) (AuthModule, error)
+
+type moduleRegistration struct {
+	constructor ModuleConstructor
+	schema      Schema
+}
+
+// RegisterModule registers the module type with the constructor and the schema of the module properties
+func RegisterModule(mt string, constructor ModuleConstructor, schema ...Property) {
 	logrus.Infof("registered %v module", mt)
-	modulesRegistry.Store(mt, constructor)
+	modulesRegistry.Store(mt, moduleRegistration{constructor: constructor, schema: schema})
 }
 
-type moduleConstructor = func(base BaseAuthModule) AuthModule
+// fileCaches keep files of the modules, like identity provider metadata or keys, parsed by the module settings
+var fileCaches = []*sync.Map{samlProviders, clientCertTrusts}
+
+// ResetFileCaches clears parsed files of the modules, so they are read again, when the modules are created next time,
+// it is called, when a new configuration is applied
+func ResetFileCaches() {
+	for _, c := range fileCaches {
+		c.Range(func(k, _ interface{}) bool {
+			c.Delete(k)
+			return true
+		})
+	}
+}
+
+// IsRegistered returns true if the module type is registered
+func IsRegistered(mt string) bool {
+	_, ok := modulesRegistry.Load(mt)
+	return ok
+}
+
+// GetSchema returns the schema of the module type properties
+func GetSchema(mt string) (Schema, bool) {
+	r, ok := modulesRegistry.Load(mt)
+	if !ok {
+		return nil, false
+	}
+	return r.(moduleRegistration).schema, true
+}
 
 func GetAuthModule(mi state.FlowStateModuleInfo, req *http.Request, w http.ResponseWriter) (AuthModule, error) {
+	r, ok := modulesRegistry.Load(mi.Type)
+	if !ok {
+		return nil, fmt.Errorf("module %v does not exists", mi.Type)
+	}
+	mr := r.(moduleRegistration)
+	props, err := mr.schema.Apply(mi.Properties)
+	if err != nil {
+		return nil, fmt.Errorf("module %v: %w", mi.Type, err)
+	}
 	base := BaseAuthModule{
-		Properties: mi.Properties,
+		Properties: props,
 		State:      mi.State,
 		req:        req,
 		w:          w,
 		l:          log.WithField("module", mi.Type),
 	}
-	constructor, ok := modulesRegistry.Load(mi.Type)
-	if !ok {
-		return nil, fmt.Errorf("module %v does not exists", mi.Type)
+	m, err := mr.constructor(base)
+	if err != nil {
+		return nil, fmt.Errorf("module %v: %w", mi.Type, err)
+	}
+	return m, nil
+}
+
+// identifyingModuleTypes set the flow user without checking the user credentials
+var identifyingModuleTypes = map[string]bool{CredentialsModuleType: true, ChoiceModuleType: true}
+
+// UserAuthenticated returns true if the flow user was authenticated before the current module:
+// by a passed module, that checks the user credentials, by the parent flow of the sub-flow
+// or by the session upgraded by the step-up flow
+func UserAuthenticated(fs *state.FlowState) bool {
+	if fs.UserID == "" {
+		return false
 	}
-	if c, ok := constructor.(moduleConstructor); ok {
-		return moduleConstructor(c)(base), nil
+	if fs.SessionID != "" || fs.UserAuthenticated {
+		return true
+	}
+	for i := range fs.Modules {
+		mi := &fs.Modules[i]
+		if mi.Status != state.Pass || identifyingModuleTypes[mi.Type] {
+			continue
+		}
+		if mi.SubFlow == nil || UserAuthenticated(mi.SubFlow) {
+			return true
+		}
 	}
-	return nil, fmt.Errorf("error converting %v to module constructor", constructor)
+	return false
 }
 
 type BaseAuthModule struct {
@@ -1,6 +1,7 @@
 package modules
 
 import (
+	"context"
 	"testing"
 
 	"github.com/maximthomas/gortas/pkg/auth/callbacks"
@@ -13,11 +14,11 @@ type SimpleModule struct {
 	BaseAuthModule
 }
 
-func (sm *SimpleModule) Process(_ *state.FlowState) (ms state.ModuleStatus, cbs []callbacks.Callback, err error) {
+func (sm *SimpleModule) Process(_ context.Context, _ *state.FlowState) (ms state.ModuleStatus, cbs []callbacks.Callback, err error) {
 	return state.InProgress, sm.Callbacks, err
 }
 
-func (sm *SimpleModule) ProcessCallbacks(inCbs []callbacks.Callback, fs *state.FlowState) (ms state.ModuleStatus, cbs []callbacks.Callback, err error) {
+func (sm *SimpleModule) ProcessCallbacks(_ context.Context, inCbs []callbacks.Callback, fs *state.FlowState) (ms state.ModuleStatus, cbs []callbacks.Callback, err error) {
 	return state.InProgress, sm.Callbacks, err
 }
 
@@ -25,7 +26,7 @@ func (sm *SimpleModule) ValidateCallbacks(cbs []callbacks.Callback) error {
 	return sm.BaseAuthModule.ValidateCallbacks(cbs)
 }
 
-func (sm *SimpleModule) PostProcess(_ *state.FlowState) error {
+func (sm *SimpleModule) PostProcess(_ context.Context, _ *state.FlowState) error {
 	return nil
 }
 
@@ -33,17 +34,17 @@ func init() {
 	RegisterModule("simple", newSimpleModule)
 }
 
-func newSimpleModule(base BaseAuthModule) AuthModule {
+func newSimpleModule(base BaseAuthModule) (AuthModule, error) {
 	return &SimpleModule{
 		base,
-	}
+	}, nil
 }
 
 func TestModuleRegistered(t *testing.T) {
-	constructor, ok := modulesRegistry.Load("simple")
+	r, ok := modulesRegistry.Load("simple")
 	assert.True(t, ok)
 
-	_, ok = constructor.(moduleConstructor)
+	_, ok = r.(moduleRegistration)
 	assert.True(t, ok)
 }
 
@@ -59,3 +60,28 @@ func TestGetModuleFromRegistry(t *testing.T) {
 	_, ok := m.(*SimpleModule)
 	assert.True(t, ok)
 }
+
+func TestUserAuthenticated(t *testing.T) {
+	login := state.FlowStateModuleInfo{ID: "login", Type: "login", Status: state.Pass}
+	username := state.FlowStateModuleInfo{ID: "username", Type: CredentialsModuleType, Status: state.Pass}
+	tests := []struct {
+		name string
+		fs   state.FlowState
+		want bool
+	}{
+		{name: "no user", fs: state.FlowState{Modules: []state.FlowStateModuleInfo{login}}},
+		{name: "passed module", fs: state.FlowState{UserID: "user1", Modules: []state.FlowStateModuleInfo{login}}, want: true},
+		{name: "identified only", fs: state.FlowState{UserID: "user1", Modules: []state.FlowStateModuleInfo{username}}},
+		{name: "failed module", fs: state.FlowState{UserID: "user1",
+			Modules: []state.FlowStateModuleInfo{{ID: "login", Type: "login", Status: state.Fail}}}},
+		{name: "passed sub-flow", fs: state.FlowState{UserID: "user1", Modules: []state.FlowStateModuleInfo{
+			{ID: "sub", Type: "flow", Status: state.Pass, SubFlow: &state.FlowState{UserID: "user1", Modules: []state.FlowStateModuleInfo{login}}}}}, want: true},
+		{name: "identified in sub-flow", fs: state.FlowState{UserID: "user1", Modules: []state.FlowStateModuleInfo{
+			{ID: "sub", Type: "flow", Status: state.Pass, SubFlow: &state.FlowState{UserID: "user1", Modules: []state.FlowStateModuleInfo{username}}}}}},
+		{name: "authenticated by parent flow", fs: state.FlowState{UserID: "user1", UserAuthenticated: true}, want: true},
+		{name: "step-up session", fs: state.FlowState{UserID: "user1", SessionID: "session1"}, want: true},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, UserAuthenticated(&tt.fs), tt.name)
+	}
+}
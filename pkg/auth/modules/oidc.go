@@ -0,0 +1,187 @@
+package modules
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/maximthomas/gortas/pkg/auth/callbacks"
+	"github.com/maximthomas/gortas/pkg/auth/modules/oidc"
+	"github.com/maximthomas/gortas/pkg/auth/state"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+)
+
+// OIDCModuleType module authenticates the user with an external OpenID Connect provider
+const OIDCModuleType = "oidc"
+
+const (
+	oidcCallbackName   = "oidc"
+	oidcRequestTimeout = 10 * time.Second
+)
+
+type oidcState struct {
+	State        string
+	Nonce        string
+	CodeVerifier string
+	IssuedAt     int64
+}
+
+// OIDC redirects the user to the authorization endpoint of the provider with the state, the nonce and the PKCE challenge.
+// The client sends the URL of the redirect back as the callback value,
+// the module exchanges the code for the ID token, verifies it with the provider keys and maps the claims to the user properties
+type OIDC struct {
+	BaseAuthModule
+	Issuer                string
+	ClientID              string
+	ClientSecret          string
+	RedirectURI           string
+	Scopes                []string
+	AuthorizationEndpoint string // the endpoints are discovered from the issuer, if not set
+	TokenEndpoint         string
+	JwksURI               string
+	UserIDClaim           string            // claim with the user id
+	UserIDPrefix          string            // prefix of the user ids, oidc:<issuer host>: if not set
+	Claims                map[string]string // claims mapped to the user properties
+	Provision             bool              // create users, that do not exist, otherwise such users fail
+	LoginTimeoutSec       int               // time to authenticate with the provider
+	provider              *oidc.Provider
+}
+
+func (o *OIDC) Process(ctx context.Context, _ *state.FlowState) (ms state.ModuleStatus, cbs []callbacks.Callback, err error) {
+	ar, err := oidc.NewAuthRequest()
+	if err != nil {
+		return state.Fail, nil, err
+	}
+	authURL, err := o.provider.AuthURL(ctx, ar)
+	if err != nil {
+		return state.Fail, nil, err
+	}
+	o.State["state"] = ar.State
+	o.State["nonce"] = ar.Nonce
+	o.State["codeVerifier"] = ar.CodeVerifier
+	o.State["issuedAt"] = time.Now().UnixMilli()
+	return state.InProgress, []callbacks.Callback{{
+		Name:  oidcCallbackName,
+		Type:  callbacks.TypeRedirect,
+		Value: authURL,
+	}}, nil
+}
+
+func (o *OIDC) ProcessCallbacks(ctx context.Context, inCbs []callbacks.Callback, fs *state.FlowState) (ms state.ModuleStatus, cbs []callbacks.Callback, err error) {
+	var st oidcState
+	_ = mapstructure.Decode(o.State, &st)
+	if st.State == "" || len(inCbs) == 0 || inCbs[0].Value == "" {
+		return o.Process(ctx, fs)
+	}
+	if time.Since(time.UnixMilli(st.IssuedAt)) > time.Duration(o.LoginTimeoutSec)*time.Second {
+		o.l.Warn("authentication with the provider expired")
+		return state.Fail, nil, nil
+	}
+	// the authorization request could be used only once
+	for k := range o.State {
+		delete(o.State, k)
+	}
+	claims, err := o.provider.Exchange(ctx, oidc.AuthRequest{State: st.State, Nonce: st.Nonce, CodeVerifier: st.CodeVerifier},
+		callbackQuery(inCbs[0].Value))
+	var ce *oidc.CallbackError
+	if errors.As(err, &ce) {
+		o.l.Warnf("authentication with the provider failed: %v", err)
+		return state.Fail, nil, nil
+	} else if err != nil {
+		return state.Fail, nil, err
+	}
+	subject := claimString(claims[o.UserIDClaim])
+	if subject == "" {
+		o.l.Warnf("id_token has no %v claim", o.UserIDClaim)
+		return state.Fail, nil, nil
+	}
+	userID := o.UserIDPrefix + subject
+	err = syncFederatedUser(ctx, userID, claims, o.Claims, o.Provision)
+	if errors.Is(err, errUserNotFound) {
+		o.l.Warnf("user %v not found", userID)
+		return state.Fail, nil, nil
+	} else if err != nil {
+		return state.Fail, nil, err
+	}
+	fs.UserID = userID
+	return state.Pass, nil, nil
+}
+
+// callbackQuery returns the query of the redirect back URL, the value could be the whole URL or only its query
+func callbackQuery(value string) url.Values {
+	if i := strings.IndexByte(value, '?'); i >= 0 {
+		value = value[i+1:]
+	}
+	if i := strings.IndexByte(value, '#'); i >= 0 {
+		value = value[:i]
+	}
+	q, _ := url.ParseQuery(value)
+	return q
+}
+
+func (o *OIDC) ValidateCallbacks(cbs []callbacks.Callback) error {
+	return o.BaseAuthModule.ValidateCallbacks(cbs)
+}
+
+func (o *OIDC) PostProcess(_ context.Context, _ *state.FlowState) error {
+	return nil
+}
+
+func init() {
+	RegisterModule(OIDCModuleType, newOIDCModule,
+		Property{Name: "issuer", Type: PropertyString, Required: true},
+		Property{Name: "clientId", Type: PropertyString, Required: true},
+		Property{Name: "clientSecret", Type: PropertyString},
+		Property{Name: "redirectUri", Type: PropertyString, Required: true},
+		Property{Name: "scopes", Type: PropertyList, Default: []interface{}{"openid", "profile", "email"}},
+		Property{Name: "authorizationEndpoint", Type: PropertyString},
+		Property{Name: "tokenEndpoint", Type: PropertyString},
+		Property{Name: "jwksUri", Type: PropertyString},
+		Property{Name: "userIdClaim", Type: PropertyString, Default: "sub"},
+		Property{Name: "userIdPrefix", Type: PropertyString},
+		Property{Name: "claims", Type: PropertyObject},
+		Property{Name: "provision", Type: PropertyBool, Default: false},
+		Property{Name: "loginTimeoutSec", Type: PropertyInt, Default: 600},
+	)
+}
+
+func newOIDCModule(base BaseAuthModule) (AuthModule, error) {
+	var o OIDC
+	err := mapstructure.Decode(base.Properties, &o)
+	if err != nil {
+		return nil, errors.Wrap(err, "error decoding oidc properties")
+	}
+	switch {
+	case !strings.HasPrefix(o.Issuer, "https://") && !strings.HasPrefix(o.Issuer, "http://"):
+		return nil, errors.New("properties.issuer: should be a URL")
+	case o.UserIDClaim == "":
+		return nil, errors.New("properties.userIdClaim: required")
+	case o.LoginTimeoutSec <= 0:
+		return nil, errors.New("properties.loginTimeoutSec: should be positive")
+	}
+	if err = validateFederatedMapping("claims", o.Claims); err != nil {
+		return nil, err
+	}
+	if o.UserIDPrefix == "" {
+		o.UserIDPrefix = federatedUserIDPrefix(OIDCModuleType, o.Issuer)
+	}
+	o.provider = &oidc.Provider{
+		Metadata: oidc.Metadata{
+			Issuer:                o.Issuer,
+			AuthorizationEndpoint: o.AuthorizationEndpoint,
+			TokenEndpoint:         o.TokenEndpoint,
+			JwksURI:               o.JwksURI,
+		},
+		ClientID:     o.ClientID,
+		ClientSecret: o.ClientSecret,
+		RedirectURI:  o.RedirectURI,
+		Scopes:       o.Scopes,
+		Client:       &http.Client{Timeout: oidcRequestTimeout},
+	}
+	(&base).Callbacks = []callbacks.Callback{{Name: oidcCallbackName, Type: callbacks.TypeRedirect}}
+	o.BaseAuthModule = base
+	return &o, nil
+}
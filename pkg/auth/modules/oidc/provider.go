@@ -0,0 +1,426 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/pkg/errors"
+)
+
+const (
+	discoveryPath = "/.well-known/openid-configuration"
+	// metadata and keys are fetched again after cacheTTL
+	cacheTTL = time.Hour
+	// keys are fetched again for an unknown key id, but not more often than keysMinRefresh
+	keysMinRefresh  = time.Minute
+	maxResponseSize = 1 << 20
+)
+
+var signingMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+
+// Metadata are the provider endpoints, discovered from the issuer, if not set
+type Metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksURI               string `json:"jwks_uri"`
+}
+
+// Provider is the OpenID Connect provider, the relying party is registered with
+type Provider struct {
+	Metadata
+	ClientID     string
+	ClientSecret string
+	RedirectURI  string
+	Scopes       []string
+	Client       *http.Client
+}
+
+// AuthRequest are the random values, the authorization request is bound to, they should be kept until the callback
+type AuthRequest struct {
+	State        string
+	Nonce        string
+	CodeVerifier string
+}
+
+// NewAuthRequest generates the state, the nonce and the PKCE code verifier
+func NewAuthRequest() (ar AuthRequest, err error) {
+	for _, v := range []*string{&ar.State, &ar.Nonce, &ar.CodeVerifier} {
+		*v, err = randomString()
+		if err != nil {
+			return ar, err
+		}
+	}
+	return ar, nil
+}
+
+// AuthURL returns the authorization endpoint URL, the user is redirected to
+func (p *Provider) AuthURL(ctx context.Context, ar AuthRequest) (string, error) {
+	md, err := p.metadata(ctx)
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(md.AuthorizationEndpoint)
+	if err != nil {
+		return "", errors.Wrap(err, "invalid authorization endpoint")
+	}
+	challenge := sha256.Sum256([]byte(ar.CodeVerifier))
+	q := u.Query()
+	q.Set("response_type", "code")
+	q.Set("client_id", p.ClientID)
+	q.Set("redirect_uri", p.RedirectURI)
+	q.Set("scope", strings.Join(p.Scopes, " "))
+	q.Set("state", ar.State)
+	q.Set("nonce", ar.Nonce)
+	q.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	q.Set("code_challenge_method", "S256")
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// CallbackError is returned if the callback is invalid or the provider rejected the authentication
+type CallbackError struct {
+	Message string
+}
+
+func (e *CallbackError) Error() string {
+	return e.Message
+}
+
+func callbackErrorf(format string, args ...interface{}) error {
+	return &CallbackError{Message: fmt.Sprintf(format, args...)}
+}
+
+// Exchange checks the callback query of the authorization request, exchanges the code for tokens
+// and returns the claims of the verified ID token
+func (p *Provider) Exchange(ctx context.Context, ar AuthRequest, query url.Values) (jwt.MapClaims, error) {
+	if e := query.Get("error"); e != "" {
+		return nil, callbackErrorf("provider error %v: %v", e, query.Get("error_description"))
+	}
+	if ar.State == "" || subtle.ConstantTimeCompare([]byte(ar.State), []byte(query.Get("state"))) != 1 {
+		return nil, callbackErrorf("state does not match")
+	}
+	code := query.Get("code")
+	if code == "" {
+		return nil, callbackErrorf("code is missing")
+	}
+	md, err := p.metadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.RedirectURI},
+		"code_verifier": {ar.CodeVerifier},
+	}
+	if p.ClientSecret == "" {
+		form.Set("client_id", p.ClientID)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, md.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating token request")
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+	var tokens struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	status, err := p.doJSON(req, &tokens)
+	if err != nil {
+		return nil, errors.Wrap(err, "error requesting tokens")
+	}
+	if tokens.Error != "" || status != http.StatusOK {
+		return nil, callbackErrorf("token request failed %v: %v %v", status, tokens.Error, tokens.ErrorDescription)
+	}
+	if tokens.IDToken == "" {
+		return nil, callbackErrorf("id_token is missing")
+	}
+	return p.VerifyIDToken(ctx, tokens.IDToken, ar.Nonce)
+}
+
+// VerifyIDToken verifies the signature of the ID token with the provider keys, the issuer, the audience,
+// the expiration and the nonce
+func (p *Provider) VerifyIDToken(ctx context.Context, idToken, nonce string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	_, err := (&jwt.Parser{ValidMethods: signingMethods}).ParseWithClaims(idToken, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		return p.key(ctx, kid)
+	})
+	if err != nil {
+		return nil, callbackErrorf("invalid id_token: %v", err)
+	}
+	md, err := p.metadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if iss, _ := claims["iss"].(string); iss != md.Issuer {
+		return nil, callbackErrorf("invalid id_token issuer %v", claims["iss"])
+	}
+	if _, ok := claims["exp"]; !ok {
+		return nil, callbackErrorf("id_token expiration is missing")
+	}
+	if !hasAudience(claims, p.ClientID) {
+		return nil, callbackErrorf("invalid id_token audience %v", claims["aud"])
+	}
+	if azp, ok := claims["azp"].(string); ok && azp != p.ClientID {
+		return nil, callbackErrorf("invalid id_token authorized party %v", azp)
+	}
+	if n, _ := claims["nonce"].(string); nonce == "" || subtle.ConstantTimeCompare([]byte(n), []byte(nonce)) != 1 {
+		return nil, callbackErrorf("id_token nonce does not match")
+	}
+	return claims, nil
+}
+
+func hasAudience(claims jwt.MapClaims, clientID string) bool {
+	switch aud := claims["aud"].(type) {
+	case string:
+		return aud == clientID
+	case []interface{}:
+		for _, a := range aud {
+			if a == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// provider metadata and keys are cached by the configured metadata, as modules are created for each request
+type cacheEntry struct {
+	metadata      Metadata
+	keys          map[string]crypto.PublicKey
+	fetchedAt     time.Time
+	keysFetchedAt time.Time
+}
+
+var cache = struct {
+	sync.Mutex
+	entries map[Metadata]*cacheEntry
+}{entries: make(map[Metadata]*cacheEntry)}
+
+func (p *Provider) metadata(ctx context.Context) (Metadata, error) {
+	e, err := p.cached(ctx)
+	if err != nil {
+		return Metadata{}, err
+	}
+	return e.metadata, nil
+}
+
+func (p *Provider) cached(ctx context.Context) (*cacheEntry, error) {
+	cache.Lock()
+	e, ok := cache.entries[p.Metadata]
+	cache.Unlock()
+	if ok && time.Since(e.fetchedAt) < cacheTTL {
+		return e, nil
+	}
+	md := p.Metadata
+	if md.AuthorizationEndpoint == "" || md.TokenEndpoint == "" || md.JwksURI == "" {
+		var discovered Metadata
+		err := p.get(ctx, strings.TrimSuffix(p.Issuer, "/")+discoveryPath, &discovered)
+		if err != nil {
+			return nil, errors.Wrap(err, "error discovering provider metadata")
+		}
+		if discovered.Issuer != p.Issuer {
+			return nil, fmt.Errorf("discovered issuer %v does not match %v", discovered.Issuer, p.Issuer)
+		}
+		if md.AuthorizationEndpoint == "" {
+			md.AuthorizationEndpoint = discovered.AuthorizationEndpoint
+		}
+		if md.TokenEndpoint == "" {
+			md.TokenEndpoint = discovered.TokenEndpoint
+		}
+		if md.JwksURI == "" {
+			md.JwksURI = discovered.JwksURI
+		}
+	}
+	e = &cacheEntry{metadata: md, fetchedAt: time.Now()}
+	cache.Lock()
+	cache.entries[p.Metadata] = e
+	cache.Unlock()
+	return e, nil
+}
+
+// key returns the provider key by the key id, the keys are fetched again, if the key is not found
+func (p *Provider) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	e, err := p.cached(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cache.Lock()
+	keys, fetchedAt := e.keys, e.keysFetchedAt
+	cache.Unlock()
+	k, ok := findKey(keys, kid)
+	if ok || time.Since(fetchedAt) < keysMinRefresh {
+		if !ok {
+			return nil, fmt.Errorf("unknown key %v", kid)
+		}
+		return k, nil
+	}
+	keys, err = p.fetchKeys(ctx, e.metadata.JwksURI)
+	if err != nil {
+		return nil, err
+	}
+	cache.Lock()
+	e.keys, e.keysFetchedAt = keys, time.Now()
+	cache.Unlock()
+	if k, ok = findKey(keys, kid); !ok {
+		return nil, fmt.Errorf("unknown key %v", kid)
+	}
+	return k, nil
+}
+
+// findKey finds the key by the id, the only key is used, if the token has no key id
+func findKey(keys map[string]crypto.PublicKey, kid string) (crypto.PublicKey, bool) {
+	if k, ok := keys[kid]; ok {
+		return k, true
+	}
+	if kid == "" && len(keys) == 1 {
+		for _, k := range keys {
+			return k, true
+		}
+	}
+	return nil, false
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (p *Provider) fetchKeys(ctx context.Context, jwksURI string) (map[string]crypto.PublicKey, error) {
+	var jwks struct {
+		Keys []jwk `json:"keys"`
+	}
+	err := p.get(ctx, jwksURI, &jwks)
+	if err != nil {
+		return nil, errors.Wrap(err, "error fetching provider keys")
+	}
+	keys := make(map[string]crypto.PublicKey, len(jwks.Keys))
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pk, err := k.publicKey()
+		if err != nil {
+			// keys of unsupported types are skipped
+			continue
+		}
+		keys[k.Kid] = pk
+	}
+	return keys, nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid modulus")
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("invalid exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %v", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid x coordinate")
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid y coordinate")
+		}
+		pk := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(pk.X, pk.Y) {
+			return nil, errors.New("point is not on the curve")
+		}
+		return pk, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %v", k.Kty)
+	}
+}
+
+func (p *Provider) get(ctx context.Context, uri string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, http.NoBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	status, err := p.doJSON(req, v)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("unexpected status %v of %v", status, uri)
+	}
+	return nil
+}
+
+func (p *Provider) doJSON(req *http.Request, v interface{}) (int, error) {
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return resp.StatusCode, err
+	}
+	if err = json.Unmarshal(body, v); err != nil && resp.StatusCode == http.StatusOK {
+		return resp.StatusCode, errors.Wrap(err, "invalid response")
+	}
+	return resp.StatusCode, nil
+}
+
+func randomString() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "error generating random value")
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
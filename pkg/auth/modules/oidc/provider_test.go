@@ -0,0 +1,187 @@
+package oidc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+)
+
+const testClientID = "gortas"
+
+type testProvider struct {
+	*httptest.Server
+	rsaKey    *rsa.PrivateKey
+	ecKey     *ecdsa.PrivateKey
+	code      string
+	challenge string
+	claims    jwt.MapClaims
+}
+
+func newTestProvider(t *testing.T) *testProvider {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	tp := &testProvider{rsaKey: rsaKey, ecKey: ecKey, code: "test-code"}
+	mux := http.NewServeMux()
+	mux.HandleFunc(discoveryPath, func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(Metadata{Issuer: tp.URL, AuthorizationEndpoint: tp.URL + "/authorize",
+			TokenEndpoint: tp.URL + "/token", JwksURI: tp.URL + "/jwks"})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		enc := base64.RawURLEncoding.EncodeToString
+		_ = json.NewEncoder(w).Encode(map[string][]jwk{"keys": {
+			{Kty: "RSA", Kid: "rsa", Use: "sig", N: enc(rsaKey.N.Bytes()), E: enc(big.NewInt(int64(rsaKey.E)).Bytes())},
+			{Kty: "EC", Kid: "ec", Crv: "P-256", X: enc(ecKey.X.Bytes()), Y: enc(ecKey.Y.Bytes())},
+			{Kty: "oct", Kid: "hmac"},
+		}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		verifier := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		if id != testClientID || secret != "secret" || r.PostFormValue("code") != tp.code ||
+			base64.RawURLEncoding.EncodeToString(verifier[:]) != tp.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"id_token": tp.idToken(t, jwt.SigningMethodRS256, "rsa", tp.claims)})
+	})
+	tp.Server = httptest.NewServer(mux)
+	t.Cleanup(tp.Close)
+	return tp
+}
+
+func (tp *testProvider) provider() *Provider {
+	return &Provider{Metadata: Metadata{Issuer: tp.URL}, ClientID: testClientID, ClientSecret: "secret",
+		RedirectURI: "https://app.example.com/callback", Scopes: []string{"openid", "email"}}
+}
+
+func (tp *testProvider) validClaims(nonce string) jwt.MapClaims {
+	return jwt.MapClaims{"iss": tp.URL, "sub": "alice", "aud": testClientID, "nonce": nonce,
+		"iat": time.Now().Unix(), "exp": time.Now().Add(time.Minute).Unix()}
+}
+
+func (tp *testProvider) idToken(t *testing.T, m jwt.SigningMethod, kid string, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(m, claims)
+	token.Header["kid"] = kid
+	var key interface{} = tp.rsaKey
+	switch m {
+	case jwt.SigningMethodES256:
+		key = tp.ecKey
+	case jwt.SigningMethodHS256:
+		key = []byte("secret")
+	}
+	s, err := token.SignedString(key)
+	assert.NoError(t, err)
+	return s
+}
+
+func TestProvider_AuthURL(t *testing.T) {
+	tp := newTestProvider(t)
+	ar, err := NewAuthRequest()
+	assert.NoError(t, err)
+	authURL, err := tp.provider().AuthURL(context.Background(), ar)
+	assert.NoError(t, err)
+	u, err := url.Parse(authURL)
+	assert.NoError(t, err)
+	assert.Equal(t, tp.URL+"/authorize", u.Scheme+"://"+u.Host+u.Path)
+	q := u.Query()
+	challenge := sha256.Sum256([]byte(ar.CodeVerifier))
+	assert.Equal(t, "code", q.Get("response_type"))
+	assert.Equal(t, testClientID, q.Get("client_id"))
+	assert.Equal(t, "openid email", q.Get("scope"))
+	assert.Equal(t, ar.State, q.Get("state"))
+	assert.Equal(t, ar.Nonce, q.Get("nonce"))
+	assert.Equal(t, base64.RawURLEncoding.EncodeToString(challenge[:]), q.Get("code_challenge"))
+	assert.Equal(t, "S256", q.Get("code_challenge_method"))
+}
+
+func TestProvider_VerifyIDToken(t *testing.T) {
+	tp := newTestProvider(t)
+	p := tp.provider()
+	with := func(k string, v interface{}) jwt.MapClaims {
+		c := tp.validClaims("nonce")
+		if v == nil {
+			delete(c, k)
+		} else {
+			c[k] = v
+		}
+		return c
+	}
+	tests := []struct {
+		name   string
+		method jwt.SigningMethod
+		kid    string
+		claims jwt.MapClaims
+		valid  bool
+	}{
+		{name: "rsa", method: jwt.SigningMethodRS256, kid: "rsa", claims: tp.validClaims("nonce"), valid: true},
+		{name: "ec", method: jwt.SigningMethodES256, kid: "ec", claims: tp.validClaims("nonce"), valid: true},
+		{name: "audience list", method: jwt.SigningMethodRS256, kid: "rsa", claims: with("aud", []string{"other", testClientID}), valid: true},
+		{name: "hmac", method: jwt.SigningMethodHS256, kid: "hmac", claims: tp.validClaims("nonce")},
+		{name: "key mismatch", method: jwt.SigningMethodRS256, kid: "ec", claims: tp.validClaims("nonce")},
+		{name: "unknown key", method: jwt.SigningMethodRS256, kid: "other", claims: tp.validClaims("nonce")},
+		{name: "issuer", method: jwt.SigningMethodRS256, kid: "rsa", claims: with("iss", "https://evil.example.com")},
+		{name: "audience", method: jwt.SigningMethodRS256, kid: "rsa", claims: with("aud", "other")},
+		{name: "authorized party", method: jwt.SigningMethodRS256, kid: "rsa", claims: with("azp", "other")},
+		{name: "nonce", method: jwt.SigningMethodRS256, kid: "rsa", claims: with("nonce", "other")},
+		{name: "expired", method: jwt.SigningMethodRS256, kid: "rsa", claims: with("exp", time.Now().Add(-time.Minute).Unix())},
+		{name: "no expiration", method: jwt.SigningMethodRS256, kid: "rsa", claims: with("exp", nil)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := p.VerifyIDToken(context.Background(), tp.idToken(t, tt.method, tt.kid, tt.claims), "nonce")
+			if !tt.valid {
+				assert.Error(t, err)
+				assert.IsType(t, &CallbackError{}, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, "alice", claims["sub"])
+		})
+	}
+}
+
+func TestProvider_Exchange(t *testing.T) {
+	tp := newTestProvider(t)
+	p := tp.provider()
+	ctx := context.Background()
+	ar, err := NewAuthRequest()
+	assert.NoError(t, err)
+	challenge := sha256.Sum256([]byte(ar.CodeVerifier))
+	tp.challenge = base64.RawURLEncoding.EncodeToString(challenge[:])
+	tp.claims = tp.validClaims(ar.Nonce)
+
+	_, err = p.Exchange(ctx, ar, url.Values{"error": {"access_denied"}, "state": {ar.State}})
+	assert.EqualError(t, err, "provider error access_denied: ")
+	_, err = p.Exchange(ctx, ar, url.Values{"code": {tp.code}, "state": {"other"}})
+	assert.EqualError(t, err, "state does not match")
+	_, err = p.Exchange(ctx, ar, url.Values{"code": {"other"}, "state": {ar.State}})
+	assert.EqualError(t, err, "token request failed 400: invalid_grant ")
+
+	// the code verifier should match the challenge of the authorization request
+	other, err := NewAuthRequest()
+	assert.NoError(t, err)
+	other.State = ar.State
+	_, err = p.Exchange(ctx, other, url.Values{"code": {tp.code}, "state": {ar.State}})
+	assert.Error(t, err)
+
+	claims, err := p.Exchange(ctx, ar, url.Values{"code": {tp.code}, "state": {ar.State}})
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", claims["sub"])
+}
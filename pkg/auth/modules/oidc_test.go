@@ -0,0 +1,206 @@
+package modules
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/maximthomas/gortas/pkg/auth/callbacks"
+	"github.com/maximthomas/gortas/pkg/auth/state"
+	"github.com/maximthomas/gortas/pkg/config"
+	"github.com/maximthomas/gortas/pkg/session"
+	"github.com/maximthomas/gortas/pkg/user"
+	"github.com/stretchr/testify/assert"
+)
+
+// testOIDCProvider issues ID tokens for the subject to the code of the last authorization request
+type testOIDCProvider struct {
+	*httptest.Server
+	key       *rsa.PrivateKey
+	subject   string
+	nonce     string
+	challenge string
+}
+
+func newTestOIDCProvider(t *testing.T) *testOIDCProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	tp := &testOIDCProvider{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{"issuer": tp.URL, "authorization_endpoint": tp.URL + "/authorize",
+			"token_endpoint": tp.URL + "/token", "jwks_uri": tp.URL + "/jwks"})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		enc := base64.RawURLEncoding.EncodeToString
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{
+			{"kty": "RSA", "kid": "1", "n": enc(key.N.Bytes()), "e": enc(big.NewInt(int64(key.E)).Bytes())},
+		}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		verifier := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		if r.PostFormValue("code") != "code-"+tp.subject || base64.RawURLEncoding.EncodeToString(verifier[:]) != tp.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{"iss": tp.URL, "aud": "gortas", "sub": tp.subject,
+			"nonce": tp.nonce, "exp": time.Now().Add(time.Minute).Unix(), "email": tp.subject + "@example.com", "email_verified": true})
+		token.Header["kid"] = "1"
+		idToken, err := token.SignedString(key)
+		assert.NoError(t, err)
+		_ = json.NewEncoder(w).Encode(map[string]string{"id_token": idToken})
+	})
+	tp.Server = httptest.NewServer(mux)
+	t.Cleanup(tp.Close)
+	return tp
+}
+
+// authorize authenticates the subject with the authorization request URL and returns the redirect back URL
+func (tp *testOIDCProvider) authorize(t *testing.T, authURL, subject string) string {
+	u, err := url.Parse(authURL)
+	assert.NoError(t, err)
+	q := u.Query()
+	tp.subject, tp.nonce, tp.challenge = subject, q.Get("nonce"), q.Get("code_challenge")
+	return q.Get("redirect_uri") + "?" + url.Values{"code": {"code-" + subject}, "state": {q.Get("state")}}.Encode()
+}
+
+func TestOIDC(t *testing.T) {
+	config.SetConfig(&config.Config{})
+	tp := newTestOIDCProvider(t)
+	ctx := context.Background()
+	prefix := "oidc:" + strings.TrimPrefix(tp.URL, "http://") + ":"
+	_, err := user.GetUserService().CreateUser(ctx, user.User{ID: prefix + "carol"})
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name      string
+		subject   string
+		provision bool
+		redirect  func(redirect string) string
+		status    state.ModuleStatus
+	}{
+		{name: "existing user", subject: "carol", status: state.Pass},
+		{name: "local user with the same id", subject: "user1", status: state.Fail},
+		{name: "provisioning", subject: "alice", provision: true, status: state.Pass},
+		{name: "provisioning of the local user id", subject: "user2", provision: true, status: state.Pass},
+		{name: "no provisioning", subject: "bob", status: state.Fail},
+		{name: "invalid state", subject: "carol", redirect: func(redirect string) string {
+			return redirect + "x"
+		}, status: state.Fail},
+		{name: "provider error", subject: "carol", redirect: func(redirect string) string {
+			return "?error=access_denied"
+		}, status: state.Fail},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mi := oidcModuleInfo(tp.URL)
+			mi.Properties["provision"] = tt.provision
+			fs := &state.FlowState{}
+			status, cbs, err := getOIDCModule(t, mi).Process(ctx, fs)
+			assert.NoError(t, err)
+			assert.Equal(t, state.InProgress, status)
+			assert.Equal(t, callbacks.TypeRedirect, cbs[0].Type)
+
+			redirect := tp.authorize(t, cbs[0].Value, tt.subject)
+			if tt.redirect != nil {
+				redirect = tt.redirect(redirect)
+			}
+			status, _, err = getOIDCModule(t, mi).ProcessCallbacks(ctx, []callbacks.Callback{{Name: "oidc", Value: redirect}}, fs)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.status, status)
+			if tt.status != state.Pass {
+				assert.Empty(t, fs.UserID)
+				return
+			}
+			assert.Equal(t, prefix+tt.subject, fs.UserID)
+			u, ok := user.GetUserService().GetUser(ctx, prefix+tt.subject)
+			assert.True(t, ok)
+			assert.Equal(t, tt.subject+"@example.com", u.Properties["email"])
+			assert.False(t, u.EmailVerified())
+		})
+	}
+
+	// local users are never updated by the provider
+	u, ok := user.GetUserService().GetUser(ctx, "user2")
+	assert.True(t, ok)
+	assert.Empty(t, u.Properties["email"])
+}
+
+func TestOIDC_UserIDPrefix(t *testing.T) {
+	config.SetConfig(&config.Config{})
+	tp := newTestOIDCProvider(t)
+	ctx := context.Background()
+	mi := oidcModuleInfo(tp.URL)
+	mi.Properties["userIdPrefix"] = "corp-"
+	mi.Properties["provision"] = true
+	fs := &state.FlowState{}
+	_, cbs, err := getOIDCModule(t, mi).Process(ctx, fs)
+	assert.NoError(t, err)
+	redirect := tp.authorize(t, cbs[0].Value, "alice")
+	status, _, err := getOIDCModule(t, mi).ProcessCallbacks(ctx, []callbacks.Callback{{Name: "oidc", Value: redirect}}, fs)
+	assert.NoError(t, err)
+	assert.Equal(t, state.Pass, status)
+	assert.Equal(t, "corp-alice", fs.UserID)
+}
+
+func TestOIDC_ReservedClaims(t *testing.T) {
+	config.SetConfig(&config.Config{})
+	for _, prop := range []string{user.EmailVerifiedProperty, user.PendingUntilProperty, user.APIKeysProperty, "passwordHistory",
+		"sub", "userId", session.AcrProperty, session.AmrProperty, session.AuthTimeProperty} {
+		mi := oidcModuleInfo("https://idp.example.com")
+		mi.Properties["claims"] = map[string]interface{}{"email": "email", "custom": prop}
+		_, err := GetAuthModule(mi, nil, nil)
+		assert.EqualError(t, err, "module oidc: properties.claims.custom: user property "+prop+" could not be mapped")
+	}
+}
+
+func TestOIDC_ReplayedCallback(t *testing.T) {
+	config.SetConfig(&config.Config{})
+	tp := newTestOIDCProvider(t)
+	ctx := context.Background()
+	mi := oidcModuleInfo(tp.URL)
+	mi.Properties["provision"] = true
+	fs := &state.FlowState{}
+	_, cbs, err := getOIDCModule(t, mi).Process(ctx, fs)
+	assert.NoError(t, err)
+	redirect := tp.authorize(t, cbs[0].Value, "alice")
+	status, _, err := getOIDCModule(t, mi).ProcessCallbacks(ctx, []callbacks.Callback{{Name: "oidc", Value: redirect}}, fs)
+	assert.NoError(t, err)
+	assert.Equal(t, state.Pass, status)
+
+	// the state of the authorization request is cleared, so a new request is started
+	status, cbs, err = getOIDCModule(t, mi).ProcessCallbacks(ctx, []callbacks.Callback{{Name: "oidc", Value: redirect}}, &state.FlowState{})
+	assert.NoError(t, err)
+	assert.Equal(t, state.InProgress, status)
+	assert.Equal(t, callbacks.TypeRedirect, cbs[0].Type)
+}
+
+func oidcModuleInfo(issuer string) state.FlowStateModuleInfo {
+	return state.FlowStateModuleInfo{ID: "oidc", Type: OIDCModuleType,
+		Properties: map[string]interface{}{
+			"issuer":      issuer,
+			"clientId":    "gortas",
+			"redirectUri": "https://app.example.com/callback",
+			"claims":      map[string]interface{}{"email": "email"},
+		},
+		State: map[string]interface{}{}}
+}
+
+func getOIDCModule(t *testing.T, mi state.FlowStateModuleInfo) *OIDC {
+	t.Helper()
+	m, err := GetAuthModule(mi, nil, nil)
+	assert.NoError(t, err)
+	return m.(*OIDC)
+}
@@ -2,6 +2,7 @@ package modules
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
@@ -12,6 +13,7 @@ import (
 
 	"github.com/maximthomas/gortas/pkg/auth/callbacks"
 	"github.com/maximthomas/gortas/pkg/auth/constants"
+	autherrors "github.com/maximthomas/gortas/pkg/auth/errors"
 	"github.com/maximthomas/gortas/pkg/auth/modules/otp"
 	"github.com/maximthomas/gortas/pkg/auth/state"
 	"github.com/maximthomas/gortas/pkg/crypt"
@@ -52,17 +54,17 @@ type otpSenderProperties struct {
 	Properties map[string]interface{}
 }
 
-func (lm *OTP) Process(fs *state.FlowState) (ms state.ModuleStatus, cbs []callbacks.Callback, err error) {
+func (lm *OTP) Process(ctx context.Context, fs *state.FlowState) (ms state.ModuleStatus, cbs []callbacks.Callback, err error) {
 	defer lm.updateState()
 
 	// TODO add check expired date
 	if lm.OtpCheckMagicLink { // TODO refactor move to function and code to constant
-		return lm.checkMagicLink(fs)
+		return lm.checkMagicLink(ctx, fs)
 	}
-	return lm.generateAndSendOTP(fs)
+	return lm.generateAndSendOTP(ctx, fs)
 }
 
-func (lm *OTP) checkMagicLink(fs *state.FlowState) (ms state.ModuleStatus, cbs []callbacks.Callback, err error) {
+func (lm *OTP) checkMagicLink(ctx context.Context, fs *state.FlowState) (ms state.ModuleStatus, cbs []callbacks.Callback, err error) {
 
 	if lm.req.URL.Query().Get(otpMagicLinkParameter) == "" {
 		return state.Fail, lm.Callbacks, err
@@ -82,10 +84,10 @@ func (lm *OTP) checkMagicLink(fs *state.FlowState) (ms state.ModuleStatus, cbs [
 	}
 
 	if time.Now().UnixMilli() > expired {
-		return state.Fail, lm.Callbacks, errors.New("code link expired")
+		return state.Fail, lm.Callbacks, autherrors.NewFlowExpired("code link expired")
 	}
 
-	sess, err := session.GetSessionService().GetSession(sessionID)
+	sess, err := session.GetSessionService().GetSession(ctx, sessionID)
 	if err != nil {
 		return state.Fail, lm.Callbacks, err
 	}
@@ -99,14 +101,16 @@ func (lm *OTP) checkMagicLink(fs *state.FlowState) (ms state.ModuleStatus, cbs [
 		fs.SharedState[k] = v
 	}
 
-	for i, m := range oldFlowState.Modules {
-		fs.Modules[i].State = m.State
+	for i := range fs.Modules {
+		if m, ok := oldFlowState.FindModule(fs.Modules[i].ID); ok {
+			fs.Modules[i].State = m.State
+		}
 	}
 
 	return state.Pass, lm.Callbacks, err
 }
 
-func (lm *OTP) ProcessCallbacks(inCbs []callbacks.Callback, fs *state.FlowState) (ms state.ModuleStatus, cbs []callbacks.Callback, err error) {
+func (lm *OTP) ProcessCallbacks(ctx context.Context, inCbs []callbacks.Callback, fs *state.FlowState) (ms state.ModuleStatus, cbs []callbacks.Callback, err error) {
 	defer lm.updateState()
 	var o string
 	var action string
@@ -121,7 +125,7 @@ func (lm *OTP) ProcessCallbacks(inCbs []callbacks.Callback, fs *state.FlowState)
 	}
 
 	if action == actionSend {
-		return lm.generateAndSendOTP(fs)
+		return lm.generateAndSendOTP(ctx, fs)
 	}
 	// TODO move to BaseAuthModule
 	cbs = make([]callbacks.Callback, len(lm.Callbacks))
@@ -165,7 +169,7 @@ func (lm *OTP) updateState() {
 	lm.State["retries"] = lm.otpState.Retries
 }
 
-func (lm *OTP) generateAndSendOTP(fs *state.FlowState) (ms state.ModuleStatus, cbs []callbacks.Callback, err error) {
+func (lm *OTP) generateAndSendOTP(ctx context.Context, fs *state.FlowState) (ms state.ModuleStatus, cbs []callbacks.Callback, err error) {
 	cbs = make([]callbacks.Callback, len(lm.Callbacks))
 	copy(cbs, lm.Callbacks)
 	generatedAt := lm.otpState.GeneratedAt
@@ -180,7 +184,7 @@ func (lm *OTP) generateAndSendOTP(fs *state.FlowState) (ms state.ModuleStatus, c
 	if err != nil {
 		return state.Fail, cbs, err
 	}
-	err = lm.send(fs)
+	err = lm.send(ctx, fs)
 	if err != nil {
 		return state.Fail, cbs, err
 	}
@@ -199,12 +203,12 @@ func (lm *OTP) generate() error {
 	return nil
 }
 
-func (lm *OTP) send(fs *state.FlowState) error {
+func (lm *OTP) send(ctx context.Context, fs *state.FlowState) error {
 	msg, err := lm.getMessage(fs)
 	if err != nil {
 		return errors.Wrap(err, "error generating message")
 	}
-	err = lm.otpSender.Send(fs.UserID, msg)
+	err = lm.otpSender.Send(ctx, fs.UserID, msg)
 	if err != nil {
 		return errors.Wrap(err, "error sending message")
 	}
@@ -277,20 +281,35 @@ func (lm *OTP) ValidateCallbacks(cbs []callbacks.Callback) error {
 	return lm.BaseAuthModule.ValidateCallbacks(cbs)
 }
 
-func (lm *OTP) PostProcess(_ *state.FlowState) error {
+func (lm *OTP) PostProcess(_ context.Context, _ *state.FlowState) error {
 	return nil
 }
 
 func init() {
-	RegisterModule("otp", newOTP)
+	RegisterModule("otp", newOTP,
+		Property{Name: "otpLength", Type: PropertyInt},
+		Property{Name: "useLetters", Type: PropertyBool},
+		Property{Name: "useDigits", Type: PropertyBool},
+		Property{Name: "otpTimeoutSec", Type: PropertyInt},
+		Property{Name: "otpResendSec", Type: PropertyInt},
+		Property{Name: "otpRetryCount", Type: PropertyInt},
+		Property{Name: "otpMessageTemplate", Type: PropertyString},
+		Property{Name: "otpCheckMagicLink", Type: PropertyBool},
+		Property{Name: otpSenderProperty, Type: PropertyObject},
+	)
 }
 
-func newOTP(base BaseAuthModule) AuthModule {
+func newOTP(base BaseAuthModule) (AuthModule, error) {
 
 	var om OTP
 	err := mapstructure.Decode(base.Properties, &om)
 	if err != nil {
-		panic(err) // TODO add error processing
+		return nil, errors.Wrap(err, "error decoding otp properties")
+	}
+	if om.OtpMessageTemplate != "" {
+		if _, err = template.New("message").Parse(om.OtpMessageTemplate); err != nil {
+			return nil, errors.Wrap(err, "error parsing otpMessageTemplate")
+		}
 	}
 
 	(&base).Callbacks = []callbacks.Callback{
@@ -328,17 +347,17 @@ func newOTP(base BaseAuthModule) AuthModule {
 		var osp otpSenderProperties
 		err = mapstructure.Decode(base.Properties[otpSenderProperty], &osp)
 		if err != nil {
-			panic(err)
+			return nil, errors.Wrap(err, "error decoding otp sender properties")
 		}
 		var sender otp.Sender
 		sender, err = otp.GetSender(osp.SenderType, osp.Properties)
 
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
 
 		om.otpSender = sender
 	}
 
-	return &om
+	return &om, nil
 }
@@ -1,6 +1,7 @@
 package otp
 
 import (
+	"context"
 	"crypto/tls"
 	"time"
 
@@ -15,14 +16,17 @@ type EmailSender struct {
 }
 
 type smtpProperties struct {
-	Host     string
-	Port     int
-	Username string
-	Password string
-	From     string
-	Subject  string
+	Host       string
+	Port       int
+	Username   string
+	Password   string
+	From       string
+	Subject    string
+	TimeoutSec int // connect and send timeout, 5 seconds by default
 }
 
+const defaultEmailTimeoutSec = 5
+
 func init() {
 	RegisterSender("email", NewEmailSender)
 }
@@ -45,17 +49,35 @@ func NewEmailSender(props map[string]interface{}) (Sender, error) {
 
 	server.KeepAlive = false
 
-	server.ConnectTimeout = 5 * time.Second
-	server.SendTimeout = 5 * time.Second
+	timeout := defaultEmailTimeoutSec * time.Second
+	if sp.TimeoutSec > 0 {
+		timeout = time.Duration(sp.TimeoutSec) * time.Second
+	}
+	server.ConnectTimeout = timeout
+	server.SendTimeout = timeout
 
 	server.TLSConfig = &tls.Config{InsecureSkipVerify: true}
 
 	return EmailSender{server: server, From: sp.From, Subject: sp.Subject}, nil
 }
 
-func (es EmailSender) Send(to, text string) error {
+// Send sends the email, SMTP client does not support context, so timeouts are limited by the ctx deadline
+func (es EmailSender) Send(ctx context.Context, to, text string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	server := *es.server
+	if deadline, ok := ctx.Deadline(); ok {
+		left := time.Until(deadline)
+		if left < server.ConnectTimeout {
+			server.ConnectTimeout = left
+		}
+		if left < server.SendTimeout {
+			server.SendTimeout = left
+		}
+	}
 
-	smtpClient, err := es.server.Connect()
+	smtpClient, err := server.Connect()
 
 	if err != nil {
 		return err
@@ -3,6 +3,7 @@
 package otp
 
 import (
+	"context"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -15,7 +16,7 @@ const (
 
 func TestSendEmail(t *testing.T) {
 	es := getEmailSender(t)
-	err := es.Send("test@test.com", "hello email")
+	err := es.Send(context.Background(), "test@test.com", "hello email")
 	assert.NoError(t, err)
 }
 
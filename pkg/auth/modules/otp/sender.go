@@ -1,6 +1,7 @@
 package otp
 
 import (
+	"context"
 	"fmt"
 	"sync"
 
@@ -10,7 +11,7 @@ import (
 )
 
 type Sender interface {
-	Send(to string, text string) error
+	Send(ctx context.Context, to string, text string) error
 }
 
 var senderRegistry = &sync.Map{}
@@ -60,7 +61,7 @@ func NewTestSender(props map[string]interface{}) (Sender, error) {
 	return ts, nil
 }
 
-func (ts *TestSender) Send(to, text string) error {
+func (ts *TestSender) Send(_ context.Context, to, text string) error {
 	ts.Messages[to] = text
 	return nil
 }
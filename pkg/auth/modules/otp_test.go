@@ -1,6 +1,7 @@
 package modules
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/base64"
 	"fmt"
@@ -39,7 +40,7 @@ func TestProcess(t *testing.T) {
 
 	m := getOTPModule(t)
 	var fs state.FlowState
-	status, cbs, err := m.Process(&fs)
+	status, cbs, err := m.Process(context.Background(), &fs)
 	assert.NoError(t, err)
 	assert.Equal(t, state.InProgress, status)
 	assert.Equal(t, 2, len(cbs))
@@ -72,13 +73,13 @@ func TestProcess_MagicLink(t *testing.T) {
 	sess.Properties = make(map[string]string, 1)
 	sess.Properties[constants.FlowStateSessionProperty] = "{}"
 	sess.ID = sessionID
-	session.GetSessionService().CreateSession(sess)
+	session.GetSessionService().CreateSession(context.Background(), sess)
 
 	m := getOTPModule(t)
 	m.req = httptest.NewRequest("GET", "http://localhost/gortas?code="+encrypted, nil)
 	m.OtpCheckMagicLink = true
 	var fs state.FlowState
-	st, _, err := m.Process(&fs)
+	st, _, err := m.Process(context.Background(), &fs)
 	assert.NoError(t, err)
 	assert.Equal(t, state.Pass, st)
 }
@@ -111,7 +112,7 @@ func TestProcessCallbacks_CodeExpired(t *testing.T) {
 			Value: "check",
 		},
 	}
-	st, cbs, err := m.ProcessCallbacks(inCbs, nil)
+	st, cbs, err := m.ProcessCallbacks(context.Background(), inCbs, nil)
 	assert.NoError(t, err)
 	assert.Equal(t, state.InProgress, st)
 	assert.Equal(t, "OTP expired", cbs[0].Error)
@@ -134,7 +135,7 @@ func TestProcessCallbacks_BadOTP(t *testing.T) {
 			Value: "check",
 		},
 	}
-	st, cbs, err := m.ProcessCallbacks(inCbs, nil)
+	st, cbs, err := m.ProcessCallbacks(context.Background(), inCbs, nil)
 	assert.NoError(t, err)
 	assert.Equal(t, state.InProgress, st)
 	assert.Equal(t, "Invalid OTP", cbs[0].Error)
@@ -155,7 +156,7 @@ func TestProcessCallbacks_SendNotAllowed(t *testing.T) {
 	}
 	m.otpState.GeneratedAt = time.Now().UnixMilli() - 1000
 	var fs state.FlowState
-	st, cbs, err := m.ProcessCallbacks(inCbs, &fs)
+	st, cbs, err := m.ProcessCallbacks(context.Background(), inCbs, &fs)
 	assert.NoError(t, err)
 	assert.Equal(t, state.InProgress, st)
 	assert.Equal(t, "Sending not allowed yet", cbs[1].Error)
@@ -180,7 +181,7 @@ func TestProcessCallbacks_Send(t *testing.T) {
 	}
 	m.otpState.GeneratedAt = int64(1000)
 	m.otpState.Otp = testOTP
-	st, cbs, err := m.ProcessCallbacks(inCbs, &state.FlowState{})
+	st, cbs, err := m.ProcessCallbacks(context.Background(), inCbs, &state.FlowState{})
 	assert.NoError(t, err)
 	assert.Equal(t, state.InProgress, st)
 	assert.Empty(t, cbs[1].Error)
@@ -208,7 +209,7 @@ func TestProcessCallbacks_CodeValid(t *testing.T) {
 			Value: "check",
 		},
 	}
-	st, cbs, err := m.ProcessCallbacks(inCbs, nil)
+	st, cbs, err := m.ProcessCallbacks(context.Background(), inCbs, nil)
 	assert.NoError(t, err)
 	assert.Equal(t, state.Pass, st)
 	assert.Empty(t, cbs[0].Error)
@@ -231,7 +232,7 @@ func TestSend(t *testing.T) {
 		ID: "test",
 	}
 	m := getOTPModule(t)
-	err := m.send(fs)
+	err := m.send(context.Background(), fs)
 	assert.NoError(t, err)
 	ts := m.otpSender.(*otp.TestSender)
 	assert.Equal(t, 1, len(ts.Messages))
@@ -257,7 +258,8 @@ func getOTPModule(t *testing.T) *OTP {
 			},
 		},
 	}
-	am := newOTP(b)
+	am, err := newOTP(b)
+	assert.NoError(t, err)
 	assert.NotNil(t, am)
 	o, ok := am.(*OTP)
 	assert.True(t, ok)
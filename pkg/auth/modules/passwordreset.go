@@ -0,0 +1,288 @@
+package modules
+
+import (
+	"context"
+	"strconv"
+	"text/template"
+	"time"
+
+	"github.com/maximthomas/gortas/pkg/auth/callbacks"
+	autherrors "github.com/maximthomas/gortas/pkg/auth/errors"
+	"github.com/maximthomas/gortas/pkg/auth/modules/otp"
+	"github.com/maximthomas/gortas/pkg/auth/state"
+	"github.com/maximthomas/gortas/pkg/crypt"
+	"github.com/maximthomas/gortas/pkg/session"
+	"github.com/maximthomas/gortas/pkg/user"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+)
+
+// PasswordResetModuleType module resets the password of the user, who proved control of the email address
+const PasswordResetModuleType = "passwordReset"
+
+// password reset stages
+const (
+	resetIdentify = "identify"
+	resetVerify   = "verify"
+	resetPassword = "password"
+)
+
+const defaultResetMessageTemplate = "Your password reset code is {{.OTP}}, it is valid for {{.ValidFor}}"
+
+type passwordResetState struct {
+	Stage       string
+	Login       string
+	CodeHash    string
+	GeneratedAt int64
+	Retries     int
+}
+
+// PasswordReset asks for the login, sends the code and the magic link to the user email address,
+// and after the code is confirmed, sets the new password.
+// Responses do not depend on whether the account exists, so accounts could not be enumerated
+type PasswordReset struct {
+	BaseAuthModule
+	EmailProperty   string // user property with the email address, the user id is used if not set
+	OtpLength       int
+	UseLetters      bool
+	UseDigits       bool
+	OtpTimeoutSec   int
+	RetryCount      int
+	MessageTemplate string
+	RevokeSessions  bool // delete sessions of the user after the password is reset
+	sender          otp.Sender
+	st              passwordResetState
+}
+
+func (pr *PasswordReset) Process(ctx context.Context, fs *state.FlowState) (ms state.ModuleStatus, cbs []callbacks.Callback, err error) {
+	if pr.req != nil {
+		if code := pr.req.URL.Query().Get(otpMagicLinkParameter); code != "" {
+			return pr.checkMagicLink(ctx, fs, code)
+		}
+	}
+	return state.InProgress, pr.stageCallbacks(resetIdentify), nil
+}
+
+func (pr *PasswordReset) ProcessCallbacks(ctx context.Context, inCbs []callbacks.Callback, fs *state.FlowState) (ms state.ModuleStatus, cbs []callbacks.Callback, err error) {
+	values := make(map[string]string, len(inCbs))
+	for _, cb := range inCbs {
+		values[cb.Name] = cb.Value
+	}
+	switch pr.st.Stage {
+	case resetVerify:
+		return pr.verify(values["otp"])
+	case resetPassword:
+		return pr.setPassword(ctx, fs, values["password"], values["repeatPassword"])
+	default:
+		return pr.sendCode(ctx, fs, values["login"])
+	}
+}
+
+// sendInBackground runs the send of the message after the response,
+// so the response time does not depend on the account existence
+var sendInBackground = func(send func()) { go send() }
+
+// sendCode sends the code to the user, if the user exists and has the email address,
+// otherwise the code is not sent, but the response and the work done before the response are the same
+func (pr *PasswordReset) sendCode(ctx context.Context, fs *state.FlowState, login string) (state.ModuleStatus, []callbacks.Callback, error) {
+	if login == "" {
+		cbs := pr.stageCallbacks(resetIdentify)
+		(&cbs[0]).Error = "Login required"
+		return state.InProgress, cbs, nil
+	}
+	code, err := crypt.RandomString(pr.OtpLength, pr.UseLetters, pr.UseDigits)
+	if err != nil {
+		return state.Fail, nil, errors.Wrap(err, "error generating code")
+	}
+	pr.st = passwordResetState{Stage: resetVerify, Login: login, GeneratedAt: time.Now().UnixMilli()}
+	codeHash := hashCode(code)
+	expiresAt := time.Now().UnixMilli() + int64(pr.OtpTimeoutSec)*millisecondsMultiplier
+	msg, err := codeMessage(pr.MessageTemplate, code, pr.OtpTimeoutSec, magicLink{FlowID: fs.ID, ExpiresAt: expiresAt, Code: code})
+	if err != nil {
+		return state.Fail, nil, err
+	}
+
+	u, ok := user.GetUserService().GetUser(ctx, login)
+	address := u.ID
+	if pr.EmailProperty != "" {
+		address = u.Properties[pr.EmailProperty]
+	}
+	if ok && address != "" {
+		pr.st.CodeHash = codeHash
+		// the request context is cancelled after the response, the sender limits the send with its own timeout,
+		// the send error is not returned to the client, as it would reveal the account
+		sender := pr.sender
+		sendInBackground(func() {
+			if err := sender.Send(context.Background(), address, msg); err != nil {
+				pr.l.Errorf("error sending password reset code to %v: %v", login, err)
+			}
+		})
+	} else {
+		pr.l.Infof("password reset for unknown account %v", login)
+	}
+	pr.saveState()
+	return state.InProgress, pr.stageCallbacks(resetVerify), nil
+}
+
+func (pr *PasswordReset) verify(code string) (state.ModuleStatus, []callbacks.Callback, error) {
+	if time.Now().UnixMilli() > pr.st.GeneratedAt+int64(pr.OtpTimeoutSec)*millisecondsMultiplier {
+		pr.l.Warnf("password reset code of %v expired", pr.st.Login)
+		return state.Fail, nil, nil
+	}
+	if !codeMatches(pr.st.CodeHash, code) {
+		pr.st.Retries++
+		if pr.st.Retries >= pr.RetryCount {
+			return state.Fail, nil, nil
+		}
+		pr.saveState()
+		cbs := pr.stageCallbacks(resetVerify)
+		(&cbs[0]).Error = "Invalid code"
+		return state.InProgress, cbs, nil
+	}
+	pr.st.Stage = resetPassword
+	pr.saveState()
+	return state.InProgress, pr.stageCallbacks(resetPassword), nil
+}
+
+// checkMagicLink continues the flow, that sent the link, with the new password stage,
+// the flow is deleted, so the link could be used only once
+func (pr *PasswordReset) checkMagicLink(ctx context.Context, fs *state.FlowState, link string) (state.ModuleStatus, []callbacks.Callback, error) {
+	ml, linkFs, err := readMagicLink(ctx, link)
+	if autherrors.Code(err) != autherrors.CodeInternal {
+		return state.Fail, nil, err
+	} else if err != nil {
+		pr.l.Warnf("invalid password reset link: %v", err)
+		return state.Fail, nil, nil
+	}
+	var st passwordResetState
+	_ = mapstructure.Decode(linkModuleState(&linkFs, fs, PasswordResetModuleType), &st)
+	if st.Stage != resetVerify || !codeMatches(st.CodeHash, ml.Code) {
+		pr.l.Warn("password reset link does not match the flow")
+		return state.Fail, nil, nil
+	}
+	if err = deleteLinkFlow(ctx, ml); err != nil {
+		pr.l.Warnf("error deleting flow %v: %v", ml.FlowID, err)
+	}
+	pr.st = passwordResetState{Stage: resetPassword, Login: st.Login}
+	pr.saveState()
+	return state.InProgress, pr.stageCallbacks(resetPassword), nil
+}
+
+func (pr *PasswordReset) setPassword(ctx context.Context, fs *state.FlowState, password, repeatPassword string) (state.ModuleStatus, []callbacks.Callback, error) {
+	cbs := pr.stageCallbacks(resetPassword)
+	if password != repeatPassword {
+		(&cbs[1]).Error = "Passwords do not match"
+		return state.InProgress, cbs, nil
+	}
+	us := user.GetUserService()
+	err := us.SetPassword(ctx, pr.st.Login, password)
+	if setPasswordPolicyError(cbs, "password", err) {
+		return state.InProgress, cbs, nil
+	} else if err != nil {
+		return state.Fail, nil, errors.Wrap(err, "error setting password")
+	}
+	if pr.RevokeSessions {
+		err = session.GetSessionService().DeleteUserSessions(ctx, pr.st.Login)
+		if err != nil {
+			return state.Fail, nil, errors.Wrap(err, "error revoking sessions")
+		}
+	}
+	fs.UserID = pr.st.Login
+	for k := range pr.State {
+		delete(pr.State, k)
+	}
+	return state.Pass, nil, nil
+}
+
+func (pr *PasswordReset) saveState() {
+	pr.State["stage"] = pr.st.Stage
+	pr.State["login"] = pr.st.Login
+	pr.State["codeHash"] = pr.st.CodeHash
+	pr.State["generatedAt"] = pr.st.GeneratedAt
+	pr.State["retries"] = pr.st.Retries
+}
+
+func (pr *PasswordReset) stageCallbacks(stage string) []callbacks.Callback {
+	switch stage {
+	case resetVerify:
+		return []callbacks.Callback{{
+			Name:     "otp",
+			Type:     callbacks.TypeText,
+			Prompt:   "If the account exists, the code was sent to its email address",
+			Required: true,
+			Properties: map[string]string{
+				"timeoutSec": strconv.Itoa(pr.OtpTimeoutSec),
+			},
+		}}
+	case resetPassword:
+		return []callbacks.Callback{
+			{Name: "password", Type: callbacks.TypePassword, Prompt: "New password", Required: true},
+			{Name: "repeatPassword", Type: callbacks.TypePassword, Prompt: "Repeat password", Required: true},
+		}
+	default:
+		return []callbacks.Callback{{Name: "login", Type: callbacks.TypeText, Prompt: "Login", Required: true}}
+	}
+}
+
+func (pr *PasswordReset) ValidateCallbacks(cbs []callbacks.Callback) error {
+	return pr.BaseAuthModule.ValidateCallbacks(cbs)
+}
+
+func (pr *PasswordReset) PostProcess(_ context.Context, _ *state.FlowState) error {
+	return nil
+}
+
+// requiredFlowLifetime returns the code timeout, the code and the link are kept in the flow,
+// so the flow should not expire before them
+func (pr *PasswordReset) requiredFlowLifetime() (string, time.Duration) {
+	return "otpTimeoutSec", time.Duration(pr.OtpTimeoutSec) * time.Second
+}
+
+func init() {
+	RegisterModule(PasswordResetModuleType, newPasswordReset,
+		Property{Name: otpSenderProperty, Type: PropertyObject, Required: true},
+		Property{Name: "emailProperty", Type: PropertyString},
+		Property{Name: "otpLength", Type: PropertyInt, Default: 6},
+		Property{Name: "useLetters", Type: PropertyBool, Default: false},
+		Property{Name: "useDigits", Type: PropertyBool, Default: true},
+		Property{Name: "otpTimeoutSec", Type: PropertyInt, Default: 600},
+		Property{Name: "retryCount", Type: PropertyInt, Default: 3},
+		Property{Name: "messageTemplate", Type: PropertyString, Default: defaultResetMessageTemplate},
+		Property{Name: "revokeSessions", Type: PropertyBool, Default: false},
+	)
+}
+
+func newPasswordReset(base BaseAuthModule) (AuthModule, error) {
+	var pr PasswordReset
+	err := mapstructure.Decode(base.Properties, &pr)
+	if err != nil {
+		return nil, errors.Wrap(err, "error decoding properties")
+	}
+	switch {
+	case pr.OtpLength <= 0:
+		return nil, errors.New("properties.otpLength: should be positive")
+	case !pr.UseLetters && !pr.UseDigits:
+		return nil, errors.New("properties.useDigits: letters or digits should be used")
+	case pr.OtpTimeoutSec <= 0:
+		return nil, errors.New("properties.otpTimeoutSec: should be positive")
+	case pr.RetryCount <= 0:
+		return nil, errors.New("properties.retryCount: should be positive")
+	}
+	if _, err = template.New("message").Parse(pr.MessageTemplate); err != nil {
+		return nil, errors.Wrap(err, "properties.messageTemplate")
+	}
+	var osp otpSenderProperties
+	err = mapstructure.Decode(base.Properties[otpSenderProperty], &osp)
+	if err != nil {
+		return nil, errors.Wrap(err, "error decoding sender properties")
+	}
+	pr.sender, err = otp.GetSender(osp.SenderType, osp.Properties)
+	if err != nil {
+		return nil, err
+	}
+
+	_ = mapstructure.Decode(base.State, &pr.st)
+	(&base).Callbacks = pr.stageCallbacks(pr.st.Stage)
+	pr.BaseAuthModule = base
+	return &pr, nil
+}
@@ -0,0 +1,172 @@
+package modules
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+
+	"github.com/maximthomas/gortas/pkg/auth/callbacks"
+	"github.com/maximthomas/gortas/pkg/auth/constants"
+	"github.com/maximthomas/gortas/pkg/auth/modules/otp"
+	"github.com/maximthomas/gortas/pkg/auth/state"
+	"github.com/maximthomas/gortas/pkg/session"
+	"github.com/maximthomas/gortas/pkg/user"
+	"github.com/stretchr/testify/assert"
+)
+
+var resetMessageRe = regexp.MustCompile(`^code (\w+) link (\S+)$`)
+
+func TestPasswordReset(t *testing.T) {
+	setTOTPConfig(t)
+	fs := &state.FlowState{ID: "reset-flow", Name: "reset"}
+	mi := passwordResetModuleInfo()
+
+	status, cbs, err := getPasswordResetModule(t, mi, nil).Process(context.Background(), fs)
+	assert.NoError(t, err)
+	assert.Equal(t, state.InProgress, status)
+	assert.Equal(t, "login", cbs[0].Name)
+
+	status, cbs, err = getPasswordResetModule(t, mi, nil).ProcessCallbacks(context.Background(),
+		[]callbacks.Callback{{Name: "login", Value: "user1"}}, fs)
+	assert.NoError(t, err)
+	assert.Equal(t, state.InProgress, status)
+	assert.Equal(t, "otp", cbs[0].Name)
+	code := sentResetCode(t, "user1")
+
+	status, cbs, err = getPasswordResetModule(t, mi, nil).ProcessCallbacks(context.Background(),
+		[]callbacks.Callback{{Name: "otp", Value: "bad"}}, fs)
+	assert.NoError(t, err)
+	assert.Equal(t, state.InProgress, status)
+	assert.Equal(t, "Invalid code", cbs[0].Error)
+
+	status, cbs, err = getPasswordResetModule(t, mi, nil).ProcessCallbacks(context.Background(),
+		[]callbacks.Callback{{Name: "otp", Value: code}}, fs)
+	assert.NoError(t, err)
+	assert.Equal(t, state.InProgress, status)
+	assert.Equal(t, []string{"password", "repeatPassword"}, []string{cbs[0].Name, cbs[1].Name})
+
+	status, cbs, err = getPasswordResetModule(t, mi, nil).ProcessCallbacks(context.Background(),
+		[]callbacks.Callback{{Name: "password", Value: "newPassw0rd"}, {Name: "repeatPassword", Value: "other"}}, fs)
+	assert.NoError(t, err)
+	assert.Equal(t, state.InProgress, status)
+	assert.Equal(t, "Passwords do not match", cbs[1].Error)
+
+	status, _, err = getPasswordResetModule(t, mi, nil).ProcessCallbacks(context.Background(),
+		[]callbacks.Callback{{Name: "password", Value: "newPassw0rd"}, {Name: "repeatPassword", Value: "newPassw0rd"}}, fs)
+	assert.NoError(t, err)
+	assert.Equal(t, state.Pass, status)
+	assert.Equal(t, "user1", fs.UserID)
+	assert.True(t, user.GetUserService().ValidatePassword(context.Background(), "user1", "newPassw0rd"))
+}
+
+func TestPasswordReset_UnknownAccount(t *testing.T) {
+	setTOTPConfig(t)
+	mi := passwordResetModuleInfo()
+	mi.Properties["retryCount"] = 2
+	knownCbs := sendResetCode(t, "user2")
+	delete(sentMessages(), "unknown")
+
+	// the response does not reveal, that the account does not exist
+	fs := &state.FlowState{ID: "reset-unknown", Name: "reset"}
+	_, cbs, err := getPasswordResetModule(t, mi, nil).ProcessCallbacks(context.Background(),
+		[]callbacks.Callback{{Name: "login", Value: "unknown"}}, fs)
+	assert.NoError(t, err)
+	assert.Equal(t, knownCbs, cbs)
+	assert.NotContains(t, sentMessages(), "unknown")
+
+	status, _, err := getPasswordResetModule(t, mi, nil).ProcessCallbacks(context.Background(),
+		[]callbacks.Callback{{Name: "otp", Value: ""}}, fs)
+	assert.NoError(t, err)
+	assert.Equal(t, state.InProgress, status)
+	status, _, err = getPasswordResetModule(t, mi, nil).ProcessCallbacks(context.Background(),
+		[]callbacks.Callback{{Name: "otp", Value: "123456"}}, fs)
+	assert.NoError(t, err)
+	assert.Equal(t, state.Fail, status)
+}
+
+func TestPasswordReset_MagicLink(t *testing.T) {
+	setTOTPConfig(t)
+	ctx := context.Background()
+	ss := session.GetSessionService()
+	userSession, err := ss.CreateSession(ctx, session.Session{Properties: map[string]string{"sub": "user2"}})
+	assert.NoError(t, err)
+
+	mi := passwordResetModuleInfo()
+	mi.Properties["revokeSessions"] = true
+	fs := &state.FlowState{ID: "reset-link", Name: "reset", Modules: []state.FlowStateModuleInfo{mi}}
+	_, _, err = getPasswordResetModule(t, mi, nil).ProcessCallbacks(ctx, []callbacks.Callback{{Name: "login", Value: "user2"}}, fs)
+	assert.NoError(t, err)
+	fsJSON, err := json.Marshal(fs)
+	assert.NoError(t, err)
+	_, err = ss.CreateSession(ctx, session.Session{ID: fs.ID, Properties: map[string]string{constants.FlowStateSessionProperty: string(fsJSON)}})
+	assert.NoError(t, err)
+	link := resetMessageRe.FindStringSubmatch(sentMessages()["user2"])[2]
+
+	// the link continues the flow in the new browser with the new password stage
+	r := httptest.NewRequest("GET", "/gortas/v1/auth/reset?code="+url.QueryEscape(link), nil)
+	linkMi := passwordResetModuleInfo()
+	linkMi.Properties["revokeSessions"] = true
+	linkFs := &state.FlowState{ID: "reset-link-2", Name: "reset"}
+	status, cbs, err := getPasswordResetModule(t, linkMi, r).Process(ctx, linkFs)
+	assert.NoError(t, err)
+	assert.Equal(t, state.InProgress, status)
+	assert.Equal(t, "password", cbs[0].Name)
+
+	status, _, err = getPasswordResetModule(t, linkMi, nil).ProcessCallbacks(ctx,
+		[]callbacks.Callback{{Name: "password", Value: "linkPassw0rd"}, {Name: "repeatPassword", Value: "linkPassw0rd"}}, linkFs)
+	assert.NoError(t, err)
+	assert.Equal(t, state.Pass, status)
+	assert.True(t, user.GetUserService().ValidatePassword(ctx, "user2", "linkPassw0rd"))
+	_, err = ss.GetSession(ctx, userSession.ID)
+	assert.Error(t, err)
+
+	// the link could be used only once
+	status, _, err = getPasswordResetModule(t, passwordResetModuleInfo(), r).Process(ctx, &state.FlowState{ID: "reset-link-3", Name: "reset"})
+	assert.Error(t, err)
+	assert.Equal(t, state.Fail, status)
+}
+
+func passwordResetModuleInfo() state.FlowStateModuleInfo {
+	return state.FlowStateModuleInfo{ID: "reset", Type: PasswordResetModuleType,
+		Properties: map[string]interface{}{
+			"sender":          map[string]interface{}{"senderType": "test"},
+			"messageTemplate": "code {{.OTP}} link {{.MagicLink}}",
+		},
+		State: map[string]interface{}{}}
+}
+
+func getPasswordResetModule(t *testing.T, mi state.FlowStateModuleInfo, r *http.Request) *PasswordReset {
+	t.Helper()
+	m, err := GetAuthModule(mi, r, nil)
+	assert.NoError(t, err)
+	return m.(*PasswordReset)
+}
+
+func sendResetCode(t *testing.T, login string) []callbacks.Callback {
+	t.Helper()
+	_, cbs, err := getPasswordResetModule(t, passwordResetModuleInfo(), nil).ProcessCallbacks(context.Background(),
+		[]callbacks.Callback{{Name: "login", Value: login}}, &state.FlowState{ID: "reset-" + login, Name: "reset"})
+	assert.NoError(t, err)
+	return cbs
+}
+
+func sentResetCode(t *testing.T, to string) string {
+	t.Helper()
+	m := resetMessageRe.FindStringSubmatch(sentMessages()[to])
+	assert.Len(t, m, 3)
+	return m[1]
+}
+
+func init() {
+	// messages are sent before the response, so tests could read them
+	sendInBackground = func(send func()) { send() }
+}
+
+func sentMessages() map[string]string {
+	s, _ := otp.GetSender("test", nil)
+	return s.(*otp.TestSender).Messages
+}
@@ -1,6 +1,7 @@
 package modules
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/base64"
 	"fmt"
@@ -10,6 +11,8 @@ import (
 	"github.com/maximthomas/gortas/pkg/auth/callbacks"
 	"github.com/maximthomas/gortas/pkg/auth/state"
 	"github.com/maximthomas/gortas/pkg/crypt"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
 	"github.com/skip2/go-qrcode"
 )
 
@@ -23,7 +26,7 @@ type QR struct {
 	qrTimeout int64
 }
 
-func (q *QR) Process(lss *state.FlowState) (ms state.ModuleStatus, cbs []callbacks.Callback, err error) {
+func (q *QR) Process(_ context.Context, lss *state.FlowState) (ms state.ModuleStatus, cbs []callbacks.Callback, err error) {
 
 	var qrT int64
 	qrTf, ok := q.State["qrT"].(float64)
@@ -44,7 +47,7 @@ func (q *QR) Process(lss *state.FlowState) (ms state.ModuleStatus, cbs []callbac
 	return state.InProgress, q.Callbacks, err
 }
 
-func (q *QR) ProcessCallbacks(_ []callbacks.Callback, lss *state.FlowState) (ms state.ModuleStatus, cbs []callbacks.Callback, err error) {
+func (q *QR) ProcessCallbacks(_ context.Context, _ []callbacks.Callback, lss *state.FlowState) (ms state.ModuleStatus, cbs []callbacks.Callback, err error) {
 
 	uid, ok := q.BaseAuthModule.State["qrUserId"].(string)
 	if !ok {
@@ -82,7 +85,7 @@ func (q *QR) ValidateCallbacks(_ []callbacks.Callback) error {
 	return nil
 }
 
-func (q *QR) PostProcess(_ *state.FlowState) error {
+func (q *QR) PostProcess(_ context.Context, _ *state.FlowState) error {
 	return nil
 }
 
@@ -120,10 +123,12 @@ func (q *QR) generateQRImage(sessID string, qrT int64) (string, error) {
 }
 
 func init() {
-	RegisterModule("qr", newQRModule)
+	RegisterModule("qr", newQRModule,
+		Property{Name: "qrTimeout", Type: PropertyInt, Default: 30},
+	)
 }
 
-func newQRModule(base BaseAuthModule) AuthModule {
+func newQRModule(base BaseAuthModule) (AuthModule, error) {
 	(&base).Callbacks = []callbacks.Callback{
 		{
 			Name:       "qr",
@@ -141,12 +146,19 @@ func newQRModule(base BaseAuthModule) AuthModule {
 		},
 	}
 
-	qrTimeout := 30
-	if qrTimeoutProp, ok := base.Properties["qrTimeout"]; ok {
-		qrTimeout = qrTimeoutProp.(int)
+	props := struct {
+		QRTimeout int
+	}{QRTimeout: 30}
+	err := mapstructure.Decode(base.Properties, &props)
+	if err != nil {
+		return nil, errors.Wrap(err, "error decoding qr properties")
+	}
+	if props.QRTimeout <= 0 {
+		return nil, errors.New("qrTimeout should be positive")
 	}
+	qrTimeout := props.QRTimeout
 	return &QR{
 		BaseAuthModule: base,
 		qrTimeout:      int64(qrTimeout),
-	}
+	}, nil
 }
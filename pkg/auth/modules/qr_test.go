@@ -1,6 +1,7 @@
 package modules
 
 import (
+	"context"
 	"log"
 	"net/http/httptest"
 	"testing"
@@ -22,7 +23,7 @@ func TestQR(t *testing.T) {
 		lss := &state.FlowState{}
 		lss.ID = uuid.New().String()
 
-		status, cbs, err := q.Process(lss)
+		status, cbs, err := q.Process(context.Background(), lss)
 		img, ok := cbs[0].Properties["image"]
 		assert.True(t, ok)
 		assert.NotEmpty(t, img)
@@ -37,7 +38,7 @@ func TestQR(t *testing.T) {
 		lss := &state.FlowState{SharedState: map[string]string{}}
 		lss.ID = uuid.New().String()
 		q.BaseAuthModule.State["qrUserId"] = "ivan"
-		ms, _, err := q.ProcessCallbacks(q.Callbacks, lss)
+		ms, _, err := q.ProcessCallbacks(context.Background(), q.Callbacks, lss)
 		assert.Equal(t, state.Pass, ms)
 		assert.NoError(t, err)
 	})
@@ -49,7 +50,7 @@ func TestQR(t *testing.T) {
 		c.Request = httptest.NewRequest("POST", "/login", nil)
 		lss := &state.FlowState{SharedState: map[string]string{}}
 		lss.ID = uuid.New().String()
-		ms, cbs, err := q.ProcessCallbacks(q.Callbacks, lss)
+		ms, cbs, err := q.ProcessCallbacks(context.Background(), q.Callbacks, lss)
 		assert.Equal(t, state.InProgress, ms)
 		assert.NoError(t, err)
 		image := cbs[0].Properties["image"]
@@ -65,7 +66,7 @@ func getQRModule() *QR {
 		},
 		State: map[string]interface{}{},
 	}
-	m := newQRModule(b)
+	m, _ := newQRModule(b)
 	q, _ := m.(*QR)
 	return q
 }
@@ -1,16 +1,37 @@
 package modules
 
 import (
+	"context"
 	"regexp"
+	"strconv"
+	"text/template"
+	"time"
 
 	"github.com/maximthomas/gortas/pkg/auth/callbacks"
+	autherrors "github.com/maximthomas/gortas/pkg/auth/errors"
+	"github.com/maximthomas/gortas/pkg/auth/modules/otp"
 	"github.com/maximthomas/gortas/pkg/auth/state"
+	"github.com/maximthomas/gortas/pkg/crypt"
 	"github.com/maximthomas/gortas/pkg/user"
 	"github.com/mitchellh/mapstructure"
 	"github.com/pkg/errors"
 )
 
-// TODO add password format
+// RegistrationModuleType module creates the user
+const RegistrationModuleType = "registration"
+
+const registrationVerify = "verify"
+
+const defaultVerificationMessageTemplate = "Your verification code is {{.OTP}}, it is valid for {{.ValidFor}}"
+
+type registrationState struct {
+	Stage       string
+	UserID      string
+	CodeHash    string
+	GeneratedAt int64
+	Retries     int
+}
+
 // TODO add confirmation password callback
 type Registration struct {
 	BaseAuthModule
@@ -18,6 +39,16 @@ type Registration struct {
 	UsePassword       bool
 	UseRepeatPassword bool
 	AdditionalFields  []Field
+	// with VerifyEmail the user is created pending and the code is sent to the email address,
+	// the user could log in only after the code is confirmed
+	VerifyEmail            bool
+	EmailField             string // field with the email address, the primary field if not set
+	OtpLength              int
+	VerificationTimeoutSec int // validity of the code and of the pending registration, not greater than the flow lifetime
+	RetryCount             int
+	MessageTemplate        string
+	sender                 otp.Sender
+	st                     registrationState
 }
 
 func (f *Field) initField() error {
@@ -31,13 +62,21 @@ func (f *Field) initField() error {
 	return nil
 }
 
-func (rm *Registration) Process(_ *state.FlowState) (ms state.ModuleStatus, cbs []callbacks.Callback, err error) {
+func (rm *Registration) Process(ctx context.Context, fs *state.FlowState) (ms state.ModuleStatus, cbs []callbacks.Callback, err error) {
+	if rm.VerifyEmail && rm.req != nil {
+		if code := rm.req.URL.Query().Get(otpMagicLinkParameter); code != "" {
+			return rm.checkMagicLink(ctx, fs, code)
+		}
+	}
 	return state.InProgress, rm.Callbacks, err
 }
 
-func (rm *Registration) ProcessCallbacks(inCbs []callbacks.Callback, fs *state.FlowState) (ms state.ModuleStatus, cbs []callbacks.Callback, err error) {
+func (rm *Registration) ProcessCallbacks(ctx context.Context, inCbs []callbacks.Callback, fs *state.FlowState) (ms state.ModuleStatus, cbs []callbacks.Callback, err error) {
 	if inCbs == nil {
-		return state.Fail, cbs, errors.New("callbacks can't be nil")
+		return state.Fail, cbs, autherrors.NewInvalidCallbacks("callbacks can't be nil")
+	}
+	if rm.st.Stage == registrationVerify {
+		return rm.verify(ctx, fs, inCbs[0].Value)
 	}
 	callbacksValid := true
 	errCbs := make([]callbacks.Callback, len(rm.Callbacks))
@@ -93,8 +132,9 @@ func (rm *Registration) ProcessCallbacks(inCbs []callbacks.Callback, fs *state.F
 	}
 
 	us := user.GetUserService()
-	_, exists := us.GetUser(username)
-	if exists {
+	existing, exists := us.GetUser(ctx, username)
+	// unconfirmed registrations are replaced after they expire
+	if exists && !existing.PendingExpired(time.Now()) {
 		(&errCbs[0]).Error = "User exists"
 		return state.InProgress, errCbs, nil
 	}
@@ -104,40 +144,232 @@ func (rm *Registration) ProcessCallbacks(inCbs []callbacks.Callback, fs *state.F
 		Properties: fields,
 	}
 
-	_, err = us.CreateUser(u)
-	if err != nil {
-		return state.Fail, cbs, err
+	var address string
+	if rm.VerifyEmail {
+		address = rm.emailAddress(username, fields)
+		if address == "" {
+			setCallbackError(errCbs, rm.emailField(), "Email required")
+			return state.InProgress, errCbs, nil
+		}
+		u.SetProperty(user.EmailVerifiedProperty, "false")
+		u.SetProperty(user.PendingUntilProperty,
+			strconv.FormatInt(time.Now().Unix()+int64(rm.VerificationTimeoutSec), 10))
+	}
+
+	if rm.UsePassword {
+		err = us.CheckPasswordPolicy(u, password)
+		if setPasswordPolicyError(errCbs, "password", err) {
+			return state.InProgress, errCbs, nil
+		} else if err != nil {
+			return state.Fail, cbs, err
+		}
 	}
 
-	err = us.SetPassword(u.ID, password)
+	if exists {
+		err = us.UpdateUser(ctx, u)
+	} else {
+		_, err = us.CreateUser(ctx, u)
+	}
 	if err != nil {
 		return state.Fail, cbs, err
 	}
 
+	if rm.UsePassword {
+		err = us.SetPassword(ctx, u.ID, password)
+		if err != nil {
+			return state.Fail, cbs, err
+		}
+	}
+
+	if rm.VerifyEmail {
+		return rm.sendCode(ctx, fs, u.ID, address)
+	}
+
 	fs.UserID = u.ID
 
 	return state.Pass, rm.Callbacks, err
 }
 
+func (rm *Registration) emailField() string {
+	if rm.EmailField == "" {
+		return rm.PrimaryField.Name
+	}
+	return rm.EmailField
+}
+
+func (rm *Registration) emailAddress(username string, fields map[string]string) string {
+	if rm.emailField() == rm.PrimaryField.Name {
+		return username
+	}
+	return fields[rm.emailField()]
+}
+
+// sendCode sends the verification code and the magic link to the email address of the pending user
+func (rm *Registration) sendCode(ctx context.Context, fs *state.FlowState, userID, address string) (state.ModuleStatus, []callbacks.Callback, error) {
+	code, err := crypt.RandomString(rm.OtpLength, false, true)
+	if err != nil {
+		return state.Fail, nil, errors.Wrap(err, "error generating code")
+	}
+	rm.st = registrationState{Stage: registrationVerify, UserID: userID, CodeHash: hashCode(code), GeneratedAt: time.Now().UnixMilli()}
+	expiresAt := rm.st.GeneratedAt + int64(rm.VerificationTimeoutSec)*millisecondsMultiplier
+	msg, err := codeMessage(rm.MessageTemplate, code, rm.VerificationTimeoutSec, magicLink{FlowID: fs.ID, ExpiresAt: expiresAt, Code: code})
+	if err != nil {
+		return state.Fail, nil, err
+	}
+	err = rm.sender.Send(ctx, address, msg)
+	if err != nil {
+		return state.Fail, nil, errors.Wrap(err, "error sending verification code")
+	}
+	rm.saveState()
+	return state.InProgress, rm.verifyCallbacks(), nil
+}
+
+func (rm *Registration) verify(ctx context.Context, fs *state.FlowState, code string) (state.ModuleStatus, []callbacks.Callback, error) {
+	if time.Now().UnixMilli() > rm.st.GeneratedAt+int64(rm.VerificationTimeoutSec)*millisecondsMultiplier {
+		rm.l.Warnf("verification code of %v expired", rm.st.UserID)
+		return state.Fail, nil, nil
+	}
+	if !codeMatches(rm.st.CodeHash, code) {
+		rm.st.Retries++
+		if rm.st.Retries >= rm.RetryCount {
+			return state.Fail, nil, nil
+		}
+		rm.saveState()
+		cbs := rm.verifyCallbacks()
+		(&cbs[0]).Error = "Invalid code"
+		return state.InProgress, cbs, nil
+	}
+	return rm.confirm(ctx, fs, rm.st.UserID)
+}
+
+// checkMagicLink confirms the registration of the flow, that sent the link,
+// the flow is deleted, so the link could be used only once
+func (rm *Registration) checkMagicLink(ctx context.Context, fs *state.FlowState, link string) (state.ModuleStatus, []callbacks.Callback, error) {
+	ml, linkFs, err := readMagicLink(ctx, link)
+	if autherrors.Code(err) != autherrors.CodeInternal {
+		return state.Fail, nil, err
+	} else if err != nil {
+		rm.l.Warnf("invalid verification link: %v", err)
+		return state.Fail, nil, nil
+	}
+	var st registrationState
+	_ = mapstructure.Decode(linkModuleState(&linkFs, fs, RegistrationModuleType), &st)
+	if st.Stage != registrationVerify || !codeMatches(st.CodeHash, ml.Code) {
+		rm.l.Warn("verification link does not match the flow")
+		return state.Fail, nil, nil
+	}
+	if err = deleteLinkFlow(ctx, ml); err != nil {
+		rm.l.Warnf("error deleting flow %v: %v", ml.FlowID, err)
+	}
+	return rm.confirm(ctx, fs, st.UserID)
+}
+
+// confirm marks the email address of the pending user as verified and authenticates the user
+func (rm *Registration) confirm(ctx context.Context, fs *state.FlowState, userID string) (state.ModuleStatus, []callbacks.Callback, error) {
+	us := user.GetUserService()
+	u, ok := us.GetUser(ctx, userID)
+	if !ok || !u.Pending() {
+		rm.l.Warnf("pending user %v not found", userID)
+		return state.Fail, nil, nil
+	}
+	u.SetProperty(user.EmailVerifiedProperty, "true")
+	delete(u.Properties, user.PendingUntilProperty)
+	err := us.UpdateUser(ctx, u)
+	if err != nil {
+		return state.Fail, nil, errors.Wrap(err, "error confirming user")
+	}
+	fs.UserID = u.ID
+	for k := range rm.State {
+		delete(rm.State, k)
+	}
+	return state.Pass, nil, nil
+}
+
+func (rm *Registration) saveState() {
+	rm.State["stage"] = rm.st.Stage
+	rm.State["userID"] = rm.st.UserID
+	rm.State["codeHash"] = rm.st.CodeHash
+	rm.State["generatedAt"] = rm.st.GeneratedAt
+	rm.State["retries"] = rm.st.Retries
+}
+
+func (rm *Registration) verifyCallbacks() []callbacks.Callback {
+	return []callbacks.Callback{{
+		Name:     "otp",
+		Type:     callbacks.TypeText,
+		Prompt:   "Verification code",
+		Required: true,
+		Properties: map[string]string{
+			"timeoutSec": strconv.Itoa(rm.VerificationTimeoutSec),
+		},
+	}}
+}
+
+func setCallbackError(cbs []callbacks.Callback, name, msg string) {
+	for i := range cbs {
+		if cbs[i].Name == name {
+			cbs[i].Error = msg
+		}
+	}
+}
+
+// setPasswordPolicyError sets the password policy violations as the error of the callback,
+// returns false if err is not a password policy error
+func setPasswordPolicyError(cbs []callbacks.Callback, name string, err error) bool {
+	var pe *user.PasswordPolicyError
+	if !errors.As(err, &pe) {
+		return false
+	}
+	setCallbackError(cbs, name, pe.Error())
+	return true
+}
+
 func (rm *Registration) ValidateCallbacks(cbs []callbacks.Callback) error {
 	return rm.BaseAuthModule.ValidateCallbacks(cbs)
 }
 
-func (rm *Registration) PostProcess(_ *state.FlowState) error {
+func (rm *Registration) PostProcess(_ context.Context, _ *state.FlowState) error {
 	return nil
 }
 
 func init() {
-	RegisterModule("registration", newRegistrationModule)
+	RegisterModule(RegistrationModuleType, newRegistrationModule,
+		Property{Name: "primaryField", Type: PropertyObject, Required: true},
+		Property{Name: "usePassword", Type: PropertyBool, Default: true},
+		Property{Name: "useRepeatPassword", Type: PropertyBool, Default: true},
+		Property{Name: "additionalFields", Type: PropertyList},
+		Property{Name: "verifyEmail", Type: PropertyBool, Default: false},
+		Property{Name: "emailField", Type: PropertyString},
+		Property{Name: otpSenderProperty, Type: PropertyObject},
+		Property{Name: "otpLength", Type: PropertyInt, Default: 6},
+		Property{Name: "verificationTimeoutSec", Type: PropertyInt, Default: 1800},
+		Property{Name: "retryCount", Type: PropertyInt, Default: 3},
+		Property{Name: "messageTemplate", Type: PropertyString, Default: defaultVerificationMessageTemplate},
+	)
 }
 
-func newRegistrationModule(base BaseAuthModule) AuthModule {
+func newRegistrationModule(base BaseAuthModule) (AuthModule, error) {
 	var rm Registration
 	rm.UsePassword = true // default value
 	rm.UseRepeatPassword = true
+	rm.OtpLength = 6
+	rm.VerificationTimeoutSec = 1800
+	rm.RetryCount = 3
+	rm.MessageTemplate = defaultVerificationMessageTemplate
 	err := mapstructure.Decode(base.Properties, &rm)
 	if err != nil {
-		panic(err) // TODO add error processing
+		return nil, errors.Wrap(err, "error decoding registration properties")
+	}
+	if rm.VerifyEmail {
+		err = rm.initVerification(base.Properties[otpSenderProperty])
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, f := range append([]Field{rm.PrimaryField}, rm.AdditionalFields...) {
+		if err = f.initField(); err != nil {
+			return nil, errors.Wrapf(err, "field %v validation", f.Name)
+		}
 	}
 	rm.BaseAuthModule = base
 
@@ -191,5 +423,43 @@ func newRegistrationModule(base BaseAuthModule) AuthModule {
 	}
 
 	(&rm.BaseAuthModule).Callbacks = adcbs
-	return &rm
+	if rm.VerifyEmail {
+		_ = mapstructure.Decode(base.State, &rm.st)
+		if rm.st.Stage == registrationVerify {
+			(&rm.BaseAuthModule).Callbacks = rm.verifyCallbacks()
+		}
+	}
+	return &rm, nil
+}
+
+// requiredFlowLifetime returns the verification timeout, the code and the link are kept in the flow,
+// so the flow should not expire before them
+func (rm *Registration) requiredFlowLifetime() (string, time.Duration) {
+	if !rm.VerifyEmail {
+		return "verificationTimeoutSec", 0
+	}
+	return "verificationTimeoutSec", time.Duration(rm.VerificationTimeoutSec) * time.Second
+}
+
+func (rm *Registration) initVerification(senderProps interface{}) error {
+	switch {
+	case senderProps == nil:
+		return errors.New("properties.sender: required to verify email")
+	case rm.OtpLength <= 0:
+		return errors.New("properties.otpLength: should be positive")
+	case rm.VerificationTimeoutSec <= 0:
+		return errors.New("properties.verificationTimeoutSec: should be positive")
+	case rm.RetryCount <= 0:
+		return errors.New("properties.retryCount: should be positive")
+	}
+	if _, err := template.New("message").Parse(rm.MessageTemplate); err != nil {
+		return errors.Wrap(err, "properties.messageTemplate")
+	}
+	var osp otpSenderProperties
+	err := mapstructure.Decode(senderProps, &osp)
+	if err != nil {
+		return errors.Wrap(err, "error decoding sender properties")
+	}
+	rm.sender, err = otp.GetSender(osp.SenderType, osp.Properties)
+	return err
 }
@@ -1,16 +1,23 @@
 package modules
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/maximthomas/gortas/pkg/auth/callbacks"
+	"github.com/maximthomas/gortas/pkg/auth/constants"
 	"github.com/maximthomas/gortas/pkg/auth/state"
 	"github.com/maximthomas/gortas/pkg/config"
 	"github.com/maximthomas/gortas/pkg/log"
+	"github.com/maximthomas/gortas/pkg/session"
 	"github.com/maximthomas/gortas/pkg/user"
 	"github.com/stretchr/testify/assert"
 )
@@ -52,7 +59,7 @@ func TestRegistration_Process_InvalidLogin(t *testing.T) {
 				},
 			}
 			fs := &state.FlowState{}
-			ms, cbs, err := rm.ProcessCallbacks(inCbs, fs)
+			ms, cbs, err := rm.ProcessCallbacks(context.Background(), inCbs, fs)
 			assert.NoError(t, err)
 			assert.Equal(t, 4, len(cbs))
 			assert.Equal(t, tt.emailError, cbs[0].Error)
@@ -70,7 +77,7 @@ func TestRegistration_Process(t *testing.T) {
 		c, _ := gin.CreateTestContext(recorder)
 		c.Request = httptest.NewRequest("GET", "/login", nil)
 		lss := &state.FlowState{}
-		status, cbs, err := rm.Process(lss)
+		status, cbs, err := rm.Process(context.Background(), lss)
 		fmt.Print(status, cbs, err)
 		assert.Equal(t, 4, len(cbs))
 		assert.NoError(t, err)
@@ -194,9 +201,9 @@ func TestRegistration_ProcessCallbacks(t *testing.T) {
 				assert.NoError(t, err)
 				assert.Equal(t, state.Pass, status)
 				us := user.GetUserService()
-				_, ok := us.GetUser(userName)
+				_, ok := us.GetUser(context.Background(), userName)
 				assert.True(t, ok)
-				pValid := us.ValidatePassword(userName, password)
+				pValid := us.ValidatePassword(context.Background(), userName, password)
 				assert.True(t, pValid)
 			},
 		},
@@ -208,12 +215,35 @@ func TestRegistration_ProcessCallbacks(t *testing.T) {
 			c, _ := gin.CreateTestContext(recorder)
 			c.Request = httptest.NewRequest("POST", "/login", nil)
 			lss := &state.FlowState{}
-			status, cbs, err := rm.ProcessCallbacks(tt.inCbs, lss)
+			status, cbs, err := rm.ProcessCallbacks(context.Background(), tt.inCbs, lss)
 			tt.assertions(t, status, cbs, err)
 		})
 	}
 }
 
+func TestRegistration_PasswordPolicy(t *testing.T) {
+	rm := getNewRegistrationModule(t)
+	config.SetConfig(&config.Config{UserDataStore: user.Config{PasswordPolicy: user.PasswordPolicy{
+		MinLength:        10,
+		NotContainFields: []string{"name"},
+	}}})
+	defer config.SetConfig(&config.Config{})
+
+	inCbs := []callbacks.Callback{
+		{Name: "login", Value: "janeDoe"},
+		{Name: "name", Value: "Jane"},
+		{Name: "password", Value: "jane123"},
+		{Name: "repeatPassword", Value: "jane123"},
+	}
+	status, cbs, err := rm.ProcessCallbacks(context.Background(), inCbs, &state.FlowState{})
+	assert.NoError(t, err)
+	assert.Equal(t, state.InProgress, status)
+	assert.Equal(t, "Password should be at least 10 characters long, Password should not contain name", cbs[2].Error)
+	assert.Empty(t, cbs[3].Error)
+	_, ok := user.GetUserService().GetUser(context.Background(), "janeDoe")
+	assert.False(t, ok)
+}
+
 func getNewRegistrationModule(t *testing.T) *Registration {
 	config.SetConfig(&config.Config{})
 	var b = BaseAuthModule{
@@ -234,8 +264,132 @@ func getNewRegistrationModule(t *testing.T) *Registration {
 		},
 	}
 
-	var m = newRegistrationModule(b)
+	m, err := newRegistrationModule(b)
+	assert.NoError(t, err)
 	rm, ok := m.(*Registration)
 	assert.True(t, ok)
 	return rm
 }
+
+func TestRegistration_VerifyEmail(t *testing.T) {
+	setTOTPConfig(t)
+	ctx := context.Background()
+	us := user.GetUserService()
+	mi := verifyRegistrationModuleInfo()
+	fs := &state.FlowState{ID: "register-flow", Name: "register"}
+
+	status, cbs, err := getVerifyRegistrationModule(t, mi, nil).ProcessCallbacks(ctx, registrationCallbacks("jane"), fs)
+	assert.NoError(t, err)
+	assert.Equal(t, state.InProgress, status)
+	assert.Equal(t, "otp", cbs[0].Name)
+	assert.Empty(t, fs.UserID)
+
+	// the pending user could not log in
+	u, ok := us.GetUser(ctx, "jane")
+	assert.True(t, ok)
+	assert.True(t, u.Pending())
+	assert.False(t, u.EmailVerified())
+	assert.False(t, us.ValidatePassword(ctx, "jane", password))
+
+	status, cbs, err = getVerifyRegistrationModule(t, mi, nil).ProcessCallbacks(ctx, []callbacks.Callback{{Name: "otp", Value: "bad"}}, fs)
+	assert.NoError(t, err)
+	assert.Equal(t, state.InProgress, status)
+	assert.Equal(t, "Invalid code", cbs[0].Error)
+
+	status, _, err = getVerifyRegistrationModule(t, mi, nil).ProcessCallbacks(ctx,
+		[]callbacks.Callback{{Name: "otp", Value: sentResetCode(t, "jane")}}, fs)
+	assert.NoError(t, err)
+	assert.Equal(t, state.Pass, status)
+	assert.Equal(t, "jane", fs.UserID)
+	u, _ = us.GetUser(ctx, "jane")
+	assert.False(t, u.Pending())
+	assert.True(t, u.EmailVerified())
+	assert.True(t, us.ValidatePassword(ctx, "jane", password))
+}
+
+func TestRegistration_VerifyEmail_MagicLink(t *testing.T) {
+	setTOTPConfig(t)
+	ctx := context.Background()
+	mi := verifyRegistrationModuleInfo()
+	fs := &state.FlowState{ID: "register-link", Name: "register", Modules: []state.FlowStateModuleInfo{mi}}
+	_, _, err := getVerifyRegistrationModule(t, mi, nil).ProcessCallbacks(ctx, registrationCallbacks("jack"), fs)
+	assert.NoError(t, err)
+	fsJSON, err := json.Marshal(fs)
+	assert.NoError(t, err)
+	_, err = session.GetSessionService().CreateSession(ctx,
+		session.Session{ID: fs.ID, Properties: map[string]string{constants.FlowStateSessionProperty: string(fsJSON)}})
+	assert.NoError(t, err)
+	link := resetMessageRe.FindStringSubmatch(sentMessages()["jack"])[2]
+
+	r := httptest.NewRequest("GET", "/gortas/v1/auth/register?code="+url.QueryEscape(link), nil)
+	linkFs := &state.FlowState{ID: "register-link-2", Name: "register"}
+	status, _, err := getVerifyRegistrationModule(t, verifyRegistrationModuleInfo(), r).Process(ctx, linkFs)
+	assert.NoError(t, err)
+	assert.Equal(t, state.Pass, status)
+	assert.Equal(t, "jack", linkFs.UserID)
+	u, _ := user.GetUserService().GetUser(ctx, "jack")
+	assert.True(t, u.EmailVerified())
+
+	// the link could be used only once
+	status, _, err = getVerifyRegistrationModule(t, verifyRegistrationModuleInfo(), r).Process(ctx,
+		&state.FlowState{ID: "register-link-3", Name: "register"})
+	assert.Error(t, err)
+	assert.Equal(t, state.Fail, status)
+}
+
+func TestRegistration_VerifyEmail_Expired(t *testing.T) {
+	setTOTPConfig(t)
+	ctx := context.Background()
+	us := user.GetUserService()
+	_, err := us.CreateUser(ctx, user.User{ID: "jill", Properties: map[string]string{
+		user.EmailVerifiedProperty: "false",
+		user.PendingUntilProperty:  strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10),
+	}})
+	assert.NoError(t, err)
+
+	// the pending registration could not be replaced until it expires
+	_, cbs, err := getVerifyRegistrationModule(t, verifyRegistrationModuleInfo(), nil).ProcessCallbacks(ctx,
+		registrationCallbacks("jill"), &state.FlowState{ID: "register-jill", Name: "register"})
+	assert.NoError(t, err)
+	assert.Equal(t, "User exists", cbs[0].Error)
+
+	u, _ := us.GetUser(ctx, "jill")
+	u.SetProperty(user.PendingUntilProperty, strconv.FormatInt(time.Now().Add(-time.Second).Unix(), 10))
+	assert.NoError(t, us.UpdateUser(ctx, u))
+	status, cbs, err := getVerifyRegistrationModule(t, verifyRegistrationModuleInfo(), nil).ProcessCallbacks(ctx,
+		registrationCallbacks("jill"), &state.FlowState{ID: "register-jill-2", Name: "register"})
+	assert.NoError(t, err)
+	assert.Equal(t, state.InProgress, status)
+	assert.Equal(t, "otp", cbs[0].Name)
+	u, _ = us.GetUser(ctx, "jill")
+	assert.False(t, u.PendingExpired(time.Now()))
+	assert.Equal(t, "Jane Doe", u.Properties["name"])
+}
+
+func verifyRegistrationModuleInfo() state.FlowStateModuleInfo {
+	return state.FlowStateModuleInfo{ID: "registration", Type: RegistrationModuleType,
+		Properties: map[string]interface{}{
+			"primaryField":     map[string]interface{}{"name": "login", "prompt": "Email", "required": true},
+			"additionalFields": []interface{}{map[string]interface{}{"name": "name", "prompt": "Name"}},
+			"verifyEmail":      true,
+			"sender":           map[string]interface{}{"senderType": "test"},
+			"messageTemplate":  "code {{.OTP}} link {{.MagicLink}}",
+		},
+		State: map[string]interface{}{}}
+}
+
+func getVerifyRegistrationModule(t *testing.T, mi state.FlowStateModuleInfo, r *http.Request) *Registration {
+	t.Helper()
+	m, err := GetAuthModule(mi, r, nil)
+	assert.NoError(t, err)
+	return m.(*Registration)
+}
+
+func registrationCallbacks(login string) []callbacks.Callback {
+	return []callbacks.Callback{
+		{Name: "login", Value: login},
+		{Name: "name", Value: "Jane Doe"},
+		{Name: "password", Value: password},
+		{Name: "repeatPassword", Value: password},
+	}
+}
@@ -0,0 +1,364 @@
+package modules
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/beevik/etree"
+	"github.com/crewjam/saml"
+	"github.com/maximthomas/gortas/pkg/auth/callbacks"
+	"github.com/maximthomas/gortas/pkg/auth/state"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+// SAMLModuleType module authenticates the user with an external SAML 2.0 identity provider
+const SAMLModuleType = "saml"
+
+const samlCallbackName = "saml"
+
+// SAML bindings of the authentication request
+const (
+	samlBindingRedirect = "redirect"
+	samlBindingPost     = "post"
+)
+
+type samlState struct {
+	RequestID string
+	IssuedAt  int64
+}
+
+// SAML sends the authentication request to the identity provider with the HTTP-Redirect or HTTP-POST binding,
+// the flow id is sent as the relay state. The client sends the SAMLResponse, posted to the assertion consumer service,
+// as the callback value, the module validates the signed response and maps the attributes to the user and the shared state
+type SAML struct {
+	BaseAuthModule
+	EntityID        string
+	AcsURL          string
+	IDPMetadata     string // XML metadata of the identity provider, or
+	IDPMetadataFile string // file with the metadata
+	KeyFile         string // PEM key and certificate of the service provider to sign requests and decrypt assertions
+	CertFile        string
+	Binding         string
+	NameIDFormat    string
+	UserIDAttribute string            // attribute with the user id, NameID if not set
+	UserIDPrefix    string            // prefix of the user ids, saml:<identity provider entity id>: if not set
+	Attributes      map[string]string // attributes mapped to the user properties
+	SharedState     map[string]string // attributes mapped to the shared state keys
+	Provision       bool              // create users, that do not exist, otherwise such users fail
+	LoginTimeoutSec int
+	sp              *saml.ServiceProvider
+}
+
+func (s *SAML) Process(_ context.Context, fs *state.FlowState) (ms state.ModuleStatus, cbs []callbacks.Callback, err error) {
+	binding := saml.HTTPRedirectBinding
+	if s.Binding == samlBindingPost {
+		binding = saml.HTTPPostBinding
+	}
+	idpURL := s.sp.GetSSOBindingLocation(binding)
+	if idpURL == "" {
+		return state.Fail, nil, errors.Errorf("identity provider has no %v binding", s.Binding)
+	}
+	req, err := s.sp.MakeAuthenticationRequest(idpURL, binding, saml.HTTPPostBinding)
+	if err != nil {
+		return state.Fail, nil, errors.Wrap(err, "error creating authentication request")
+	}
+	s.State["requestID"] = req.ID
+	s.State["issuedAt"] = time.Now().UnixMilli()
+	cb := callbacks.Callback{Name: samlCallbackName, Type: callbacks.TypeRedirect}
+	if binding == saml.HTTPRedirectBinding {
+		u, err := req.Redirect(url.QueryEscape(fs.ID), s.sp)
+		if err != nil {
+			return state.Fail, nil, errors.Wrap(err, "error creating authentication request")
+		}
+		cb.Value = u.String()
+	} else {
+		doc := etree.NewDocument()
+		doc.SetRoot(req.Element())
+		b, err := doc.WriteToBytes()
+		if err != nil {
+			return state.Fail, nil, errors.Wrap(err, "error creating authentication request")
+		}
+		cb.Value = req.Destination
+		cb.Properties = map[string]string{
+			"method":      "POST",
+			"SAMLRequest": base64.StdEncoding.EncodeToString(b),
+			"RelayState":  fs.ID,
+		}
+	}
+	return state.InProgress, []callbacks.Callback{cb}, nil
+}
+
+func (s *SAML) ProcessCallbacks(ctx context.Context, inCbs []callbacks.Callback, fs *state.FlowState) (ms state.ModuleStatus, cbs []callbacks.Callback, err error) {
+	var st samlState
+	_ = mapstructure.Decode(s.State, &st)
+	if st.RequestID == "" || len(inCbs) == 0 || inCbs[0].Value == "" {
+		return s.Process(ctx, fs)
+	}
+	if time.Since(time.UnixMilli(st.IssuedAt)) > time.Duration(s.LoginTimeoutSec)*time.Second {
+		s.l.Warn("authentication with the identity provider expired")
+		return state.Fail, nil, nil
+	}
+	// the authentication request could be answered only once
+	for k := range s.State {
+		delete(s.State, k)
+	}
+	responseXML, err := base64.StdEncoding.DecodeString(inCbs[0].Value)
+	if err != nil {
+		s.l.Warnf("invalid SAMLResponse encoding: %v", err)
+		return state.Fail, nil, nil
+	}
+	assertion, err := s.sp.ParseXMLResponse(responseXML, []string{st.RequestID})
+	if err != nil {
+		var ire *saml.InvalidResponseError
+		if errors.As(err, &ire) {
+			err = ire.PrivateErr
+		}
+		s.l.Warnf("invalid SAMLResponse: %v", err)
+		return state.Fail, nil, nil
+	}
+	if !samlAssertions.add(assertion.ID, assertion.Conditions.NotOnOrAfter.Add(saml.MaxClockSkew)) {
+		s.l.Warnf("assertion %v is replayed", assertion.ID)
+		return state.Fail, nil, nil
+	}
+
+	attrs := samlAttributes(assertion)
+	subject := ""
+	if s.UserIDAttribute == "" {
+		if assertion.Subject != nil && assertion.Subject.NameID != nil {
+			subject = assertion.Subject.NameID.Value
+		}
+	} else {
+		subject = claimString(attrs[s.UserIDAttribute])
+	}
+	if subject == "" {
+		s.l.Warn("assertion has no user id")
+		return state.Fail, nil, nil
+	}
+	userID := s.UserIDPrefix + subject
+	err = syncFederatedUser(ctx, userID, attrs, s.Attributes, s.Provision)
+	if errors.Is(err, errUserNotFound) {
+		s.l.Warnf("user %v not found", userID)
+		return state.Fail, nil, nil
+	} else if err != nil {
+		return state.Fail, nil, err
+	}
+	for attr, key := range s.SharedState {
+		if v, ok := attrs[attr]; ok {
+			if fs.SharedState == nil {
+				fs.SharedState = make(map[string]string)
+			}
+			fs.SharedState[key] = claimString(v)
+		}
+	}
+	fs.UserID = userID
+	return state.Pass, nil, nil
+}
+
+// samlAttributes returns the attributes by their names and friendly names,
+// single values are strings, multiple values are lists
+func samlAttributes(assertion *saml.Assertion) map[string]interface{} {
+	attrs := make(map[string]interface{})
+	for _, as := range assertion.AttributeStatements {
+		for _, a := range as.Attributes {
+			values := make([]string, len(a.Values))
+			for i, v := range a.Values {
+				values[i] = v.Value
+			}
+			var v interface{} = values
+			if len(values) == 1 {
+				v = values[0]
+			}
+			for _, name := range []string{a.Name, a.FriendlyName} {
+				if name != "" {
+					attrs[name] = v
+				}
+			}
+		}
+	}
+	return attrs
+}
+
+// Metadata returns the XML metadata of the service provider, registered with the identity provider
+func (s *SAML) Metadata() ([]byte, error) {
+	b, err := xml.MarshalIndent(s.sp.Metadata(), "", "  ")
+	if err != nil {
+		return nil, errors.Wrap(err, "error generating metadata")
+	}
+	return b, nil
+}
+
+func (s *SAML) ValidateCallbacks(cbs []callbacks.Callback) error {
+	return s.BaseAuthModule.ValidateCallbacks(cbs)
+}
+
+func (s *SAML) PostProcess(_ context.Context, _ *state.FlowState) error {
+	return nil
+}
+
+// assertionCache keeps ids of accepted assertions until they expire, so they could not be replayed
+type assertionCache struct {
+	sync.Mutex
+	ids map[string]time.Time
+}
+
+var samlAssertions = &assertionCache{ids: make(map[string]time.Time)}
+
+// add returns false if the assertion was already accepted
+func (c *assertionCache) add(id string, expiresAt time.Time) bool {
+	c.Lock()
+	defer c.Unlock()
+	now := time.Now()
+	for k, exp := range c.ids {
+		if now.After(exp) {
+			delete(c.ids, k)
+		}
+	}
+	if _, ok := c.ids[id]; ok {
+		return false
+	}
+	c.ids[id] = expiresAt
+	return true
+}
+
+func init() {
+	RegisterModule(SAMLModuleType, newSAMLModule,
+		Property{Name: "entityId", Type: PropertyString, Required: true},
+		Property{Name: "acsUrl", Type: PropertyString, Required: true},
+		Property{Name: "idpMetadata", Type: PropertyString},
+		Property{Name: "idpMetadataFile", Type: PropertyString},
+		Property{Name: "keyFile", Type: PropertyString},
+		Property{Name: "certFile", Type: PropertyString},
+		Property{Name: "binding", Type: PropertyString, Default: samlBindingRedirect},
+		Property{Name: "nameIdFormat", Type: PropertyString, Default: string(saml.UnspecifiedNameIDFormat)},
+		Property{Name: "userIdAttribute", Type: PropertyString},
+		Property{Name: "userIdPrefix", Type: PropertyString},
+		Property{Name: "attributes", Type: PropertyObject},
+		Property{Name: "sharedState", Type: PropertyObject},
+		Property{Name: "provision", Type: PropertyBool, Default: false},
+		Property{Name: "loginTimeoutSec", Type: PropertyInt, Default: 600},
+	)
+}
+
+func newSAMLModule(base BaseAuthModule) (AuthModule, error) {
+	var s SAML
+	err := mapstructure.Decode(base.Properties, &s)
+	if err != nil {
+		return nil, errors.Wrap(err, "error decoding saml properties")
+	}
+	switch {
+	case s.Binding != samlBindingRedirect && s.Binding != samlBindingPost:
+		return nil, errors.Errorf("properties.binding: unknown binding %v", s.Binding)
+	case s.LoginTimeoutSec <= 0:
+		return nil, errors.New("properties.loginTimeoutSec: should be positive")
+	case (s.KeyFile == "") != (s.CertFile == ""):
+		return nil, errors.New("properties.certFile: key and certificate should be set together")
+	}
+	if err = validateFederatedMapping("attributes", s.Attributes); err != nil {
+		return nil, err
+	}
+	s.sp, err = samlServiceProvider(samlProviderKey{
+		entityID:        s.EntityID,
+		acsURL:          s.AcsURL,
+		idpMetadata:     s.IDPMetadata,
+		idpMetadataFile: s.IDPMetadataFile,
+		keyFile:         s.KeyFile,
+		certFile:        s.CertFile,
+		nameIDFormat:    s.NameIDFormat,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if s.UserIDPrefix == "" {
+		s.UserIDPrefix = federatedUserIDPrefix(SAMLModuleType, s.sp.IDPMetadata.EntityID)
+	}
+	(&base).Callbacks = []callbacks.Callback{{Name: samlCallbackName, Type: callbacks.TypeRedirect}}
+	s.BaseAuthModule = base
+	return &s, nil
+}
+
+// samlProviderKey is the settings of the service provider, the modules with the same settings share the provider
+type samlProviderKey struct {
+	entityID        string
+	acsURL          string
+	idpMetadata     string
+	idpMetadataFile string
+	keyFile         string
+	certFile        string
+	nameIDFormat    string
+}
+
+// samlProviders caches parsed service providers, so the metadata and key files are not read on every request,
+// the cache is cleared with ResetFileCaches
+var samlProviders = &sync.Map{}
+
+// samlServiceProvider returns the cached service provider or creates it with the settings
+func samlServiceProvider(k samlProviderKey) (*saml.ServiceProvider, error) {
+	if sp, ok := samlProviders.Load(k); ok {
+		return sp.(*saml.ServiceProvider), nil
+	}
+	acsURL, err := url.Parse(k.acsURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "properties.acsUrl")
+	}
+	idpMetadata, err := readIDPMetadata(k.idpMetadata, k.idpMetadataFile)
+	if err != nil {
+		return nil, err
+	}
+	sp := &saml.ServiceProvider{
+		EntityID:          k.entityID,
+		AcsURL:            *acsURL,
+		IDPMetadata:       idpMetadata,
+		AuthnNameIDFormat: saml.NameIDFormat(k.nameIDFormat),
+	}
+	if k.keyFile != "" {
+		kp, err := tls.LoadX509KeyPair(k.certFile, k.keyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "error loading service provider key")
+		}
+		key, ok := kp.PrivateKey.(*rsa.PrivateKey)
+		if !ok {
+			return nil, errors.New("properties.keyFile: should be an RSA key")
+		}
+		cert, err := x509.ParseCertificate(kp.Certificate[0])
+		if err != nil {
+			return nil, errors.Wrap(err, "error parsing service provider certificate")
+		}
+		sp.Key, sp.Certificate = key, cert
+		sp.SignatureMethod = dsig.RSASHA256SignatureMethod
+	}
+	actual, _ := samlProviders.LoadOrStore(k, sp)
+	return actual.(*saml.ServiceProvider), nil
+}
+
+func readIDPMetadata(metadata, file string) (*saml.EntityDescriptor, error) {
+	b := []byte(metadata)
+	if file != "" {
+		var err error
+		if b, err = os.ReadFile(file); err != nil {
+			return nil, errors.Wrap(err, "error reading identity provider metadata")
+		}
+	}
+	if len(bytes.TrimSpace(b)) == 0 {
+		return nil, errors.New("properties.idpMetadata: identity provider metadata required")
+	}
+	var ed saml.EntityDescriptor
+	if err := xml.Unmarshal(b, &ed); err != nil {
+		return nil, errors.Wrap(err, "invalid identity provider metadata")
+	}
+	if len(ed.IDPSSODescriptors) == 0 || strings.TrimSpace(ed.EntityID) == "" {
+		return nil, errors.New("invalid identity provider metadata: IDPSSODescriptor or entityID is missing")
+	}
+	return &ed, nil
+}
@@ -0,0 +1,307 @@
+package modules
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"encoding/xml"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/crewjam/saml"
+	"github.com/maximthomas/gortas/pkg/auth/callbacks"
+	"github.com/maximthomas/gortas/pkg/auth/state"
+	"github.com/maximthomas/gortas/pkg/config"
+	"github.com/maximthomas/gortas/pkg/user"
+	"github.com/stretchr/testify/assert"
+)
+
+// testIDP is a SAML identity provider with a locally generated key, that answers the requests of the service provider
+type testIDP struct {
+	saml.IdentityProvider
+	sp *saml.EntityDescriptor
+}
+
+func (idp *testIDP) GetServiceProvider(_ *http.Request, _ string) (*saml.EntityDescriptor, error) {
+	return idp.sp, nil
+}
+
+func newTestIDP(t *testing.T) *testIDP {
+	key, cert := newTestCertificate(t, "idp.example.com")
+	idp := &testIDP{IdentityProvider: saml.IdentityProvider{
+		Key:         key,
+		Certificate: cert,
+		MetadataURL: url.URL{Scheme: "https", Host: "idp.example.com", Path: "/metadata"},
+		SSOURL:      url.URL{Scheme: "https", Host: "idp.example.com", Path: "/sso"},
+	}}
+	idp.ServiceProviderProvider = idp
+	return idp
+}
+
+func (idp *testIDP) metadata(t *testing.T) string {
+	b, err := xml.Marshal(idp.Metadata())
+	assert.NoError(t, err)
+	return string(b)
+}
+
+// respond authenticates the user for the request of the callback and returns the signed SAMLResponse
+func (idp *testIDP) respond(t *testing.T, s *SAML, cb callbacks.Callback, session *saml.Session) (response, relayState string) {
+	idp.sp = s.sp.Metadata()
+	r := httptest.NewRequest(http.MethodGet, cb.Value, nil)
+	if cb.Properties["method"] == http.MethodPost {
+		form := url.Values{"SAMLRequest": {cb.Properties["SAMLRequest"]}, "RelayState": {cb.Properties["RelayState"]}}
+		r = httptest.NewRequest(http.MethodPost, cb.Value, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	req, err := saml.NewIdpAuthnRequest(&idp.IdentityProvider, r)
+	assert.NoError(t, err)
+	assert.NoError(t, req.Validate())
+	assert.NoError(t, saml.DefaultAssertionMaker{}.MakeAssertion(req, session))
+	form, err := req.PostBinding()
+	assert.NoError(t, err)
+	return form.SAMLResponse, form.RelayState
+}
+
+func newTestCertificate(t *testing.T, cn string) (*rsa.PrivateKey, *x509.Certificate) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	return key, cert
+}
+
+func TestSAML(t *testing.T) {
+	config.SetConfig(&config.Config{})
+	idp := newTestIDP(t)
+	ctx := context.Background()
+
+	dir := t.TempDir()
+	key, cert := newTestCertificate(t, "gortas.example.com")
+	keyFile, certFile := filepath.Join(dir, "sp.key"), filepath.Join(dir, "sp.crt")
+	assert.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0600))
+	assert.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0600))
+	_, err := user.GetUserService().CreateUser(ctx, user.User{ID: samlTestPrefix + "carol"})
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name      string
+		nameID    string
+		provision bool
+		binding   string
+		encrypted bool
+		tamper    func(response string) string
+		status    state.ModuleStatus
+	}{
+		{name: "existing user", nameID: "carol", status: state.Pass},
+		{name: "local user with the same id", nameID: "user1", status: state.Fail},
+		{name: "provisioning", nameID: "alice", provision: true, status: state.Pass},
+		{name: "provisioning of the local user id", nameID: "user2", provision: true, status: state.Pass},
+		{name: "post binding", nameID: "carol", binding: samlBindingPost, status: state.Pass},
+		{name: "encrypted assertion", nameID: "carol", encrypted: true, status: state.Pass},
+		{name: "no provisioning", nameID: "bob", status: state.Fail},
+		{name: "tampered response", nameID: "user2", tamper: func(response string) string {
+			b, _ := base64.StdEncoding.DecodeString(response)
+			return base64.StdEncoding.EncodeToString([]byte(strings.ReplaceAll(string(b), ">user2<", ">user1<")))
+		}, status: state.Fail},
+		{name: "invalid encoding", nameID: "user2", tamper: func(response string) string {
+			return "<Response/>"
+		}, status: state.Fail},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mi := samlModuleInfo(idp.metadata(t))
+			mi.Properties["provision"] = tt.provision
+			if tt.binding != "" {
+				mi.Properties["binding"] = tt.binding
+			}
+			if tt.encrypted {
+				mi.Properties["keyFile"] = keyFile
+				mi.Properties["certFile"] = certFile
+			}
+			fs := &state.FlowState{ID: "flow-id"}
+			s := getSAMLModule(t, mi)
+			status, cbs, err := s.Process(ctx, fs)
+			assert.NoError(t, err)
+			assert.Equal(t, state.InProgress, status)
+			assert.Equal(t, callbacks.TypeRedirect, cbs[0].Type)
+
+			response, relayState := idp.respond(t, s, cbs[0], &saml.Session{NameID: tt.nameID,
+				UserEmail: tt.nameID + "@example.com", Groups: []string{"staff", "admins"}})
+			assert.Equal(t, fs.ID, relayState)
+			if tt.encrypted {
+				b, _ := base64.StdEncoding.DecodeString(response)
+				assert.Contains(t, string(b), "EncryptedAssertion")
+			}
+			if tt.tamper != nil {
+				response = tt.tamper(response)
+			}
+			status, _, err = getSAMLModule(t, mi).ProcessCallbacks(ctx, []callbacks.Callback{{Name: "saml", Value: response}}, fs)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.status, status)
+			if tt.status != state.Pass {
+				assert.Empty(t, fs.UserID)
+				return
+			}
+			assert.Equal(t, samlTestPrefix+tt.nameID, fs.UserID)
+			assert.Equal(t, `["staff","admins"]`, fs.SharedState["groups"])
+			u, ok := user.GetUserService().GetUser(ctx, samlTestPrefix+tt.nameID)
+			assert.True(t, ok)
+			assert.Equal(t, tt.nameID+"@example.com", u.Properties["email"])
+		})
+	}
+
+	// local users are never updated by the identity provider
+	u, ok := user.GetUserService().GetUser(ctx, "user2")
+	assert.True(t, ok)
+	assert.Empty(t, u.Properties["email"])
+}
+
+func TestSAML_Replay(t *testing.T) {
+	config.SetConfig(&config.Config{})
+	idp := newTestIDP(t)
+	ctx := context.Background()
+	mi := samlModuleInfo(idp.metadata(t))
+	mi.Properties["provision"] = true
+	session := &saml.Session{NameID: "alice"}
+
+	s := getSAMLModule(t, mi)
+	_, cbs, err := s.Process(ctx, &state.FlowState{})
+	assert.NoError(t, err)
+	requestID := mi.State["requestID"]
+	response, _ := idp.respond(t, s, cbs[0], session)
+
+	// the response to another request is rejected
+	other := samlModuleInfo(idp.metadata(t))
+	_, _, err = getSAMLModule(t, other).Process(ctx, &state.FlowState{})
+	assert.NoError(t, err)
+	status, _, err := getSAMLModule(t, other).ProcessCallbacks(ctx, []callbacks.Callback{{Name: "saml", Value: response}}, &state.FlowState{})
+	assert.NoError(t, err)
+	assert.Equal(t, state.Fail, status)
+
+	status, _, err = getSAMLModule(t, mi).ProcessCallbacks(ctx, []callbacks.Callback{{Name: "saml", Value: response}}, &state.FlowState{})
+	assert.NoError(t, err)
+	assert.Equal(t, state.Pass, status)
+	assert.Empty(t, mi.State)
+
+	// the request state is cleared, so a new request is started
+	status, cbs, err = getSAMLModule(t, mi).ProcessCallbacks(ctx, []callbacks.Callback{{Name: "saml", Value: response}}, &state.FlowState{})
+	assert.NoError(t, err)
+	assert.Equal(t, state.InProgress, status)
+	assert.Equal(t, callbacks.TypeRedirect, cbs[0].Type)
+
+	// the accepted assertion could not be used again even for the same request
+	mi.State["requestID"] = requestID
+	mi.State["issuedAt"] = time.Now().UnixMilli()
+	status, _, err = getSAMLModule(t, mi).ProcessCallbacks(ctx, []callbacks.Callback{{Name: "saml", Value: response}}, &state.FlowState{})
+	assert.NoError(t, err)
+	assert.Equal(t, state.Fail, status)
+}
+
+func TestSAML_Metadata(t *testing.T) {
+	idp := newTestIDP(t)
+	b, err := getSAMLModule(t, samlModuleInfo(idp.metadata(t))).Metadata()
+	assert.NoError(t, err)
+	var ed saml.EntityDescriptor
+	assert.NoError(t, xml.Unmarshal(b, &ed))
+	assert.Equal(t, "https://gortas.example.com/saml", ed.EntityID)
+	assert.Equal(t, 1, len(ed.SPSSODescriptors))
+	acs := ed.SPSSODescriptors[0].AssertionConsumerServices
+	assert.NotEmpty(t, acs)
+	assert.Equal(t, "https://gortas.example.com/acs", acs[0].Location)
+	assert.Equal(t, saml.HTTPPostBinding, acs[0].Binding)
+}
+
+func TestSAML_ProviderCache(t *testing.T) {
+	config.SetConfig(&config.Config{})
+	file := filepath.Join(t.TempDir(), "idp.xml")
+	assert.NoError(t, os.WriteFile(file, []byte(newTestIDP(t).metadata(t)), 0600))
+	mi := samlModuleInfo("")
+	mi.Properties["idpMetadataFile"] = file
+
+	// the metadata file is read once for the modules with the same settings
+	sp := getSAMLModule(t, mi).sp
+	assert.Same(t, sp, getSAMLModule(t, mi).sp)
+	other := samlModuleInfo("")
+	other.Properties["idpMetadataFile"] = file
+	other.Properties["acsUrl"] = "https://gortas.example.com/acs2"
+	assert.NotSame(t, sp, getSAMLModule(t, other).sp)
+
+	// the changed file is read again, when the configuration is reloaded
+	idp := newTestIDP(t)
+	idp.MetadataURL.Host = "idp2.example.com"
+	assert.NoError(t, os.WriteFile(file, []byte(idp.metadata(t)), 0600))
+	assert.Same(t, sp, getSAMLModule(t, mi).sp)
+	ResetFileCaches()
+	s := getSAMLModule(t, mi)
+	assert.NotSame(t, sp, s.sp)
+	assert.Equal(t, "https://idp2.example.com/metadata", s.sp.IDPMetadata.EntityID)
+	assert.Equal(t, "saml:idp2.example.com:", s.UserIDPrefix)
+}
+
+func TestSAML_Properties(t *testing.T) {
+	idp := newTestIDP(t)
+	tests := []struct {
+		name  string
+		props map[string]interface{}
+		err   string
+	}{
+		{name: "no metadata", props: map[string]interface{}{"idpMetadata": ""}, err: "identity provider metadata required"},
+		{name: "invalid metadata", props: map[string]interface{}{"idpMetadata": "<EntityDescriptor/>"}, err: "invalid identity provider metadata"},
+		{name: "unknown binding", props: map[string]interface{}{"binding": "artifact"}, err: "unknown binding artifact"},
+		{name: "key without certificate", props: map[string]interface{}{"keyFile": "sp.key"}, err: "key and certificate should be set together"},
+		{name: "reserved attribute mapping", props: map[string]interface{}{"attributes": map[string]interface{}{"verified": user.EmailVerifiedProperty}},
+			err: "properties.attributes.verified: user property emailVerified could not be mapped"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mi := samlModuleInfo(idp.metadata(t))
+			for k, v := range tt.props {
+				mi.Properties[k] = v
+			}
+			_, err := GetAuthModule(mi, nil, nil)
+			assert.Error(t, err)
+			assert.Contains(t, err.Error(), tt.err)
+		})
+	}
+}
+
+// samlTestPrefix is the prefix of the users, authenticated by the test identity provider
+const samlTestPrefix = "saml:idp.example.com:"
+
+func samlModuleInfo(idpMetadata string) state.FlowStateModuleInfo {
+	return state.FlowStateModuleInfo{ID: "saml", Type: SAMLModuleType,
+		Properties: map[string]interface{}{
+			"entityId":    "https://gortas.example.com/saml",
+			"acsUrl":      "https://gortas.example.com/acs",
+			"idpMetadata": idpMetadata,
+			"attributes":  map[string]interface{}{"eduPersonPrincipalName": "email"},
+			"sharedState": map[string]interface{}{"eduPersonAffiliation": "groups"},
+		},
+		State: map[string]interface{}{}}
+}
+
+func getSAMLModule(t *testing.T, mi state.FlowStateModuleInfo) *SAML {
+	t.Helper()
+	m, err := GetAuthModule(mi, nil, nil)
+	assert.NoError(t, err)
+	return m.(*SAML)
+}
@@ -0,0 +1,117 @@
+package modules
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+)
+
+// PropertyType is the type of a module property value
+type PropertyType int
+
+const (
+	PropertyString PropertyType = iota
+	PropertyBool
+	PropertyInt
+	PropertyList
+	PropertyObject
+)
+
+func (t PropertyType) String() string {
+	switch t {
+	case PropertyString:
+		return "string"
+	case PropertyBool:
+		return "bool"
+	case PropertyInt:
+		return "int"
+	case PropertyList:
+		return "list"
+	case PropertyObject:
+		return "object"
+	}
+	return "unknown"
+}
+
+// Property declares a module property, property names are case insensitive, as viper lowercases the config keys
+type Property struct {
+	Name     string
+	Type     PropertyType
+	Required bool
+	Default  interface{} // set, if the property is missing
+}
+
+// Schema declares properties of a module type, properties, that are not declared, are passed to the module as is
+type Schema []Property
+
+// Apply validates the properties and returns a copy of them with defaults for the missing properties,
+// numbers are converted to int for the int properties, because numbers are decoded as float64 from the flow state
+func (s Schema) Apply(props map[string]interface{}) (map[string]interface{}, error) {
+	res := make(map[string]interface{}, len(props)+len(s))
+	for k, v := range props {
+		res[k] = v
+	}
+	var errs []error
+	for _, p := range s {
+		key, ok := findProperty(res, p.Name)
+		if !ok || res[key] == nil {
+			if p.Required {
+				errs = append(errs, fmt.Errorf("properties.%v: is required", p.Name))
+			} else if p.Default != nil {
+				res[p.Name] = p.Default
+			}
+			continue
+		}
+		v, err := p.convert(res[key])
+		if err != nil {
+			errs = append(errs, fmt.Errorf("properties.%v: %w", p.Name, err))
+			continue
+		}
+		res[key] = v
+	}
+	return res, errors.Join(errs...)
+}
+
+// convert checks the property value type
+func (p Property) convert(v interface{}) (interface{}, error) {
+	rv := reflect.ValueOf(v)
+	ok := false
+	switch p.Type {
+	case PropertyString:
+		ok = rv.Kind() == reflect.String
+	case PropertyBool:
+		ok = rv.Kind() == reflect.Bool
+	case PropertyInt:
+		switch {
+		case rv.CanInt():
+			return int(rv.Int()), nil
+		case rv.CanUint():
+			return int(rv.Uint()), nil
+		case rv.CanFloat() && rv.Float() == math.Trunc(rv.Float()):
+			return int(rv.Float()), nil
+		}
+	case PropertyList:
+		ok = rv.Kind() == reflect.Slice || rv.Kind() == reflect.Array
+	case PropertyObject:
+		ok = rv.Kind() == reflect.Map || rv.Kind() == reflect.Struct
+	}
+	if !ok {
+		return v, fmt.Errorf("should be %v, got %v", p.Type, rv.Kind())
+	}
+	return v, nil
+}
+
+// findProperty returns the key of the property with the case insensitive name
+func findProperty(props map[string]interface{}, name string) (string, bool) {
+	if _, ok := props[name]; ok {
+		return name, true
+	}
+	for k := range props {
+		if strings.EqualFold(k, name) {
+			return k, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,84 @@
+package modules
+
+import (
+	"testing"
+
+	"github.com/maximthomas/gortas/pkg/auth/state"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSchema_Apply(t *testing.T) {
+	schema := Schema{
+		{Name: "uri", Type: PropertyString, Required: true},
+		{Name: "skipTLS", Type: PropertyBool, Default: false},
+		{Name: "timeout", Type: PropertyInt, Default: 30},
+		{Name: "fields", Type: PropertyList},
+		{Name: "sender", Type: PropertyObject},
+	}
+	tests := []struct {
+		name  string
+		props map[string]interface{}
+		want  map[string]interface{}
+		err   []string
+	}{
+		{
+			name:  "defaults",
+			props: map[string]interface{}{"uri": "http://localhost"},
+			want:  map[string]interface{}{"uri": "http://localhost", "skipTLS": false, "timeout": 30},
+		},
+		{
+			name: "case insensitive names",
+			props: map[string]interface{}{"uri": "http://localhost", "skiptls": true, "timeout": float64(10),
+				"fields": []interface{}{"a"}, "sender": map[string]interface{}{}, "other": "value"},
+			want: map[string]interface{}{"uri": "http://localhost", "skiptls": true, "timeout": 10,
+				"fields": []interface{}{"a"}, "sender": map[string]interface{}{}, "other": "value"},
+		},
+		{
+			name:  "invalid",
+			props: map[string]interface{}{"skipTLS": "yes", "timeout": 1.5, "fields": "a", "sender": "sms"},
+			err: []string{
+				"properties.uri: is required",
+				"properties.skipTLS: should be bool, got string",
+				"properties.timeout: should be int, got float64",
+				"properties.fields: should be list, got string",
+				"properties.sender: should be object, got string",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := schema.Apply(tt.props)
+			if len(tt.err) > 0 {
+				assert.Error(t, err)
+				for _, e := range tt.err {
+					assert.Contains(t, err.Error(), e)
+				}
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestGetAuthModule_InvalidProperties(t *testing.T) {
+	mi := state.FlowStateModuleInfo{
+		ID:         "hydra",
+		Type:       "hydra",
+		Properties: map[string]interface{}{},
+	}
+	_, err := GetAuthModule(mi, nil, nil)
+	assert.EqualError(t, err, "module hydra: properties.uri: is required")
+
+	_, err = GetAuthModule(state.FlowStateModuleInfo{ID: "unknown", Type: "unknown"}, nil, nil)
+	assert.Error(t, err)
+}
+
+func TestGetSchema(t *testing.T) {
+	s, ok := GetSchema("qr")
+	assert.True(t, ok)
+	assert.Equal(t, Schema{{Name: "qrTimeout", Type: PropertyInt, Default: 30}}, s)
+
+	_, ok = GetSchema("unknown")
+	assert.False(t, ok)
+}
@@ -0,0 +1,375 @@
+package modules
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/maximthomas/gortas/pkg/auth/callbacks"
+	"github.com/maximthomas/gortas/pkg/auth/state"
+	"github.com/maximthomas/gortas/pkg/crypt"
+	"github.com/maximthomas/gortas/pkg/user"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+	"github.com/skip2/go-qrcode"
+)
+
+const (
+	// TOTPModuleType module checks time-based one-time passwords of authenticator apps (RFC 6238)
+	TOTPModuleType = "totp"
+	// HOTPModuleType module checks counter-based one-time passwords (RFC 4226)
+	HOTPModuleType = "hotp"
+)
+
+const (
+	totpStateSecret  = "secret" // encrypted secret, generated for the enrollment
+	totpStateRetries = "retries"
+)
+
+// totpNow returns the current time, replaced in tests
+var totpNow = time.Now
+
+var totpSecretEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// totpAlgorithms hash functions and secret lengths, recommended by RFC 6238
+var totpAlgorithms = map[string]struct {
+	hash      func() hash.Hash
+	secretLen int
+}{
+	"SHA1":   {sha1.New, 20},
+	"SHA256": {sha256.New, 32},
+	"SHA512": {sha512.New, 64},
+}
+
+// TOTP checks one-time passwords generated by an authenticator app for the user identified by the previous modules.
+// If the user has no secret yet and the enrollment is enabled, the module enrolls the user authenticated by the previous modules:
+// shows the otpauth:// QR code
+// and stores the encrypted secret in the user properties after the first code is confirmed
+type TOTP struct {
+	BaseAuthModule
+	Digits          int
+	Period          int    // time step in seconds, totp only
+	Skew            int    // number of time steps before and after the current one or number of counters ahead for hotp
+	Algorithm       string // SHA1, SHA256 or SHA512
+	Issuer          string
+	Enroll          bool // enroll users without a secret, authenticated by the previous modules, otherwise such users fail
+	RetryCount      int
+	SecretProperty  string // user property with the encrypted secret
+	CounterProperty string // user property with the next accepted counter, prevents codes reuse
+	counterBased    bool
+	hash            func() hash.Hash
+}
+
+func (t *TOTP) Process(ctx context.Context, fs *state.FlowState) (ms state.ModuleStatus, cbs []callbacks.Callback, err error) {
+	u, ok, err := t.getUser(ctx, fs)
+	if err != nil || !ok {
+		return state.Fail, nil, err
+	}
+	if u.Properties[t.SecretProperty] != "" {
+		return state.InProgress, t.Callbacks, nil
+	}
+	if !t.Enroll {
+		t.l.Warnf("user %v has no %v secret", u.ID, t.moduleType())
+		return state.Fail, nil, nil
+	}
+	// the user, that was only identified, for example by the username, could be anyone, so the secret is not enrolled
+	if !UserAuthenticated(fs) {
+		t.l.Warnf("user %v without %v secret is not authenticated to enroll", u.ID, t.moduleType())
+		return state.Fail, nil, nil
+	}
+
+	key := make([]byte, totpAlgorithms[t.Algorithm].secretLen)
+	_, err = rand.Read(key)
+	if err != nil {
+		return state.Fail, nil, errors.Wrap(err, "error generating secret")
+	}
+	encrypted, err := crypt.EncryptWithConfig(totpSecretEncoding.EncodeToString(key))
+	if err != nil {
+		return state.Fail, nil, errors.Wrap(err, "error encrypting secret")
+	}
+	t.State[totpStateSecret] = encrypted
+	cbs, err = t.enrollmentCallbacks(u.ID)
+	if err != nil {
+		return state.Fail, nil, err
+	}
+	return state.InProgress, cbs, nil
+}
+
+func (t *TOTP) ProcessCallbacks(ctx context.Context, inCbs []callbacks.Callback, fs *state.FlowState) (ms state.ModuleStatus, cbs []callbacks.Callback, err error) {
+	u, ok, err := t.getUser(ctx, fs)
+	if err != nil || !ok {
+		return state.Fail, nil, err
+	}
+	var code string
+	for _, cb := range inCbs {
+		if cb.Name == "otp" {
+			code = strings.TrimSpace(cb.Value)
+		}
+	}
+
+	enrolling := false
+	encrypted, _ := t.State[totpStateSecret].(string)
+	var next uint64
+	if encrypted != "" {
+		enrolling = true
+	} else {
+		encrypted = u.Properties[t.SecretProperty]
+		if c := u.Properties[t.CounterProperty]; c != "" {
+			next, err = strconv.ParseUint(c, 10, 64)
+			if err != nil {
+				return state.Fail, nil, errors.Wrapf(err, "invalid %v of user %v", t.CounterProperty, u.ID)
+			}
+		}
+	}
+	secret, err := t.decryptSecret(encrypted)
+	if err != nil {
+		return state.Fail, nil, err
+	}
+
+	counter, valid := t.checkCode(secret, code, next)
+	if !valid {
+		return t.retry(u.ID, enrolling)
+	}
+	u.SetProperty(t.SecretProperty, encrypted)
+	u.SetProperty(t.CounterProperty, strconv.FormatUint(counter+1, 10))
+	err = user.GetUserService().UpdateUser(ctx, u)
+	if err != nil {
+		return state.Fail, nil, errors.Wrap(err, "error updating user")
+	}
+	delete(t.State, totpStateSecret)
+	delete(t.State, totpStateRetries)
+	return state.Pass, nil, nil
+}
+
+// retry returns the callbacks with an error, until the retry count is exceeded
+func (t *TOTP) retry(userID string, enrolling bool) (ms state.ModuleStatus, cbs []callbacks.Callback, err error) {
+	var retries int
+	_ = mapstructure.Decode(t.State[totpStateRetries], &retries)
+	retries++
+	t.State[totpStateRetries] = retries
+	if retries >= t.RetryCount {
+		return state.Fail, nil, nil
+	}
+	if enrolling {
+		cbs, err = t.enrollmentCallbacks(userID)
+		if err != nil {
+			return state.Fail, nil, err
+		}
+	} else {
+		cbs = make([]callbacks.Callback, len(t.Callbacks))
+		copy(cbs, t.Callbacks)
+	}
+	(&cbs[len(cbs)-1]).Error = "Invalid code"
+	return state.InProgress, cbs, nil
+}
+
+// checkCode returns the counter of the valid code, counters before next are not accepted, as their codes were used
+func (t *TOTP) checkCode(secret []byte, code string, next uint64) (uint64, bool) {
+	if len(code) != t.Digits {
+		return 0, false
+	}
+	from, to := next, next+uint64(t.Skew)
+	if !t.counterBased {
+		step := uint64(totpNow().Unix()) / uint64(t.Period)
+		to = step + uint64(t.Skew)
+		if step > uint64(t.Skew) && step-uint64(t.Skew) > from {
+			from = step - uint64(t.Skew)
+		}
+	}
+	for c := from; c <= to; c++ {
+		if subtle.ConstantTimeCompare([]byte(hotpCode(t.hash, secret, c, t.Digits)), []byte(code)) == 1 {
+			return c, true
+		}
+	}
+	return 0, false
+}
+
+// hotpCode generates the code for the counter (RFC 4226), totp uses the time step as the counter
+func hotpCode(h func() hash.Hash, secret []byte, counter uint64, digits int) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, counter)
+	mac := hmac.New(h, secret)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, value%mod)
+}
+
+func (t *TOTP) getUser(ctx context.Context, fs *state.FlowState) (u user.User, ok bool, err error) {
+	if fs.UserID == "" {
+		return u, false, errors.Errorf("%v module requires the user, identified by the previous modules", t.moduleType())
+	}
+	u, ok = user.GetUserService().GetUser(ctx, fs.UserID)
+	if !ok {
+		t.l.Warnf("user %v not found", fs.UserID)
+	}
+	return u, ok, nil
+}
+
+func (t *TOTP) decryptSecret(encrypted string) ([]byte, error) {
+	decrypted, err := crypt.DecryptWithConfig(encrypted)
+	if err != nil {
+		return nil, errors.Wrap(err, "error decrypting secret")
+	}
+	secret, err := totpSecretEncoding.DecodeString(decrypted)
+	if err != nil {
+		return nil, errors.Wrap(err, "error decoding secret")
+	}
+	return secret, nil
+}
+
+// enrollmentCallbacks returns the QR code of the otpauth:// uri with the secret, generated for the enrollment,
+// and the code callback to confirm the enrollment
+func (t *TOTP) enrollmentCallbacks(userID string) ([]callbacks.Callback, error) {
+	encrypted, _ := t.State[totpStateSecret].(string)
+	secret, err := t.decryptSecret(encrypted)
+	if err != nil {
+		return nil, err
+	}
+	uri := t.keyURI(userID, totpSecretEncoding.EncodeToString(secret))
+	png, err := qrcode.Encode(uri, qrcode.Medium, qrCodeSize)
+	if err != nil {
+		return nil, errors.Wrap(err, "error generating qr code")
+	}
+	qrCb := totpQRCallback()
+	qrCb.Properties = map[string]string{
+		"image":  "data:image/png;base64," + base64.StdEncoding.EncodeToString(png),
+		"secret": totpSecretEncoding.EncodeToString(secret),
+		"uri":    uri,
+	}
+	return []callbacks.Callback{qrCb, totpCodeCallback(t.Digits)}, nil
+}
+
+func totpQRCallback() callbacks.Callback {
+	return callbacks.Callback{
+		Name:   "qr",
+		Type:   callbacks.TypeImage,
+		Prompt: "Scan the QR code with the authenticator app",
+	}
+}
+
+func totpCodeCallback(digits int) callbacks.Callback {
+	return callbacks.Callback{
+		Name:       "otp",
+		Type:       callbacks.TypeText,
+		Prompt:     "Verification code",
+		Required:   true,
+		Validation: fmt.Sprintf("^\\d{%v}$", digits),
+	}
+}
+
+// keyURI returns the otpauth:// uri, that is read by authenticator apps
+func (t *TOTP) keyURI(userID, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", t.Issuer)
+	v.Set("algorithm", t.Algorithm)
+	v.Set("digits", strconv.Itoa(t.Digits))
+	if t.counterBased {
+		v.Set("counter", "0")
+	} else {
+		v.Set("period", strconv.Itoa(t.Period))
+	}
+	u := url.URL{
+		Scheme:   "otpauth",
+		Host:     t.moduleType(),
+		Path:     "/" + t.Issuer + ":" + userID,
+		RawQuery: v.Encode(),
+	}
+	return u.String()
+}
+
+func (t *TOTP) moduleType() string {
+	if t.counterBased {
+		return HOTPModuleType
+	}
+	return TOTPModuleType
+}
+
+func (t *TOTP) ValidateCallbacks(cbs []callbacks.Callback) error {
+	return t.BaseAuthModule.ValidateCallbacks(cbs)
+}
+
+func (t *TOTP) PostProcess(_ context.Context, _ *state.FlowState) error {
+	return nil
+}
+
+func init() {
+	RegisterModule(TOTPModuleType, newTOTP, totpSchema(TOTPModuleType, 1)...)
+	RegisterModule(HOTPModuleType, newHOTP, totpSchema(HOTPModuleType, 10)...)
+	user.RegisterPrivateProperty(TOTPModuleType + "Secret")
+	user.RegisterPrivateProperty(HOTPModuleType + "Secret")
+}
+
+func totpSchema(mt string, skew int) Schema {
+	return Schema{
+		{Name: "digits", Type: PropertyInt, Default: 6},
+		{Name: "period", Type: PropertyInt, Default: 30},
+		{Name: "skew", Type: PropertyInt, Default: skew},
+		{Name: "algorithm", Type: PropertyString, Default: "SHA1"},
+		{Name: "issuer", Type: PropertyString, Default: "Gortas"},
+		{Name: "enroll", Type: PropertyBool, Default: false},
+		{Name: "retryCount", Type: PropertyInt, Default: 5},
+		{Name: "secretProperty", Type: PropertyString, Default: mt + "Secret"},
+		{Name: "counterProperty", Type: PropertyString, Default: mt + "Counter"},
+	}
+}
+
+func newTOTP(base BaseAuthModule) (AuthModule, error) {
+	return newOneTimePasswordModule(base, false)
+}
+
+func newHOTP(base BaseAuthModule) (AuthModule, error) {
+	return newOneTimePasswordModule(base, true)
+}
+
+func newOneTimePasswordModule(base BaseAuthModule, counterBased bool) (AuthModule, error) {
+	t := TOTP{counterBased: counterBased}
+	err := mapstructure.Decode(base.Properties, &t)
+	if err != nil {
+		return nil, errors.Wrap(err, "error decoding properties")
+	}
+	t.Algorithm = strings.ToUpper(t.Algorithm)
+	alg, ok := totpAlgorithms[t.Algorithm]
+	switch {
+	case !ok:
+		return nil, errors.Errorf("properties.algorithm: unknown algorithm %v", t.Algorithm)
+	case t.Digits < 6 || t.Digits > 8:
+		return nil, errors.New("properties.digits: should be from 6 to 8")
+	case t.Period <= 0:
+		return nil, errors.New("properties.period: should be positive")
+	case t.Skew < 0:
+		return nil, errors.New("properties.skew: should not be negative")
+	case t.RetryCount <= 0:
+		return nil, errors.New("properties.retryCount: should be positive")
+	}
+	t.hash = alg.hash
+	// modules are created, when the configuration is validated, so the configured property is registered before sessions are created
+	user.RegisterPrivateProperty(t.SecretProperty)
+
+	// callbacks of the enrollment in progress include the qr code
+	(&base).Callbacks = []callbacks.Callback{totpCodeCallback(t.Digits)}
+	if _, ok := base.State[totpStateSecret]; ok {
+		(&base).Callbacks = []callbacks.Callback{totpQRCallback(), totpCodeCallback(t.Digits)}
+	}
+	t.BaseAuthModule = base
+	return &t, nil
+}
@@ -0,0 +1,204 @@
+package modules
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maximthomas/gortas/pkg/auth/callbacks"
+	"github.com/maximthomas/gortas/pkg/auth/state"
+	"github.com/maximthomas/gortas/pkg/config"
+	"github.com/maximthomas/gortas/pkg/crypt"
+	"github.com/maximthomas/gortas/pkg/user"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHOTPCode(t *testing.T) {
+	// RFC 4226 appendix D
+	secret := []byte("12345678901234567890")
+	for i, code := range []string{"755224", "287082", "359152", "969429", "338314"} {
+		assert.Equal(t, code, hotpCode(sha1.New, secret, uint64(i), 6))
+	}
+
+	// RFC 6238 appendix B
+	tests := []struct {
+		time   int64
+		sha1   string
+		sha256 string
+		sha512 string
+	}{
+		{time: 59, sha1: "94287082", sha256: "46119246", sha512: "90693936"},
+		{time: 1111111109, sha1: "07081804", sha256: "68084774", sha512: "25091201"},
+		{time: 20000000000, sha1: "65353130", sha256: "77737706", sha512: "47863826"},
+	}
+	seed := "1234567890"
+	for _, tt := range tests {
+		step := uint64(tt.time / 30)
+		assert.Equal(t, tt.sha1, hotpCode(sha1.New, []byte(strings.Repeat(seed, 2)), step, 8))
+		assert.Equal(t, tt.sha256, hotpCode(sha256.New, []byte(strings.Repeat(seed, 3)+"12"), step, 8))
+		assert.Equal(t, tt.sha512, hotpCode(sha512.New, []byte(strings.Repeat(seed, 6)+"1234"), step, 8))
+	}
+}
+
+func TestNewTOTP_InvalidProperties(t *testing.T) {
+	tests := []struct {
+		props map[string]interface{}
+		err   string
+	}{
+		{props: map[string]interface{}{"algorithm": "MD5"}, err: "properties.algorithm: unknown algorithm MD5"},
+		{props: map[string]interface{}{"digits": 4}, err: "properties.digits: should be from 6 to 8"},
+		{props: map[string]interface{}{"period": 0}, err: "properties.period: should be positive"},
+		{props: map[string]interface{}{"skew": -1}, err: "properties.skew: should not be negative"},
+	}
+	for _, tt := range tests {
+		_, err := GetAuthModule(state.FlowStateModuleInfo{ID: "totp", Type: TOTPModuleType, Properties: tt.props}, nil, nil)
+		assert.EqualError(t, err, "module totp: "+tt.err)
+	}
+}
+
+func TestTOTP_Enrollment(t *testing.T) {
+	setTOTPConfig(t)
+	now := time.Unix(1700000000, 0)
+	totpNow = func() time.Time { return now }
+	defer func() { totpNow = time.Now }()
+
+	fs := &state.FlowState{UserID: "user1", Modules: []state.FlowStateModuleInfo{{ID: "login", Type: "login", Status: state.Pass}}}
+	mi := state.FlowStateModuleInfo{ID: "totp", Type: TOTPModuleType,
+		Properties: map[string]interface{}{"issuer": "Example Corp", "enroll": true}, State: map[string]interface{}{}}
+	m := getTOTPModule(t, mi)
+
+	// the user without a secret gets the enrollment qr code
+	status, cbs, err := m.Process(context.Background(), fs)
+	assert.NoError(t, err)
+	assert.Equal(t, state.InProgress, status)
+	assert.Equal(t, 2, len(cbs))
+	assert.Equal(t, callbacks.TypeImage, cbs[0].Type)
+	assert.True(t, strings.HasPrefix(cbs[0].Properties["image"], "data:image/png;base64,"))
+	uri, err := url.Parse(cbs[0].Properties["uri"])
+	assert.NoError(t, err)
+	assert.Equal(t, "otpauth", uri.Scheme)
+	assert.Equal(t, "totp", uri.Host)
+	assert.Equal(t, "/Example Corp:user1", uri.Path)
+	assert.Equal(t, "Example Corp", uri.Query().Get("issuer"))
+	assert.Equal(t, "SHA1", uri.Query().Get("algorithm"))
+	assert.Equal(t, "6", uri.Query().Get("digits"))
+	assert.Equal(t, "30", uri.Query().Get("period"))
+	secretStr := uri.Query().Get("secret")
+	assert.Equal(t, secretStr, cbs[0].Properties["secret"])
+	secret, err := totpSecretEncoding.DecodeString(secretStr)
+	assert.NoError(t, err)
+	assert.Equal(t, 20, len(secret))
+
+	// an invalid code does not complete the enrollment
+	m = getTOTPModule(t, mi)
+	status, cbs, err = m.ProcessCallbacks(context.Background(), []callbacks.Callback{{Name: "qr"}, {Name: "otp", Value: "000000"}}, fs)
+	assert.NoError(t, err)
+	assert.Equal(t, state.InProgress, status)
+	assert.Equal(t, "Invalid code", cbs[1].Error)
+	assert.Equal(t, secretStr, cbs[0].Properties["secret"])
+
+	// the confirmed secret is stored encrypted in the user properties
+	step := uint64(now.Unix() / 30)
+	status, _, err = m.ProcessCallbacks(context.Background(),
+		[]callbacks.Callback{{Name: "qr"}, {Name: "otp", Value: hotpCode(sha1.New, secret, step, 6)}}, fs)
+	assert.NoError(t, err)
+	assert.Equal(t, state.Pass, status)
+	assert.Empty(t, mi.State)
+	u, _ := user.GetUserService().GetUser(context.Background(), "user1")
+	assert.NotContains(t, u.Properties["totpSecret"], secretStr)
+	decrypted, err := crypt.DecryptWithConfig(u.Properties["totpSecret"])
+	assert.NoError(t, err)
+	assert.Equal(t, secretStr, decrypted)
+	assert.True(t, user.GetUserService().IsPrivateProperty("totpSecret"))
+
+	// the enrolled user is asked for the code
+	m = getTOTPModule(t, mi)
+	status, cbs, err = m.Process(context.Background(), fs)
+	assert.NoError(t, err)
+	assert.Equal(t, state.InProgress, status)
+	assert.Equal(t, 1, len(cbs))
+	assert.Equal(t, "otp", cbs[0].Name)
+
+	// the used code is not accepted again, the code of the next time step is accepted within the skew
+	status, _, err = m.ProcessCallbacks(context.Background(), []callbacks.Callback{{Name: "otp", Value: hotpCode(sha1.New, secret, step, 6)}}, fs)
+	assert.NoError(t, err)
+	assert.Equal(t, state.InProgress, status)
+	status, _, err = m.ProcessCallbacks(context.Background(), []callbacks.Callback{{Name: "otp", Value: hotpCode(sha1.New, secret, step+1, 6)}}, fs)
+	assert.NoError(t, err)
+	assert.Equal(t, state.Pass, status)
+	status, _, err = m.ProcessCallbacks(context.Background(), []callbacks.Callback{{Name: "otp", Value: hotpCode(sha1.New, secret, step+3, 6)}}, fs)
+	assert.NoError(t, err)
+	assert.Equal(t, state.InProgress, status)
+}
+
+func TestHOTP(t *testing.T) {
+	setTOTPConfig(t)
+	secret := []byte("12345678901234567890")
+	encrypted, err := crypt.EncryptWithConfig(totpSecretEncoding.EncodeToString(secret))
+	assert.NoError(t, err)
+	u, _ := user.GetUserService().GetUser(context.Background(), "user2")
+	u.SetProperty("hotpSecret", encrypted)
+	assert.NoError(t, user.GetUserService().UpdateUser(context.Background(), u))
+
+	fs := &state.FlowState{UserID: "user2"}
+	mi := state.FlowStateModuleInfo{ID: "hotp", Type: HOTPModuleType,
+		Properties: map[string]interface{}{"skew": 2, "retryCount": 2}, State: map[string]interface{}{}}
+	m := getTOTPModule(t, mi)
+
+	status, _, err := m.ProcessCallbacks(context.Background(), []callbacks.Callback{{Name: "otp", Value: "359152"}}, fs)
+	assert.NoError(t, err)
+	assert.Equal(t, state.Pass, status)
+	u, _ = user.GetUserService().GetUser(context.Background(), "user2")
+	assert.Equal(t, "3", u.Properties["hotpCounter"])
+
+	// codes before the counter and after the look-ahead window are rejected, then the module fails
+	status, _, err = m.ProcessCallbacks(context.Background(), []callbacks.Callback{{Name: "otp", Value: "287082"}}, fs)
+	assert.NoError(t, err)
+	assert.Equal(t, state.InProgress, status)
+	status, _, err = m.ProcessCallbacks(context.Background(), []callbacks.Callback{{Name: "otp", Value: hotpCode(sha1.New, secret, 6, 6)}}, fs)
+	assert.NoError(t, err)
+	assert.Equal(t, state.Fail, status)
+}
+
+func TestTOTP_NotEnrolled(t *testing.T) {
+	setTOTPConfig(t)
+	mi := state.FlowStateModuleInfo{ID: "totp", Type: TOTPModuleType, State: map[string]interface{}{}}
+	m := getTOTPModule(t, mi)
+
+	status, _, err := m.Process(context.Background(), &state.FlowState{UserID: "staff1"})
+	assert.NoError(t, err)
+	assert.Equal(t, state.Fail, status)
+
+	// the user only identified by the username is not enrolled
+	mi.Properties = map[string]interface{}{"enroll": true}
+	m = getTOTPModule(t, mi)
+	fs := &state.FlowState{UserID: "user1", Modules: []state.FlowStateModuleInfo{
+		{ID: "username", Type: CredentialsModuleType, Status: state.Pass},
+		{ID: "totp", Type: TOTPModuleType, Status: state.InProgress},
+	}}
+	status, cbs, err := m.Process(context.Background(), fs)
+	assert.NoError(t, err)
+	assert.Equal(t, state.Fail, status)
+	assert.Empty(t, cbs)
+	assert.Empty(t, mi.State)
+
+	_, _, err = m.Process(context.Background(), &state.FlowState{})
+	assert.EqualError(t, err, "totp module requires the user, identified by the previous modules")
+}
+
+func setTOTPConfig(t *testing.T) {
+	t.Helper()
+	config.SetConfig(&config.Config{EncryptionKey: "Gb8l9wSZzEjeL2FTRG0k6bBnw7AZ/rBCcZfDDGLVreY="})
+}
+
+func getTOTPModule(t *testing.T, mi state.FlowStateModuleInfo) *TOTP {
+	t.Helper()
+	m, err := GetAuthModule(mi, nil, nil)
+	assert.NoError(t, err)
+	return m.(*TOTP)
+}
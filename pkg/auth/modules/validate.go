@@ -0,0 +1,54 @@
+package modules
+
+import (
+	"regexp"
+	"time"
+
+	"github.com/maximthomas/gortas/pkg/auth/callbacks"
+	"github.com/maximthomas/gortas/pkg/auth/state"
+	"github.com/pkg/errors"
+)
+
+// callbacksDefinition is implemented by all modules, embedding BaseAuthModule
+type callbacksDefinition interface {
+	definedCallbacks() []callbacks.Callback
+}
+
+func (b BaseAuthModule) definedCallbacks() []callbacks.Callback {
+	return b.Callbacks
+}
+
+// flowLifetimeLimited is implemented by modules, that keep sent codes and links in the flow state,
+// the codes and links are valid only while the flow exists
+type flowLifetimeLimited interface {
+	// requiredFlowLifetime returns the property with the validity period and the period
+	requiredFlowLifetime() (property string, d time.Duration)
+}
+
+// ValidateModule creates the module from the module settings and checks validation expressions of its callbacks,
+// and that codes and links, sent by the module, do not outlive the flow
+func ValidateModule(mi state.FlowStateModuleInfo, flowLifetime time.Duration) error {
+	if mi.State == nil {
+		mi.State = make(map[string]interface{})
+	}
+	instance, err := GetAuthModule(mi, nil, nil)
+	if err != nil {
+		return err
+	}
+	if cd, ok := instance.(callbacksDefinition); ok {
+		for _, cb := range cd.definedCallbacks() {
+			if cb.Validation == "" {
+				continue
+			}
+			if _, err := regexp.Compile(cb.Validation); err != nil {
+				return errors.Wrapf(err, "callback %v validation", cb.Name)
+			}
+		}
+	}
+	if fl, ok := instance.(flowLifetimeLimited); ok {
+		if property, d := fl.requiredFlowLifetime(); d > flowLifetime {
+			return errors.Errorf("properties.%v: should not be greater than the flow lifetime %v seconds", property, int(flowLifetime.Seconds()))
+		}
+	}
+	return nil
+}
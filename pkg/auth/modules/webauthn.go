@@ -0,0 +1,323 @@
+package modules
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/maximthomas/gortas/pkg/auth/callbacks"
+	"github.com/maximthomas/gortas/pkg/auth/modules/webauthn"
+	"github.com/maximthomas/gortas/pkg/auth/state"
+	"github.com/maximthomas/gortas/pkg/user"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+)
+
+// WebAuthnModuleType module registers and verifies WebAuthn credentials (passkeys and security keys)
+const WebAuthnModuleType = "webauthn"
+
+const (
+	webAuthnCallbackName = "webauthn"
+	webAuthnRegister     = "register"
+	webAuthnAssert       = "assert"
+)
+
+type webAuthnState struct {
+	Challenge string
+	Mode      string
+	IssuedAt  int64
+	Retries   int
+}
+
+// WebAuthn authenticates the user with a registered WebAuthn credential.
+// After the modules, that authenticated the user, the module registers a credential if the user has none and the registration is enabled,
+// otherwise requests an assertion of one of the user credentials.
+// As the first module, the module requests an assertion of a discoverable credential and identifies the user by its user handle
+type WebAuthn struct {
+	BaseAuthModule
+	RPID                string
+	RPName              string
+	Origins             []string
+	UserVerification    string
+	ResidentKey         string
+	ChallengeTimeoutSec int
+	Register            bool // register a credential for the authenticated user without credentials, otherwise such users fail
+	RetryCount          int
+	CredentialsProperty string // user property with the JSON list of credentials
+	rp                  *webauthn.RelyingParty
+}
+
+func (wa *WebAuthn) Process(ctx context.Context, fs *state.FlowState) (ms state.ModuleStatus, cbs []callbacks.Callback, err error) {
+	if fs.UserID == "" {
+		return wa.requestAssertion(nil)
+	}
+	u, ok := user.GetUserService().GetUser(ctx, fs.UserID)
+	if !ok {
+		wa.l.Warnf("user %v not found", fs.UserID)
+		return state.Fail, nil, nil
+	}
+	creds, err := wa.credentials(u)
+	if err != nil {
+		return state.Fail, nil, err
+	}
+	if len(creds) > 0 {
+		return wa.requestAssertion(creds)
+	}
+	if !wa.Register {
+		wa.l.Warnf("user %v has no webauthn credentials", u.ID)
+		return state.Fail, nil, nil
+	}
+	// the user, that was only identified, for example by the username, could be anyone, so the credential is not registered
+	if !UserAuthenticated(fs) {
+		wa.l.Warnf("user %v without webauthn credentials is not authenticated to register", u.ID)
+		return state.Fail, nil, nil
+	}
+	return wa.requestRegistration(u)
+}
+
+func (wa *WebAuthn) ProcessCallbacks(ctx context.Context, inCbs []callbacks.Callback, fs *state.FlowState) (ms state.ModuleStatus, cbs []callbacks.Callback, err error) {
+	st := wa.state()
+	if st.Challenge == "" || time.Since(time.UnixMilli(st.IssuedAt)) > time.Duration(wa.ChallengeTimeoutSec)*time.Second {
+		ms, cbs, err = wa.Process(ctx, fs)
+		if ms == state.InProgress {
+			(&cbs[0]).Error = "Challenge expired"
+		}
+		return ms, cbs, err
+	}
+	var response string
+	for _, cb := range inCbs {
+		if cb.Name == webAuthnCallbackName {
+			response = cb.Value
+		}
+	}
+
+	if st.Mode == webAuthnRegister {
+		err = wa.register(ctx, fs, st.Challenge, response)
+	} else {
+		err = wa.assert(ctx, fs, st.Challenge, response)
+	}
+	if err != nil {
+		wa.l.Warnf("webauthn verification failed: %v", err)
+		st.Retries++
+		if st.Retries >= wa.RetryCount {
+			return state.Fail, nil, nil
+		}
+		wa.State["retries"] = st.Retries
+		// challenges are not reused
+		ms, cbs, err = wa.Process(ctx, fs)
+		if ms == state.InProgress {
+			(&cbs[0]).Error = "Verification failed"
+		}
+		return ms, cbs, err
+	}
+	for _, k := range []string{"challenge", "mode", "issuedAt", "retries"} {
+		delete(wa.State, k)
+	}
+	return state.Pass, nil, nil
+}
+
+// register verifies the attestation and adds the credential to the user
+func (wa *WebAuthn) register(ctx context.Context, fs *state.FlowState, challenge, response string) error {
+	u, ok := user.GetUserService().GetUser(ctx, fs.UserID)
+	if !ok {
+		return errors.Errorf("user %v not found", fs.UserID)
+	}
+	cred, err := wa.rp.VerifyRegistration(challenge, response)
+	if err != nil {
+		return err
+	}
+	creds, err := wa.credentials(u)
+	if err != nil {
+		return err
+	}
+	for _, c := range creds {
+		if c.ID == cred.ID {
+			return errors.New("credential is already registered")
+		}
+	}
+	cred.CreatedAt = time.Now().UnixMilli()
+	return wa.saveCredentials(ctx, u, append(creds, cred))
+}
+
+// assert verifies the assertion of the user credential and updates the credential sign count,
+// if the user is not identified yet, it is identified by the user handle
+func (wa *WebAuthn) assert(ctx context.Context, fs *state.FlowState, challenge, response string) error {
+	a, err := webauthn.ParseAssertion(response)
+	if err != nil {
+		return err
+	}
+	userID := fs.UserID
+	if userID == "" {
+		userID = a.UserHandle
+	} else if a.UserHandle != "" && a.UserHandle != userID {
+		return errors.Errorf("user handle does not match user %v", userID)
+	}
+	u, ok := user.GetUserService().GetUser(ctx, userID)
+	if !ok {
+		return errors.Errorf("user %v not found", userID)
+	}
+	creds, err := wa.credentials(u)
+	if err != nil {
+		return err
+	}
+	for i := range creds {
+		if creds[i].ID != a.CredentialID {
+			continue
+		}
+		err = wa.rp.VerifyAssertion(challenge, a, &creds[i])
+		if err != nil {
+			return err
+		}
+		err = wa.saveCredentials(ctx, u, creds)
+		if err != nil {
+			return err
+		}
+		fs.UserID = u.ID
+		return nil
+	}
+	return errors.Errorf("credential is not registered for user %v", u.ID)
+}
+
+func (wa *WebAuthn) requestRegistration(u user.User) (ms state.ModuleStatus, cbs []callbacks.Callback, err error) {
+	challenge, err := wa.newChallenge(webAuthnRegister)
+	if err != nil {
+		return state.Fail, nil, err
+	}
+	displayName := u.Properties["name"]
+	if displayName == "" {
+		displayName = u.ID
+	}
+	options := wa.rp.CreationOptions(challenge, webauthn.User{ID: u.ID, Name: u.ID, DisplayName: displayName}, nil)
+	return wa.optionsCallbacks(callbacks.TypeWebAuthnRegistration, options)
+}
+
+func (wa *WebAuthn) requestAssertion(creds []webauthn.Credential) (ms state.ModuleStatus, cbs []callbacks.Callback, err error) {
+	challenge, err := wa.newChallenge(webAuthnAssert)
+	if err != nil {
+		return state.Fail, nil, err
+	}
+	return wa.optionsCallbacks(callbacks.TypeWebAuthnAssertion, wa.rp.RequestOptions(challenge, creds))
+}
+
+func (wa *WebAuthn) newChallenge(mode string) (string, error) {
+	challenge, err := webauthn.NewChallenge()
+	if err != nil {
+		return "", err
+	}
+	wa.State["challenge"] = challenge
+	wa.State["mode"] = mode
+	wa.State["issuedAt"] = time.Now().UnixMilli()
+	return challenge, nil
+}
+
+func (wa *WebAuthn) optionsCallbacks(cbType string, options interface{}) (ms state.ModuleStatus, cbs []callbacks.Callback, err error) {
+	o, err := json.Marshal(options)
+	if err != nil {
+		return state.Fail, nil, errors.Wrap(err, "error marshaling options")
+	}
+	cb := webAuthnCallback(cbType)
+	cb.Properties = map[string]string{"options": string(o)}
+	return state.InProgress, []callbacks.Callback{cb}, nil
+}
+
+func (wa *WebAuthn) state() webAuthnState {
+	var st webAuthnState
+	_ = mapstructure.Decode(wa.State, &st)
+	return st
+}
+
+func (wa *WebAuthn) credentials(u user.User) ([]webauthn.Credential, error) {
+	var creds []webauthn.Credential
+	if v := u.Properties[wa.CredentialsProperty]; v != "" {
+		err := json.Unmarshal([]byte(v), &creds)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid %v of user %v", wa.CredentialsProperty, u.ID)
+		}
+	}
+	return creds, nil
+}
+
+func (wa *WebAuthn) saveCredentials(ctx context.Context, u user.User, creds []webauthn.Credential) error {
+	v, err := json.Marshal(creds)
+	if err != nil {
+		return errors.Wrap(err, "error marshaling credentials")
+	}
+	u.SetProperty(wa.CredentialsProperty, string(v))
+	err = user.GetUserService().UpdateUser(ctx, u)
+	if err != nil {
+		return errors.Wrap(err, "error updating user")
+	}
+	return nil
+}
+
+func webAuthnCallback(cbType string) callbacks.Callback {
+	return callbacks.Callback{
+		Name:     webAuthnCallbackName,
+		Type:     cbType,
+		Prompt:   "Use your security key or passkey",
+		Required: true,
+	}
+}
+
+func (wa *WebAuthn) ValidateCallbacks(cbs []callbacks.Callback) error {
+	return wa.BaseAuthModule.ValidateCallbacks(cbs)
+}
+
+func (wa *WebAuthn) PostProcess(_ context.Context, _ *state.FlowState) error {
+	return nil
+}
+
+func init() {
+	RegisterModule(WebAuthnModuleType, newWebAuthn,
+		Property{Name: "rpId", Type: PropertyString, Required: true},
+		Property{Name: "rpName", Type: PropertyString, Default: "Gortas"},
+		Property{Name: "origins", Type: PropertyList},
+		Property{Name: "userVerification", Type: PropertyString, Default: webauthn.UserVerificationPreferred},
+		Property{Name: "residentKey", Type: PropertyString, Default: "preferred"},
+		Property{Name: "challengeTimeoutSec", Type: PropertyInt, Default: 300},
+		Property{Name: "register", Type: PropertyBool, Default: false},
+		Property{Name: "retryCount", Type: PropertyInt, Default: 3},
+		Property{Name: "credentialsProperty", Type: PropertyString, Default: "webauthnCredentials"},
+	)
+	user.RegisterPrivateProperty("webauthnCredentials")
+}
+
+func newWebAuthn(base BaseAuthModule) (AuthModule, error) {
+	var wa WebAuthn
+	err := mapstructure.Decode(base.Properties, &wa)
+	if err != nil {
+		return nil, errors.Wrap(err, "error decoding properties")
+	}
+	if len(wa.Origins) == 0 {
+		wa.Origins = []string{"https://" + wa.RPID}
+	}
+	switch wa.UserVerification {
+	case webauthn.UserVerificationRequired, webauthn.UserVerificationPreferred, webauthn.UserVerificationDiscouraged:
+	default:
+		return nil, errors.Errorf("properties.userVerification: unknown value %v", wa.UserVerification)
+	}
+	switch {
+	case wa.ChallengeTimeoutSec <= 0:
+		return nil, errors.New("properties.challengeTimeoutSec: should be positive")
+	case wa.RetryCount <= 0:
+		return nil, errors.New("properties.retryCount: should be positive")
+	}
+	// modules are created, when the configuration is validated, so the configured property is registered before sessions are created
+	user.RegisterPrivateProperty(wa.CredentialsProperty)
+	wa.rp = &webauthn.RelyingParty{
+		ID:               wa.RPID,
+		Name:             wa.RPName,
+		Origins:          wa.Origins,
+		UserVerification: wa.UserVerification,
+		ResidentKey:      wa.ResidentKey,
+		Timeout:          time.Duration(wa.ChallengeTimeoutSec) * time.Second,
+	}
+
+	cbType := callbacks.TypeWebAuthnAssertion
+	if mode, _ := base.State["mode"].(string); mode == webAuthnRegister {
+		cbType = callbacks.TypeWebAuthnRegistration
+	}
+	(&base).Callbacks = []callbacks.Callback{webAuthnCallback(cbType)}
+	wa.BaseAuthModule = base
+	return &wa, nil
+}
@@ -0,0 +1,112 @@
+package webauthn
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"math/big"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/pkg/errors"
+)
+
+// COSE algorithms, key types and curves
+const (
+	algES256 = -7
+	algEdDSA = -8
+	algRS256 = -257
+
+	ktyOKP = 1
+	ktyEC2 = 2
+	ktyRSA = 3
+
+	crvP256    = 1
+	crvEd25519 = 6
+)
+
+// COSE key parameters
+const (
+	coseKty = 1
+	coseAlg = 3
+	// EC2 and OKP curve, RSA modulus
+	coseCrvOrN = -1
+	// EC2 and OKP x coordinate, RSA exponent
+	coseXOrE = -2
+	coseY    = -3
+)
+
+type publicKey struct {
+	alg int
+	key crypto.PublicKey
+}
+
+// parsePublicKey parses the COSE key of ES256, EdDSA or RS256 algorithms
+func parsePublicKey(data []byte) (*publicKey, error) {
+	var params map[int]cbor.RawMessage
+	err := cbor.Unmarshal(data, &params)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid COSE key")
+	}
+	var kty, alg int
+	if err = cbor.Unmarshal(params[coseKty], &kty); err != nil {
+		return nil, errors.Wrap(err, "invalid COSE key type")
+	}
+	if err = cbor.Unmarshal(params[coseAlg], &alg); err != nil {
+		return nil, errors.Wrap(err, "invalid COSE key algorithm")
+	}
+
+	switch {
+	case kty == ktyEC2 && alg == algES256:
+		var crv int
+		var x, y []byte
+		if cbor.Unmarshal(params[coseCrvOrN], &crv) != nil || cbor.Unmarshal(params[coseXOrE], &x) != nil ||
+			cbor.Unmarshal(params[coseY], &y) != nil || crv != crvP256 {
+			return nil, errors.New("invalid ES256 key")
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("invalid ES256 key")
+		}
+		return &publicKey{alg: alg, key: key}, nil
+	case kty == ktyOKP && alg == algEdDSA:
+		var crv int
+		var x []byte
+		if cbor.Unmarshal(params[coseCrvOrN], &crv) != nil || cbor.Unmarshal(params[coseXOrE], &x) != nil ||
+			crv != crvEd25519 || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid EdDSA key")
+		}
+		return &publicKey{alg: alg, key: ed25519.PublicKey(x)}, nil
+	case kty == ktyRSA && alg == algRS256:
+		var n, e []byte
+		if cbor.Unmarshal(params[coseCrvOrN], &n) != nil || cbor.Unmarshal(params[coseXOrE], &e) != nil || len(e) > 4 {
+			return nil, errors.New("invalid RS256 key")
+		}
+		return &publicKey{alg: alg, key: &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}}, nil
+	}
+	return nil, errors.Errorf("unsupported COSE key type %v algorithm %v", kty, alg)
+}
+
+func (k *publicKey) verify(data, sig []byte) error {
+	valid := false
+	switch key := k.key.(type) {
+	case *ecdsa.PublicKey:
+		if k.alg == algES256 {
+			hash := sha256.Sum256(data)
+			valid = ecdsa.VerifyASN1(key, hash[:], sig)
+		}
+	case ed25519.PublicKey:
+		valid = k.alg == algEdDSA && ed25519.Verify(key, data, sig)
+	case *rsa.PublicKey:
+		if k.alg == algRS256 {
+			hash := sha256.Sum256(data)
+			valid = rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], sig) == nil
+		}
+	}
+	if !valid {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
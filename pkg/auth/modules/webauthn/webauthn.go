@@ -0,0 +1,438 @@
+package webauthn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/pkg/errors"
+)
+
+// User verification requirements
+const (
+	UserVerificationRequired    = "required"
+	UserVerificationPreferred   = "preferred"
+	UserVerificationDiscouraged = "discouraged"
+)
+
+const (
+	publicKeyType     = "public-key"
+	clientDataCreate  = "webauthn.create"
+	clientDataGet     = "webauthn.get"
+	attestationNone   = "none"
+	attestationPacked = "packed"
+	challengeLen      = 32
+)
+
+// authenticator data flags
+const (
+	flagUserPresent      = 0x01
+	flagUserVerified     = 0x04
+	flagAttestedCredData = 0x40
+)
+
+// RelyingParty creates options of the registration and authentication ceremonies and verifies authenticator responses
+type RelyingParty struct {
+	ID               string
+	Name             string
+	Origins          []string
+	UserVerification string
+	ResidentKey      string
+	Timeout          time.Duration
+}
+
+// User is the user account of the credential, ID is passed to the authenticator as the user handle
+type User struct {
+	ID          string
+	Name        string
+	DisplayName string
+}
+
+// Credential is a registered public key credential of the user
+type Credential struct {
+	ID        string `json:"id"`        // base64url credential id
+	PublicKey string `json:"publicKey"` // base64url COSE key
+	SignCount uint32 `json:"signCount"`
+	CreatedAt int64  `json:"createdAt,omitempty"`
+}
+
+// CredentialDescriptor identifies a credential in the options
+type CredentialDescriptor struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+// CreationOptions are passed to navigator.credentials.create as PublicKeyCredentialCreationOptions JSON
+type CreationOptions struct {
+	Challenge string `json:"challenge"`
+	RP        struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"rp"`
+	User struct {
+		ID          string `json:"id"`
+		Name        string `json:"name"`
+		DisplayName string `json:"displayName"`
+	} `json:"user"`
+	PubKeyCredParams []struct {
+		Type string `json:"type"`
+		Alg  int    `json:"alg"`
+	} `json:"pubKeyCredParams"`
+	Timeout                int64                  `json:"timeout,omitempty"`
+	ExcludeCredentials     []CredentialDescriptor `json:"excludeCredentials,omitempty"`
+	AuthenticatorSelection struct {
+		ResidentKey      string `json:"residentKey,omitempty"`
+		UserVerification string `json:"userVerification,omitempty"`
+	} `json:"authenticatorSelection"`
+	Attestation string `json:"attestation"`
+}
+
+// RequestOptions are passed to navigator.credentials.get as PublicKeyCredentialRequestOptions JSON
+type RequestOptions struct {
+	Challenge        string                 `json:"challenge"`
+	Timeout          int64                  `json:"timeout,omitempty"`
+	RPID             string                 `json:"rpId"`
+	AllowCredentials []CredentialDescriptor `json:"allowCredentials,omitempty"`
+	UserVerification string                 `json:"userVerification,omitempty"`
+}
+
+// NewChallenge returns a random base64url challenge
+func NewChallenge() (string, error) {
+	b := make([]byte, challengeLen)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", errors.Wrap(err, "error generating challenge")
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// CreationOptions returns registration options for the user, already registered credentials are excluded
+func (rp *RelyingParty) CreationOptions(challenge string, u User, exclude []Credential) CreationOptions {
+	var o CreationOptions
+	o.Challenge = challenge
+	o.RP.ID = rp.ID
+	o.RP.Name = rp.Name
+	o.User.ID = base64.RawURLEncoding.EncodeToString([]byte(u.ID))
+	o.User.Name = u.Name
+	o.User.DisplayName = u.DisplayName
+	for _, alg := range []int{algES256, algEdDSA, algRS256} {
+		o.PubKeyCredParams = append(o.PubKeyCredParams, struct {
+			Type string `json:"type"`
+			Alg  int    `json:"alg"`
+		}{publicKeyType, alg})
+	}
+	o.Timeout = rp.Timeout.Milliseconds()
+	o.ExcludeCredentials = descriptors(exclude)
+	o.AuthenticatorSelection.ResidentKey = rp.ResidentKey
+	o.AuthenticatorSelection.UserVerification = rp.UserVerification
+	o.Attestation = attestationNone
+	return o
+}
+
+// RequestOptions returns authentication options, without allowed credentials the authenticator chooses
+// a discoverable credential and returns its user handle
+func (rp *RelyingParty) RequestOptions(challenge string, allow []Credential) RequestOptions {
+	return RequestOptions{
+		Challenge:        challenge,
+		Timeout:          rp.Timeout.Milliseconds(),
+		RPID:             rp.ID,
+		AllowCredentials: descriptors(allow),
+		UserVerification: rp.UserVerification,
+	}
+}
+
+func descriptors(creds []Credential) []CredentialDescriptor {
+	var res []CredentialDescriptor
+	for _, c := range creds {
+		res = append(res, CredentialDescriptor{Type: publicKeyType, ID: c.ID})
+	}
+	return res
+}
+
+// credentialResponse is the PublicKeyCredential JSON, returned by the client
+type credentialResponse struct {
+	ID       string `json:"id"`
+	RawID    string `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AttestationObject string `json:"attestationObject"`
+		AuthenticatorData string `json:"authenticatorData"`
+		Signature         string `json:"signature"`
+		UserHandle        string `json:"userHandle"`
+	} `json:"response"`
+}
+
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+type attestationObject struct {
+	Fmt      string          `cbor:"fmt"`
+	AttStmt  cbor.RawMessage `cbor:"attStmt"`
+	AuthData []byte          `cbor:"authData"`
+}
+
+type packedStatement struct {
+	Alg int      `cbor:"alg"`
+	Sig []byte   `cbor:"sig"`
+	X5c [][]byte `cbor:"x5c"`
+}
+
+type authenticatorData struct {
+	rpIDHash     []byte
+	flags        byte
+	signCount    uint32
+	credentialID []byte
+	publicKey    []byte
+}
+
+// VerifyRegistration verifies the attestation response to the challenge and returns the new credential
+func (rp *RelyingParty) VerifyRegistration(challenge string, response string) (Credential, error) {
+	var c Credential
+	cr, err := parseCredentialResponse(response)
+	if err != nil {
+		return c, err
+	}
+	cdJSON, err := decode(cr.Response.ClientDataJSON)
+	if err != nil {
+		return c, errors.Wrap(err, "invalid clientDataJSON")
+	}
+	err = rp.verifyClientData(cdJSON, clientDataCreate, challenge)
+	if err != nil {
+		return c, err
+	}
+	attObj, err := decode(cr.Response.AttestationObject)
+	if err != nil {
+		return c, errors.Wrap(err, "invalid attestationObject")
+	}
+	var att attestationObject
+	err = cbor.Unmarshal(attObj, &att)
+	if err != nil {
+		return c, errors.Wrap(err, "invalid attestationObject")
+	}
+	ad, err := parseAuthenticatorData(att.AuthData)
+	if err != nil {
+		return c, err
+	}
+	err = rp.verifyAuthenticatorData(ad)
+	if err != nil {
+		return c, err
+	}
+	if ad.flags&flagAttestedCredData == 0 {
+		return c, errors.New("attested credential data is missing")
+	}
+	key, err := parsePublicKey(ad.publicKey)
+	if err != nil {
+		return c, err
+	}
+	cdHash := sha256.Sum256(cdJSON)
+	err = verifyAttestation(att, key, append(append([]byte{}, att.AuthData...), cdHash[:]...))
+	if err != nil {
+		return c, err
+	}
+	return Credential{
+		ID:        base64.RawURLEncoding.EncodeToString(ad.credentialID),
+		PublicKey: base64.RawURLEncoding.EncodeToString(ad.publicKey),
+		SignCount: ad.signCount,
+	}, nil
+}
+
+// verifyAttestation verifies the attestation statement of the none or packed format,
+// packed attestation certificates are not checked against trust anchors
+func verifyAttestation(att attestationObject, key *publicKey, signed []byte) error {
+	switch att.Fmt {
+	case attestationNone:
+		return nil
+	case attestationPacked:
+		var st packedStatement
+		err := cbor.Unmarshal(att.AttStmt, &st)
+		if err != nil {
+			return errors.Wrap(err, "invalid packed attestation statement")
+		}
+		if len(st.X5c) == 0 {
+			// self attestation is signed by the credential key
+			if st.Alg != key.alg {
+				return errors.Errorf("attestation algorithm %v does not match the credential algorithm %v", st.Alg, key.alg)
+			}
+			return key.verify(signed, st.Sig)
+		}
+		cert, err := x509.ParseCertificate(st.X5c[0])
+		if err != nil {
+			return errors.Wrap(err, "invalid attestation certificate")
+		}
+		return (&publicKey{alg: st.Alg, key: cert.PublicKey}).verify(signed, st.Sig)
+	}
+	return errors.Errorf("unsupported attestation format %v", att.Fmt)
+}
+
+// Assertion is the parsed authentication response
+type Assertion struct {
+	CredentialID string // base64url credential id
+	UserHandle   string // user id, if the authenticator returned the user handle
+	clientData   []byte
+	authData     []byte
+	signature    []byte
+}
+
+// ParseAssertion parses the authentication response, so the credential could be found before the verification
+func ParseAssertion(response string) (*Assertion, error) {
+	cr, err := parseCredentialResponse(response)
+	if err != nil {
+		return nil, err
+	}
+	var a Assertion
+	rawID, err := decode(cr.RawID)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid rawId")
+	}
+	a.CredentialID = base64.RawURLEncoding.EncodeToString(rawID)
+	if a.clientData, err = decode(cr.Response.ClientDataJSON); err != nil {
+		return nil, errors.Wrap(err, "invalid clientDataJSON")
+	}
+	if a.authData, err = decode(cr.Response.AuthenticatorData); err != nil {
+		return nil, errors.Wrap(err, "invalid authenticatorData")
+	}
+	if a.signature, err = decode(cr.Response.Signature); err != nil {
+		return nil, errors.Wrap(err, "invalid signature")
+	}
+	userHandle, err := decode(cr.Response.UserHandle)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid userHandle")
+	}
+	a.UserHandle = string(userHandle)
+	return &a, nil
+}
+
+// VerifyAssertion verifies the authentication response to the challenge signed by the credential
+// and updates the credential sign count
+func (rp *RelyingParty) VerifyAssertion(challenge string, a *Assertion, c *Credential) error {
+	if a.CredentialID != c.ID {
+		return errors.New("assertion credential does not match")
+	}
+	err := rp.verifyClientData(a.clientData, clientDataGet, challenge)
+	if err != nil {
+		return err
+	}
+	ad, err := parseAuthenticatorData(a.authData)
+	if err != nil {
+		return err
+	}
+	err = rp.verifyAuthenticatorData(ad)
+	if err != nil {
+		return err
+	}
+	coseKey, err := decode(c.PublicKey)
+	if err != nil {
+		return errors.Wrap(err, "invalid credential public key")
+	}
+	key, err := parsePublicKey(coseKey)
+	if err != nil {
+		return err
+	}
+	cdHash := sha256.Sum256(a.clientData)
+	err = key.verify(append(append([]byte{}, a.authData...), cdHash[:]...), a.signature)
+	if err != nil {
+		return err
+	}
+	// authenticators without a counter always return zero
+	if (ad.signCount != 0 || c.SignCount != 0) && ad.signCount <= c.SignCount {
+		return errors.Errorf("sign count %v is not greater than %v, the authenticator could be cloned", ad.signCount, c.SignCount)
+	}
+	c.SignCount = ad.signCount
+	return nil
+}
+
+func parseCredentialResponse(response string) (*credentialResponse, error) {
+	var cr credentialResponse
+	err := json.Unmarshal([]byte(response), &cr)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid credential response")
+	}
+	if cr.Type != publicKeyType {
+		return nil, errors.Errorf("invalid credential type %v", cr.Type)
+	}
+	return &cr, nil
+}
+
+func (rp *RelyingParty) verifyClientData(data []byte, typ, challenge string) error {
+	var cd clientData
+	err := json.Unmarshal(data, &cd)
+	if err != nil {
+		return errors.Wrap(err, "invalid client data")
+	}
+	if cd.Type != typ {
+		return errors.Errorf("invalid client data type %v", cd.Type)
+	}
+	if strings.TrimRight(cd.Challenge, "=") != challenge {
+		return errors.New("challenge does not match")
+	}
+	for _, o := range rp.Origins {
+		if cd.Origin == o {
+			return nil
+		}
+	}
+	return errors.Errorf("origin %v is not allowed", cd.Origin)
+}
+
+func (rp *RelyingParty) verifyAuthenticatorData(ad *authenticatorData) error {
+	rpIDHash := sha256.Sum256([]byte(rp.ID))
+	if !bytes.Equal(ad.rpIDHash, rpIDHash[:]) {
+		return errors.New("relying party id hash does not match")
+	}
+	if ad.flags&flagUserPresent == 0 {
+		return errors.New("user is not present")
+	}
+	if rp.UserVerification == UserVerificationRequired && ad.flags&flagUserVerified == 0 {
+		return errors.New("user is not verified")
+	}
+	return nil
+}
+
+func parseAuthenticatorData(data []byte) (*authenticatorData, error) {
+	const minLen = 37
+	if len(data) < minLen {
+		return nil, errors.New("authenticator data is too short")
+	}
+	ad := &authenticatorData{
+		rpIDHash:  data[:32],
+		flags:     data[32],
+		signCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+	if ad.flags&flagAttestedCredData == 0 {
+		return ad, nil
+	}
+	// aaguid, credential id length, credential id and the COSE key
+	rest := data[minLen:]
+	if len(rest) < 18 {
+		return nil, errors.New("attested credential data is too short")
+	}
+	idLen := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if len(rest) < idLen {
+		return nil, errors.New("credential id is too short")
+	}
+	ad.credentialID = rest[:idLen]
+	rest = rest[idLen:]
+	var key cbor.RawMessage
+	extensions, err := cbor.UnmarshalFirst(rest, &key)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid credential public key")
+	}
+	ad.publicKey = rest[:len(rest)-len(extensions)]
+	return ad, nil
+}
+
+// decode decodes base64url values with or without padding
+func decode(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
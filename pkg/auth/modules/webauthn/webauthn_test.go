@@ -0,0 +1,166 @@
+package webauthn
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+var testRP = &RelyingParty{ID: "example.com", Name: "Example", Origins: []string{"https://example.com"}}
+
+type testAuthenticator struct {
+	pub       ed25519.PublicKey
+	key       ed25519.PrivateKey
+	id        []byte
+	signCount uint32
+}
+
+func newTestAuthenticator(t *testing.T) *testAuthenticator {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	return &testAuthenticator{pub: pub, key: key, id: []byte("credential-id")}
+}
+
+func (a *testAuthenticator) authData(rpID string, flags byte, attested bool) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	data := append(rpIDHash[:], flags, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(data[33:], a.signCount)
+	if attested {
+		coseKey, _ := cbor.Marshal(map[int]interface{}{1: 1, 3: -8, -1: 6, -2: []byte(a.pub)})
+		credData := make([]byte, 18)
+		binary.BigEndian.PutUint16(credData[16:], uint16(len(a.id)))
+		data = append(append(append(data, credData...), a.id...), coseKey...)
+	}
+	return data
+}
+
+// register returns the packed self attestation response
+func (a *testAuthenticator) register(typ, challenge, origin string, authData []byte) string {
+	cd, _ := json.Marshal(clientData{Type: typ, Challenge: challenge, Origin: origin})
+	cdHash := sha256.Sum256(cd)
+	sig := ed25519.Sign(a.key, append(append([]byte{}, authData...), cdHash[:]...))
+	attObj, _ := cbor.Marshal(map[string]interface{}{"fmt": "packed", "attStmt": map[string]interface{}{"alg": -8, "sig": sig}, "authData": authData})
+	return a.response(map[string]string{
+		"clientDataJSON":    base64.RawURLEncoding.EncodeToString(cd),
+		"attestationObject": base64.RawURLEncoding.EncodeToString(attObj),
+	})
+}
+
+func (a *testAuthenticator) assert(challenge string, authData []byte) string {
+	cd, _ := json.Marshal(clientData{Type: clientDataGet, Challenge: challenge, Origin: "https://example.com"})
+	cdHash := sha256.Sum256(cd)
+	sig := ed25519.Sign(a.key, append(append([]byte{}, authData...), cdHash[:]...))
+	return a.response(map[string]string{
+		"clientDataJSON":    base64.RawURLEncoding.EncodeToString(cd),
+		"authenticatorData": base64.RawURLEncoding.EncodeToString(authData),
+		"signature":         base64.RawURLEncoding.EncodeToString(sig),
+		"userHandle":        base64.RawURLEncoding.EncodeToString([]byte("user1")),
+	})
+}
+
+func (a *testAuthenticator) response(resp map[string]string) string {
+	id := base64.RawURLEncoding.EncodeToString(a.id)
+	r, _ := json.Marshal(map[string]interface{}{"id": id, "rawId": id, "type": "public-key", "response": resp})
+	return string(r)
+}
+
+func TestVerifyRegistration(t *testing.T) {
+	a := newTestAuthenticator(t)
+	challenge, err := NewChallenge()
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		rp       *RelyingParty
+		response string
+		err      string
+	}{
+		{name: "valid", rp: testRP,
+			response: a.register(clientDataCreate, challenge, "https://example.com", a.authData("example.com", 0x41, true))},
+		{name: "client data type", rp: testRP,
+			response: a.register(clientDataGet, challenge, "https://example.com", a.authData("example.com", 0x41, true)),
+			err:      "invalid client data type webauthn.get"},
+		{name: "challenge", rp: testRP,
+			response: a.register(clientDataCreate, "other", "https://example.com", a.authData("example.com", 0x41, true)),
+			err:      "challenge does not match"},
+		{name: "origin", rp: testRP,
+			response: a.register(clientDataCreate, challenge, "https://example.org", a.authData("example.com", 0x41, true)),
+			err:      "origin https://example.org is not allowed"},
+		{name: "rp id", rp: testRP,
+			response: a.register(clientDataCreate, challenge, "https://example.com", a.authData("example.org", 0x41, true)),
+			err:      "relying party id hash does not match"},
+		{name: "user presence", rp: testRP,
+			response: a.register(clientDataCreate, challenge, "https://example.com", a.authData("example.com", 0x40, true)),
+			err:      "user is not present"},
+		{name: "user verification",
+			rp:       &RelyingParty{ID: "example.com", Origins: testRP.Origins, UserVerification: UserVerificationRequired},
+			response: a.register(clientDataCreate, challenge, "https://example.com", a.authData("example.com", 0x41, true)),
+			err:      "user is not verified"},
+		{name: "credential data", rp: testRP,
+			response: a.register(clientDataCreate, challenge, "https://example.com", a.authData("example.com", 0x01, false)),
+			err:      "attested credential data is missing"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := tt.rp.VerifyRegistration(challenge, tt.response)
+			if tt.err != "" {
+				assert.EqualError(t, err, tt.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, base64.RawURLEncoding.EncodeToString(a.id), c.ID)
+		})
+	}
+
+	// the attestation signed by the other key is rejected
+	other := newTestAuthenticator(t)
+	other.pub = a.pub
+	_, err = testRP.VerifyRegistration(challenge,
+		other.register(clientDataCreate, challenge, "https://example.com", other.authData("example.com", 0x41, true)))
+	assert.EqualError(t, err, "invalid signature")
+}
+
+func TestVerifyAssertion(t *testing.T) {
+	a := newTestAuthenticator(t)
+	challenge, _ := NewChallenge()
+	c, err := testRP.VerifyRegistration(challenge,
+		a.register(clientDataCreate, challenge, "https://example.com", a.authData("example.com", 0x41, true)))
+	assert.NoError(t, err)
+
+	a.signCount = 5
+	challenge, _ = NewChallenge()
+	assertion, err := ParseAssertion(a.assert(challenge, a.authData("example.com", 0x01, false)))
+	assert.NoError(t, err)
+	assert.Equal(t, c.ID, assertion.CredentialID)
+	assert.Equal(t, "user1", assertion.UserHandle)
+	assert.NoError(t, testRP.VerifyAssertion(challenge, assertion, &c))
+	assert.Equal(t, uint32(5), c.SignCount)
+
+	// the sign count of the cloned authenticator does not increase
+	assertion, _ = ParseAssertion(a.assert(challenge, a.authData("example.com", 0x01, false)))
+	assert.EqualError(t, testRP.VerifyAssertion(challenge, assertion, &c),
+		"sign count 5 is not greater than 5, the authenticator could be cloned")
+
+	// the assertion is signed over the authenticator data
+	a.signCount = 6
+	authData := a.authData("example.com", 0x01, false)
+	assertion, _ = ParseAssertion(a.assert(challenge, authData))
+	assertion.authData = a.authData("example.com", 0x05, false)
+	assert.EqualError(t, testRP.VerifyAssertion(challenge, assertion, &c), "invalid signature")
+}
+
+func TestCreationOptions(t *testing.T) {
+	o := testRP.CreationOptions("challenge", User{ID: "user1", Name: "user1", DisplayName: "User 1"},
+		[]Credential{{ID: "cred1"}})
+	assert.Equal(t, "dXNlcjE", o.User.ID)
+	assert.Equal(t, []CredentialDescriptor{{Type: "public-key", ID: "cred1"}}, o.ExcludeCredentials)
+	assert.Equal(t, 3, len(o.PubKeyCredParams))
+	assert.Equal(t, "none", o.Attestation)
+}
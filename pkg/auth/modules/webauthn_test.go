@@ -0,0 +1,257 @@
+package modules
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/maximthomas/gortas/pkg/auth/callbacks"
+	"github.com/maximthomas/gortas/pkg/auth/modules/webauthn"
+	"github.com/maximthomas/gortas/pkg/auth/state"
+	"github.com/maximthomas/gortas/pkg/config"
+	"github.com/maximthomas/gortas/pkg/user"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebAuthn_SecondFactor(t *testing.T) {
+	setWebAuthnConfig(t)
+	a := newSoftAuthenticator(t, "https://example.com")
+	fs := loggedInFlowState("user1")
+	mi := webAuthnModuleInfo()
+	mi.Properties["register"] = true
+
+	// the user without credentials registers the authenticator
+	status, cbs, err := getWebAuthnModule(t, mi).Process(context.Background(), fs)
+	assert.NoError(t, err)
+	assert.Equal(t, state.InProgress, status)
+	assert.Equal(t, callbacks.TypeWebAuthnRegistration, cbs[0].Type)
+	var co webauthn.CreationOptions
+	assert.NoError(t, json.Unmarshal([]byte(cbs[0].Properties["options"]), &co))
+	assert.Equal(t, "example.com", co.RP.ID)
+	assert.Equal(t, "user1", co.User.Name)
+
+	status, _, err = getWebAuthnModule(t, mi).ProcessCallbacks(context.Background(),
+		[]callbacks.Callback{{Name: "webauthn", Value: a.create(t, cbs[0].Properties["options"])}}, fs)
+	assert.NoError(t, err)
+	assert.Equal(t, state.Pass, status)
+	assert.Empty(t, mi.State)
+	creds := userWebAuthnCredentials(t, "user1")
+	assert.Equal(t, 1, len(creds))
+	assert.Equal(t, base64.RawURLEncoding.EncodeToString(a.credentialID), creds[0].ID)
+
+	// the registered user is asked for the assertion of the credential
+	status, cbs, err = getWebAuthnModule(t, mi).Process(context.Background(), fs)
+	assert.NoError(t, err)
+	assert.Equal(t, state.InProgress, status)
+	assert.Equal(t, callbacks.TypeWebAuthnAssertion, cbs[0].Type)
+	var ro webauthn.RequestOptions
+	assert.NoError(t, json.Unmarshal([]byte(cbs[0].Properties["options"]), &ro))
+	assert.Equal(t, creds[0].ID, ro.AllowCredentials[0].ID)
+
+	// the response from the other origin is rejected and the new challenge is issued
+	other := *a
+	other.origin = "https://evil.example.com"
+	status, retryCbs, err := getWebAuthnModule(t, mi).ProcessCallbacks(context.Background(),
+		[]callbacks.Callback{{Name: "webauthn", Value: other.get(t, cbs[0].Properties["options"])}}, fs)
+	assert.NoError(t, err)
+	assert.Equal(t, state.InProgress, status)
+	assert.Equal(t, "Verification failed", retryCbs[0].Error)
+	assert.NotEqual(t, cbs[0].Properties["options"], retryCbs[0].Properties["options"])
+
+	status, _, err = getWebAuthnModule(t, mi).ProcessCallbacks(context.Background(),
+		[]callbacks.Callback{{Name: "webauthn", Value: a.get(t, retryCbs[0].Properties["options"])}}, fs)
+	assert.NoError(t, err)
+	assert.Equal(t, state.Pass, status)
+	assert.Equal(t, a.signCount, userWebAuthnCredentials(t, "user1")[0].SignCount)
+}
+
+func TestWebAuthn_Passwordless(t *testing.T) {
+	setWebAuthnConfig(t)
+	a := newSoftAuthenticator(t, "https://example.com")
+	mi := webAuthnModuleInfo()
+	mi.Properties["register"] = true
+
+	_, cbs, err := getWebAuthnModule(t, mi).Process(context.Background(), loggedInFlowState("user2"))
+	assert.NoError(t, err)
+	status, _, err := getWebAuthnModule(t, mi).ProcessCallbacks(context.Background(),
+		[]callbacks.Callback{{Name: "webauthn", Value: a.create(t, cbs[0].Properties["options"])}}, loggedInFlowState("user2"))
+	assert.NoError(t, err)
+	assert.Equal(t, state.Pass, status)
+
+	// without the identified user the discoverable credential identifies the user
+	fs := &state.FlowState{}
+	status, cbs, err = getWebAuthnModule(t, mi).Process(context.Background(), fs)
+	assert.NoError(t, err)
+	assert.Equal(t, state.InProgress, status)
+	var ro webauthn.RequestOptions
+	assert.NoError(t, json.Unmarshal([]byte(cbs[0].Properties["options"]), &ro))
+	assert.Empty(t, ro.AllowCredentials)
+
+	status, _, err = getWebAuthnModule(t, mi).ProcessCallbacks(context.Background(),
+		[]callbacks.Callback{{Name: "webauthn", Value: a.get(t, cbs[0].Properties["options"])}}, fs)
+	assert.NoError(t, err)
+	assert.Equal(t, state.Pass, status)
+	assert.Equal(t, "user2", fs.UserID)
+
+	// the credential of the other user does not authenticate the user
+	other := newSoftAuthenticator(t, "https://example.com")
+	other.userHandle = []byte("user2")
+	fs = &state.FlowState{}
+	mi.Properties["retryCount"] = 1
+	_, cbs, err = getWebAuthnModule(t, mi).Process(context.Background(), fs)
+	assert.NoError(t, err)
+	status, _, err = getWebAuthnModule(t, mi).ProcessCallbacks(context.Background(),
+		[]callbacks.Callback{{Name: "webauthn", Value: other.get(t, cbs[0].Properties["options"])}}, fs)
+	assert.NoError(t, err)
+	assert.Equal(t, state.Fail, status)
+	assert.Empty(t, fs.UserID)
+}
+
+func TestWebAuthn_NoRegistration(t *testing.T) {
+	setWebAuthnConfig(t)
+	mi := webAuthnModuleInfo()
+	status, _, err := getWebAuthnModule(t, mi).Process(context.Background(), loggedInFlowState("staff1"))
+	assert.NoError(t, err)
+	assert.Equal(t, state.Fail, status)
+
+	// the user only identified by the username does not register the credential
+	mi.Properties["register"] = true
+	fs := &state.FlowState{UserID: "user1", Modules: []state.FlowStateModuleInfo{
+		{ID: "username", Type: CredentialsModuleType, Status: state.Pass},
+		{ID: "webauthn", Type: WebAuthnModuleType, Status: state.InProgress},
+	}}
+	status, cbs, err := getWebAuthnModule(t, mi).Process(context.Background(), fs)
+	assert.NoError(t, err)
+	assert.Equal(t, state.Fail, status)
+	assert.Empty(t, cbs)
+	assert.Empty(t, mi.State)
+	u, _ := user.GetUserService().GetUser(context.Background(), "user1")
+	assert.Empty(t, u.Properties["webauthnCredentials"])
+
+	_, err = GetAuthModule(state.FlowStateModuleInfo{ID: "webauthn", Type: WebAuthnModuleType,
+		Properties: map[string]interface{}{}}, nil, nil)
+	assert.EqualError(t, err, "module webauthn: properties.rpId: is required")
+}
+
+// loggedInFlowState returns the flow state of the user authenticated by the login module
+func loggedInFlowState(userID string) *state.FlowState {
+	return &state.FlowState{UserID: userID, Modules: []state.FlowStateModuleInfo{{ID: "login", Type: "login", Status: state.Pass}}}
+}
+
+func webAuthnModuleInfo() state.FlowStateModuleInfo {
+	return state.FlowStateModuleInfo{ID: "webauthn", Type: WebAuthnModuleType,
+		Properties: map[string]interface{}{"rpId": "example.com"}, State: map[string]interface{}{}}
+}
+
+func getWebAuthnModule(t *testing.T, mi state.FlowStateModuleInfo) *WebAuthn {
+	t.Helper()
+	m, err := GetAuthModule(mi, nil, nil)
+	assert.NoError(t, err)
+	return m.(*WebAuthn)
+}
+
+func setWebAuthnConfig(t *testing.T) {
+	t.Helper()
+	config.SetConfig(&config.Config{})
+}
+
+func userWebAuthnCredentials(t *testing.T, userID string) []webauthn.Credential {
+	t.Helper()
+	u, _ := user.GetUserService().GetUser(context.Background(), userID)
+	var creds []webauthn.Credential
+	assert.NoError(t, json.Unmarshal([]byte(u.Properties["webauthnCredentials"]), &creds))
+	return creds
+}
+
+// softAuthenticator is a software ES256 authenticator with the discoverable credential
+type softAuthenticator struct {
+	origin       string
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	userHandle   []byte
+	signCount    uint32
+}
+
+func newSoftAuthenticator(t *testing.T, origin string) *softAuthenticator {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	id := make([]byte, 16)
+	_, err = rand.Read(id)
+	assert.NoError(t, err)
+	return &softAuthenticator{origin: origin, key: key, credentialID: id}
+}
+
+func (a *softAuthenticator) create(t *testing.T, options string) string {
+	t.Helper()
+	var o webauthn.CreationOptions
+	assert.NoError(t, json.Unmarshal([]byte(options), &o))
+	userHandle, err := base64.RawURLEncoding.DecodeString(o.User.ID)
+	assert.NoError(t, err)
+	a.userHandle = userHandle
+
+	coseKey, err := cbor.Marshal(map[int]interface{}{1: 2, 3: -7, -1: 1,
+		-2: a.key.X.FillBytes(make([]byte, 32)), -3: a.key.Y.FillBytes(make([]byte, 32))})
+	assert.NoError(t, err)
+	credData := make([]byte, 18)
+	binary.BigEndian.PutUint16(credData[16:], uint16(len(a.credentialID)))
+	credData = append(append(credData, a.credentialID...), coseKey...)
+	authData := append(a.authData(o.RP.ID, 0x45), credData...)
+	attObj, err := cbor.Marshal(map[string]interface{}{"fmt": "none", "attStmt": map[string]interface{}{}, "authData": authData})
+	assert.NoError(t, err)
+
+	return a.response(t, map[string]string{
+		"clientDataJSON":    a.clientData(t, "webauthn.create", o.Challenge),
+		"attestationObject": base64.RawURLEncoding.EncodeToString(attObj),
+	})
+}
+
+func (a *softAuthenticator) get(t *testing.T, options string) string {
+	t.Helper()
+	var o webauthn.RequestOptions
+	assert.NoError(t, json.Unmarshal([]byte(options), &o))
+	a.signCount++
+	authData := a.authData(o.RPID, 0x05)
+	clientData := a.clientData(t, "webauthn.get", o.Challenge)
+	cd, _ := base64.RawURLEncoding.DecodeString(clientData)
+	cdHash := sha256.Sum256(cd)
+	hash := sha256.Sum256(append(append([]byte{}, authData...), cdHash[:]...))
+	sig, err := ecdsa.SignASN1(rand.Reader, a.key, hash[:])
+	assert.NoError(t, err)
+
+	return a.response(t, map[string]string{
+		"clientDataJSON":    clientData,
+		"authenticatorData": base64.RawURLEncoding.EncodeToString(authData),
+		"signature":         base64.RawURLEncoding.EncodeToString(sig),
+		"userHandle":        base64.RawURLEncoding.EncodeToString(a.userHandle),
+	})
+}
+
+func (a *softAuthenticator) authData(rpID string, flags byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	data := append(rpIDHash[:], flags, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(data[33:], a.signCount)
+	return data
+}
+
+func (a *softAuthenticator) clientData(t *testing.T, typ, challenge string) string {
+	t.Helper()
+	cd, err := json.Marshal(map[string]string{"type": typ, "challenge": challenge, "origin": a.origin})
+	assert.NoError(t, err)
+	return base64.RawURLEncoding.EncodeToString(cd)
+}
+
+func (a *softAuthenticator) response(t *testing.T, resp map[string]string) string {
+	t.Helper()
+	id := base64.RawURLEncoding.EncodeToString(a.credentialID)
+	r, err := json.Marshal(map[string]interface{}{"id": id, "rawId": id, "type": "public-key", "response": resp})
+	assert.NoError(t, err)
+	return string(r)
+}
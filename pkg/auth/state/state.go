@@ -4,6 +4,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/maximthomas/gortas/pkg/config"
 )
 
 type FlowState struct {
@@ -13,15 +17,29 @@ type FlowState struct {
 	ID          string
 	RedirectURI string
 	Name        string
+	ExpiresAt   int64    `json:",omitempty"` // unix time in milliseconds
+	SessionID   string   `json:",omitempty"` // existing user session upgraded by the step-up flow
+	AuthLevel   int      `json:",omitempty"` // authentication level of the completed flow
+	Amr         []string `json:",omitempty"` // authentication method references of the completed flow
+	AuthTime    int64    `json:",omitempty"` // unix time in seconds the flow was completed
+	AuthModules []string `json:",omitempty"` // types of the modules, that authenticated the user, including the step-up session
+	// UserAuthenticated is set for the sub-flow, if the parent flow authenticated the user before the sub-flow started
+	UserAuthenticated bool `json:",omitempty"`
 }
 
 type FlowStateModuleInfo struct {
-	ID         string
-	Type       string
-	Properties FlowStateModuleProperties
-	Status     ModuleStatus
-	State      map[string]interface{}
-	Criteria   string
+	ID          string
+	Type        string
+	Properties  FlowStateModuleProperties
+	Status      ModuleStatus
+	State       map[string]interface{}
+	Criteria    string
+	When        []config.Condition  `json:",omitempty"`
+	Transitions []config.Transition `json:",omitempty"`
+	SubFlow     *FlowState          `json:",omitempty"` // flow state of the sub-flow module
+	AuthLevel   int                 `json:",omitempty"`
+	Amr         string              `json:",omitempty"`
+	TimeoutSec  int                 `json:",omitempty"`
 }
 
 type FlowStateModuleProperties map[string]interface{}
@@ -78,6 +96,41 @@ func (f *FlowState) UpdateModuleInfo(mIndex int, mInfo FlowStateModuleInfo) {
 	f.Modules[mIndex] = mInfo
 }
 
+// Acr returns authentication context class reference of the flow authentication level
+func (f *FlowState) Acr() string {
+	return strconv.Itoa(f.AuthLevel)
+}
+
+// Expired returns true if the flow lifetime is over
+func (f *FlowState) Expired() bool {
+	return f.ExpiresAt > 0 && time.Now().UnixMilli() > f.ExpiresAt
+}
+
+// FindModule searches the module with the id in the flow and its sub-flows
+func (f *FlowState) FindModule(id string) (FlowStateModuleInfo, bool) {
+	for i := range f.Modules {
+		if f.Modules[i].ID == id {
+			return f.Modules[i], true
+		}
+		if f.Modules[i].SubFlow != nil {
+			if mi, ok := f.Modules[i].SubFlow.FindModule(id); ok {
+				return mi, true
+			}
+		}
+	}
+	return FlowStateModuleInfo{}, false
+}
+
+// ModuleIndex returns index of the module with the id, or -1 if there is no such module
+func (f *FlowState) ModuleIndex(id string) int {
+	for i := range f.Modules {
+		if f.Modules[i].ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
 type ModuleStatus int
 
 const (
@@ -85,8 +138,25 @@ const (
 	Start
 	InProgress // callbacks requested
 	Pass
+	Skip // module was not executed due to flow conditions
 )
 
+func (s ModuleStatus) String() string {
+	switch s {
+	case Fail:
+		return "fail"
+	case Start:
+		return "start"
+	case InProgress:
+		return "inProgress"
+	case Pass:
+		return "pass"
+	case Skip:
+		return "skip"
+	}
+	return fmt.Sprintf("unknown(%d)", int(s))
+}
+
 const (
 	FlowCookieName    = "GortasAuthFlow"
 	SessionCookieName = "GortasSession"
@@ -0,0 +1,87 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/maximthomas/gortas/pkg/auth/state"
+	"github.com/maximthomas/gortas/pkg/session"
+	"github.com/pkg/errors"
+
+	autherrors "github.com/maximthomas/gortas/pkg/auth/errors"
+)
+
+// sessionIDFromRequest returns the user session id from the session cookie or from the bearer authorization header
+func sessionIDFromRequest(r *http.Request) string {
+	if r == nil {
+		return ""
+	}
+	if sessionCookie, err := r.Cookie(state.SessionCookieName); err == nil {
+		return sessionCookie.Value
+	}
+	splitToken := strings.Split(r.Header.Get("Authorization"), "Bearer ")
+	if len(splitToken) == 2 {
+		return splitToken[1]
+	}
+	return ""
+}
+
+// startStepUp binds the flow to the existing user session from the request,
+// modules with authentication methods, that the session has already passed, are skipped.
+// If there is no valid user session, the flow authenticates the user from scratch
+func (f *flowProcessor) startStepUp(ctx context.Context, fs *state.FlowState, r *http.Request) {
+	sessionID := sessionIDFromRequest(r)
+	if sessionID == "" {
+		return
+	}
+	sess, err := session.GetSessionService().GetUserSession(ctx, sessionID)
+	if err != nil {
+		f.logger.Warnf("step-up flow %v: error getting user session %v", fs.Name, err)
+		return
+	}
+	fs.SessionID = sessionID
+	fs.UserID = sess.GetUserID()
+	passed := make(map[string]bool)
+	for _, m := range sess.GetAuthContext().Amr {
+		passed[m] = true
+	}
+	skipPassedModules(fs, passed)
+}
+
+// skipPassedModules skips modules of the flow and its sub-flows with the already passed authentication methods
+func skipPassedModules(fs *state.FlowState, passed map[string]bool) {
+	for i := range fs.Modules {
+		mi := &fs.Modules[i]
+		if mi.SubFlow != nil {
+			skipPassedModules(mi.SubFlow, passed)
+			continue
+		}
+		if mi.Status == state.Start && passed[moduleAmr(mi)] {
+			mi.Status = state.Skip
+		}
+	}
+}
+
+// getStepUpSession returns the user session upgraded by the step-up flow
+func (f *flowProcessor) getStepUpSession(ctx context.Context, fs *state.FlowState) (sess session.Session, err error) {
+	sess, err = session.GetSessionService().GetUserSession(ctx, fs.SessionID)
+	if err != nil {
+		return sess, errors.Wrap(err, "error getting user session")
+	}
+	if sess.GetUserID() != fs.UserID {
+		return sess, autherrors.NewAuthFailed(fmt.Sprintf("step-up flow user %v does not match session user %v",
+			fs.UserID, sess.GetUserID()))
+	}
+	return sess, nil
+}
+
+// upgradeSession sets the authentication context of the step-up flow to the existing user session
+func (f *flowProcessor) upgradeSession(ctx context.Context, fs *state.FlowState) (sessID string, err error) {
+	sess, err := f.getStepUpSession(ctx, fs)
+	if err != nil {
+		return sessID, err
+	}
+	return session.GetSessionService().UpdateUserSession(ctx, sess, flowAuthContext(fs))
+}
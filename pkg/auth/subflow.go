@@ -0,0 +1,58 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/maximthomas/gortas/pkg/auth/callbacks"
+	"github.com/maximthomas/gortas/pkg/auth/modules"
+	"github.com/maximthomas/gortas/pkg/auth/state"
+	"github.com/pkg/errors"
+)
+
+const (
+	// subFlowModuleType module delegates authentication to another named flow
+	subFlowModuleType = "flow"
+	// subFlowProperty module property with the name of the delegated flow
+	subFlowProperty = "flow"
+)
+
+// processSubFlow processes the flow of the sub-flow module.
+// When the sub-flow starts, it gets the parent user and shared state,
+// when the sub-flow is completed, its user and shared state are merged back into the parent flow state.
+func (f *flowProcessor) processSubFlow(ctx context.Context, root, parent *state.FlowState, moduleInfo *state.FlowStateModuleInfo,
+	cbReq callbacks.Request, r *http.Request, w http.ResponseWriter) (ms state.ModuleStatus, cbResp callbacks.Response, err error) {
+	child := moduleInfo.SubFlow
+	if child == nil {
+		return state.Fail, cbResp, errors.Errorf("sub-flow state of the module %v does not exist", moduleInfo.ID)
+	}
+	if moduleInfo.Status == state.Start {
+		child.ID = parent.ID
+		child.UserID = parent.UserID
+		child.SessionID = parent.SessionID
+		child.UserAuthenticated = modules.UserAuthenticated(parent)
+		if child.SharedState == nil {
+			child.SharedState = make(map[string]string)
+		}
+		for k, v := range parent.SharedState {
+			child.SharedState[k] = v
+		}
+	}
+
+	ms, cbResp, err = f.processFlow(ctx, root, child, cbReq, r, w)
+	if err != nil {
+		return state.Fail, cbResp, err
+	}
+	if ms == state.Pass || ms == state.Fail {
+		if child.UserID != "" {
+			parent.UserID = child.UserID
+		}
+		if child.RedirectURI != "" {
+			parent.RedirectURI = child.RedirectURI
+		}
+		for k, v := range child.SharedState {
+			parent.SharedState[k] = v
+		}
+	}
+	return ms, cbResp, nil
+}
@@ -0,0 +1,104 @@
+package auth
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/maximthomas/gortas/pkg/auth/modules"
+	"github.com/maximthomas/gortas/pkg/auth/state"
+	"github.com/maximthomas/gortas/pkg/config"
+	"github.com/maximthomas/gortas/pkg/log"
+	"github.com/pkg/errors"
+
+	stderrors "errors"
+)
+
+func init() {
+	config.RegisterValidator(validateFlows)
+	// files of the modules are read again, when the configuration is applied, validation keeps the running cache
+	config.RegisterListener(func(_ *config.Config) {
+		modules.ResetFileCaches()
+	})
+}
+
+// validateFlows creates every module of every flow and checks module settings,
+// returns all found problems with the flow and module paths
+func validateFlows(c *config.Config) error {
+	f := &flowProcessor{logger: log.WithField("module", "FlowProcessor")}
+	names := make([]string, 0, len(c.Flows))
+	for name := range c.Flows {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errs []error
+	for _, name := range names {
+		flowErrs := validateFlowModules(c.Flows, name)
+		if len(flowErrs) == 0 {
+			// sub-flows and choice options are checked, when modules are valid
+			if _, err := f.newFlowState(c.Flows, name, nil); err != nil {
+				flowErrs = append(flowErrs, errors.Wrapf(err, "flows.%v", name))
+			}
+		}
+		errs = append(errs, flowErrs...)
+	}
+	return stderrors.Join(errs...)
+}
+
+// validateFlowModules checks settings of the flow modules
+func validateFlowModules(flows map[string]config.Flow, name string) (errs []error) {
+	flow := flows[name]
+	for i, m := range flow.Modules {
+		path := fmt.Sprintf("flows.%v.modules[%v]", name, i)
+		if err := validateCriteria(m.Criteria); err != nil {
+			errs = append(errs, errors.Wrapf(err, "%v.criteria", path))
+		}
+		for j, c := range m.When {
+			if err := validateCondition(c); err != nil {
+				errs = append(errs, errors.Wrapf(err, "%v.when[%v]", path, j))
+			}
+		}
+		for j, t := range m.Transitions {
+			for k, c := range t.When {
+				if err := validateCondition(c); err != nil {
+					errs = append(errs, errors.Wrapf(err, "%v.transitions[%v].when[%v]", path, j, k))
+				}
+			}
+			if !flowHasModuleAfter(flow, i, t.Next) {
+				errs = append(errs, errors.Errorf("%v.transitions[%v].next: module %v should be after the module %v", path, j, t.Next, m.ID))
+			}
+		}
+		switch m.Type {
+		case "":
+		case subFlowModuleType:
+			subFlowName, _ := m.Properties[subFlowProperty].(string)
+			if _, ok := flows[subFlowName]; !ok {
+				errs = append(errs, errors.Errorf("%v.properties.flow: auth flow %v not found", path, subFlowName))
+			}
+		case modules.ChoiceModuleType:
+			if _, err := modules.DecodeChoiceOptions(m.Properties); err != nil {
+				errs = append(errs, errors.Wrapf(err, "%v.properties", path))
+			}
+		default:
+			if !modules.IsRegistered(m.Type) {
+				errs = append(errs, errors.Errorf("%v.type: unknown module type %v", path, m.Type))
+				continue
+			}
+			mi := state.FlowStateModuleInfo{ID: m.ID, Type: m.Type, Properties: m.Properties}
+			if err := modules.ValidateModule(mi, flowLifetime(flow)); err != nil {
+				errs = append(errs, errors.Wrapf(err, "%v", path))
+			}
+		}
+	}
+	return errs
+}
+
+// flowHasModuleAfter checks, that the module with the id follows the module with the index
+func flowHasModuleAfter(flow config.Flow, index int, id string) bool {
+	for i := index + 1; i < len(flow.Modules); i++ {
+		if flow.Modules[i].ID == id {
+			return true
+		}
+	}
+	return false
+}
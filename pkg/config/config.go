@@ -1,9 +1,20 @@
 package config
 
 import (
+	"crypto/tls"
+	"encoding/base64"
+	stderrors "errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync/atomic"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/maximthomas/gortas/pkg/lockout"
 	"github.com/maximthomas/gortas/pkg/log"
 	"github.com/maximthomas/gortas/pkg/session"
 	"github.com/maximthomas/gortas/pkg/user"
+	"github.com/pkg/errors"
 	"github.com/spf13/viper"
 )
 
@@ -13,21 +24,146 @@ type Config struct {
 	Server        Server          `yaml:"server"`
 	EncryptionKey string          `yaml:"encryptionKey"`
 	UserDataStore user.Config     `yaml:"userDataStore"`
+	Lockout       lockout.Config  `yaml:"lockout"`
 }
 
 type Flow struct {
-	Modules []Module `yaml:"modules"`
+	Modules     []Module `yaml:"modules"`
+	LifetimeSec int      `yaml:"lifetimeSec"` // maximum flow duration, flows that are not completed in time are rejected
+	StepUp      bool     `yaml:"stepUp"`      // flow raises assurance of the existing user session, if there is one
 }
 
 type Module struct {
-	ID         string                 `yaml:"id"`
-	Type       string                 `yaml:"type"`
-	Properties map[string]interface{} `yaml:"properties,omitempty"`
-	Criteria   string                 `yaml:"criteria"`
+	ID          string                 `yaml:"id"`
+	Type        string                 `yaml:"type"`
+	Properties  map[string]interface{} `yaml:"properties,omitempty"`
+	Criteria    string                 `yaml:"criteria"`
+	When        []Condition            `yaml:"when,omitempty"`        // module runs only if all conditions are met, otherwise it is skipped
+	Transitions []Transition           `yaml:"transitions,omitempty"` // evaluated in order after the module is completed
+	AuthLevel   int                    `yaml:"authLevel,omitempty"`   // authentication level the module provides, passed in the acr claim
+	Amr         string                 `yaml:"amr,omitempty"`         // authentication method reference, the module type by default
+	TimeoutSec  int                    `yaml:"timeoutSec,omitempty"`  // deadline of a single module call, not limited if not set
+}
+
+// Condition checks a value from the flow state, the user or the request
+type Condition struct {
+	Source   string `yaml:"source"`   // sharedState, user, header, remoteAddr or status
+	Key      string `yaml:"key"`      // shared state key, user property, header name or module id
+	Operator string `yaml:"operator"` // eq (default), ne, exists, notExists, matches, notMatches, inNetwork, notInNetwork
+	Value    string `yaml:"value"`
+}
+
+// Transition moves the flow to the module with the Next id if all conditions are met
+type Transition struct {
+	When []Condition `yaml:"when"`
+	Next string      `yaml:"next"`
 }
 
 type Server struct {
-	Cors Cors
+	Address string // listen address, :8080 by default
+	TLS     TLS
+	Cors    Cors
+	Admin   Admin
+	APIKeys APIKeys `yaml:"apiKeys"`
+}
+
+// TLS settings of the listener, the server listens with plain HTTP if the certificate is not set
+type TLS struct {
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string // PEM bundle of CAs, that verify client certificates
+	ClientAuth   string // none (default), request, requireAny, verifyIfGiven or requireAndVerify
+}
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"":                 tls.NoClientCert,
+	"none":             tls.NoClientCert,
+	"request":          tls.RequestClientCert,
+	"requireAny":       tls.RequireAnyClientCert,
+	"verifyIfGiven":    tls.VerifyClientCertIfGiven,
+	"requireAndVerify": tls.RequireAndVerifyClientCert,
+}
+
+// ClientAuthType returns the client certificate verification mode
+func (t TLS) ClientAuthType() (tls.ClientAuthType, error) {
+	ca, ok := clientAuthTypes[t.ClientAuth]
+	if !ok {
+		return tls.NoClientCert, errors.Errorf("clientAuth: unknown mode %v", t.ClientAuth)
+	}
+	return ca, nil
+}
+
+// Validate checks the TLS settings
+func (t TLS) Validate() error {
+	var errs []error
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		errs = append(errs, errors.New("keyFile: certificate and key should be set together"))
+	}
+	ca, err := t.ClientAuthType()
+	if err != nil {
+		errs = append(errs, err)
+	} else if ca != tls.NoClientCert && t.CertFile == "" {
+		errs = append(errs, errors.New("clientAuth: requires the server certificate"))
+	}
+	if (ca == tls.VerifyClientCertIfGiven || ca == tls.RequireAndVerifyClientCert) && t.ClientCAFile == "" {
+		errs = append(errs, errors.New("clientCAFile: is required to verify client certificates"))
+	}
+	return stderrors.Join(errs...)
+}
+
+// Admin endpoints settings, the endpoints are not registered if they are not enabled
+type Admin struct {
+	Enabled bool
+	Token   string // bearer token, required by the admin endpoints
+}
+
+const (
+	defaultAPIKeyTTLSec     = 90 * 24 * 3600
+	defaultAPIKeyMaxTTLSec  = 365 * 24 * 3600
+	defaultAPIKeyMaxAuthAge = 300
+)
+
+// APIKeys settings of the API key endpoints, keys are created and revoked only with the session of an interactive authentication
+type APIKeys struct {
+	DefaultTTLSec int `yaml:"defaultTtlSec"` // lifetime of keys, created without expiresInSec, 90 days by default
+	MaxTTLSec     int `yaml:"maxTtlSec"`     // 365 days by default
+	MaxAuthAgeSec int `yaml:"maxAuthAgeSec"` // time since the authentication of the session, 300 seconds by default
+	MinAuthLevel  int `yaml:"minAuthLevel"`  // minimal authentication level of the session, not checked if not set
+}
+
+// WithDefaults returns the settings with default values of not set settings
+func (a APIKeys) WithDefaults() APIKeys {
+	if a.DefaultTTLSec == 0 {
+		a.DefaultTTLSec = defaultAPIKeyTTLSec
+	}
+	if a.MaxTTLSec == 0 {
+		a.MaxTTLSec = defaultAPIKeyMaxTTLSec
+		if a.DefaultTTLSec > a.MaxTTLSec {
+			a.MaxTTLSec = a.DefaultTTLSec
+		}
+	}
+	if a.MaxAuthAgeSec == 0 {
+		a.MaxAuthAgeSec = defaultAPIKeyMaxAuthAge
+	}
+	return a
+}
+
+// Validate checks the API key settings
+func (a APIKeys) Validate() error {
+	var errs []error
+	settings := []struct {
+		name  string
+		value int
+	}{{"defaultTtlSec", a.DefaultTTLSec}, {"maxTtlSec", a.MaxTTLSec}, {"maxAuthAgeSec", a.MaxAuthAgeSec}, {"minAuthLevel", a.MinAuthLevel}}
+	for _, s := range settings {
+		if s.value < 0 {
+			errs = append(errs, errors.Errorf("%v: should not be negative", s.name))
+		}
+	}
+	if a.MaxTTLSec > 0 && a.DefaultTTLSec > a.MaxTTLSec {
+		errs = append(errs, errors.New("defaultTtlSec: should not be greater than maxTtlSec"))
+	}
+	return stderrors.Join(errs...)
 }
 
 type Cors struct {
@@ -36,42 +172,210 @@ type Cors struct {
 
 var configLogger = log.WithField("module", "config")
 
-var config Config
+// config is replaced as a whole on reload, so readers always get a consistent snapshot
+var config atomic.Pointer[Config]
+
+// Validator checks the configuration before it is applied
+type Validator func(c *Config) error
+
+var validators []Validator
+
+// RegisterValidator adds a validator of the configuration, the validator could return several joined errors
+func RegisterValidator(v Validator) {
+	validators = append(validators, v)
+}
+
+// Listener is notified, when the configuration is applied on load or reload
+type Listener func(c *Config)
+
+var listeners []Listener
+
+// RegisterListener adds a listener of applied configurations, rejected configurations are not notified
+func RegisterListener(l Listener) {
+	listeners = append(listeners, l)
+}
+
+// store applies the configuration and notifies the listeners
+func store(c *Config) {
+	config.Store(c)
+	for _, l := range listeners {
+		l(c)
+	}
+}
+
+func init() {
+	config.Store(&Config{})
+}
 
 func InitConfig() error {
 
 	// newLogger.SetFormatter(&logrus.JSONFormatter{})
 	// newLogger.SetReportCaller(true)
 
-	err := viper.Unmarshal(&config)
+	newConfig, err := ReadConfig()
 
 	if err != nil { // Handle errors reading the config file
 		configLogger.Errorf("Fatal error config file: %s \n", err)
 		panic(err)
 	}
-	err = user.InitUserService(config.UserDataStore)
+	err = Validate(&newConfig)
+	if err != nil {
+		return errors.Wrap(err, "invalid config")
+	}
+	err = user.InitUserService(newConfig.UserDataStore)
 	if err != nil {
 		configLogger.Errorf("Fatal error config file: %s \n", err)
 		panic(err)
 	}
-	err = session.InitSessionService(&config.Session)
+	err = session.InitSessionService(&newConfig.Session)
 
 	if err != nil {
 		configLogger.Errorf("error while init session service: %s \n", err)
 		panic(err)
 	}
+	err = lockout.InitService(newConfig.Lockout)
+	if err != nil {
+		return errors.Wrap(err, "error while init lockout service")
+	}
+	store(&newConfig)
+
+	configLogger.Debugf("got configuration %+v\n", newConfig)
+
+	return nil
+}
+
+// ReadConfig reads the configuration, loaded by viper, without applying it
+func ReadConfig() (Config, error) {
+	var c Config
+	err := viper.Unmarshal(&c)
+	if err != nil {
+		return c, errors.Wrap(err, "error reading config")
+	}
+	return c, nil
+}
 
-	configLogger.Debugf("got configuration %+v\n", config)
+// WatchConfig reloads the configuration, when the config file changes
+func WatchConfig() {
+	viper.OnConfigChange(func(e fsnotify.Event) {
+		configLogger.Infof("config file %v changed", e.Name)
+		err := ReloadConfig()
+		if err != nil {
+			configLogger.Errorf("error reloading config, the previous config is kept: %v", err)
+		}
+	})
+	viper.WatchConfig()
+}
 
+// ReloadConfig reads the configuration and replaces flows and server settings.
+// Flows in progress keep their module settings, the session, the user data store, the lockout, the encryption key,
+// the server address and TLS are not reloaded, their changes require restart
+func ReloadConfig() error {
+	newConfig, err := ReadConfig()
+	if err != nil {
+		return err
+	}
+	err = Validate(&newConfig)
+	if err != nil {
+		return errors.Wrap(err, "invalid config")
+	}
+	prev := config.Load()
+	if !reflect.DeepEqual(prev.Session, newConfig.Session) || !reflect.DeepEqual(prev.UserDataStore, newConfig.UserDataStore) ||
+		!reflect.DeepEqual(prev.Lockout, newConfig.Lockout) || prev.EncryptionKey != newConfig.EncryptionKey ||
+		prev.Server.Address != newConfig.Server.Address || prev.Server.TLS != newConfig.Server.TLS {
+		configLogger.Warn("session, user data store, lockout, encryption key, server address and TLS changes require restart")
+	}
+	newConfig.Server.Address = prev.Server.Address
+	newConfig.Server.TLS = prev.Server.TLS
+	newConfig.Session = prev.Session
+	newConfig.UserDataStore = prev.UserDataStore
+	newConfig.Lockout = prev.Lockout
+	newConfig.EncryptionKey = prev.EncryptionKey
+	store(&newConfig)
+	configLogger.Info("config reloaded")
 	return nil
 }
 
+// Validate checks the configuration and returns all found problems,
+// every problem is prefixed with the path of the setting, like flows.login.modules[0]
+func Validate(c *Config) error {
+	var errs []error
+	names := make([]string, 0, len(c.Flows))
+	for name := range c.Flows {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		flow := c.Flows[name]
+		if len(flow.Modules) == 0 {
+			errs = append(errs, errors.Errorf("flows.%v: flow has no modules", name))
+		}
+		if flow.LifetimeSec < 0 {
+			errs = append(errs, errors.Errorf("flows.%v.lifetimeSec: should not be negative", name))
+		}
+		ids := make(map[string]bool)
+		for i, m := range flow.Modules {
+			path := fmt.Sprintf("flows.%v.modules[%v]", name, i)
+			if m.ID == "" {
+				errs = append(errs, errors.Errorf("%v.id: is required", path))
+			} else if ids[m.ID] {
+				errs = append(errs, errors.Errorf("%v.id: duplicate module id %v", path, m.ID))
+			}
+			ids[m.ID] = true
+			if m.Type == "" {
+				errs = append(errs, errors.Errorf("%v.type: is required", path))
+			}
+			if m.TimeoutSec < 0 {
+				errs = append(errs, errors.Errorf("%v.timeoutSec: should not be negative", path))
+			}
+		}
+	}
+	if c.Server.Admin.Enabled && c.Server.Admin.Token == "" {
+		errs = append(errs, errors.New("server.admin.token: is required for the admin endpoints"))
+	}
+	errs = append(errs, prefixErrors("server.tls.", c.Server.TLS.Validate())...)
+	errs = append(errs, prefixErrors("server.apiKeys.", c.Server.APIKeys.Validate())...)
+	errs = append(errs, prefixErrors("session.", c.Session.Validate())...)
+	errs = append(errs, prefixErrors("userDataStore.", c.UserDataStore.Validate())...)
+	errs = append(errs, prefixErrors("lockout.", c.Lockout.Validate())...)
+	if c.EncryptionKey != "" {
+		key, err := base64.StdEncoding.DecodeString(c.EncryptionKey)
+		if err != nil {
+			errs = append(errs, errors.Wrap(err, "encryptionKey: invalid base64"))
+		} else if l := len(key); l != 16 && l != 24 && l != 32 {
+			errs = append(errs, errors.Errorf("encryptionKey: key length should be 16, 24 or 32 bytes, got %v", l))
+		}
+	}
+	for _, v := range validators {
+		errs = append(errs, prefixErrors("", v(c))...)
+	}
+	return stderrors.Join(errs...)
+}
+
+// prefixErrors splits joined errors and prefixes them with the path
+func prefixErrors(prefix string, err error) []error {
+	if err == nil {
+		return nil
+	}
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		var errs []error
+		for _, e := range joined.Unwrap() {
+			errs = append(errs, prefixErrors(prefix, e)...)
+		}
+		return errs
+	}
+	if prefix == "" {
+		return []error{err}
+	}
+	return []error{fmt.Errorf("%v%w", prefix, err)}
+}
+
 func GetConfig() Config {
-	return config
+	return *config.Load()
 }
 
 func SetConfig(newConfig *Config) {
-	config = *newConfig
+	c := *newConfig
+	store(&c)
 	err := user.InitUserService(newConfig.UserDataStore)
 	if err != nil {
 		configLogger.Warnf("error %v", err)
@@ -80,4 +384,8 @@ func SetConfig(newConfig *Config) {
 	if err != nil {
 		configLogger.Warnf("error %v", err)
 	}
+	err = lockout.InitService(newConfig.Lockout)
+	if err != nil {
+		configLogger.Warnf("error %v", err)
+	}
 }
@@ -1,7 +1,11 @@
 package config
 
 import (
+	"errors"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/spf13/viper"
 
@@ -17,6 +21,117 @@ func TestReadConfigFileViper(t *testing.T) {
 	assert.NoError(t, err)
 	conf := GetConfig()
 	assert.True(t, len(conf.Flows) > 0)
-	assert.NotEmpty(t, config.Session.Jwt.PrivateKeyPem)
+	assert.NotEmpty(t, conf.Session.Jwt.PrivateKeyPem)
 	assert.Equal(t, 1, len(conf.Server.Cors.AllowedOrigins))
 }
+
+// testConfig returns config with the login flow, extra flows, session expiration and allowed origin
+func testConfig(flows, expires, origin string) string {
+	return `
+flows:
+  login:
+    modules:
+      - id: "login"
+        type: "login"
+` + flows + `
+session:
+  type: "stateful"
+  expires: ` + expires + `
+server:
+  cors:
+    allowedOrigins:
+      - ` + origin + `
+`
+}
+
+func writeTestConfig(t *testing.T, file, data string) {
+	err := os.WriteFile(file, []byte(data), 0o600)
+	assert.NoError(t, err)
+}
+
+func TestReloadConfig(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "auth-config.yaml")
+	writeTestConfig(t, file, testConfig("", "60", "http://localhost:3000"))
+	viper.SetConfigFile(file)
+	assert.NoError(t, viper.ReadInConfig())
+	assert.NoError(t, InitConfig())
+
+	t.Run("flows and server settings are reloaded", func(t *testing.T) {
+		otpFlow := `
+  otp:
+    modules:
+      - id: "otp"
+        type: "otp"`
+		writeTestConfig(t, file, testConfig(otpFlow, "120", "http://localhost:4000"))
+		assert.NoError(t, viper.ReadInConfig())
+		assert.NoError(t, ReloadConfig())
+		conf := GetConfig()
+		assert.Len(t, conf.Flows, 2)
+		assert.Equal(t, []string{"http://localhost:4000"}, conf.Server.Cors.AllowedOrigins)
+		// session settings require restart
+		assert.Equal(t, 60, conf.Session.Expires)
+	})
+
+	t.Run("invalid config is rejected", func(t *testing.T) {
+		badFlow := `
+  bad:
+    modules:
+      - id: "bad"`
+		writeTestConfig(t, file, testConfig(badFlow, "60", "http://localhost:3000"))
+		assert.NoError(t, viper.ReadInConfig())
+		assert.Error(t, ReloadConfig())
+		assert.Len(t, GetConfig().Flows, 2)
+	})
+
+	t.Run("registered validators", func(t *testing.T) {
+		prevValidators := validators
+		defer func() { validators = prevValidators }()
+		RegisterValidator(func(c *Config) error {
+			if _, ok := c.Flows["login"]; ok {
+				return errors.New("login flow is not allowed")
+			}
+			return nil
+		})
+		writeTestConfig(t, file, testConfig("", "60", "http://localhost:3000"))
+		assert.NoError(t, viper.ReadInConfig())
+		assert.EqualError(t, ReloadConfig(), "invalid config: login flow is not allowed")
+		assert.Len(t, GetConfig().Flows, 2)
+	})
+
+	t.Run("listeners are notified only of applied configs", func(t *testing.T) {
+		prevListeners := listeners
+		defer func() { listeners = prevListeners }()
+		var applied []*Config
+		RegisterListener(func(c *Config) {
+			applied = append(applied, c)
+		})
+		writeTestConfig(t, file, testConfig("", "60", "http://localhost:5000"))
+		assert.NoError(t, viper.ReadInConfig())
+		assert.NoError(t, ReloadConfig())
+		assert.Len(t, applied, 1)
+		assert.Equal(t, []string{"http://localhost:5000"}, applied[0].Server.Cors.AllowedOrigins)
+
+		writeTestConfig(t, file, testConfig(`
+  bad:
+    modules:
+      - id: "bad"`, "60", "http://localhost:3000"))
+		assert.NoError(t, viper.ReadInConfig())
+		assert.Error(t, ReloadConfig())
+		assert.NoError(t, Validate(&Config{}))
+		assert.Len(t, applied, 1)
+	})
+}
+
+func TestWatchConfig(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "auth-config.yaml")
+	writeTestConfig(t, file, testConfig("", "60", "http://localhost:3000"))
+	viper.SetConfigFile(file)
+	assert.NoError(t, viper.ReadInConfig())
+	assert.NoError(t, InitConfig())
+	WatchConfig()
+
+	writeTestConfig(t, file, testConfig("", "60", "http://localhost:5000"))
+	assert.Eventually(t, func() bool {
+		return GetConfig().Server.Cors.AllowedOrigins[0] == "http://localhost:5000"
+	}, 5*time.Second, 50*time.Millisecond)
+}
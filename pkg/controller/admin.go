@@ -0,0 +1,49 @@
+package controller
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/maximthomas/gortas/pkg/auth"
+	"github.com/maximthomas/gortas/pkg/config"
+	"github.com/maximthomas/gortas/pkg/log"
+	"github.com/sirupsen/logrus"
+
+	autherrors "github.com/maximthomas/gortas/pkg/auth/errors"
+)
+
+// AdminController rest controller for the administration endpoints
+type AdminController struct {
+	logger logrus.FieldLogger
+}
+
+var diagramContentTypes = map[string]string{
+	auth.DiagramMermaid: "text/plain; charset=utf-8",
+	auth.DiagramDOT:     "text/vnd.graphviz; charset=utf-8",
+}
+
+// FlowDiagram returns the diagram of the flow in the format from the format query parameter, mermaid by default
+func (a *AdminController) FlowDiagram(c *gin.Context) {
+	format := c.DefaultQuery("format", auth.DiagramMermaid)
+	contentType, ok := diagramContentTypes[format]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unknown diagram format"})
+		return
+	}
+	d, err := auth.FlowDiagram(config.GetConfig().Flows, c.Param("flow"), format)
+	if err != nil {
+		if autherrors.Code(err) == autherrors.CodeFlowNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		a.logger.Errorf("error rendering flow diagram %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Data(http.StatusOK, contentType, []byte(d))
+}
+
+func NewAdminController() *AdminController {
+	logger := log.WithField("module", "AdminController")
+	return &AdminController{logger}
+}
@@ -0,0 +1,170 @@
+package controller
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/maximthomas/gortas/pkg/auth/modules"
+	"github.com/maximthomas/gortas/pkg/config"
+	"github.com/maximthomas/gortas/pkg/log"
+	"github.com/maximthomas/gortas/pkg/session"
+	"github.com/maximthomas/gortas/pkg/user"
+	"github.com/sirupsen/logrus"
+)
+
+const maxAPIKeyNameLength = 100
+
+// APIKeyController creates, lists and revokes the API keys of the session user
+type APIKeyController struct {
+	logger logrus.FieldLogger
+}
+
+func NewAPIKeyController() *APIKeyController {
+	logger := log.WithField("module", "APIKeyController")
+	return &APIKeyController{logger}
+}
+
+// nonInteractiveModules are module types of scripts and devices, their sessions could not manage api keys,
+// so a leaked key or password could not be used to create new keys
+var nonInteractiveModules = map[string]bool{modules.APIKeyModuleType: true, modules.BasicModuleType: true}
+
+// sessionUser returns the user of the session, set by the authenticated middleware,
+// with interactive the session should be authenticated interactively, recently and with the sufficient level
+func (ac *APIKeyController) sessionUser(c *gin.Context, interactive bool) (user.User, bool) {
+	si, ok := c.Get("session")
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Not authenticated"})
+		return user.User{}, false
+	}
+	s := si.(session.Session)
+	if interactive && !ac.interactiveSession(c, s) {
+		return user.User{}, false
+	}
+	u, ok := user.GetUserService().GetUser(c.Request.Context(), s.GetUserID())
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "No user found in the repository"})
+		return user.User{}, false
+	}
+	return u, true
+}
+
+// interactiveSession checks the authentication context of the session against the api key settings
+func (ac *APIKeyController) interactiveSession(c *gin.Context, s session.Session) bool {
+	conf := config.GetConfig().Server.APIKeys.WithDefaults()
+	authCtx := s.GetAuthContext()
+	if len(authCtx.Modules) == 0 {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "interactive authentication required"})
+		return false
+	}
+	for _, m := range authCtx.Modules {
+		if nonInteractiveModules[m] {
+			ac.logger.Warnf("%v session of %v could not manage api keys", m, s.GetUserID())
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "interactive authentication required"})
+			return false
+		}
+	}
+	maxAge := time.Duration(conf.MaxAuthAgeSec) * time.Second
+	if authCtx.AuthTime.IsZero() || time.Since(authCtx.AuthTime) > maxAge {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "recent authentication required"})
+		return false
+	}
+	if authCtx.Level < conf.MinAuthLevel {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "insufficient authentication level"})
+		return false
+	}
+	return true
+}
+
+// List returns the keys of the user without their hashes
+func (ac *APIKeyController) List(c *gin.Context) {
+	u, ok := ac.sessionUser(c, false)
+	if !ok {
+		return
+	}
+	keys, err := u.APIKeys()
+	if err != nil {
+		ac.logger.Errorf("error reading api keys of %v: %v", u.ID, err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "error reading api keys"})
+		return
+	}
+	for i := range keys {
+		keys[i].Hash = ""
+	}
+	c.JSON(http.StatusOK, gin.H{"keys": keys})
+}
+
+// Create generates a new key, the key is returned only in this response
+func (ac *APIKeyController) Create(c *gin.Context) {
+	var req struct {
+		Name         string `json:"name"`
+		ExpiresInSec int    `json:"expiresInSec"` // the default lifetime if not set
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.ExpiresInSec < 0 || len(req.Name) > maxAPIKeyNameLength {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+		return
+	}
+	conf := config.GetConfig().Server.APIKeys.WithDefaults()
+	if req.ExpiresInSec == 0 {
+		req.ExpiresInSec = conf.DefaultTTLSec
+	} else if req.ExpiresInSec > conf.MaxTTLSec {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("expiresInSec should not be greater than %v", conf.MaxTTLSec)})
+		return
+	}
+	u, ok := ac.sessionUser(c, true)
+	if !ok {
+		return
+	}
+	keys, err := u.APIKeys()
+	if err != nil {
+		ac.logger.Errorf("error reading api keys of %v: %v", u.ID, err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "error reading api keys"})
+		return
+	}
+	key, k, err := user.NewAPIKey(u.ID, req.Name, time.Duration(req.ExpiresInSec)*time.Second)
+	if err == nil {
+		err = u.SetAPIKeys(append(keys, k))
+	}
+	if err == nil {
+		err = user.GetUserService().UpdateUser(c.Request.Context(), u)
+	}
+	if err != nil {
+		ac.logger.Errorf("error creating api key of %v: %v", u.ID, err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "error updating user"})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"id": k.ID, "name": k.Name, "key": key, "createdAt": k.CreatedAt, "expiresAt": k.ExpiresAt})
+}
+
+// Revoke deletes the key with the id
+func (ac *APIKeyController) Revoke(c *gin.Context) {
+	u, ok := ac.sessionUser(c, true)
+	if !ok {
+		return
+	}
+	keys, err := u.APIKeys()
+	if err != nil {
+		ac.logger.Errorf("error reading api keys of %v: %v", u.ID, err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "error reading api keys"})
+		return
+	}
+	id := c.Param("id")
+	for i, k := range keys {
+		if k.ID != id {
+			continue
+		}
+		err = u.SetAPIKeys(append(keys[:i], keys[i+1:]...))
+		if err == nil {
+			err = user.GetUserService().UpdateUser(c.Request.Context(), u)
+		}
+		if err != nil {
+			ac.logger.Errorf("error revoking api key of %v: %v", u.ID, err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "error updating user"})
+			return
+		}
+		c.Status(http.StatusNoContent)
+		return
+	}
+	c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "api key not found"})
+}
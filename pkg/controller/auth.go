@@ -1,7 +1,6 @@
 package controller
 
 import (
-	"fmt"
 	"net/http"
 	"strconv"
 
@@ -9,8 +8,11 @@ import (
 	"github.com/maximthomas/gortas/pkg/auth"
 	"github.com/maximthomas/gortas/pkg/auth/callbacks"
 	"github.com/maximthomas/gortas/pkg/auth/state"
+	"github.com/maximthomas/gortas/pkg/config"
 	"github.com/maximthomas/gortas/pkg/log"
 	"github.com/sirupsen/logrus"
+
+	autherrors "github.com/maximthomas/gortas/pkg/auth/errors"
 )
 
 // AuthController rest controller for authentication
@@ -38,15 +40,37 @@ func (a *AuthController) Auth(c *gin.Context) {
 	}
 	(&cbReq).FlowID = fID
 	fp := auth.NewFlowProcessor()
-	cbResp, err := fp.Process(fn, cbReq, c.Request, c.Writer)
+	cbResp, err := fp.Process(c.Request.Context(), fn, cbReq, c.Request, c.Writer)
 	a.generateResponse(c, &cbResp, err)
 }
 
+// ModuleMetadata returns the metadata of the flow module, like SAML service provider metadata
+func (a *AuthController) ModuleMetadata(c *gin.Context) {
+	md, err := auth.ModuleMetadata(config.GetConfig().Flows, c.Param("flow"), c.Param("module"))
+	if err != nil {
+		code := autherrors.Code(err)
+		if code == autherrors.CodeInternal {
+			a.logger.Errorf("error generating module metadata %v", err)
+		}
+		a.failResponse(c, code, autherrors.Message(err))
+		return
+	}
+	c.Data(http.StatusOK, "application/samlmetadata+xml", md)
+}
+
 func (a *AuthController) generateResponse(c *gin.Context, cbResp *callbacks.Response, err error) {
 	if err != nil {
-		logrus.Errorf("authentication error %v", err)
-		deleteCookie(state.FlowCookieName, c)
-		c.JSON(http.StatusUnauthorized, gin.H{"status": "fail"})
+		code := autherrors.Code(err)
+		if code == autherrors.CodeInternal {
+			a.logger.Errorf("authentication error %v", err)
+		} else {
+			a.logger.Warnf("authentication error %v", err)
+		}
+		// the flow could be continued with valid callbacks
+		if code != autherrors.CodeInvalidCallbacks && code != autherrors.CodeUnexpectedModule {
+			deleteCookie(state.FlowCookieName, c)
+		}
+		a.failResponse(c, code, autherrors.Message(err))
 		return
 	}
 
@@ -62,9 +86,8 @@ func (a *AuthController) generateResponse(c *gin.Context, cbResp *callbacks.Resp
 			if cb.Type == callbacks.TypeHTTPStatus {
 				status, err = strconv.Atoi(cb.Value)
 				if err != nil {
-					errMsg := fmt.Sprintf("error parsing status %v", cb.Value)
-					a.logger.Errorf(errMsg)
-					c.JSON(http.StatusInternalServerError, gin.H{"status": "fail", "message": errMsg})
+					a.logger.Errorf("error parsing status %v", cb.Value)
+					a.failResponse(c, autherrors.CodeInternal, autherrors.Message(err))
 					return
 				}
 				for k, val := range cb.Properties {
@@ -83,10 +106,20 @@ func (a *AuthController) generateResponse(c *gin.Context, cbResp *callbacks.Resp
 		c.JSON(status, cbOutResp)
 	} else {
 		a.logger.Error("this should be never happen")
-		c.JSON(http.StatusInternalServerError, gin.H{"status": "fail"})
+		a.failResponse(c, autherrors.CodeInternal, autherrors.Message(nil))
 	}
 }
 
+func (a *AuthController) failResponse(c *gin.Context, code, message string) {
+	c.JSON(autherrors.HTTPStatus(code), callbacks.Response{
+		Status: "fail",
+		Error: &callbacks.Error{
+			Code:    code,
+			Message: message,
+		},
+	})
+}
+
 func setCookie(name, value string, c *gin.Context) {
 	c.SetCookie(name, value, 0, "/", "", false, true)
 }
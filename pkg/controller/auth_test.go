@@ -2,6 +2,7 @@ package controller
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -10,6 +11,8 @@ import (
 	"github.com/maximthomas/gortas/pkg/auth/callbacks"
 	"github.com/maximthomas/gortas/pkg/config"
 	"github.com/stretchr/testify/assert"
+
+	autherrors "github.com/maximthomas/gortas/pkg/auth/errors"
 )
 
 func init() {
@@ -36,12 +39,54 @@ func TestGenerateResponse(t *testing.T) {
 		expectedCookies []cookie
 		expectedHeaders []header
 	}{
+		{
+			name:           "internal error",
+			cbResp:         callbacks.Response{},
+			err:            errors.New("internalError"),
+			expectedStatus: 500,
+			expectedBody:   `{"status":"fail","error":{"code":"internal","message":"internal error"}}`,
+		},
 		{
 			name:           "auth error",
 			cbResp:         callbacks.Response{},
-			err:            errors.New("authError"),
+			err:            fmt.Errorf("process error %w", autherrors.NewAuthFailed("auth failed")),
 			expectedStatus: 401,
-			expectedBody:   `{"status":"fail"}`,
+			expectedBody:   `{"status":"fail","error":{"code":"auth_failed","message":"auth failed"}}`,
+		},
+		{
+			name:           "flow not found",
+			cbResp:         callbacks.Response{},
+			err:            autherrors.NewFlowNotFound("auth flow bad not found"),
+			expectedStatus: 404,
+			expectedBody:   `{"status":"fail","error":{"code":"flow_not_found","message":"auth flow bad not found"}}`,
+		},
+		{
+			name:           "flow expired",
+			cbResp:         callbacks.Response{},
+			err:            autherrors.NewFlowExpired("auth flow login expired"),
+			expectedStatus: 410,
+			expectedBody:   `{"status":"fail","error":{"code":"flow_expired","message":"auth flow login expired"}}`,
+		},
+		{
+			name:           "invalid callbacks",
+			cbResp:         callbacks.Response{},
+			err:            autherrors.NewInvalidCallbacks("invalid callbacks for module login"),
+			expectedStatus: 400,
+			expectedBody:   `{"status":"fail","error":{"code":"invalid_callbacks","message":"invalid callbacks for module login"}}`,
+		},
+		{
+			name:           "unexpected module",
+			cbResp:         callbacks.Response{},
+			err:            autherrors.NewUnexpectedModule("callbacks for module login, expected module otp"),
+			expectedStatus: 409,
+			expectedBody:   `{"status":"fail","error":{"code":"unexpected_module","message":"callbacks for module login, expected module otp"}}`,
+		},
+		{
+			name:           "locked out",
+			cbResp:         callbacks.Response{},
+			err:            autherrors.NewLockedOut("user locked out"),
+			expectedStatus: 429,
+			expectedBody:   `{"status":"fail","error":{"code":"locked_out","message":"user locked out"}}`,
 		},
 		{
 			name: "auth in progress",
@@ -16,7 +16,6 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
-	"github.com/maximthomas/gortas/pkg/config"
 	"github.com/sirupsen/logrus"
 	"github.com/skip2/go-qrcode"
 )
@@ -24,14 +23,14 @@ import (
 const qrSize = 256
 
 // TODO v2 refactor passwordless architecture
+// the controller does not keep a copy of the configuration, so it is up to date after the configuration reload
 type PasswordlessServicesController struct {
 	logger logrus.FieldLogger
-	conf   config.Config
 }
 
-func NewPasswordlessServicesController(c *config.Config) *PasswordlessServicesController {
+func NewPasswordlessServicesController() *PasswordlessServicesController {
 	logger := log.WithField("module", "PasswordlessServicesController")
-	return &PasswordlessServicesController{logger, *c}
+	return &PasswordlessServicesController{logger}
 }
 
 type QRProps struct {
@@ -48,7 +47,7 @@ func (pc *PasswordlessServicesController) RegisterGenerateQR(c *gin.Context) {
 	uid := s.GetUserID()
 	us := user.GetUserService()
 
-	_, ok = us.GetUser(uid)
+	_, ok = us.GetUser(c.Request.Context(), uid)
 	if !ok {
 		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "No user found in the repository"})
 		return
@@ -77,7 +76,7 @@ func (pc *PasswordlessServicesController) RegisterConfirmQR(c *gin.Context) {
 	uid := s.GetUserID()
 	us := user.GetUserService()
 
-	u, ok := us.GetUser(uid)
+	u, ok := us.GetUser(c.Request.Context(), uid)
 	if !ok {
 		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "No user found in the repository"})
 		return
@@ -94,7 +93,7 @@ func (pc *PasswordlessServicesController) RegisterConfirmQR(c *gin.Context) {
 		u.Properties = make(map[string]string)
 	}
 	u.Properties["passwordless.qr"] = string(qrPropsJSON)
-	err = us.UpdateUser(u)
+	err = us.UpdateUser(c.Request.Context(), u)
 	if err != nil {
 		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "error updating user"})
 		return
@@ -120,14 +119,14 @@ func (pc *PasswordlessServicesController) AuthQR(c *gin.Context) {
 		return
 	}
 
-	sess, err := session.GetSessionService().GetSession(authQRRequest.SID)
+	sess, err := session.GetSessionService().GetSession(c.Request.Context(), authQRRequest.SID)
 	if err != nil {
 		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "there is no valid authentication session"})
 		return
 	}
 
 	us := user.GetUserService()
-	u, ok := us.GetUser(authQRRequest.UID)
+	u, ok := us.GetUser(c.Request.Context(), authQRRequest.UID)
 	if !ok {
 		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "error updating user"})
 		return
@@ -159,15 +158,7 @@ func (pc *PasswordlessServicesController) AuthQR(c *gin.Context) {
 		return
 	}
 
-	moduleFound := false
-	for _, m := range fs.Modules {
-		if m.Type == "qr" && m.Status == state.InProgress {
-			m.State["qrUserId"] = authQRRequest.UID
-			moduleFound = true
-			break
-		}
-	}
-	if !moduleFound {
+	if !setQRUserID(&fs, authQRRequest.UID) {
 		pc.logger.Warn("AuthQR: no active qr module in the chain")
 		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "there is no valid authentication session"})
 		return
@@ -178,7 +169,7 @@ func (pc *PasswordlessServicesController) AuthQR(c *gin.Context) {
 		return
 	}
 	sess.Properties[constants.FlowStateSessionProperty] = string(fsJSON)
-	err = session.GetSessionService().UpdateSession(sess)
+	err = session.GetSessionService().UpdateSession(c.Request.Context(), sess)
 	if err != nil {
 		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err})
 		return
@@ -187,3 +178,17 @@ func (pc *PasswordlessServicesController) AuthQR(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"status": "success"})
 
 }
+
+// setQRUserID sets the user id to the qr module in progress in the flow or its sub-flows
+func setQRUserID(fs *state.FlowState, uid string) bool {
+	for _, m := range fs.Modules {
+		if m.Type == "qr" && m.Status == state.InProgress {
+			m.State["qrUserId"] = uid
+			return true
+		}
+		if m.SubFlow != nil && setQRUserID(m.SubFlow, uid) {
+			return true
+		}
+	}
+	return false
+}
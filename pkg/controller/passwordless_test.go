@@ -1,6 +1,7 @@
 package controller
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -74,7 +75,7 @@ var qrTests = []qrTestCase{
 }
 
 func TestPasswordlessServicesController_RegisterGenerateQR(t *testing.T) {
-	pc := NewPasswordlessServicesController(&conf)
+	pc := NewPasswordlessServicesController()
 
 	for _, tt := range qrTests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -93,7 +94,7 @@ func TestPasswordlessServicesController_RegisterGenerateQR(t *testing.T) {
 }
 
 func TestPasswordlessServicesController_RegisterConfirmQR(t *testing.T) {
-	pc := NewPasswordlessServicesController(&conf)
+	pc := NewPasswordlessServicesController()
 	type args struct {
 		session interface{}
 	}
@@ -125,7 +126,7 @@ func TestPasswordlessServicesController_AuthQR(t *testing.T) {
 		CreatedAt:  time.Now(),
 		Properties: nil,
 	}
-	_, err := session.GetSessionService().CreateSession(badSess)
+	_, err := session.GetSessionService().CreateSession(context.Background(), badSess)
 	assert.NoError(t, err)
 
 	lss := state.FlowState{
@@ -151,18 +152,18 @@ func TestPasswordlessServicesController_AuthQR(t *testing.T) {
 			"lss": string(lssBytes),
 		},
 	}
-	_, err = session.GetSessionService().CreateSession(validSess)
+	_, err = session.GetSessionService().CreateSession(context.Background(), validSess)
 	assert.NoError(t, err)
 
 	us := user.GetUserService()
-	u, _ := us.GetUser("user1")
+	u, _ := us.GetUser(context.Background(), "user1")
 	u.Properties = map[string]string{
 		"passwordless.qr": `{"secret": "s3cr3t"}`,
 	}
-	err = us.UpdateUser(u)
+	err = us.UpdateUser(context.Background(), u)
 	assert.NoError(t, err)
 
-	pc := NewPasswordlessServicesController(&conf)
+	pc := NewPasswordlessServicesController()
 	type args struct {
 		body string
 	}
@@ -34,7 +34,7 @@ func (sc *SessionController) SessionInfo(c *gin.Context) {
 		return
 	}
 
-	sess, err := session.GetSessionService().GetSessionData(sessionID)
+	sess, err := session.GetSessionService().GetSessionData(c.Request.Context(), sessionID)
 	if err != nil {
 		sc.logger.Warnf("error validating sessionId %s", sessionID)
 		sc.generateErrorResponse(c)
@@ -60,7 +60,7 @@ func (sc *SessionController) SessionJwt(c *gin.Context) {
 		sc.generateErrorResponse(c)
 		return
 	}
-	jwt, err := session.GetSessionService().ConvertSessionToJwt(sessionID)
+	jwt, err := session.GetSessionService().ConvertSessionToJwt(c.Request.Context(), sessionID)
 	if err != nil {
 		sc.logger.Warnf("error validating sessionId %s", sessionID)
 		sc.generateErrorResponse(c)
@@ -1,6 +1,7 @@
 package controller
 
 import (
+	"context"
 	"math/rand"
 	"net/http"
 	"net/http/httptest"
@@ -40,7 +41,7 @@ func setupConfig(sessRepoType string) {
 			"realm":  "users",
 		},
 	}
-	_, err := session.GetSessionService().CreateSession(statefulSession)
+	_, err := session.GetSessionService().CreateSession(context.Background(), statefulSession)
 	if err != nil {
 		panic(err)
 	}
@@ -0,0 +1,27 @@
+// Package datastore contains helpers, shared by the services with data stores
+package datastore
+
+import (
+	"context"
+	"time"
+)
+
+// DefaultTimeoutSec is the deadline of a single data store call, if the timeout is not configured
+const DefaultTimeoutSec = 5
+
+// Timeout returns the deadline of data store calls with the configured timeout in seconds
+func Timeout(timeoutSec int) time.Duration {
+	if timeoutSec > 0 {
+		return time.Duration(timeoutSec) * time.Second
+	}
+	return DefaultTimeoutSec * time.Second
+}
+
+// CallContext limits a data store call with the deadline,
+// the context is cancelled when the call is completed
+func CallContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return context.WithCancel(ctx)
+}
@@ -0,0 +1,92 @@
+package lockout
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	defaultWindowSec     = 900
+	defaultLockoutSec    = 300
+	defaultMultiplier    = 2
+	defaultMaxLockoutSec = 86400
+)
+
+type Config struct {
+	User      Policy    `yaml:"user"` // failed attempts of a username
+	IP        Policy    `yaml:"ip"`   // failed attempts from a client IP address
+	DataStore DataStore `yaml:"dataStore,omitempty"`
+}
+
+// Policy locks out the username or the IP address after MaxFailures failed attempts within WindowSec,
+// every next lockout is Multiplier times longer than the previous one, up to MaxLockoutSec
+type Policy struct {
+	MaxFailures   int `yaml:"maxFailures"` // lockout is disabled if not set
+	WindowSec     int `yaml:"windowSec"`   // failures and lockouts are forgotten after the period without failures, 900 by default
+	LockoutSec    int `yaml:"lockoutSec"`  // first lockout duration, 300 by default
+	Multiplier    int `yaml:"multiplier"`  // 2 by default, 1 keeps the lockout duration constant
+	MaxLockoutSec int `yaml:"maxLockoutSec"`
+}
+
+type DataStore struct {
+	Type       string
+	Properties map[string]string
+	TimeoutSec int `yaml:"timeoutSec,omitempty"` // deadline of a single data store call, 5 seconds by default
+}
+
+// Validate checks the policies and the data store settings
+func (c *Config) Validate() error {
+	var errs []error
+	errs = append(errs, c.User.validate("user.")...)
+	errs = append(errs, c.IP.validate("ip.")...)
+	switch c.DataStore.Type {
+	case "", "inMemory":
+	case "mongo":
+		for _, p := range []string{"url", "database", "collection"} {
+			if c.DataStore.Properties[p] == "" {
+				errs = append(errs, fmt.Errorf("dataStore.properties.%v: is required for mongo data store", p))
+			}
+		}
+	default:
+		errs = append(errs, fmt.Errorf("dataStore.type: unknown data store type %v", c.DataStore.Type))
+	}
+	return errors.Join(errs...)
+}
+
+func (p Policy) validate(prefix string) []error {
+	var errs []error
+	settings := []struct {
+		name  string
+		value int
+	}{{"maxFailures", p.MaxFailures}, {"windowSec", p.WindowSec}, {"lockoutSec", p.LockoutSec},
+		{"multiplier", p.Multiplier}, {"maxLockoutSec", p.MaxLockoutSec}}
+	for _, s := range settings {
+		if s.value < 0 {
+			errs = append(errs, fmt.Errorf("%v%v: should not be negative", prefix, s.name))
+		}
+	}
+	if p.MaxLockoutSec > 0 && p.LockoutSec > p.MaxLockoutSec {
+		errs = append(errs, fmt.Errorf("%vlockoutSec: should not be greater than maxLockoutSec", prefix))
+	}
+	return errs
+}
+
+// withDefaults returns the policy with default values of not set settings
+func (p Policy) withDefaults() Policy {
+	if p.WindowSec == 0 {
+		p.WindowSec = defaultWindowSec
+	}
+	if p.LockoutSec == 0 {
+		p.LockoutSec = defaultLockoutSec
+	}
+	if p.Multiplier == 0 {
+		p.Multiplier = defaultMultiplier
+	}
+	if p.MaxLockoutSec == 0 {
+		p.MaxLockoutSec = defaultMaxLockoutSec
+		if p.LockoutSec > p.MaxLockoutSec {
+			p.MaxLockoutSec = p.LockoutSec
+		}
+	}
+	return p
+}
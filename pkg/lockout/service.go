@@ -0,0 +1,145 @@
+package lockout
+
+import (
+	"context"
+	"time"
+
+	"github.com/maximthomas/gortas/pkg/datastore"
+)
+
+// Service tracks failed authentication attempts per username and per client IP address,
+// and locks them out, when there are too many failures
+type Service struct {
+	store   Store
+	user    Policy
+	ip      Policy
+	timeout time.Duration
+}
+
+type policyKey struct {
+	policy Policy
+	key    string
+}
+
+var now = time.Now
+
+// Check returns the remaining lockout duration of the username or the IP address, zero if they are not locked out
+func (s *Service) Check(ctx context.Context, username, ip string) (time.Duration, error) {
+	ctx, cancel := datastore.CallContext(ctx, s.timeout)
+	defer cancel()
+	var remaining time.Duration
+	for _, pk := range s.keys(username, ip) {
+		r, ok, err := s.store.Get(ctx, pk.key)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			if d := r.LockedUntil.Sub(now()); d > remaining {
+				remaining = d
+			}
+		}
+	}
+	return remaining, nil
+}
+
+// Fail registers the failed attempt and returns the lockout duration, if the attempt locked out
+// the username or the IP address
+func (s *Service) Fail(ctx context.Context, username, ip string) (time.Duration, error) {
+	ctx, cancel := datastore.CallContext(ctx, s.timeout)
+	defer cancel()
+	t := now()
+	var lockout time.Duration
+	for _, pk := range s.keys(username, ip) {
+		window := time.Duration(pk.policy.WindowSec) * time.Second
+		r, err := s.store.AddFailure(ctx, pk.key, t, t.Add(window))
+		if err != nil {
+			return 0, err
+		}
+		if r.Failures < pk.policy.MaxFailures {
+			continue
+		}
+		d := lockoutDuration(pk.policy, r.Lockouts)
+		// a concurrent failure, that has already locked out the key, is not counted twice
+		locked, err := s.store.Lock(ctx, r, t.Add(d), t.Add(d+window))
+		if err != nil {
+			return 0, err
+		}
+		if locked && d > lockout {
+			lockout = d
+		}
+	}
+	return lockout, nil
+}
+
+// Succeed resets failures of the username, failures of the IP address are kept,
+// so a valid account could not be used to reset them.
+// A lockout by a concurrent failure is not reset
+func (s *Service) Succeed(ctx context.Context, username string) error {
+	if s.user.MaxFailures == 0 || username == "" {
+		return nil
+	}
+	ctx, cancel := datastore.CallContext(ctx, s.timeout)
+	defer cancel()
+	return s.store.Reset(ctx, "user:"+username, now())
+}
+
+func (s *Service) keys(username, ip string) []policyKey {
+	var keys []policyKey
+	if s.user.MaxFailures > 0 && username != "" {
+		keys = append(keys, policyKey{s.user, "user:" + username})
+	}
+	if s.ip.MaxFailures > 0 && ip != "" {
+		keys = append(keys, policyKey{s.ip, "ip:" + ip})
+	}
+	return keys
+}
+
+// lockoutDuration returns the duration of the next lockout after the previous consecutive lockouts
+func lockoutDuration(p Policy, lockouts int) time.Duration {
+	lockout := time.Duration(p.LockoutSec) * time.Second
+	maxLockout := time.Duration(p.MaxLockoutSec) * time.Second
+	for i := 0; i < lockouts && lockout < maxLockout; i++ {
+		lockout *= time.Duration(p.Multiplier)
+	}
+	if lockout > maxLockout {
+		lockout = maxLockout
+	}
+	return lockout
+}
+
+var ls Service
+
+func init() {
+	ls = newService(Config{}, newInMemoryStore())
+}
+
+// InitService creates the lockout service with the configured data store
+func InitService(c Config) error {
+	var store Store
+	if c.DataStore.Type == "mongo" {
+		p := c.DataStore.Properties
+		s, err := newMongoStore(p["url"], p["database"], p["collection"])
+		if err != nil {
+			return err
+		}
+		store = s
+	} else {
+		store = newInMemoryStore()
+	}
+	ls = newService(c, store)
+	return nil
+}
+
+func newService(c Config, store Store) Service {
+	s := Service{
+		store:   store,
+		user:    c.User.withDefaults(),
+		ip:      c.IP.withDefaults(),
+		timeout: datastore.Timeout(c.DataStore.TimeoutSec),
+	}
+	return s
+}
+
+func GetService() *Service {
+	return &ls
+}
@@ -0,0 +1,139 @@
+package lockout
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestService_UserLockout(t *testing.T) {
+	current := setNow(t)
+	s := newService(Config{User: Policy{MaxFailures: 3, WindowSec: 600, LockoutSec: 60, MaxLockoutSec: 200}}, newInMemoryStore())
+	ctx := context.Background()
+
+	// every next lockout is twice longer, up to the maximum duration
+	for _, expected := range []time.Duration{time.Minute, 2 * time.Minute, 200 * time.Second, 200 * time.Second} {
+		for i := 1; i < 3; i++ {
+			locked, err := s.Fail(ctx, "user1", "10.0.0.1")
+			assert.NoError(t, err)
+			assert.Zero(t, locked)
+		}
+		locked, err := s.Fail(ctx, "user1", "10.0.0.1")
+		assert.NoError(t, err)
+		assert.Equal(t, expected, locked)
+
+		remaining, err := s.Check(ctx, "user1", "10.0.0.2")
+		assert.NoError(t, err)
+		assert.Equal(t, expected, remaining)
+		remaining, _ = s.Check(ctx, "user2", "10.0.0.1")
+		assert.Zero(t, remaining)
+
+		*current = current.Add(expected)
+		remaining, _ = s.Check(ctx, "user1", "10.0.0.1")
+		assert.Zero(t, remaining)
+	}
+
+	// failures and lockouts are forgotten after the window
+	_, _ = s.Fail(ctx, "user1", "")
+	*current = current.Add(601 * time.Second)
+	_, _ = s.Fail(ctx, "user1", "")
+	_, _ = s.Fail(ctx, "user1", "")
+	remaining, _ := s.Check(ctx, "user1", "")
+	assert.Zero(t, remaining)
+	locked, _ := s.Fail(ctx, "user1", "")
+	assert.Equal(t, time.Minute, locked)
+
+	// successful login resets failures
+	*current = current.Add(time.Minute)
+	_, _ = s.Fail(ctx, "user1", "")
+	_, _ = s.Fail(ctx, "user1", "")
+	assert.NoError(t, s.Succeed(ctx, "user1"))
+	locked, _ = s.Fail(ctx, "user1", "")
+	assert.Zero(t, locked)
+}
+
+func TestService_IPLockout(t *testing.T) {
+	setNow(t)
+	s := newService(Config{IP: Policy{MaxFailures: 2}}, newInMemoryStore())
+	ctx := context.Background()
+
+	// failures of different usernames from the same address are counted together
+	locked, _ := s.Fail(ctx, "user1", "10.0.0.1")
+	assert.Zero(t, locked)
+	assert.NoError(t, s.Succeed(ctx, "user1"))
+	locked, _ = s.Fail(ctx, "user2", "10.0.0.1")
+	assert.Equal(t, defaultLockoutSec*time.Second, locked)
+
+	remaining, _ := s.Check(ctx, "user3", "10.0.0.1")
+	assert.Equal(t, defaultLockoutSec*time.Second, remaining)
+	remaining, _ = s.Check(ctx, "user1", "10.0.0.2")
+	assert.Zero(t, remaining)
+}
+
+func TestService_ConcurrentFailures(t *testing.T) {
+	setNow(t)
+	// services of two instances share the store
+	store := newInMemoryStore()
+	p := Policy{MaxFailures: 10}
+	services := []Service{newService(Config{User: p}, store), newService(Config{User: p}, store)}
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	lockouts := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(s Service) {
+			defer wg.Done()
+			locked, err := s.Fail(ctx, "user1", "")
+			assert.NoError(t, err)
+			if locked > 0 {
+				mu.Lock()
+				lockouts++
+				mu.Unlock()
+			}
+		}(services[i%2])
+	}
+	wg.Wait()
+	assert.Equal(t, 1, lockouts)
+
+	// the successful login, that was checked before the lockout, does not reset it
+	assert.NoError(t, services[0].Succeed(ctx, "user1"))
+	remaining, err := services[1].Check(ctx, "user1", "")
+	assert.NoError(t, err)
+	assert.Equal(t, defaultLockoutSec*time.Second, remaining)
+}
+
+func TestInMemoryStore_DeleteExpired(t *testing.T) {
+	current := setNow(t)
+	s := newInMemoryStore().(*inMemoryStore)
+	_, _ = s.AddFailure(context.Background(), "active", *current, current.Add(time.Minute))
+	_, _ = s.AddFailure(context.Background(), "expired", *current, current.Add(-time.Second))
+
+	s.deleteExpired(*current)
+	assert.Contains(t, s.records, "active")
+	assert.NotContains(t, s.records, "expired")
+}
+
+func TestConfig_Validate(t *testing.T) {
+	c := Config{
+		User:      Policy{MaxFailures: -1, LockoutSec: 600, MaxLockoutSec: 60},
+		DataStore: DataStore{Type: "mongo", Properties: map[string]string{"url": "mongodb://localhost:27017"}},
+	}
+	assert.EqualError(t, c.Validate(), "user.maxFailures: should not be negative\n"+
+		"user.lockoutSec: should not be greater than maxLockoutSec\n"+
+		"dataStore.properties.database: is required for mongo data store\n"+
+		"dataStore.properties.collection: is required for mongo data store")
+	assert.NoError(t, (&Config{User: Policy{MaxFailures: 5}}).Validate())
+}
+
+func setNow(t *testing.T) *time.Time {
+	t.Helper()
+	current := time.Now()
+	now = func() time.Time { return current }
+	t.Cleanup(func() { now = time.Now })
+	return &current
+}
@@ -0,0 +1,115 @@
+package lockout
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Record counts failed attempts of a key, like a username or an IP address
+type Record struct {
+	Key         string    `bson:"_id"`
+	Failures    int       `bson:"failures"` // failures since the last lockout
+	Lockouts    int       `bson:"lockouts"` // consecutive lockouts, every next lockout is longer
+	LastFailure time.Time `bson:"lastFailure"`
+	LockedUntil time.Time `bson:"lockedUntil"`
+	ExpiresAt   time.Time `bson:"expiresAt"` // the record is forgotten after the time
+}
+
+// Store keeps lockout records, a record that does not exist or is expired is not found.
+// Records are updated atomically by the store, so concurrent failures on several instances are not lost
+type Store interface {
+	Get(ctx context.Context, key string) (Record, bool, error)
+	// AddFailure counts the failure of the key at the time, starts a new record if it does not exist or is expired,
+	// the record is kept at least until expiresAt, returns the updated record
+	AddFailure(ctx context.Context, key string, t, expiresAt time.Time) (Record, error)
+	// Lock locks out the key until the time and resets its failures, if the record lockouts were not changed
+	// after r was read, returns false if the record was changed, for example locked out by a concurrent failure
+	Lock(ctx context.Context, r Record, until, expiresAt time.Time) (bool, error)
+	// Reset deletes the record of the key, if it is not locked out at the time
+	Reset(ctx context.Context, key string, t time.Time) error
+}
+
+type inMemoryStore struct {
+	records map[string]Record
+	mu      sync.Mutex
+}
+
+func (s *inMemoryStore) Get(_ context.Context, key string) (Record, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.records[key]
+	if !ok || !r.ExpiresAt.After(now()) {
+		return Record{}, false, nil
+	}
+	return r, true, nil
+}
+
+func (s *inMemoryStore) AddFailure(_ context.Context, key string, t, expiresAt time.Time) (Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.records[key]
+	if !ok || !r.ExpiresAt.After(t) {
+		r = Record{Key: key}
+	}
+	r.Failures++
+	r.LastFailure = t
+	if expiresAt.After(r.ExpiresAt) {
+		r.ExpiresAt = expiresAt
+	}
+	s.records[key] = r
+	return r, nil
+}
+
+func (s *inMemoryStore) Lock(_ context.Context, r Record, until, expiresAt time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cur, ok := s.records[r.Key]
+	if !ok || cur.Lockouts != r.Lockouts {
+		return false, nil
+	}
+	cur.Failures = 0
+	cur.Lockouts++
+	cur.LockedUntil = until
+	if expiresAt.After(cur.ExpiresAt) {
+		cur.ExpiresAt = expiresAt
+	}
+	s.records[r.Key] = cur
+	return true, nil
+}
+
+func (s *inMemoryStore) Reset(_ context.Context, key string, t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r, ok := s.records[key]; ok && !r.LockedUntil.After(t) {
+		delete(s.records, key)
+	}
+	return nil
+}
+
+const cleanupIntervalSeconds = 60
+
+func (s *inMemoryStore) cleanupExpired() {
+	ticker := time.NewTicker(time.Second * cleanupIntervalSeconds)
+	defer ticker.Stop()
+	for {
+		<-ticker.C
+		s.deleteExpired(time.Now())
+	}
+}
+
+func (s *inMemoryStore) deleteExpired(t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, r := range s.records {
+		if !r.ExpiresAt.After(t) {
+			delete(s.records, k)
+		}
+	}
+}
+
+func newInMemoryStore() Store {
+	s := &inMemoryStore{records: make(map[string]Record)}
+	go s.cleanupExpired()
+	return s
+}
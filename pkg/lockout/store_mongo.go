@@ -0,0 +1,100 @@
+package lockout
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type mongoStore struct {
+	client     *mongo.Client
+	db         string
+	collection string
+}
+
+const mongoConnectTimeoutSec = 10
+
+func newMongoStore(uri, db, c string) (*mongoStore, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoConnectTimeoutSec*time.Second)
+	defer cancel()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		return nil, err
+	}
+	s := &mongoStore{
+		client:     client,
+		db:         db,
+		collection: c,
+	}
+	// records are deleted by the TTL monitor, when they expire
+	_, err = s.getCollection().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.M{"expiresAt": 1},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *mongoStore) Get(ctx context.Context, key string) (Record, bool, error) {
+	var r Record
+	err := s.getCollection().FindOne(ctx, bson.M{"_id": key}).Decode(&r)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return Record{}, false, nil
+	} else if err != nil {
+		return Record{}, false, err
+	}
+	// TTL monitor removes expired documents periodically, so expired records could still exist for a while
+	if !r.ExpiresAt.After(now()) {
+		return Record{}, false, nil
+	}
+	return r, true, nil
+}
+
+// AddFailure increments failures with $inc, so failures of several instances are counted without a lost update,
+// an expired record, that was not deleted by the TTL monitor yet, is deleted first
+func (s *mongoStore) AddFailure(ctx context.Context, key string, t, expiresAt time.Time) (Record, error) {
+	c := s.getCollection()
+	_, err := c.DeleteOne(ctx, bson.M{"_id": key, "expiresAt": bson.M{"$lte": t}})
+	if err != nil {
+		return Record{}, err
+	}
+	update := bson.M{
+		"$inc":         bson.M{"failures": 1},
+		"$set":         bson.M{"lastFailure": t},
+		"$max":         bson.M{"expiresAt": expiresAt},
+		"$setOnInsert": bson.M{"lockouts": 0, "lockedUntil": time.Time{}},
+	}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	var r Record
+	err = c.FindOneAndUpdate(ctx, bson.M{"_id": key}, update, opts).Decode(&r)
+	return r, err
+}
+
+// Lock updates the record only if its lockouts match, so concurrent failures lock out the key once
+func (s *mongoStore) Lock(ctx context.Context, r Record, until, expiresAt time.Time) (bool, error) {
+	update := bson.M{
+		"$set": bson.M{"failures": 0, "lockedUntil": until},
+		"$inc": bson.M{"lockouts": 1},
+		"$max": bson.M{"expiresAt": expiresAt},
+	}
+	res, err := s.getCollection().UpdateOne(ctx, bson.M{"_id": r.Key, "lockouts": r.Lockouts}, update)
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount > 0, nil
+}
+
+func (s *mongoStore) Reset(ctx context.Context, key string, t time.Time) error {
+	_, err := s.getCollection().DeleteOne(ctx, bson.M{"_id": key, "lockedUntil": bson.M{"$lte": t}})
+	return err
+}
+
+func (s *mongoStore) getCollection() *mongo.Collection {
+	return s.client.Database(s.db).Collection(s.collection)
+}
@@ -0,0 +1,24 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/maximthomas/gortas/pkg/config"
+)
+
+// NewAdminMiddleware checks the bearer token of the admin endpoints,
+// the token is read from the current configuration on every request, so it is updated on the configuration reload
+func NewAdminMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		admin := config.GetConfig().Server.Admin
+		token := strings.TrimPrefix(c.Request.Header.Get("Authorization"), "Bearer ")
+		if !admin.Enabled || admin.Token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(admin.Token)) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Not authenticated"})
+			return
+		}
+		c.Next()
+	}
+}
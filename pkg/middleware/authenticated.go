@@ -69,8 +69,10 @@ func (a *authenticatedMiddleware) build() gin.HandlerFunc {
 				ID:         sessionID,
 				Properties: sessionProps,
 			}
+			// the authentication context claims are not strings, so they are converted as in the session service
+			sess.SetAuthContext(session.AuthContextFromClaims(claims))
 		} else {
-			sess, err = session.GetSessionService().GetSession(sessionID)
+			sess, err = session.GetSessionService().GetSession(c.Request.Context(), sessionID)
 			if err != nil {
 				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Not authenticated"})
 				return
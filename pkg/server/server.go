@@ -1,20 +1,25 @@
 package server
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"os"
+	"strings"
+
 	"github.com/gin-gonic/gin"
 	"github.com/maximthomas/gortas/pkg/config"
 	"github.com/maximthomas/gortas/pkg/controller"
 	"github.com/maximthomas/gortas/pkg/middleware"
+	"github.com/pkg/errors"
 	cors "github.com/rs/cors/wrapper/gin"
 )
 
+// SetupRouter creates routes for the configuration, allowed origins are read from the current configuration
+// on every request, so they are updated on the configuration reload
 func SetupRouter(conf *config.Config) *gin.Engine {
 	router := gin.Default()
-	c := cors.New(cors.Options{
-		AllowedOrigins:   conf.Server.Cors.AllowedOrigins,
-		AllowCredentials: true,
-		Debug:            gin.IsDebugging(),
-	})
+	c := corsMiddleware()
 
 	ru := middleware.NewRequestURIMiddleware()
 
@@ -29,19 +34,131 @@ func SetupRouter(conf *config.Config) *gin.Engine {
 			route := "/:flow"
 			auth.GET(route, ac.Auth)
 			auth.POST(route, ac.Auth)
+			auth.GET(route+"/:module/metadata", ac.ModuleMetadata)
 		}
 		session := v1.Group("/session")
 		session.GET("/info", sc.SessionInfo)
 		session.GET("/jwt", sc.SessionJwt)
+		// api keys of the session user, the session settings are read on startup
+		var akc = controller.NewAPIKeyController()
+		apiKeys := v1.Group("/apikeys", middleware.NewAuthenticatedMiddleware(&conf.Session))
+		apiKeys.GET("", akc.List)
+		apiKeys.POST("", akc.Create)
+		apiKeys.DELETE("/:id", akc.Revoke)
+		// admin endpoints are registered on startup, enabling them requires restart
+		if conf.Server.Admin.Enabled {
+			var adm = controller.NewAdminController()
+			admin := v1.Group("/admin", middleware.NewAdminMiddleware())
+			admin.GET("/flows/:flow/diagram", adm.FlowDiagram)
+		}
 
 	}
 	return router
 }
 
+// corsMiddleware allows credentials only for the explicitly listed origins.
+// Other origins are allowed without credentials, if the allowed origins are empty or contain *,
+// so browsers do not send the session cookie with cross-origin requests from any site
+func corsMiddleware() gin.HandlerFunc {
+	credentialed := cors.New(cors.Options{
+		AllowOriginFunc: func(origin string) bool {
+			return originAllowed(config.GetConfig().Server.Cors.AllowedOrigins, origin)
+		},
+		AllowCredentials: true,
+		Debug:            gin.IsDebugging(),
+	})
+	public := cors.New(cors.Options{
+		AllowedOrigins: []string{"*"},
+		Debug:          gin.IsDebugging(),
+	})
+	return func(c *gin.Context) {
+		allowedOrigins := config.GetConfig().Server.Cors.AllowedOrigins
+		if allOriginsAllowed(allowedOrigins) && !originAllowed(allowedOrigins, c.GetHeader("Origin")) {
+			public(c)
+			return
+		}
+		credentialed(c)
+	}
+}
+
+// allOriginsAllowed returns true if the allowed origins are not set or contain *
+func allOriginsAllowed(allowedOrigins []string) bool {
+	for _, o := range allowedOrigins {
+		if o == "*" {
+			return true
+		}
+	}
+	return len(allowedOrigins) == 0
+}
+
+// originAllowed checks the origin against the explicitly allowed origins,
+// an allowed origin could contain one wildcard, * is not matched, as it allows origins only without credentials
+func originAllowed(allowedOrigins []string, origin string) bool {
+	origin = strings.ToLower(origin)
+	for _, o := range allowedOrigins {
+		o = strings.ToLower(o)
+		if o == "*" {
+			continue
+		}
+		if o == origin {
+			return true
+		}
+		if i := strings.IndexByte(o, '*'); i >= 0 {
+			prefix, suffix := o[:i], o[i+1:]
+			if len(origin) >= len(prefix)+len(suffix) && strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// tlsConfig creates the TLS settings of the listener with the server certificate and the client certificate verification
+func tlsConfig(c config.TLS) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "error loading server certificate")
+	}
+	clientAuth, err := c.ClientAuthType()
+	if err != nil {
+		return nil, err
+	}
+	tc := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   clientAuth,
+	}
+	if c.ClientCAFile != "" {
+		b, err := os.ReadFile(c.ClientCAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "error reading client CA file")
+		}
+		tc.ClientCAs = x509.NewCertPool()
+		if !tc.ClientCAs.AppendCertsFromPEM(b) {
+			return nil, errors.Errorf("no certificates found in %v", c.ClientCAFile)
+		}
+	}
+	return tc, nil
+}
+
 func RunServer() {
+	config.WatchConfig()
 	ac := config.GetConfig()
 	router := SetupRouter(&ac)
-	err := router.Run(":" + "8080")
+	srv := &http.Server{Addr: ac.Server.Address, Handler: router}
+	if srv.Addr == "" {
+		srv.Addr = ":8080"
+	}
+	var err error
+	if ac.Server.TLS.CertFile == "" {
+		err = srv.ListenAndServe()
+	} else {
+		srv.TLSConfig, err = tlsConfig(ac.Server.TLS)
+		if err != nil {
+			panic(err)
+		}
+		err = srv.ListenAndServeTLS("", "")
+	}
 	if err != nil {
 		panic(err)
 	}
@@ -2,18 +2,27 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 
@@ -59,6 +68,25 @@ var (
 				Type: "qr",
 			},
 		}},
+		"basic": {Modules: []config.Module{
+			{
+				ID:   "basic",
+				Type: "basic",
+			},
+		}},
+		"basic-pwd": {Modules: []config.Module{
+			{
+				ID:   "basic",
+				Type: "basic",
+				Amr:  "pwd",
+			},
+		}},
+		"api": {Modules: []config.Module{
+			{
+				ID:   "apiKey",
+				Type: "apiKey",
+			},
+		}},
 	}
 
 	conf = config.Config{
@@ -83,7 +111,7 @@ func init() {
 }
 
 func TestSetupRouter(t *testing.T) {
-	assert.Equal(t, 4, len(router.Routes()))
+	assert.Equal(t, 8, len(router.Routes()))
 }
 
 const target = "http://localhost/gortas/v1/auth/default"
@@ -182,7 +210,9 @@ func TestLogin(t *testing.T) {
 	})
 
 	t.Run("Test successful authentication", func(t *testing.T) {
-		_ = us.SetPassword("jerso", "passw0rd")
+		// passwords of users, that could not be read, are never valid
+		_, _ = us.CreateUser(context.Background(), user.User{ID: "jerso"})
+		_ = us.SetPassword(context.Background(), "jerso", "passw0rd")
 		request := httptest.NewRequest("GET", target, nil)
 		recorder := httptest.NewRecorder()
 
@@ -249,7 +279,7 @@ func TestLogin(t *testing.T) {
 		const login = "jerso"
 		const password = "passw0rd"
 
-		_ = us.SetPassword(login, password)
+		_ = us.SetPassword(context.Background(), login, password)
 
 		cbReq := callbacks.Request{
 			Callbacks: []callbacks.Callback{
@@ -299,7 +329,8 @@ func TestLogin(t *testing.T) {
 		var respJSON = make(map[string]interface{})
 		_ = json.Unmarshal(recorder.Body.Bytes(), &respJSON)
 		assert.Equal(t, "fail", respJSON["status"])
-		assert.Equal(t, 401, recorder.Result().StatusCode)
+		assert.Equal(t, "invalid_callbacks", respJSON["error"].(map[string]interface{})["code"])
+		assert.Equal(t, 400, recorder.Result().StatusCode)
 	})
 }
 
@@ -351,9 +382,9 @@ func TestAuthQR(t *testing.T) {
 	t.Skip()
 	assert.Fail(t, "implement test")
 	const secret = "s3cr3t"
-	user1, _ := us.GetUser("user1")
+	user1, _ := us.GetUser(context.Background(), "user1")
 	user1.SetProperty("passwordless.qr", fmt.Sprintf(`{"secret": "%q"}`, secret))
-	_ = us.UpdateUser(user1)
+	_ = us.UpdateUser(context.Background(), user1)
 
 	request := httptest.NewRequest("GET", "http://localhost/gortas/v1/login/staff/qr", nil)
 	recorder := httptest.NewRecorder()
@@ -432,3 +463,308 @@ func getCookieValue(name string, c []*http.Cookie) (string, error) {
 	}
 	return "", errors.New("cookie not found")
 }
+
+func TestOriginAllowed(t *testing.T) {
+	tests := []struct {
+		allowed []string
+		origin  string
+		want    bool
+	}{
+		{[]string{"http://localhost:3000"}, "http://localhost:3000", true},
+		{[]string{"http://localhost:3000"}, "http://LOCALHOST:3000", true},
+		{[]string{"http://localhost:3000"}, "http://localhost:4000", false},
+		{[]string{"*"}, "http://example.com", false},
+		{[]string{"*", "http://localhost:3000"}, "http://localhost:3000", true},
+		{[]string{"https://*.example.com"}, "https://app.example.com", true},
+		{[]string{"https://*.example.com"}, "https://example.com", false},
+		{nil, "http://localhost:3000", false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, originAllowed(tt.allowed, tt.origin), "%v %v", tt.allowed, tt.origin)
+	}
+}
+
+func TestCors_ConfigReload(t *testing.T) {
+	prev := config.GetConfig()
+	defer func() {
+		config.SetConfig(&prev)
+		user.SetUserService(us)
+		session.SetSessionService(&ss)
+	}()
+
+	request := func() string {
+		req := httptest.NewRequest("GET", target, nil)
+		req.Header.Set("Origin", "http://localhost:3000")
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder.Header().Get("Access-Control-Allow-Origin")
+	}
+	assert.Equal(t, "*", request())
+
+	c := prev
+	c.Server.Cors.AllowedOrigins = []string{"http://localhost:4000"}
+	config.SetConfig(&c)
+	assert.Empty(t, request())
+
+	c.Server.Cors.AllowedOrigins = []string{"http://localhost:3000"}
+	config.SetConfig(&c)
+	assert.Equal(t, "http://localhost:3000", request())
+}
+
+func TestCors_AllOriginsWithoutCredentials(t *testing.T) {
+	prev := config.GetConfig()
+	defer func() {
+		config.SetConfig(&prev)
+		user.SetUserService(us)
+		session.SetSessionService(&ss)
+	}()
+	c := prev
+	c.Server.Cors.AllowedOrigins = []string{"*", "https://app.example.com"}
+	config.SetConfig(&c)
+
+	tests := []struct {
+		origin      string
+		allowOrigin string
+		credentials string
+	}{
+		{origin: "https://evil.example.org", allowOrigin: "*"},
+		{origin: "https://app.example.com", allowOrigin: "https://app.example.com", credentials: "true"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.origin, func(t *testing.T) {
+			for _, method := range []string{http.MethodGet, http.MethodOptions} {
+				req := httptest.NewRequest(method, "http://localhost/gortas/v1/session", nil)
+				req.Header.Set("Origin", tt.origin)
+				if method == http.MethodOptions {
+					req.Header.Set("Access-Control-Request-Method", http.MethodGet)
+				}
+				recorder := httptest.NewRecorder()
+				router.ServeHTTP(recorder, req)
+				assert.Equal(t, tt.allowOrigin, recorder.Header().Get("Access-Control-Allow-Origin"), method)
+				assert.Equal(t, tt.credentials, recorder.Header().Get("Access-Control-Allow-Credentials"), method)
+			}
+		})
+	}
+}
+
+func TestAdmin_FlowDiagram(t *testing.T) {
+	prev := config.GetConfig()
+	defer func() {
+		config.SetConfig(&prev)
+		user.SetUserService(us)
+		session.SetSessionService(&ss)
+	}()
+	c := prev
+	c.Server.Admin = config.Admin{Enabled: true, Token: "admin-token"}
+	config.SetConfig(&c)
+	adminRouter := SetupRouter(&c)
+	assert.Equal(t, 9, len(adminRouter.Routes()))
+
+	tests := []struct {
+		name        string
+		path        string
+		token       string
+		status      int
+		contentType string
+		body        string
+	}{
+		{name: "without token", path: "/default/diagram", status: http.StatusUnauthorized},
+		{name: "invalid token", path: "/default/diagram", token: "bad", status: http.StatusUnauthorized},
+		{name: "mermaid", path: "/default/diagram", token: "admin-token", status: http.StatusOK,
+			contentType: "text/plain; charset=utf-8", body: `m0["login: login<br/>requisite"]`},
+		{name: "dot", path: "/default/diagram?format=dot", token: "admin-token", status: http.StatusOK,
+			contentType: "text/vnd.graphviz; charset=utf-8", body: `digraph "default" {`},
+		{name: "unknown format", path: "/default/diagram?format=svg", token: "admin-token", status: http.StatusBadRequest},
+		{name: "unknown flow", path: "/unknown/diagram", token: "admin-token", status: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest("GET", "http://localhost/gortas/v1/admin/flows"+tt.path, nil)
+			if tt.token != "" {
+				request.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			recorder := httptest.NewRecorder()
+			adminRouter.ServeHTTP(recorder, request)
+			assert.Equal(t, tt.status, recorder.Code)
+			if tt.contentType != "" {
+				assert.Equal(t, tt.contentType, recorder.Header().Get("Content-Type"))
+			}
+			assert.Contains(t, recorder.Body.String(), tt.body)
+		})
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	serve := func(method, path, token string, header http.Header, body string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, "http://localhost/gortas/v1"+path, strings.NewReader(body))
+		for k := range header {
+			request.Header.Set(k, header.Get(k))
+		}
+		if token != "" {
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	// basic authentication returns the challenge until the credentials are valid
+	recorder := serve("GET", "/auth/basic", "", nil, "")
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+	assert.Equal(t, `Basic realm="gortas", charset="UTF-8"`, recorder.Header().Get("WWW-Authenticate"))
+	request := httptest.NewRequest("GET", "/", nil)
+	request.SetBasicAuth("user1", "password")
+	recorder = serve("GET", "/auth/basic", "", request.Header, "")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var resp callbacks.Response
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &resp))
+	basicToken := resp.Token
+	assert.NotEmpty(t, basicToken)
+
+	// keys are managed only with the session of a recent interactive authentication
+	token := doLogin("user1", "password")
+	assert.NotEmpty(t, token)
+	assert.Equal(t, http.StatusUnauthorized, serve("GET", "/apikeys", "", nil, "").Code)
+	recorder = serve("POST", "/apikeys", basicToken, nil, `{"name": "ci"}`)
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "interactive authentication required")
+	// the module type is checked, so overriding amr does not make the basic session interactive
+	recorder = serve("GET", "/auth/basic-pwd", "", request.Header, "")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &resp))
+	recorder = serve("POST", "/apikeys", resp.Token, nil, `{"name": "ci"}`)
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "interactive authentication required")
+	staleToken, err := ss.CreateUserSession(context.Background(), "user1",
+		session.AuthContext{Amr: []string{"login"}, AuthTime: time.Now().Add(-time.Hour), Modules: []string{"login"}})
+	assert.NoError(t, err)
+	recorder = serve("POST", "/apikeys", staleToken, nil, `{"name": "ci"}`)
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "recent authentication required")
+
+	assert.Equal(t, http.StatusBadRequest, serve("POST", "/apikeys", token, nil, `{"expiresInSec": -1}`).Code)
+	assert.Equal(t, http.StatusBadRequest, serve("POST", "/apikeys", token, nil, `{"expiresInSec": 31536001}`).Code)
+	recorder = serve("POST", "/apikeys", token, nil, `{"name": "ci"}`)
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+	var created struct {
+		ID        string `json:"id"`
+		Key       string `json:"key"`
+		CreatedAt int64  `json:"createdAt"`
+		ExpiresAt int64  `json:"expiresAt"`
+	}
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &created))
+	assert.NotEmpty(t, created.Key)
+	assert.Equal(t, int64(90*24*3600), created.ExpiresAt-created.CreatedAt)
+
+	recorder = serve("GET", "/apikeys", token, nil, "")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var list struct {
+		Keys []user.APIKey `json:"keys"`
+	}
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &list))
+	assert.Equal(t, 1, len(list.Keys))
+	assert.Equal(t, created.ID, list.Keys[0].ID)
+	assert.Equal(t, "ci", list.Keys[0].Name)
+	assert.Empty(t, list.Keys[0].Hash)
+
+	keyHeader := http.Header{"X-Api-Key": {created.Key}}
+	recorder = serve("GET", "/auth/api", "", keyHeader, "")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &resp))
+	assert.NotEmpty(t, resp.Token)
+	// the session of the api key lists the keys, but could not create or revoke them
+	assert.Equal(t, http.StatusOK, serve("GET", "/apikeys", resp.Token, nil, "").Code)
+	recorder = serve("POST", "/apikeys", resp.Token, nil, `{"name": "ci"}`)
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "interactive authentication required")
+	assert.Equal(t, http.StatusForbidden, serve("DELETE", "/apikeys/"+created.ID, resp.Token, nil, "").Code)
+
+	assert.Equal(t, http.StatusNoContent, serve("DELETE", "/apikeys/"+created.ID, token, nil, "").Code)
+	assert.Equal(t, http.StatusNotFound, serve("DELETE", "/apikeys/"+created.ID, token, nil, "").Code)
+	assert.Equal(t, http.StatusUnauthorized, serve("GET", "/auth/api", "", keyHeader, "").Code)
+
+	// the settings are read on every request
+	c := config.GetConfig()
+	c.Server.APIKeys = config.APIKeys{MinAuthLevel: 1}
+	config.SetConfig(&c)
+	defer config.SetConfig(&conf)
+	assert.Equal(t, http.StatusForbidden, serve("POST", "/apikeys", token, nil, `{"name": "ci"}`).Code)
+}
+
+// issueTestCertificate creates the certificate and its PEM files, signed by the parent, self-signed CA if the parent is nil
+func issueTestCertificate(t *testing.T, tmpl *x509.Certificate, parent *tls.Certificate) (tls.Certificate, string, string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	tmpl.SerialNumber = big.NewInt(time.Now().UnixNano())
+	tmpl.NotBefore, tmpl.NotAfter = time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	issuer, issuerKey := tmpl, interface{}(key)
+	if parent != nil {
+		issuer, issuerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, issuer, &key.PublicKey, issuerKey)
+	assert.NoError(t, err)
+	leaf, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	assert.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0600))
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, certFile, keyFile
+}
+
+func TestTLSConfig(t *testing.T) {
+	ca, caFile, _ := issueTestCertificate(t, &x509.Certificate{Subject: pkix.Name{CommonName: "ca"}, IsCA: true,
+		BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign}, nil)
+	_, certFile, keyFile := issueTestCertificate(t, &x509.Certificate{Subject: pkix.Name{CommonName: "gortas"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")}, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}}, &ca)
+	client, _, _ := issueTestCertificate(t, &x509.Certificate{Subject: pkix.Name{CommonName: "kiosk-1"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}, &ca)
+
+	tests := []struct {
+		name       string
+		clientAuth string
+		clientCert bool
+		peer       string
+		fails      bool
+	}{
+		{name: "no client certificate", clientAuth: "none", clientCert: true},
+		{name: "verify if given", clientAuth: "verifyIfGiven", clientCert: true, peer: "kiosk-1"},
+		{name: "verify if given without certificate", clientAuth: "verifyIfGiven"},
+		{name: "required", clientAuth: "requireAndVerify", clientCert: true, peer: "kiosk-1"},
+		{name: "required without certificate", clientAuth: "requireAndVerify", fails: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc, err := tlsConfig(config.TLS{CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile, ClientAuth: tt.clientAuth})
+			assert.NoError(t, err)
+			s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if len(r.TLS.PeerCertificates) > 0 {
+					_, _ = w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+				}
+			}))
+			s.TLS = tc
+			s.StartTLS()
+			defer s.Close()
+
+			roots := x509.NewCertPool()
+			roots.AddCert(ca.Leaf)
+			clientTLS := &tls.Config{RootCAs: roots}
+			if tt.clientCert {
+				clientTLS.Certificates = []tls.Certificate{client}
+			}
+			resp, err := (&http.Client{Transport: &http.Transport{TLSClientConfig: clientTLS}}).Get(s.URL)
+			if tt.fails {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			assert.Equal(t, tt.peer, string(body))
+		})
+	}
+
+	_, err := tlsConfig(config.TLS{CertFile: certFile, KeyFile: keyFile, ClientCAFile: keyFile, ClientAuth: "requireAndVerify"})
+	assert.Error(t, err)
+}
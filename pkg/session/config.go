@@ -1,5 +1,10 @@
 package session
 
+import (
+	"errors"
+	"fmt"
+)
+
 type Config struct {
 	Type      string    `yaml:"type"`
 	Expires   int       `yaml:"expires"`
@@ -15,4 +20,39 @@ type JWT struct {
 type DataStore struct {
 	Type       string
 	Properties map[string]string
+	TimeoutSec int `yaml:"timeoutSec,omitempty"` // deadline of a single data store call, 5 seconds by default
+}
+
+// Validate checks the session type, the jwt key and the data store settings
+func (c *Config) Validate() error {
+	var errs []error
+	switch c.Type {
+	case "", "stateful", "stateless":
+	default:
+		errs = append(errs, fmt.Errorf("type: unknown session type %v", c.Type))
+	}
+	if c.Jwt.PrivateKeyPem == "" {
+		if c.Type == "stateless" {
+			errs = append(errs, errors.New("jwt.privateKeyPem: private key is required for stateless sessions"))
+		}
+	} else {
+		if _, err := parsePrivateKey(c.Jwt.PrivateKeyPem); err != nil {
+			errs = append(errs, fmt.Errorf("jwt.privateKeyPem: %w", err))
+		}
+		if c.Expires <= 0 {
+			errs = append(errs, errors.New("expires: should be positive"))
+		}
+	}
+	switch c.DataStore.Type {
+	case "", "inMemory":
+	case "mongo":
+		for _, p := range []string{"url", "database", "collection"} {
+			if c.DataStore.Properties[p] == "" {
+				errs = append(errs, fmt.Errorf("dataStore.properties.%v: is required for mongo data store", p))
+			}
+		}
+	default:
+		errs = append(errs, fmt.Errorf("dataStore.type: unknown data store type %v", c.DataStore.Type))
+	}
+	return errors.Join(errs...)
 }
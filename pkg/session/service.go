@@ -1,15 +1,19 @@
 package session
 
 import (
+	"context"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
 	"errors"
+	"fmt"
 	"math/rand"
+	"strconv"
 	"time"
 
 	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/google/uuid"
+	"github.com/maximthomas/gortas/pkg/datastore"
 	"github.com/maximthomas/gortas/pkg/user"
 	"github.com/mitchellh/mapstructure"
 )
@@ -19,6 +23,7 @@ type Service struct {
 	sessionType string
 	jwt         Jwt
 	expires     int
+	timeout     time.Duration
 }
 
 type Jwt struct {
@@ -28,24 +33,39 @@ type Jwt struct {
 	PublicKey    *rsa.PublicKey
 }
 
-func (ss *Service) CreateSession(session Session) (Session, error) {
-	return ss.repo.CreateSession(session)
+func (ss *Service) CreateSession(ctx context.Context, session Session) (Session, error) {
+	ctx, cancel := datastore.CallContext(ctx, ss.timeout)
+	defer cancel()
+	return ss.repo.CreateSession(ctx, session)
 }
 
-func (ss *Service) DeleteSession(id string) error {
-	return ss.repo.DeleteSession(id)
+func (ss *Service) DeleteSession(ctx context.Context, id string) error {
+	ctx, cancel := datastore.CallContext(ctx, ss.timeout)
+	defer cancel()
+	return ss.repo.DeleteSession(ctx, id)
 }
 
-func (ss *Service) GetSession(id string) (Session, error) {
-	return ss.repo.GetSession(id)
+func (ss *Service) GetSession(ctx context.Context, id string) (Session, error) {
+	ctx, cancel := datastore.CallContext(ctx, ss.timeout)
+	defer cancel()
+	return ss.repo.GetSession(ctx, id)
 }
 
-func (ss *Service) UpdateSession(session Session) error {
-	return ss.repo.UpdateSession(session)
+func (ss *Service) UpdateSession(ctx context.Context, session Session) error {
+	ctx, cancel := datastore.CallContext(ctx, ss.timeout)
+	defer cancel()
+	return ss.repo.UpdateSession(ctx, session)
 }
 
-func (ss *Service) ConvertSessionToJwt(sessID string) (string, error) {
-	sess, err := ss.GetSession(sessID)
+// DeleteUserSessions deletes all sessions of the user, stateless session tokens stay valid until they expire
+func (ss *Service) DeleteUserSessions(ctx context.Context, userID string) error {
+	ctx, cancel := datastore.CallContext(ctx, ss.timeout)
+	defer cancel()
+	return ss.repo.DeleteUserSessions(ctx, userID)
+}
+
+func (ss *Service) ConvertSessionToJwt(ctx context.Context, sessID string) (string, error) {
+	sess, err := ss.GetSession(ctx, sessID)
 	if err != nil {
 		return "", err
 	}
@@ -58,46 +78,47 @@ func (ss *Service) ConvertSessionToJwt(sessID string) (string, error) {
 	claims["iat"] = time.Now().Unix()
 	claims["iss"] = ss.jwt.Issuer
 	claims["sub"] = sess.GetUserID()
-	claims["props"] = sess.Properties
+	claims["props"] = publicProperties(sess.Properties)
+	if _, ok := sess.Properties[AcrProperty]; ok {
+		setAuthContextClaims(claims, sess.GetAuthContext())
+	}
 	token.Header["jks"] = ss.jwt.PrivateKeyID
 	return token.SignedString(ss.jwt.PrivateKey)
 }
 
-func (ss *Service) CreateUserSession(userID string) (sessID string, err error) {
+// CreateUserSession creates authenticated user session with the authentication context
+func (ss *Service) CreateUserSession(ctx context.Context, userID string, ac AuthContext) (sessID string, err error) {
 	var sessionID string
-	u, userExists := user.GetUserService().GetUser(userID)
+	us := user.GetUserService()
+	u, userExists := us.GetUser(ctx, userID)
 	if ss.sessionType == "stateless" {
-		token := jwt.New(jwt.SigningMethodRS256)
-		claims := token.Claims.(jwt.MapClaims)
-		exp := time.Second * time.Duration(rand.Intn(ss.expires))
-		claims["exp"] = time.Now().Add(exp).Unix()
-		claims["jti"] = ss.jwt.PrivateKeyID
-		claims["iat"] = time.Now().Unix()
-		claims["iss"] = ss.jwt.Issuer
-		claims["sub"] = userID
+		var sessionProps map[string]string
 		if userExists {
-			claims["props"] = u.Properties
+			sessionProps = publicProperties(u.Properties)
+		}
+		sessionID, err = ss.newSessionToken(userID, sessionProps, ac)
+		if err != nil {
+			return sessID, err
 		}
-
-		token.Header["jks"] = ss.jwt.PrivateKeyID
-		ss, _ := token.SignedString(ss.jwt.PrivateKey)
-		sessionID = ss
 	} else {
 		sessionID = uuid.New().String()
 		newSession := Session{
-			ID: sessionID,
-			Properties: map[string]string{
-				"userId": u.ID,
-				"sub":    userID,
-			},
+			ID:         sessionID,
+			Properties: make(map[string]string),
 		}
+		// user properties are copied first, so they could not overwrite the subject and the authentication context
 		if userExists {
-			for k, v := range u.Properties {
+			for k, v := range publicProperties(u.Properties) {
 				newSession.Properties[k] = v
 			}
 		}
+		newSession.Properties["userId"] = u.ID
+		newSession.Properties["sub"] = userID
+		for k, v := range ac.properties() {
+			newSession.Properties[k] = v
+		}
 
-		newSession, err = ss.CreateSession(newSession)
+		newSession, err = ss.CreateSession(ctx, newSession)
 		if err != nil {
 			return sessID, err
 		}
@@ -105,7 +126,87 @@ func (ss *Service) CreateUserSession(userID string) (sessID string, err error) {
 	return sessionID, nil
 }
 
-func (ss *Service) GetSessionData(sessionID string) (sess map[string]interface{}, err error) {
+// GetUserSession returns authenticated user session by the session id or by the token for stateless sessions
+func (ss *Service) GetUserSession(ctx context.Context, sessionID string) (sess Session, err error) {
+	if ss.sessionType == "stateless" {
+		claims := jwt.MapClaims{}
+		_, err = jwt.ParseWithClaims(sessionID, claims, func(token *jwt.Token) (interface{}, error) {
+			return ss.jwt.PublicKey, nil
+		})
+		if err != nil {
+			return sess, err
+		}
+		sess = Session{
+			ID:         sessionID,
+			Properties: make(map[string]string),
+		}
+		if props, ok := claims["props"].(map[string]interface{}); ok {
+			for k, v := range props {
+				sess.Properties[k] = fmt.Sprintf("%v", v)
+			}
+		}
+		if sub, ok := claims["sub"].(string); ok {
+			sess.SetUserID(sub)
+		}
+		sess.SetAuthContext(AuthContextFromClaims(claims))
+	} else {
+		sess, err = ss.GetSession(ctx, sessionID)
+		if err != nil {
+			return sess, err
+		}
+	}
+	if sess.GetUserID() == "" {
+		return sess, errors.New("user session not found")
+	}
+	return sess, nil
+}
+
+// UpdateUserSession sets the authentication context of the authenticated user session and returns the session id,
+// stateless sessions can not be changed, so a new token with the same subject is issued
+func (ss *Service) UpdateUserSession(ctx context.Context, sess Session, ac AuthContext) (sessID string, err error) {
+	if sess.Properties == nil {
+		sess.Properties = make(map[string]string)
+	}
+	if ss.sessionType == "stateless" {
+		sessionProps := make(map[string]string)
+		for k, v := range sess.Properties {
+			switch k {
+			case "sub", AcrProperty, AmrProperty, AuthTimeProperty, AuthModulesProperty:
+			default:
+				sessionProps[k] = v
+			}
+		}
+		return ss.newSessionToken(sess.GetUserID(), sessionProps, ac)
+	}
+	for k, v := range ac.properties() {
+		sess.Properties[k] = v
+	}
+	err = ss.UpdateSession(ctx, sess)
+	if err != nil {
+		return sessID, err
+	}
+	return sess.ID, nil
+}
+
+func (ss *Service) newSessionToken(userID string, props map[string]string, ac AuthContext) (string, error) {
+	token := jwt.New(jwt.SigningMethodRS256)
+	claims := token.Claims.(jwt.MapClaims)
+	exp := time.Second * time.Duration(rand.Intn(ss.expires))
+	claims["exp"] = time.Now().Add(exp).Unix()
+	claims["jti"] = ss.jwt.PrivateKeyID
+	claims["iat"] = time.Now().Unix()
+	claims["iss"] = ss.jwt.Issuer
+	claims["sub"] = userID
+	if len(props) > 0 {
+		claims["props"] = props
+	}
+	setAuthContextClaims(claims, ac)
+
+	token.Header["jks"] = ss.jwt.PrivateKeyID
+	return token.SignedString(ss.jwt.PrivateKey)
+}
+
+func (ss *Service) GetSessionData(ctx context.Context, sessionID string) (sess map[string]interface{}, err error) {
 	sess = make(map[string]interface{})
 
 	if ss.sessionType == "stateless" {
@@ -120,7 +221,7 @@ func (ss *Service) GetSessionData(sessionID string) (sess map[string]interface{}
 		sess = claims
 	} else {
 		var statefulSession Session
-		statefulSession, err = ss.GetSession(sessionID)
+		statefulSession, err = ss.GetSession(ctx, sessionID)
 		if statefulSession.GetUserID() == "" {
 			return sess, errors.New("user session  not found")
 		}
@@ -129,11 +230,24 @@ func (ss *Service) GetSessionData(sessionID string) (sess map[string]interface{}
 		}
 		sess["id"] = statefulSession.ID
 		sess["created"] = statefulSession.CreatedAt
-		sess["properties"] = statefulSession.Properties
+		sess["properties"] = publicProperties(statefulSession.Properties)
 	}
 	return sess, err
 }
 
+// publicProperties returns a copy of the properties without private user properties,
+// like the password history and secrets of authentication modules
+func publicProperties(props map[string]string) map[string]string {
+	us := user.GetUserService()
+	public := make(map[string]string, len(props))
+	for k, v := range props {
+		if !us.IsPrivateProperty(k) {
+			public[k] = v
+		}
+	}
+	return public
+}
+
 func (ss *Service) GetJwtPublicKey() *rsa.PublicKey {
 	return ss.jwt.PublicKey
 }
@@ -154,8 +268,7 @@ func newSessionServce(sc *Config) (ss Service, err error) {
 
 	if token.PrivateKeyPem != "" {
 		var privateKey *rsa.PrivateKey
-		privateKeyBlock, _ := pem.Decode([]byte(token.PrivateKeyPem))
-		privateKey, err = x509.ParsePKCS1PrivateKey(privateKeyBlock.Bytes)
+		privateKey, err = parsePrivateKey(token.PrivateKeyPem)
 		if err != nil {
 			return ss, err
 		}
@@ -184,9 +297,19 @@ func newSessionServce(sc *Config) (ss Service, err error) {
 	}
 	ss.sessionType = sc.Type
 	ss.expires = sc.Expires
+	ss.timeout = datastore.Timeout(sc.DataStore.TimeoutSec)
 	return ss, err
 }
 
+// parsePrivateKey parses PEM encoded PKCS1 RSA private key
+func parsePrivateKey(privateKeyPem string) (*rsa.PrivateKey, error) {
+	privateKeyBlock, _ := pem.Decode([]byte(privateKeyPem))
+	if privateKeyBlock == nil {
+		return nil, errors.New("invalid PEM private key")
+	}
+	return x509.ParsePKCS1PrivateKey(privateKeyBlock.Bytes)
+}
+
 func GetSessionService() *Service {
 	return &ss
 }
@@ -194,3 +317,38 @@ func GetSessionService() *Service {
 func SetSessionService(newSs *Service) {
 	ss = *newSs
 }
+
+func setAuthContextClaims(claims jwt.MapClaims, ac AuthContext) {
+	claims[AcrProperty] = ac.Acr()
+	if len(ac.Amr) > 0 {
+		claims[AmrProperty] = ac.Amr
+	}
+	if !ac.AuthTime.IsZero() {
+		claims[AuthTimeProperty] = ac.AuthTime.Unix()
+	}
+	if len(ac.Modules) > 0 {
+		claims[AuthModulesProperty] = ac.Modules
+	}
+}
+
+// AuthContextFromClaims returns the authentication context from the session token claims
+func AuthContextFromClaims(claims jwt.MapClaims) AuthContext {
+	var ac AuthContext
+	if acr, ok := claims[AcrProperty].(string); ok {
+		ac.Level, _ = strconv.Atoi(acr)
+	}
+	if amr, ok := claims[AmrProperty].([]interface{}); ok {
+		for _, m := range amr {
+			ac.Amr = append(ac.Amr, fmt.Sprintf("%v", m))
+		}
+	}
+	if authTime, ok := claims[AuthTimeProperty].(float64); ok {
+		ac.AuthTime = time.Unix(int64(authTime), 0)
+	}
+	if modules, ok := claims[AuthModulesProperty].([]interface{}); ok {
+		for _, m := range modules {
+			ac.Modules = append(ac.Modules, fmt.Sprintf("%v", m))
+		}
+	}
+	return ac
+}
@@ -0,0 +1,201 @@
+package session
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/maximthomas/gortas/pkg/datastore"
+	"github.com/maximthomas/gortas/pkg/user"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUserSession_AuthContext(t *testing.T) {
+	assert.NoError(t, user.InitUserService(user.Config{}))
+	privateKey, _ := rsa.GenerateKey(rand.Reader, 1024)
+	privateKeyStr := string(pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(privateKey),
+	}))
+	authTime := time.Unix(time.Now().Unix(), 0)
+	ac := AuthContext{Level: 1, Amr: []string{"login"}, AuthTime: authTime, Modules: []string{"login"}}
+	stepUpAc := AuthContext{Level: 2, Amr: []string{"login", "mfa", "otp"}, AuthTime: authTime.Add(time.Minute),
+		Modules: []string{"login", "otp"}}
+
+	for _, sessionType := range []string{"stateful", "stateless"} {
+		t.Run(sessionType, func(t *testing.T) {
+			ss, err := newSessionServce(&Config{
+				Type:    sessionType,
+				Expires: 60,
+				Jwt:     JWT{Issuer: "http://gortas", PrivateKeyPem: privateKeyStr},
+			})
+			assert.NoError(t, err)
+
+			sessID, err := ss.CreateUserSession(context.Background(), "user1", ac)
+			assert.NoError(t, err)
+			sess, err := ss.GetUserSession(context.Background(), sessID)
+			assert.NoError(t, err)
+			assert.Equal(t, "user1", sess.GetUserID())
+			assert.Equal(t, "1", sess.Properties[AcrProperty])
+			assert.Equal(t, ac, sess.GetAuthContext())
+
+			sessID, err = ss.UpdateUserSession(context.Background(), sess, stepUpAc)
+			assert.NoError(t, err)
+			sess, err = ss.GetUserSession(context.Background(), sessID)
+			assert.NoError(t, err)
+			assert.Equal(t, "user1", sess.GetUserID())
+			assert.Equal(t, stepUpAc, sess.GetAuthContext())
+		})
+	}
+
+	t.Run("invalid session", func(t *testing.T) {
+		ss, _ := newSessionServce(&Config{Type: "stateless", Jwt: JWT{PrivateKeyPem: privateKeyStr}})
+		_, err := ss.GetUserSession(context.Background(), "bad")
+		assert.Error(t, err)
+	})
+}
+
+func TestUserSession_ReservedProperties(t *testing.T) {
+	assert.NoError(t, user.InitUserService(user.Config{}))
+	ctx := context.Background()
+	u, _ := user.GetUserService().GetUser(ctx, "user1")
+	for _, p := range []string{"sub", "userId", AcrProperty, AmrProperty, AuthTimeProperty, AuthModulesProperty} {
+		u.SetProperty(p, "forged")
+	}
+	assert.NoError(t, user.GetUserService().UpdateUser(ctx, u))
+
+	ss, err := newSessionServce(&Config{Type: "stateful", Expires: 60})
+	assert.NoError(t, err)
+	authTime := time.Unix(time.Now().Unix(), 0)
+	sessID, err := ss.CreateUserSession(ctx, "user1", AuthContext{Level: 1, Amr: []string{"login"}, AuthTime: authTime})
+	assert.NoError(t, err)
+	sess, err := ss.GetUserSession(ctx, sessID)
+	assert.NoError(t, err)
+	assert.Equal(t, "user1", sess.GetUserID())
+	assert.Equal(t, "user1", sess.Properties["userId"])
+	assert.Equal(t, AuthContext{Level: 1, Amr: []string{"login"}, AuthTime: authTime}, sess.GetAuthContext())
+}
+
+func TestUserSession_PrivateProperties(t *testing.T) {
+	assert.NoError(t, user.InitUserService(user.Config{}))
+	// registered by the totp module
+	user.RegisterPrivateProperty("totpSecret")
+	ctx := context.Background()
+	u, _ := user.GetUserService().GetUser(ctx, "user1")
+	u.SetProperty("passwordHistory", "$2a$10$hash")
+	u.SetProperty("totpSecret", "encrypted")
+	u.SetProperty(user.APIKeysProperty, "[]")
+	u.SetProperty("email", "user1@example.com")
+	assert.NoError(t, user.GetUserService().UpdateUser(ctx, u))
+
+	privateKey, _ := rsa.GenerateKey(rand.Reader, 1024)
+	privateKeyStr := string(pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(privateKey),
+	}))
+	for _, sessionType := range []string{"stateful", "stateless"} {
+		t.Run(sessionType, func(t *testing.T) {
+			ss, err := newSessionServce(&Config{Type: sessionType, Expires: 60, Jwt: JWT{PrivateKeyPem: privateKeyStr}})
+			assert.NoError(t, err)
+			sessID, err := ss.CreateUserSession(ctx, "user1", AuthContext{Level: 1, Amr: []string{"login"}, AuthTime: time.Now()})
+			assert.NoError(t, err)
+
+			sess, err := ss.GetUserSession(ctx, sessID)
+			assert.NoError(t, err)
+			assert.Equal(t, "user1@example.com", sess.Properties["email"])
+			for _, p := range []string{"passwordHistory", "totpSecret", user.APIKeysProperty} {
+				assert.NotContains(t, sess.Properties, p)
+			}
+			data, err := ss.GetSessionData(ctx, sessID)
+			assert.NoError(t, err)
+			assert.NotContains(t, fmt.Sprint(data), "totpSecret")
+			assert.NotContains(t, fmt.Sprint(data), "passwordHistory")
+		})
+	}
+
+	t.Run("jwt of the stored session", func(t *testing.T) {
+		ss, err := newSessionServce(&Config{Type: "stateful", Expires: 60, Jwt: JWT{PrivateKeyPem: privateKeyStr}})
+		assert.NoError(t, err)
+		// the session, that was created with all user properties
+		sess, err := ss.CreateSession(ctx, Session{Properties: map[string]string{"sub": "user1", "userId": "user1", "totpSecret": "encrypted"}})
+		assert.NoError(t, err)
+		token, err := ss.ConvertSessionToJwt(ctx, sess.ID)
+		assert.NoError(t, err)
+		claims := jwt.MapClaims{}
+		_, err = jwt.ParseWithClaims(token, claims, func(token *jwt.Token) (interface{}, error) {
+			return ss.jwt.PublicKey, nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]interface{}{"sub": "user1", "userId": "user1"}, claims["props"])
+	})
+}
+
+// deadlineRepository records the deadline of the data store call
+type deadlineRepository struct {
+	sessionRepository
+	deadline time.Time
+}
+
+func (r *deadlineRepository) GetSession(ctx context.Context, id string) (Session, error) {
+	r.deadline, _ = ctx.Deadline()
+	return r.sessionRepository.GetSession(ctx, id)
+}
+
+func TestService_CallTimeout(t *testing.T) {
+	for _, tt := range []struct {
+		timeoutSec int
+		expected   time.Duration
+	}{
+		{0, datastore.DefaultTimeoutSec * time.Second},
+		{1, time.Second},
+	} {
+		ss, err := newSessionServce(&Config{Type: "stateful", DataStore: DataStore{TimeoutSec: tt.timeoutSec}})
+		assert.NoError(t, err)
+		repo := &deadlineRepository{sessionRepository: ss.repo}
+		ss.repo = repo
+		_, _ = ss.GetSession(context.Background(), "id")
+		assert.WithinDuration(t, time.Now().Add(tt.expected), repo.deadline, 500*time.Millisecond)
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	privateKey, _ := rsa.GenerateKey(rand.Reader, 1024)
+	privateKeyStr := string(pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(privateKey),
+	}))
+	tests := []struct {
+		name string
+		c    Config
+		err  string
+	}{
+		{name: "stateful", c: Config{Type: "stateful"}},
+		{name: "stateless", c: Config{Type: "stateless", Expires: 60, Jwt: JWT{PrivateKeyPem: privateKeyStr}}},
+		{name: "unknown type", c: Config{Type: "bad"}, err: "type: unknown session type bad"},
+		{name: "no private key", c: Config{Type: "stateless", Expires: 60},
+			err: "jwt.privateKeyPem: private key is required for stateless sessions"},
+		{name: "bad private key", c: Config{Type: "stateless", Expires: 60, Jwt: JWT{PrivateKeyPem: "bad"}},
+			err: "jwt.privateKeyPem: invalid PEM private key"},
+		{name: "no expiration", c: Config{Type: "stateless", Jwt: JWT{PrivateKeyPem: privateKeyStr}},
+			err: "expires: should be positive"},
+		{name: "mongo without properties", c: Config{DataStore: DataStore{Type: "mongo", Properties: map[string]string{"url": "mongodb://localhost"}}},
+			err: "dataStore.properties.database: is required for mongo data store\ndataStore.properties.collection: is required for mongo data store"},
+		{name: "unknown data store", c: Config{DataStore: DataStore{Type: "bad"}}, err: "dataStore.type: unknown data store type bad"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.c.Validate()
+			if tt.err == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tt.err)
+			}
+		})
+	}
+}
@@ -1,11 +1,49 @@
 package session
 
-import "time"
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// user session properties with the authentication context
+const (
+	AcrProperty         = "acr"
+	AmrProperty         = "amr"          // comma separated authentication method references
+	AuthTimeProperty    = "auth_time"    // unix time in seconds
+	AuthModulesProperty = "auth_modules" // comma separated types of the modules, that authenticated the user
+)
+
+// AuthContext describes how the user was authenticated
+type AuthContext struct {
+	Level    int      // authentication level, passed as acr
+	Amr      []string // authentication method references
+	AuthTime time.Time
+	Modules  []string // types of the modules, that authenticated the user, unlike amr they are not configurable
+}
+
+// Acr returns authentication context class reference of the authentication level
+func (ac AuthContext) Acr() string {
+	return strconv.Itoa(ac.Level)
+}
+
+func (ac AuthContext) properties() map[string]string {
+	props := map[string]string{
+		AcrProperty:         ac.Acr(),
+		AmrProperty:         strings.Join(ac.Amr, ","),
+		AuthModulesProperty: strings.Join(ac.Modules, ","),
+	}
+	if !ac.AuthTime.IsZero() {
+		props[AuthTimeProperty] = strconv.FormatInt(ac.AuthTime.Unix(), 10)
+	}
+	return props
+}
 
 // SessionDataStore struct represents session object from session service
 type Session struct {
 	ID         string            `json:"id,omitempty"`
 	CreatedAt  time.Time         `json:"createdat,omitempty" bson:"createdAt"`
+	ExpiresAt  time.Time         `json:"expiresat,omitempty" bson:"expiresAt,omitempty"` // optional, overrides the datastore session expiration
 	Properties map[string]string `json:"properties,omitempty"`
 }
 
@@ -28,3 +66,34 @@ func (s *Session) GetRealm() string {
 	}
 	return realm
 }
+
+// Expired returns true if the session has expiration time and it is over
+func (s *Session) Expired(now time.Time) bool {
+	return !s.ExpiresAt.IsZero() && now.After(s.ExpiresAt)
+}
+
+// GetAuthContext returns the authentication context from the session properties
+func (s *Session) GetAuthContext() AuthContext {
+	var ac AuthContext
+	ac.Level, _ = strconv.Atoi(s.Properties[AcrProperty])
+	if amr := s.Properties[AmrProperty]; amr != "" {
+		ac.Amr = strings.Split(amr, ",")
+	}
+	if authTime, err := strconv.ParseInt(s.Properties[AuthTimeProperty], 10, 64); err == nil {
+		ac.AuthTime = time.Unix(authTime, 0)
+	}
+	if modules := s.Properties[AuthModulesProperty]; modules != "" {
+		ac.Modules = strings.Split(modules, ",")
+	}
+	return ac
+}
+
+// SetAuthContext sets the authentication context to the session properties
+func (s *Session) SetAuthContext(ac AuthContext) {
+	if s.Properties == nil {
+		s.Properties = make(map[string]string)
+	}
+	for k, v := range ac.properties() {
+		s.Properties[k] = v
+	}
+}
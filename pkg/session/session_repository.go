@@ -1,36 +1,46 @@
 package session
 
 import (
+	"context"
 	"errors"
+	"sync"
 	"time"
 
+	"github.com/maximthomas/gortas/pkg/log"
+
 	"github.com/sirupsen/logrus"
 
 	"github.com/google/uuid"
 )
 
 type sessionRepository interface {
-	CreateSession(session Session) (Session, error)
-	DeleteSession(id string) error
-	GetSession(id string) (Session, error)
-	UpdateSession(session Session) error
+	CreateSession(ctx context.Context, session Session) (Session, error)
+	DeleteSession(ctx context.Context, id string) error
+	GetSession(ctx context.Context, id string) (Session, error)
+	UpdateSession(ctx context.Context, session Session) error
+	DeleteUserSessions(ctx context.Context, userID string) error
 }
 
 type inMemorySessionRepository struct {
 	sessions map[string]Session
+	mu       sync.RWMutex
 	logger   logrus.FieldLogger
 }
 
-func (sr *inMemorySessionRepository) CreateSession(session Session) (Session, error) {
+func (sr *inMemorySessionRepository) CreateSession(_ context.Context, session Session) (Session, error) {
 	if session.ID == "" {
 		session.ID = uuid.New().String()
 	}
 	session.CreatedAt = time.Now()
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
 	sr.sessions[session.ID] = session
 	return session, nil
 }
 
-func (sr *inMemorySessionRepository) DeleteSession(id string) error {
+func (sr *inMemorySessionRepository) DeleteSession(_ context.Context, id string) error {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
 	if _, ok := sr.sessions[id]; ok {
 		delete(sr.sessions, id)
 		return nil
@@ -38,14 +48,18 @@ func (sr *inMemorySessionRepository) DeleteSession(id string) error {
 	return errors.New("session does not exist")
 }
 
-func (sr *inMemorySessionRepository) GetSession(id string) (Session, error) {
+func (sr *inMemorySessionRepository) GetSession(_ context.Context, id string) (Session, error) {
+	sr.mu.RLock()
+	defer sr.mu.RUnlock()
 	if session, ok := sr.sessions[id]; ok {
 		return session, nil
 	}
 	return Session{}, errors.New("session does not exist")
 }
 
-func (sr *inMemorySessionRepository) UpdateSession(session Session) error {
+func (sr *inMemorySessionRepository) UpdateSession(_ context.Context, session Session) error {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
 	if _, ok := sr.sessions[session.ID]; ok {
 		sr.sessions[session.ID] = session
 		return nil
@@ -53,19 +67,40 @@ func (sr *inMemorySessionRepository) UpdateSession(session Session) error {
 	return errors.New("session does not exist")
 }
 
-const cleanupIntervalSeconds = 10
+func (sr *inMemorySessionRepository) DeleteUserSessions(_ context.Context, userID string) error {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	for k, sess := range sr.sessions {
+		if sess.GetUserID() == userID {
+			delete(sr.sessions, k)
+		}
+	}
+	return nil
+}
+
+const (
+	cleanupIntervalSeconds  = 10
+	inMemorySessionLifetime = 24 * time.Hour
+)
 
 func (sr *inMemorySessionRepository) cleanupExpired() {
 	ticker := time.NewTicker(time.Second * cleanupIntervalSeconds)
 	defer ticker.Stop()
 	for {
 		<-ticker.C
-		for k := range sr.sessions {
-			sess := sr.sessions[k]
-			if (sess.CreatedAt.Second() + 60*60*24) < time.Now().Second() {
-				sr.logger.Infof("delete session %s due to timeout", sess.ID)
-				delete(sr.sessions, k)
-			}
+		sr.deleteExpired(time.Now())
+	}
+}
+
+// deleteExpired deletes sessions with expired own expiration time or older than the repository session lifetime
+func (sr *inMemorySessionRepository) deleteExpired(now time.Time) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	for k := range sr.sessions {
+		sess := sr.sessions[k]
+		if sess.Expired(now) || sess.CreatedAt.Add(inMemorySessionLifetime).Before(now) {
+			sr.logger.Infof("delete session %s due to timeout", sess.ID)
+			delete(sr.sessions, k)
 		}
 	}
 }
@@ -73,6 +108,7 @@ func (sr *inMemorySessionRepository) cleanupExpired() {
 func newInMemorySessionRepository() sessionRepository {
 	repo := &inMemorySessionRepository{
 		sessions: make(map[string]Session),
+		logger:   log.WithField("module", "inMemorySessionRepository"),
 	}
 
 	go repo.cleanupExpired()
@@ -2,6 +2,7 @@ package session
 
 import (
 	"context"
+	"errors"
 	"log"
 	"time"
 
@@ -41,13 +42,21 @@ func newMongoSessionRepository(uri, db, c string) (*mongoSessionRepository, erro
 		}, Options: idxOpt,
 	}
 
+	// sessions with own expiration time, like authentication flow states, are deleted when the time is over
+	expiresIdxOpt := options.Index().SetExpireAfterSeconds(0)
+	expiresMod := mongo.IndexModel{
+		Keys: bson.M{
+			"expiresAt": 1,
+		}, Options: expiresIdxOpt,
+	}
+
 	rep := &mongoSessionRepository{
 		client:     client,
 		db:         db,
 		collection: c,
 	}
 
-	_, err = rep.getCollection().Indexes().CreateOne(ctx, mod)
+	_, err = rep.getCollection().Indexes().CreateMany(ctx, []mongo.IndexModel{mod, expiresMod})
 	if err != nil {
 		return nil, err
 	}
@@ -55,7 +64,7 @@ func newMongoSessionRepository(uri, db, c string) (*mongoSessionRepository, erro
 
 }
 
-func (sr *mongoSessionRepository) CreateSession(session Session) (Session, error) {
+func (sr *mongoSessionRepository) CreateSession(ctx context.Context, session Session) (Session, error) {
 	if session.ID == "" {
 		session.ID = uuid.New().String()
 	}
@@ -67,8 +76,6 @@ func (sr *mongoSessionRepository) CreateSession(session Session) (Session, error
 	}
 
 	collection := sr.getCollection()
-	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
-	defer cancel()
 
 	_, err := collection.InsertOne(ctx, &repoSession)
 	if err != nil {
@@ -78,10 +85,8 @@ func (sr *mongoSessionRepository) CreateSession(session Session) (Session, error
 	return session, nil
 }
 
-func (sr *mongoSessionRepository) DeleteSession(id string) error {
+func (sr *mongoSessionRepository) DeleteSession(ctx context.Context, id string) error {
 	collection := sr.getCollection()
-	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
-	defer cancel()
 	filter := bson.M{"id": id}
 	err := collection.FindOneAndDelete(ctx, filter).Err()
 	if err != nil {
@@ -90,11 +95,9 @@ func (sr *mongoSessionRepository) DeleteSession(id string) error {
 	return nil
 }
 
-func (sr *mongoSessionRepository) GetSession(id string) (Session, error) {
+func (sr *mongoSessionRepository) GetSession(ctx context.Context, id string) (Session, error) {
 	var session Session
 	collection := sr.getCollection()
-	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
-	defer cancel()
 	filter := bson.M{"id": id}
 
 	var repoSession mongoRepoSession
@@ -103,14 +106,16 @@ func (sr *mongoSessionRepository) GetSession(id string) (Session, error) {
 	if err != nil {
 		return session, err
 	}
+	// TTL monitor removes expired documents periodically, so expired sessions could still exist for a while
+	if repoSession.Expired(time.Now()) {
+		return session, errors.New("session expired")
+	}
 
 	return repoSession.Session, nil
 }
 
-func (sr *mongoSessionRepository) UpdateSession(session Session) error {
+func (sr *mongoSessionRepository) UpdateSession(ctx context.Context, session Session) error {
 	collection := sr.getCollection()
-	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
-	defer cancel()
 
 	filter := bson.M{"id": session.ID}
 	var repoSession mongoRepoSession
@@ -122,6 +127,11 @@ func (sr *mongoSessionRepository) UpdateSession(session Session) error {
 	return nil
 }
 
+func (sr *mongoSessionRepository) DeleteUserSessions(ctx context.Context, userID string) error {
+	_, err := sr.getCollection().DeleteMany(ctx, bson.M{"properties.sub": userID})
+	return err
+}
+
 func (sr *mongoSessionRepository) getCollection() *mongo.Collection {
 	return sr.client.Database(sr.db).Collection(sr.collection)
 }
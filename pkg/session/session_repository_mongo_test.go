@@ -19,12 +19,12 @@ func TestGetSession(t *testing.T) {
 
 	repo := getRepo(t, true)
 	t.Run("test get session", func(t *testing.T) {
-		sess, err := repo.GetSession(testSessionID)
+		sess, err := repo.GetSession(context.Background(), testSessionID)
 		assert.NoError(t, err)
 		assert.Equal(t, testSessionID, sess.ID)
 	})
 	t.Run("test get not existing session", func(t *testing.T) {
-		sess, err := repo.GetSession("bad")
+		sess, err := repo.GetSession(context.Background(), "bad")
 		assert.Error(t, err)
 		assert.Empty(t, sess.ID)
 	})
@@ -39,7 +39,7 @@ func TestCreateSession(t *testing.T) {
 				"prop1": "value",
 			},
 		}
-		newSession, err := repo.CreateSession(session)
+		newSession, err := repo.CreateSession(context.Background(), session)
 		assert.NoError(t, err)
 		assert.NotEmpty(t, newSession.ID)
 	})
@@ -48,13 +48,13 @@ func TestCreateSession(t *testing.T) {
 func TestDeleteSession(t *testing.T) {
 	repo := getRepo(t, true)
 	t.Run("test delete session", func(t *testing.T) {
-		_, err := repo.GetSession(testSessionID)
+		_, err := repo.GetSession(context.Background(), testSessionID)
 		assert.NoError(t, err)
 
-		err = repo.DeleteSession(testSessionID)
+		err = repo.DeleteSession(context.Background(), testSessionID)
 		assert.NoError(t, err)
 
-		_, err = repo.GetSession(testSessionID)
+		_, err = repo.GetSession(context.Background(), testSessionID)
 		assert.Error(t, err)
 
 	})
@@ -63,18 +63,18 @@ func TestDeleteSession(t *testing.T) {
 func TestUpdateSession(t *testing.T) {
 	repo := getRepo(t, true)
 	t.Run("test update session", func(t *testing.T) {
-		sess, err := repo.GetSession(testSessionID)
+		sess, err := repo.GetSession(context.Background(), testSessionID)
 		assert.NoError(t, err)
 		assert.Equal(t, testSessionID, sess.ID)
 		(&sess).Properties["prop2"] = "value2"
-		err = repo.UpdateSession(sess)
+		err = repo.UpdateSession(context.Background(), sess)
 		assert.NoError(t, err)
-		newSess, _ := repo.GetSession(testSessionID)
+		newSess, _ := repo.GetSession(context.Background(), testSessionID)
 		assert.Equal(t, sess.Properties["prop2"], newSess.Properties["prop2"])
 
 	})
 	t.Run("test get not existing session", func(t *testing.T) {
-		err := repo.UpdateSession(models.Session{
+		err := repo.UpdateSession(context.Background(), models.Session{
 			ID:         "bad",
 			Properties: nil,
 		})
@@ -105,7 +105,7 @@ func getRepo(t *testing.T, drop bool) SessionRepository {
 			"prop1": "value",
 		},
 	}
-	_, err = repo.CreateSession(session)
+	_, err = repo.CreateSession(context.Background(), session)
 	assert.NoError(t, err)
 
 	return repo
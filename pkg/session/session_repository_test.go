@@ -0,0 +1,31 @@
+package session
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInMemorySessionRepository_DeleteExpired(t *testing.T) {
+	repo := newInMemorySessionRepository().(*inMemorySessionRepository)
+	now := time.Now()
+	_, _ = repo.CreateSession(context.Background(), Session{ID: "active"})
+	_, _ = repo.CreateSession(context.Background(), Session{ID: "expires", ExpiresAt: now.Add(time.Minute)})
+	_, _ = repo.CreateSession(context.Background(), Session{ID: "expired", ExpiresAt: now.Add(-time.Second)})
+	old, _ := repo.CreateSession(context.Background(), Session{ID: "old"})
+	old.CreatedAt = now.Add(-inMemorySessionLifetime - time.Second)
+	assert.NoError(t, repo.UpdateSession(context.Background(), old))
+
+	repo.deleteExpired(now)
+
+	for _, id := range []string{"active", "expires"} {
+		_, err := repo.GetSession(context.Background(), id)
+		assert.NoError(t, err, id)
+	}
+	for _, id := range []string{"expired", "old"} {
+		_, err := repo.GetSession(context.Background(), id)
+		assert.Error(t, err, id)
+	}
+}
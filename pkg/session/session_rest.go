@@ -14,7 +14,7 @@ type restSessionRepository struct {
 	client   http.Client
 }
 
-func (sr *restSessionRepository) CreateSession(session Session) (Session, error) {
+func (sr *restSessionRepository) CreateSession(ctx context.Context, session Session) (Session, error) {
 	var newSession Session
 	sessBytes, err := json.Marshal(session)
 	if err != nil {
@@ -22,7 +22,12 @@ func (sr *restSessionRepository) CreateSession(session Session) (Session, error)
 	}
 	buf := bytes.NewBuffer(sessBytes)
 
-	resp, err := sr.client.Post(sr.Endpoint, "application/json", buf)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sr.Endpoint, buf)
+	if err != nil {
+		return newSession, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := sr.client.Do(req)
 	if err != nil {
 		log.Printf("error creating session: %v", err)
 		return newSession, err
@@ -44,8 +49,7 @@ func (sr *restSessionRepository) CreateSession(session Session) (Session, error)
 	return newSession, err
 }
 
-func (sr *restSessionRepository) DeleteSession(id string) error {
-	ctx := context.Background()
+func (sr *restSessionRepository) DeleteSession(ctx context.Context, id string) error {
 	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, sr.Endpoint+"/"+id, http.NoBody)
 	if err != nil {
 		return err
@@ -60,6 +64,6 @@ func (sr *restSessionRepository) DeleteSession(id string) error {
 	return err
 }
 
-func (sr *restSessionRepository) UpdateSession(id string, session Session) error {
+func (sr *restSessionRepository) UpdateSession(_ context.Context, id string, session Session) error {
 	return nil
 }
@@ -0,0 +1,96 @@
+package user
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// APIKeysProperty user property with the JSON list of the user API keys
+const APIKeysProperty = "apiKeys"
+
+// APIKey is the API key of the user, only the hash of the key secret is stored
+type APIKey struct {
+	ID        string `json:"id"`
+	Name      string `json:"name,omitempty"`
+	Hash      string `json:"hash,omitempty"`
+	CreatedAt int64  `json:"createdAt"`           // unix time
+	ExpiresAt int64  `json:"expiresAt,omitempty"` // unix time, the key does not expire if not set
+}
+
+// NewAPIKey generates the key for the user, the key is returned only once, it consists of the user id,
+// the key id and the secret, so the user could be found by the key
+func NewAPIKey(userID, name string, ttl time.Duration) (key string, k APIKey, err error) {
+	id := make([]byte, 8)
+	secret := make([]byte, 32)
+	if _, err = rand.Read(id); err != nil {
+		return "", k, errors.Wrap(err, "error generating api key")
+	}
+	if _, err = rand.Read(secret); err != nil {
+		return "", k, errors.Wrap(err, "error generating api key")
+	}
+	now := time.Now()
+	k = APIKey{ID: hex.EncodeToString(id), Name: name, CreatedAt: now.Unix()}
+	if ttl > 0 {
+		k.ExpiresAt = now.Add(ttl).Unix()
+	}
+	s := base64.RawURLEncoding.EncodeToString(secret)
+	k.Hash = hashAPIKeySecret(s)
+	return strings.Join([]string{base64.RawURLEncoding.EncodeToString([]byte(userID)), k.ID, s}, "."), k, nil
+}
+
+// ParseAPIKey splits the key into the user id, the key id and the secret
+func ParseAPIKey(key string) (userID, keyID, secret string, ok bool) {
+	parts := strings.Split(key, ".")
+	if len(parts) != 3 || parts[1] == "" || parts[2] == "" {
+		return "", "", "", false
+	}
+	uid, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || len(uid) == 0 {
+		return "", "", "", false
+	}
+	return string(uid), parts[1], parts[2], true
+}
+
+func hashAPIKeySecret(secret string) string {
+	h := sha256.Sum256([]byte(secret))
+	return base64.RawURLEncoding.EncodeToString(h[:])
+}
+
+// Matches checks the secret of the key and its expiration
+func (k APIKey) Matches(secret string, now time.Time) bool {
+	if k.ExpiresAt > 0 && now.Unix() >= k.ExpiresAt {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(k.Hash), []byte(hashAPIKeySecret(secret))) == 1
+}
+
+// APIKeys returns the API keys of the user
+func (u User) APIKeys() ([]APIKey, error) {
+	var keys []APIKey
+	v, ok := u.Properties[APIKeysProperty]
+	if !ok || v == "" {
+		return keys, nil
+	}
+	if err := json.Unmarshal([]byte(v), &keys); err != nil {
+		return nil, errors.Wrap(err, "error reading api keys")
+	}
+	return keys, nil
+}
+
+// SetAPIKeys replaces the API keys of the user
+func (u *User) SetAPIKeys(keys []APIKey) error {
+	b, err := json.Marshal(keys)
+	if err != nil {
+		return errors.Wrap(err, "error writing api keys")
+	}
+	u.SetProperty(APIKeysProperty, string(b))
+	return nil
+}
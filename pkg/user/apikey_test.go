@@ -0,0 +1,43 @@
+package user
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAPIKey(t *testing.T) {
+	key, k, err := NewAPIKey("user.1@example.com", "ci", time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, "ci", k.Name)
+	assert.NotContains(t, key, k.Hash)
+
+	userID, keyID, secret, ok := ParseAPIKey(key)
+	assert.True(t, ok)
+	assert.Equal(t, "user.1@example.com", userID)
+	assert.Equal(t, k.ID, keyID)
+	now := time.Now()
+	assert.True(t, k.Matches(secret, now))
+	assert.False(t, k.Matches(secret+"x", now))
+	assert.False(t, k.Matches(secret, now.Add(time.Hour)))
+
+	for _, invalid := range []string{"", "abc", "dXNlcjE..secret", ".id.secret", strings.Replace(key, ".", "", 1)} {
+		_, _, _, ok = ParseAPIKey(invalid)
+		assert.False(t, ok, invalid)
+	}
+
+	var u User
+	keys, err := u.APIKeys()
+	assert.NoError(t, err)
+	assert.Empty(t, keys)
+	assert.NoError(t, u.SetAPIKeys([]APIKey{k}))
+	keys, err = u.APIKeys()
+	assert.NoError(t, err)
+	assert.Equal(t, []APIKey{k}, keys)
+
+	u.Properties[APIKeysProperty] = "invalid"
+	_, err = u.APIKeys()
+	assert.Error(t, err)
+}
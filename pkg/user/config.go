@@ -1,6 +1,46 @@
 package user
 
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
 type Config struct {
 	Type       string                 `yaml:"type"`
 	Properties map[string]interface{} `yaml:"properties,omitempty"`
+	TimeoutSec int                    `yaml:"timeoutSec,omitempty"` // deadline of a single data store call, 5 seconds by default
+	// PasswordPolicy is checked by SetPassword, so it applies to every password change
+	PasswordPolicy PasswordPolicy `yaml:"passwordPolicy,omitempty"`
+}
+
+// Validate checks the data store type, its required properties and the password policy
+func (c Config) Validate() error {
+	errs := c.PasswordPolicy.validate()
+	var required []string
+	switch c.Type {
+	case "", "inMemory":
+	case "ldap":
+		required = []string{"address", "baseDN"}
+	case "mongodb":
+		required = []string{"url", "database", "collection"}
+	default:
+		errs = append(errs, fmt.Errorf("type: unknown data store type %v", c.Type))
+	}
+	for _, p := range required {
+		if v, _ := c.property(p).(string); v == "" {
+			errs = append(errs, fmt.Errorf("properties.%v: is required for %v data store", p, c.Type))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// property returns the property value, property names are case insensitive, as they are decoded with mapstructure
+func (c Config) property(name string) interface{} {
+	for k, v := range c.Properties {
+		if strings.EqualFold(k, name) {
+			return v
+		}
+	}
+	return nil
 }
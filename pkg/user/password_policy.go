@@ -0,0 +1,204 @@
+package user
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Password character classes
+const (
+	ClassLower   = "lower"
+	ClassUpper   = "upper"
+	ClassDigit   = "digit"
+	ClassSpecial = "special"
+)
+
+const (
+	defaultHistoryProperty = "passwordHistory"
+	minFieldLength         = 3 // shorter user fields are not checked, as they match too many passwords
+)
+
+// PasswordPolicy is checked whenever a password is set, the policy is disabled if no checks are set
+type PasswordPolicy struct {
+	MinLength        int      `yaml:"minLength"`
+	CharacterClasses []string `yaml:"characterClasses"` // required classes: lower, upper, digit or special
+	MaxRepeated      int      `yaml:"maxRepeated"`      // maximum number of the same consecutive characters
+	DenylistFile     string   `yaml:"denylistFile"`     // file with forbidden passwords, one per line, compared case insensitive
+	NotContainUserID bool     `yaml:"notContainUserId"`
+	NotContainFields []string `yaml:"notContainFields"` // user properties the password should not contain
+	HistorySize      int      `yaml:"historySize"`      // number of previous passwords, that could not be reused
+	HistoryProperty  string   `yaml:"historyProperty"`  // user property with hashes of previous passwords, passwordHistory by default
+	denylist         map[string]bool
+}
+
+// PasswordPolicyError lists the violated rules of the password policy, messages could be shown to the user
+type PasswordPolicyError struct {
+	Violations []string
+}
+
+func (e *PasswordPolicyError) Error() string {
+	return strings.Join(e.Violations, ", ")
+}
+
+// validate checks the policy settings
+func (p *PasswordPolicy) validate() []error {
+	var errs []error
+	if p.MinLength < 0 {
+		errs = append(errs, errors.New("passwordPolicy.minLength: should not be negative"))
+	}
+	if p.MaxRepeated < 0 {
+		errs = append(errs, errors.New("passwordPolicy.maxRepeated: should not be negative"))
+	}
+	if p.HistorySize < 0 {
+		errs = append(errs, errors.New("passwordPolicy.historySize: should not be negative"))
+	}
+	for _, c := range p.CharacterClasses {
+		switch c {
+		case ClassLower, ClassUpper, ClassDigit, ClassSpecial:
+		default:
+			errs = append(errs, fmt.Errorf("passwordPolicy.characterClasses: unknown class %v", c))
+		}
+	}
+	if p.DenylistFile != "" {
+		if _, err := os.Stat(p.DenylistFile); err != nil {
+			errs = append(errs, fmt.Errorf("passwordPolicy.denylistFile: %w", err))
+		}
+	}
+	return errs
+}
+
+// init loads the denylist and sets default values
+func (p *PasswordPolicy) init() error {
+	if p.HistoryProperty == "" {
+		p.HistoryProperty = defaultHistoryProperty
+	}
+	if p.DenylistFile == "" {
+		return nil
+	}
+	f, err := os.Open(p.DenylistFile)
+	if err != nil {
+		return errors.Wrap(err, "error reading password denylist")
+	}
+	defer f.Close()
+	p.denylist = make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if pw := strings.TrimSpace(scanner.Text()); pw != "" {
+			p.denylist[strings.ToLower(pw)] = true
+		}
+	}
+	return errors.Wrap(scanner.Err(), "error reading password denylist")
+}
+
+// Check returns PasswordPolicyError if the password of the user violates the policy,
+// the password history is not checked
+func (p *PasswordPolicy) Check(u User, password string) error {
+	var violations []string
+	if len([]rune(password)) < p.MinLength {
+		violations = append(violations, fmt.Sprintf("Password should be at least %v characters long", p.MinLength))
+	}
+	for _, c := range p.CharacterClasses {
+		if !containsClass(password, c) {
+			violations = append(violations, classViolations[c])
+		}
+	}
+	if p.MaxRepeated > 0 && maxRepeated(password) > p.MaxRepeated {
+		violations = append(violations, fmt.Sprintf("Password should not contain more than %v same characters in a row", p.MaxRepeated))
+	}
+	if p.denylist[strings.ToLower(password)] {
+		violations = append(violations, "Password is too common")
+	}
+	lowerPassword := strings.ToLower(password)
+	if p.NotContainUserID && len(u.ID) >= minFieldLength && strings.Contains(lowerPassword, strings.ToLower(u.ID)) {
+		violations = append(violations, "Password should not contain the username")
+	}
+	for _, f := range p.NotContainFields {
+		v := u.Properties[f]
+		if len(v) >= minFieldLength && strings.Contains(lowerPassword, strings.ToLower(v)) {
+			violations = append(violations, fmt.Sprintf("Password should not contain %v", f))
+		}
+	}
+	if len(violations) > 0 {
+		return &PasswordPolicyError{Violations: violations}
+	}
+	return nil
+}
+
+var classViolations = map[string]string{
+	ClassLower:   "Password should contain a lowercase letter",
+	ClassUpper:   "Password should contain an uppercase letter",
+	ClassDigit:   "Password should contain a digit",
+	ClassSpecial: "Password should contain a special character",
+}
+
+func containsClass(password, class string) bool {
+	for _, r := range password {
+		switch {
+		case class == ClassLower && unicode.IsLower(r),
+			class == ClassUpper && unicode.IsUpper(r),
+			class == ClassDigit && unicode.IsDigit(r),
+			class == ClassSpecial && !unicode.IsLetter(r) && !unicode.IsDigit(r):
+			return true
+		}
+	}
+	return false
+}
+
+func maxRepeated(password string) int {
+	var res, cur int
+	var prev rune
+	for i, r := range []rune(password) {
+		if i > 0 && r == prev {
+			cur++
+		} else {
+			cur = 1
+		}
+		if cur > res {
+			res = cur
+		}
+		prev = r
+	}
+	return res
+}
+
+// checkHistory returns PasswordPolicyError if the password is one of the previous passwords of the user
+func (p *PasswordPolicy) checkHistory(u User, password string) error {
+	for _, h := range p.history(u) {
+		if bcrypt.CompareHashAndPassword([]byte(h), []byte(password)) == nil {
+			return &PasswordPolicyError{Violations: []string{
+				fmt.Sprintf("Password should not be one of the last %v passwords", p.HistorySize)}}
+		}
+	}
+	return nil
+}
+
+// addToHistory adds the password hash to the user history and keeps only the last HistorySize hashes
+func (p *PasswordPolicy) addToHistory(u *User, password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return errors.Wrap(err, "error hashing password")
+	}
+	history := append(p.history(*u), string(hash))
+	if len(history) > p.HistorySize {
+		history = history[len(history)-p.HistorySize:]
+	}
+	v, err := json.Marshal(history)
+	if err != nil {
+		return errors.Wrap(err, "error marshaling password history")
+	}
+	u.SetProperty(p.HistoryProperty, string(v))
+	return nil
+}
+
+func (p *PasswordPolicy) history(u User) []string {
+	var history []string
+	_ = json.Unmarshal([]byte(u.Properties[p.HistoryProperty]), &history)
+	return history
+}
@@ -0,0 +1,79 @@
+package user
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPasswordPolicy_Check(t *testing.T) {
+	denylist := filepath.Join(t.TempDir(), "denylist.txt")
+	assert.NoError(t, os.WriteFile(denylist, []byte("Summer2024!\nqwerty\n"), 0o600))
+	p := PasswordPolicy{
+		MinLength:        8,
+		CharacterClasses: []string{ClassLower, ClassUpper, ClassDigit, ClassSpecial},
+		MaxRepeated:      2,
+		DenylistFile:     denylist,
+		NotContainUserID: true,
+		NotContainFields: []string{"name"},
+	}
+	assert.NoError(t, p.init())
+	u := User{ID: "john", Properties: map[string]string{"name": "Doe"}}
+
+	tests := []struct {
+		password   string
+		violations []string
+	}{
+		{password: "Str0ng-Passw0rd"},
+		{password: "aB1-", violations: []string{"Password should be at least 8 characters long"}},
+		{password: "strongpassword", violations: []string{"Password should contain an uppercase letter",
+			"Password should contain a digit", "Password should contain a special character"}},
+		{password: "Str0ng-Passs0rd", violations: []string{"Password should not contain more than 2 same characters in a row"}},
+		{password: "summer2024!", violations: []string{"Password should contain an uppercase letter", "Password is too common"}},
+		{password: "Str0ng-JOHN", violations: []string{"Password should not contain the username"}},
+		{password: "Str0ng-doe-1", violations: []string{"Password should not contain name"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.password, func(t *testing.T) {
+			err := p.Check(u, tt.password)
+			if len(tt.violations) == 0 {
+				assert.NoError(t, err)
+				return
+			}
+			pe, ok := err.(*PasswordPolicyError)
+			assert.True(t, ok)
+			assert.Equal(t, tt.violations, pe.Violations)
+		})
+	}
+}
+
+func TestService_SetPassword_History(t *testing.T) {
+	us, err := newUserService(Config{PasswordPolicy: PasswordPolicy{MinLength: 4, HistorySize: 2}})
+	assert.NoError(t, err)
+	ctx := context.Background()
+
+	assert.EqualError(t, us.SetPassword(ctx, "user1", "abc"), "Password should be at least 4 characters long")
+	for _, p := range []string{"first", "second", "third"} {
+		assert.NoError(t, us.SetPassword(ctx, "user1", p))
+	}
+	// only the last passwords could not be reused
+	assert.EqualError(t, us.SetPassword(ctx, "user1", "third"), "Password should not be one of the last 2 passwords")
+	assert.EqualError(t, us.SetPassword(ctx, "user1", "second"), "Password should not be one of the last 2 passwords")
+	assert.NoError(t, us.SetPassword(ctx, "user1", "first"))
+	assert.True(t, us.ValidatePassword(ctx, "user1", "first"))
+
+	u, _ := us.GetUser(ctx, "user1")
+	assert.NotContains(t, u.Properties["passwordHistory"], "first")
+	assert.True(t, us.IsPrivateProperty("passwordHistory"))
+	assert.True(t, us.IsPrivateProperty(APIKeysProperty))
+	assert.False(t, us.IsPrivateProperty("email"))
+}
+
+func TestConfig_Validate_PasswordPolicy(t *testing.T) {
+	c := Config{PasswordPolicy: PasswordPolicy{MinLength: -1, CharacterClasses: []string{"emoji"}}}
+	assert.EqualError(t, c.Validate(), "passwordPolicy.minLength: should not be negative\n"+
+		"passwordPolicy.characterClasses: unknown class emoji")
+}
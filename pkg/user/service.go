@@ -1,31 +1,120 @@
 package user
 
 import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/maximthomas/gortas/pkg/datastore"
 	"github.com/mitchellh/mapstructure"
 )
 
 type Service struct {
-	repo userRepository
+	repo    userRepository
+	timeout time.Duration
+	policy  *PasswordPolicy
+}
+
+func (us Service) GetUser(ctx context.Context, id string) (user User, exists bool) {
+	ctx, cancel := datastore.CallContext(ctx, us.timeout)
+	defer cancel()
+	return us.repo.GetUser(ctx, id)
+}
+
+// ValidatePassword validates the password of the user, passwords of pending users,
+// or users that could not be read, are never valid
+func (us Service) ValidatePassword(ctx context.Context, id, password string) (valid bool) {
+	ctx, cancel := datastore.CallContext(ctx, us.timeout)
+	defer cancel()
+	if !us.repo.ValidatePassword(ctx, id, password) {
+		return false
+	}
+	u, ok := us.repo.GetUser(ctx, id)
+	return ok && !u.Pending()
+}
+
+func (us Service) CreateUser(ctx context.Context, user User) (User, error) {
+	ctx, cancel := datastore.CallContext(ctx, us.timeout)
+	defer cancel()
+	return us.repo.CreateUser(ctx, user)
+}
+
+func (us Service) UpdateUser(ctx context.Context, usr User) error {
+	ctx, cancel := datastore.CallContext(ctx, us.timeout)
+	defer cancel()
+	return us.repo.UpdateUser(ctx, usr)
+}
+
+// SetPassword sets the password, if it conforms to the password policy, otherwise returns PasswordPolicyError
+func (us Service) SetPassword(ctx context.Context, id, password string) error {
+	ctx, cancel := datastore.CallContext(ctx, us.timeout)
+	defer cancel()
+	p := us.passwordPolicy()
+	u, exists := User{ID: id}, false
+	if p.NotContainUserID || len(p.NotContainFields) > 0 || p.HistorySize > 0 {
+		if found, ok := us.repo.GetUser(ctx, id); ok {
+			u, exists = found, true
+		}
+	}
+	err := p.Check(u, password)
+	if err != nil {
+		return err
+	}
+	if p.HistorySize > 0 {
+		err = p.checkHistory(u, password)
+		if err != nil {
+			return err
+		}
+	}
+	err = us.repo.SetPassword(ctx, id, password)
+	if err != nil {
+		return err
+	}
+	if p.HistorySize > 0 && exists {
+		err = p.addToHistory(&u, password)
+		if err != nil {
+			return err
+		}
+		return us.repo.UpdateUser(ctx, u)
+	}
+	return nil
 }
 
-func (us Service) GetUser(id string) (user User, exists bool) {
-	return us.repo.GetUser(id)
+// CheckPasswordPolicy returns PasswordPolicyError if the password of the user violates the password policy,
+// so the password could be checked before the user is created
+func (us Service) CheckPasswordPolicy(u User, password string) error {
+	return us.passwordPolicy().Check(u, password)
 }
 
-func (us Service) ValidatePassword(id, password string) (valid bool) {
-	return us.repo.ValidatePassword(id, password)
+// privateProperties user properties registered as private by RegisterPrivateProperty
+var privateProperties = &sync.Map{}
+
+// RegisterPrivateProperty registers the user property, that should not be exposed in sessions and tokens,
+// like secrets of authentication modules
+func RegisterPrivateProperty(name string) {
+	privateProperties.Store(name, true)
 }
 
-func (us Service) CreateUser(user User) (User, error) {
-	return us.repo.CreateUser(user)
+// IsPrivateProperty returns true for user properties, that should not be exposed, like the password history
+// or properties registered with RegisterPrivateProperty
+func (us Service) IsPrivateProperty(name string) bool {
+	if name == us.passwordPolicy().HistoryProperty {
+		return true
+	}
+	_, ok := privateProperties.Load(name)
+	return ok
 }
 
-func (us Service) UpdateUser(usr User) error {
-	return us.repo.UpdateUser(usr)
+func init() {
+	RegisterPrivateProperty(APIKeysProperty)
+	RegisterPrivateProperty(PendingUntilProperty)
 }
 
-func (us Service) SetPassword(id, password string) error {
-	return us.repo.SetPassword(id, password)
+func (us Service) passwordPolicy() *PasswordPolicy {
+	if us.policy == nil {
+		return &PasswordPolicy{HistoryProperty: defaultHistoryProperty}
+	}
+	return us.policy
 }
 
 var us Service
@@ -76,6 +165,13 @@ func newUserService(uc Config) (us Service, err error) {
 	} else {
 		us.repo = NewInMemoryUserRepository()
 	}
+	policy := uc.PasswordPolicy
+	err = policy.init()
+	if err != nil {
+		return us, err
+	}
+	us.policy = &policy
+	us.timeout = datastore.Timeout(uc.TimeoutSec)
 
 	return us, err
 }
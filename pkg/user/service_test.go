@@ -0,0 +1,27 @@
+package user
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// unreadableUserRepository validates passwords, but fails to read users
+type unreadableUserRepository struct {
+	userRepository
+}
+
+func (r unreadableUserRepository) GetUser(_ context.Context, _ string) (User, bool) {
+	return User{}, false
+}
+
+func TestService_ValidatePassword(t *testing.T) {
+	ctx := context.Background()
+	us := Service{repo: NewInMemoryUserRepository()}
+	assert.True(t, us.ValidatePassword(ctx, "user1", "password"))
+	assert.False(t, us.ValidatePassword(ctx, "user1", "invalid"))
+
+	us.repo = unreadableUserRepository{userRepository: us.repo}
+	assert.False(t, us.ValidatePassword(ctx, "user1", "password"))
+}
@@ -1,5 +1,10 @@
 package user
 
+import (
+	"strconv"
+	"time"
+)
+
 type User struct {
 	ID         string            `json:"id,omitempty"`
 	Realm      string            `json:"realm,omitempty"`
@@ -21,3 +26,30 @@ func (u *User) SetProperty(prop, val string) {
 	}
 	u.Properties[prop] = val
 }
+
+// Properties of users registered with the email verification
+const (
+	EmailVerifiedProperty = "emailVerified" // "true" after the user confirmed the email address
+	PendingUntilProperty  = "pendingUntil"  // unix time, until the unconfirmed registration is valid
+)
+
+// EmailVerified returns true if the user confirmed the email address
+func (u User) EmailVerified() bool {
+	return u.Properties[EmailVerifiedProperty] == "true"
+}
+
+// Pending returns true if the user registration is not confirmed yet, pending users could not log in
+func (u User) Pending() bool {
+	_, ok := u.Properties[PendingUntilProperty]
+	return ok
+}
+
+// PendingExpired returns true if the user registration was not confirmed in time,
+// so the user could be registered again
+func (u User) PendingExpired(now time.Time) bool {
+	if !u.Pending() {
+		return false
+	}
+	until, err := strconv.ParseInt(u.Properties[PendingUntilProperty], 10, 64)
+	return err != nil || now.Unix() > until
+}
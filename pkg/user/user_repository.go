@@ -1,15 +1,17 @@
 package user
 
 import (
+	"context"
+
 	"github.com/google/uuid"
 )
 
 type userRepository interface {
-	GetUser(id string) (User, bool)
-	ValidatePassword(id, password string) bool
-	CreateUser(user User) (User, error)
-	UpdateUser(user User) error
-	SetPassword(id, password string) error
+	GetUser(ctx context.Context, id string) (User, bool)
+	ValidatePassword(ctx context.Context, id, password string) bool
+	CreateUser(ctx context.Context, user User) (User, error)
+	UpdateUser(ctx context.Context, user User) error
+	SetPassword(ctx context.Context, id, password string) error
 }
 
 type inMemoryUserRepository struct {
@@ -18,7 +20,7 @@ type inMemoryUserRepository struct {
 	passwords map[string]string
 }
 
-func (ur *inMemoryUserRepository) GetUser(id string) (user User, exists bool) {
+func (ur *inMemoryUserRepository) GetUser(_ context.Context, id string) (user User, exists bool) {
 	for _, u := range ur.Users {
 		if u.ID == id {
 			user = u
@@ -29,7 +31,7 @@ func (ur *inMemoryUserRepository) GetUser(id string) (user User, exists bool) {
 	return user, exists
 }
 
-func (ur *inMemoryUserRepository) ValidatePassword(id, password string) (valid bool) {
+func (ur *inMemoryUserRepository) ValidatePassword(_ context.Context, id, password string) (valid bool) {
 	if password == "password" {
 		valid = true
 	}
@@ -41,7 +43,7 @@ func (ur *inMemoryUserRepository) ValidatePassword(id, password string) (valid b
 	return valid
 }
 
-func (ur *inMemoryUserRepository) CreateUser(user User) (User, error) {
+func (ur *inMemoryUserRepository) CreateUser(_ context.Context, user User) (User, error) {
 	if user.ID == "" {
 		user.ID = uuid.New().String()
 	}
@@ -49,7 +51,7 @@ func (ur *inMemoryUserRepository) CreateUser(user User) (User, error) {
 	return user, nil
 }
 
-func (ur *inMemoryUserRepository) UpdateUser(usr User) error {
+func (ur *inMemoryUserRepository) UpdateUser(_ context.Context, usr User) error {
 	for i, u := range ur.Users {
 		if u.ID == usr.ID {
 			ur.Users[i] = usr
@@ -59,7 +61,7 @@ func (ur *inMemoryUserRepository) UpdateUser(usr User) error {
 	return nil
 }
 
-func (ur *inMemoryUserRepository) SetPassword(id, password string) error {
+func (ur *inMemoryUserRepository) SetPassword(_ context.Context, id, password string) error {
 	ur.passwords[id] = password
 	return nil
 }
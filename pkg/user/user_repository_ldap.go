@@ -1,9 +1,12 @@
 package user
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
+	"net"
+	"time"
 
 	"github.com/go-ldap/ldap/v3"
 )
@@ -19,11 +22,22 @@ type userLdapRepository struct {
 	UserAttributes []string
 }
 
-func (ur *userLdapRepository) getConnection() (*ldap.Conn, error) {
-	conn, err := ldap.Dial("tcp", ur.Address)
+// getConnection connects to the ldap server, the connection is closed when the ctx is done
+func (ur *userLdapRepository) getConnection(ctx context.Context) (*ldap.Conn, error) {
+	var d net.Dialer
+	netConn, err := d.DialContext(ctx, "tcp", ur.Address)
 	if err != nil {
 		return nil, err
 	}
+	conn := ldap.NewConn(netConn, false)
+	conn.Start()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetTimeout(time.Until(deadline))
+	}
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
 	err = conn.Bind(ur.BindDN, ur.Password)
 	if err != nil {
 		return nil, err
@@ -56,8 +70,8 @@ func (ur *userLdapRepository) getLdapEntry(id string, conn *ldap.Conn) (*ldap.En
 	return result.Entries[0], nil
 }
 
-func (ur *userLdapRepository) GetUser(id string) (user User, exists bool) {
-	conn, err := ur.getConnection()
+func (ur *userLdapRepository) GetUser(ctx context.Context, id string) (user User, exists bool) {
+	conn, err := ur.getConnection(ctx)
 	if err != nil {
 		log.Print(err)
 		return user, exists
@@ -84,8 +98,8 @@ func (ur *userLdapRepository) GetUser(id string) (user User, exists bool) {
 	return user, exists
 }
 
-func (ur *userLdapRepository) ValidatePassword(id, password string) bool {
-	conn, err := ur.getConnection()
+func (ur *userLdapRepository) ValidatePassword(ctx context.Context, id, password string) bool {
+	conn, err := ur.getConnection(ctx)
 	if err != nil {
 		log.Print(err)
 		return false
@@ -102,8 +116,8 @@ func (ur *userLdapRepository) ValidatePassword(id, password string) bool {
 	}
 	return true
 }
-func (ur *userLdapRepository) CreateUser(user User) (User, error) {
-	conn, err := ur.getConnection()
+func (ur *userLdapRepository) CreateUser(ctx context.Context, user User) (User, error) {
+	conn, err := ur.getConnection(ctx)
 	if err != nil {
 		log.Print(err)
 		return user, err
@@ -122,12 +136,12 @@ func (ur *userLdapRepository) CreateUser(user User) (User, error) {
 	return user, err
 
 }
-func (ur *userLdapRepository) UpdateUser(user User) error {
+func (ur *userLdapRepository) UpdateUser(_ context.Context, user User) error {
 	return errors.New("not implemented")
 }
 
-func (ur *userLdapRepository) SetPassword(id, password string) error {
-	conn, err := ur.getConnection()
+func (ur *userLdapRepository) SetPassword(ctx context.Context, id, password string) error {
+	conn, err := ur.getConnection(ctx)
 	if err != nil {
 		log.Print(err)
 		return err
@@ -1,6 +1,7 @@
 package user
 
 import (
+	"context"
 	"testing"
 
 	"github.com/google/uuid"
@@ -11,7 +12,7 @@ import (
 func TestLdapConnection(t *testing.T) {
 	t.Skip("mock LDAP later...")
 	ur := getUserLdapRepository()
-	conn, err := ur.getConnection()
+	conn, err := ur.getConnection(context.Background())
 	assert.NoError(t, err)
 	conn.Close()
 }
@@ -19,18 +20,18 @@ func TestLdapConnection(t *testing.T) {
 func TestGetUser(t *testing.T) {
 	t.Skip("mock LDAP later...")
 	ur := getUserLdapRepository()
-	user, exists := ur.GetUser("jerso")
+	user, exists := ur.GetUser(context.Background(), "jerso")
 	assert.True(t, exists)
 	assert.Equal(t, "jerso", user.ID)
 
-	_, exists2 := ur.GetUser("bad")
+	_, exists2 := ur.GetUser(context.Background(), "bad")
 	assert.False(t, exists2)
 }
 
 func TestValidatePassword(t *testing.T) {
 	t.Skip("mock LDAP later...")
 	ur := getUserLdapRepository()
-	err := ur.SetPassword("jerso", "passw0rd")
+	err := ur.SetPassword(context.Background(), "jerso", "passw0rd")
 	assert.NoError(t, err)
 	tests := []struct {
 		name     string
@@ -45,7 +46,7 @@ func TestValidatePassword(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			result := ur.ValidatePassword(tt.user, tt.password)
+			result := ur.ValidatePassword(context.Background(), tt.user, tt.password)
 			assert.Equal(t, tt.result, result)
 		})
 	}
@@ -60,10 +61,10 @@ func TestCreateUser(t *testing.T) {
 	user := User{
 		ID: userID,
 	}
-	_, err := ur.CreateUser(user)
+	_, err := ur.CreateUser(context.Background(), user)
 	assert.NoError(t, err)
 
-	_, exists := ur.GetUser("jerso")
+	_, exists := ur.GetUser(context.Background(), "jerso")
 	assert.True(t, exists)
 }
 
@@ -74,16 +75,16 @@ func TestSetPassword(t *testing.T) {
 	var user = "jerso"
 	newPassword := "newPassw0rd"
 
-	err := ur.SetPassword(user, uuid.New().String())
+	err := ur.SetPassword(context.Background(), user, uuid.New().String())
 	assert.NoError(t, err)
 
-	result := ur.ValidatePassword(user, newPassword)
+	result := ur.ValidatePassword(context.Background(), user, newPassword)
 	assert.False(t, result)
 
-	err = ur.SetPassword(user, newPassword)
+	err = ur.SetPassword(context.Background(), user, newPassword)
 	assert.NoError(t, err)
 
-	result = ur.ValidatePassword(user, newPassword)
+	result = ur.ValidatePassword(context.Background(), user, newPassword)
 	assert.True(t, result)
 }
 
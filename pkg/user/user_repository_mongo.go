@@ -28,11 +28,9 @@ type mongoRepoUser struct {
 	Password string `json:"password,omitempty"`
 }
 
-func (ur *userMongoRepository) GetUser(id string) (User, bool) {
+func (ur *userMongoRepository) GetUser(ctx context.Context, id string) (User, bool) {
 	var user User
 	collection := ur.getCollection()
-	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
-	defer cancel()
 	filter := bson.M{"id": id}
 
 	var repoUser mongoRepoUser
@@ -45,10 +43,8 @@ func (ur *userMongoRepository) GetUser(id string) (User, bool) {
 	return repoUser.User, true
 }
 
-func (ur *userMongoRepository) ValidatePassword(id, password string) bool {
+func (ur *userMongoRepository) ValidatePassword(ctx context.Context, id, password string) bool {
 	collection := ur.getCollection()
-	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
-	defer cancel()
 	filter := bson.M{"id": id}
 	var repoUser mongoRepoUser
 	err := collection.FindOne(ctx, filter).Decode(&repoUser)
@@ -67,7 +63,7 @@ func (ur *userMongoRepository) ValidatePassword(id, password string) bool {
 	return valid
 }
 
-func (ur *userMongoRepository) CreateUser(user User) (User, error) {
+func (ur *userMongoRepository) CreateUser(ctx context.Context, user User) (User, error) {
 	if user.ID == "" {
 		user.ID = uuid.New().String()
 	}
@@ -76,8 +72,6 @@ func (ur *userMongoRepository) CreateUser(user User) (User, error) {
 		Password: "",
 	}
 	collection := ur.getCollection()
-	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
-	defer cancel()
 
 	_, err := collection.InsertOne(ctx, &repoUser)
 	if err != nil {
@@ -87,10 +81,8 @@ func (ur *userMongoRepository) CreateUser(user User) (User, error) {
 	return user, nil
 }
 
-func (ur *userMongoRepository) UpdateUser(user User) error {
+func (ur *userMongoRepository) UpdateUser(ctx context.Context, user User) error {
 	collection := ur.getCollection()
-	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
-	defer cancel()
 
 	filter := bson.M{"id": user.ID, "realm": user.Realm}
 	var updatedUser mongoRepoUser
@@ -103,10 +95,8 @@ func (ur *userMongoRepository) UpdateUser(user User) error {
 	return nil
 }
 
-func (ur *userMongoRepository) SetPassword(id, password string) error {
+func (ur *userMongoRepository) SetPassword(ctx context.Context, id, password string) error {
 	collection := ur.getCollection()
-	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
-	defer cancel()
 
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
 	if err != nil {
@@ -19,11 +19,11 @@ const (
 
 func TestUserMongoRepository_GetUser(t *testing.T) {
 	ur := getUserMongoRepo(t, true)
-	user, exists := ur.GetUser(testUserId)
+	user, exists := ur.GetUser(context.Background(), testUserId)
 	assert.True(t, exists)
 	assert.Equal(t, testUserId, user.ID)
 
-	_, exists2 := ur.GetUser("bad")
+	_, exists2 := ur.GetUser(context.Background(), "bad")
 	assert.False(t, exists2)
 }
 
@@ -42,7 +42,7 @@ func TestUserMongoRepository_ValidatePassword(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			result := ur.ValidatePassword(tt.user, tt.password)
+			result := ur.ValidatePassword(context.Background(), tt.user, tt.password)
 			assert.Equal(t, tt.result, result)
 		})
 	}
@@ -53,10 +53,10 @@ func TestUserMongoRepository_CreateUser(t *testing.T) {
 		ID: testUser2Id,
 	}
 	ur := getUserMongoRepo(t, true)
-	user, err := ur.CreateUser(user)
+	user, err := ur.CreateUser(context.Background(), user)
 	assert.NoError(t, err)
 
-	user, exists := ur.GetUser(testUser2Id)
+	user, exists := ur.GetUser(context.Background(), testUser2Id)
 	assert.True(t, exists)
 }
 
@@ -64,34 +64,34 @@ func TestUserMongoRepository_SetPassword(t *testing.T) {
 	var user = testUserId
 	newPassword := "newPassw0rd"
 	ur := getUserMongoRepo(t, true)
-	err := ur.SetPassword(user, uuid.New().String())
+	err := ur.SetPassword(context.Background(), user, uuid.New().String())
 	assert.NoError(t, err)
 
-	result := ur.ValidatePassword(user, newPassword)
+	result := ur.ValidatePassword(context.Background(), user, newPassword)
 	assert.False(t, result)
 
-	err = ur.SetPassword(user, newPassword)
+	err = ur.SetPassword(context.Background(), user, newPassword)
 	assert.NoError(t, err)
 
-	result = ur.ValidatePassword(user, newPassword)
+	result = ur.ValidatePassword(context.Background(), user, newPassword)
 	assert.True(t, result)
 }
 
 func TestUserMongoRepository_ModifyUser(t *testing.T) {
 	repo := getUserMongoRepo(t, true)
 	t.Run("test update user", func(t *testing.T) {
-		user, ok := repo.GetUser(testUserId)
+		user, ok := repo.GetUser(context.Background(), testUserId)
 		assert.True(t, ok)
 		assert.Equal(t, testUserId, user.ID)
 		(&user).Properties["prop2"] = "value2"
-		err := repo.UpdateUser(user)
+		err := repo.UpdateUser(context.Background(), user)
 		assert.NoError(t, err)
-		newUser, _ := repo.GetUser(testUserId)
+		newUser, _ := repo.GetUser(context.Background(), testUserId)
 		assert.Equal(t, user.Properties["prop2"], newUser.Properties["prop2"])
 
 	})
 	t.Run("test update not existing user", func(t *testing.T) {
-		err := repo.UpdateUser(models.User{
+		err := repo.UpdateUser(context.Background(), models.User{
 			ID:         "bad",
 			Properties: nil,
 		})
@@ -114,9 +114,9 @@ func getUserMongoRepo(t *testing.T, drop bool) UserRepository {
 			"prop1": "value",
 		},
 	}
-	_, err = repo.CreateUser(user)
+	_, err = repo.CreateUser(context.Background(), user)
 	assert.NoError(t, err)
-	repo.SetPassword(testUserId, testPassword)
+	repo.SetPassword(context.Background(), testUserId, testPassword)
 
 	return repo
 }
@@ -15,8 +15,7 @@ type userRestRepository struct {
 	client   http.Client
 }
 
-func (ur *userRestRepository) GetUser(id string) (user User, exists bool) {
-	ctx := context.Background()
+func (ur *userRestRepository) GetUser(ctx context.Context, id string) (user User, exists bool) {
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ur.endpoint+"/users/"+id, http.NoBody)
 	if err != nil {
 		log.Printf("error crearing request: %v", err)
@@ -50,7 +49,7 @@ func (ur *userRestRepository) GetUser(id string) (user User, exists bool) {
 	return user, exists
 }
 
-func (ur *userRestRepository) ValidatePassword(id, password string) (valid bool) {
+func (ur *userRestRepository) ValidatePassword(ctx context.Context, id, password string) (valid bool) {
 	pr := Password{
 		Password: password,
 	}
@@ -61,7 +60,6 @@ func (ur *userRestRepository) ValidatePassword(id, password string) (valid bool)
 	}
 
 	buf := bytes.NewBuffer(prBytes)
-	ctx := context.Background()
 	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ur.endpoint+"/users/"+id+"/validatepassword", buf)
 	if err != nil {
 		log.Printf("error crearing request: %v", err)
@@ -100,14 +98,14 @@ func (ur *userRestRepository) ValidatePassword(id, password string) (valid bool)
 	return valid
 }
 
-func (ur *userRestRepository) CreateUser(user User) (User, error) {
+func (ur *userRestRepository) CreateUser(_ context.Context, user User) (User, error) {
 	return user, nil
 }
 
-func (ur *userRestRepository) UpdateUser(user User) error {
+func (ur *userRestRepository) UpdateUser(_ context.Context, user User) error {
 	return nil
 }
-func (ur *userRestRepository) SetPassword(id, password string) error {
+func (ur *userRestRepository) SetPassword(_ context.Context, id, password string) error {
 	return nil
 }
 
@@ -2,6 +2,7 @@ package integration_test
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
@@ -119,7 +120,7 @@ func TestOTPAuth(t *testing.T) {
 	assert.Equal(t, "action", cbReq.Callbacks[1].Name)
 
 	// send OTP
-	sess, _ := session.GetSessionService().GetSession(flowCookie.Value)
+	sess, _ := session.GetSessionService().GetSession(context.Background(), flowCookie.Value)
 	var fs state.FlowState
 	err := json.Unmarshal([]byte(sess.Properties[constants.FlowStateSessionProperty]), &fs)
 	if err != nil {
@@ -128,7 +129,7 @@ func TestOTPAuth(t *testing.T) {
 	fs.Modules[2].State["otp"] = "1234"
 	sd, _ := json.Marshal(fs)
 	sess.Properties[constants.FlowStateSessionProperty] = string(sd)
-	err = session.GetSessionService().UpdateSession(sess)
+	err = session.GetSessionService().UpdateSession(context.Background(), sess)
 	if err != nil {
 		panic(err)
 	}